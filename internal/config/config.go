@@ -1,9 +1,18 @@
 package config
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/wclewett/gcdeploy/internal/deploy"
@@ -11,10 +20,97 @@ import (
 
 const cfg_file = ".gcd.toml"
 
+// StateDir holds gcdeploy's local state, next to .gcd.toml
+const StateDir = ".gcdeploy"
+
+// defaultLockPath is the deployment lock directory on the VM when lock_path is not set
+const defaultLockPath = "/tmp/gcdeploy.lock"
+
 // DeploymentStep represents a single step in the deployment script
 type DeploymentStep struct {
 	Command string `toml:"command"`
-	Target  string `toml:"target"` // "local" or "remote"
+	Target  string `toml:"target"` // "local", "remote", "upload" or "download"
+
+	// Dependency graph, both optional
+	Name      string   `toml:"name"`       // Unique name that other steps can depend on
+	DependsOn []string `toml:"depends_on"` // Names of the steps that must finish first
+
+	// File transfer steps (target "upload" or "download")
+	Src     string   `toml:"src"`     // Source path or glob
+	Dest    string   `toml:"dest"`    // Destination path, a directory when it ends in "/"
+	Mode    string   `toml:"mode"`    // Optional: octal mode for transferred files, e.g. "0644"
+	Exclude []string `toml:"exclude"` // Optional: patterns to skip, in addition to .gcdignore
+
+	// Execution controls, all optional
+	Timeout         string            `toml:"timeout"`           // Kill the step after this long, e.g. "10m"
+	Retries         int               `toml:"retries"`           // Extra attempts after a failure
+	RetryDelay      string            `toml:"retry_delay"`       // Wait before the first retry, doubled for each further one (default "5s")
+	ContinueOnError bool              `toml:"continue_on_error"` // A failure is reported but does not stop the deployment
+	Env             map[string]string `toml:"env"`               // Environment variables for the command
+	Workdir         string            `toml:"workdir"`           // Directory the command runs in
+
+	// Barrier is set on the steps added by [release]: the step waits for every step
+	// before it, and every step after it waits for it, even when depends_on is used
+	Barrier bool `toml:"-"`
+}
+
+// defaultRetryDelay is the wait before the first retry when retry_delay is not set
+const defaultRetryDelay = 5 * time.Second
+
+// maxRetryBackoff caps the doubling wait between retries
+const maxRetryBackoff = 10 * time.Minute
+
+// envNamePattern matches names that can be exported by a POSIX shell
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// IsTransfer reports whether the step copies files instead of running a command
+func (s DeploymentStep) IsTransfer() bool {
+	return s.Target == "upload" || s.Target == "download"
+}
+
+// Description returns the command, or "src → dest" for file transfer steps
+func (s DeploymentStep) Description() string {
+	if s.IsTransfer() {
+		return s.Src + " → " + s.Dest
+	}
+	return s.Command
+}
+
+// FileMode returns the parsed mode for transferred files, 0 when not set
+func (s DeploymentStep) FileMode() os.FileMode {
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(mode).Perm()
+}
+
+// TimeoutDuration returns the parsed timeout, 0 when the step has none
+func (s DeploymentStep) TimeoutDuration() time.Duration {
+	timeout, err := time.ParseDuration(s.Timeout)
+	if err != nil {
+		return 0
+	}
+	return timeout
+}
+
+// RetryBackoff returns how long to wait before the given retry (1 for the first)
+// The delay doubles with every retry up to maxRetryBackoff, or retry_delay if that is longer
+func (s DeploymentStep) RetryBackoff(retry int) time.Duration {
+	delay, err := time.ParseDuration(s.RetryDelay)
+	if err != nil {
+		delay = defaultRetryDelay
+	}
+	limit := max(delay, maxRetryBackoff)
+	for ; retry > 1 && delay < limit; retry-- {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// CommandOptions returns the environment and working directory for the step command
+func (s DeploymentStep) CommandOptions() deploy.CommandOptions {
+	return deploy.CommandOptions{Env: s.Env, Workdir: s.Workdir}
 }
 
 // Config represents the configuration from .gcd.toml
@@ -24,10 +120,69 @@ type Config struct {
 	Deployment      []DeploymentStep  `toml:"deployment"`      // Optional deployment script
 	CredentialsPath string            `toml:"credentials_path"` // Optional: path to GCP service account key file
 	SSHKeyPath      string            `toml:"ssh_key_path"`     // Optional: path to SSH private key file
+	Resolver        string            `toml:"resolver"`         // Optional: instance lookup backend ("auto", "gcloud" or "api")
+	Env             map[string]EnvProfile `toml:"env"`          // Optional: named environments selected with --env
+	Vars            map[string]string     `toml:"vars"`         // Optional: values for ${{ name }} references in commands
+	Parallelism     int                   `toml:"parallelism"`  // Optional: steps with depends_on run at once (default 4)
+	RemoteHistory   string                `toml:"remote_history"` // Optional: also append deployment history to this file on the VM
+	Release         *Release              `toml:"release"`        // Optional: deploy into release directories with a current symlink
+	LockPath        string                `toml:"lock_path"`      // Optional: deployment lock directory on the VM (default /tmp/gcdeploy.lock)
+	HealthChecks    []HealthCheck         `toml:"healthcheck"`    // Optional: checks that must pass before the deployment succeeds
+	OnFailure       []DeploymentStep      `toml:"on_failure"`     // Optional: steps run when a health check fails, e.g. to roll back
+	Hooks           Hooks                 `toml:"hooks"`          // Optional: steps run before and after every deployment
+	Scrollback      int                   `toml:"scrollback"`     // Optional: lines of output each pane keeps (default 5000)
+
+	// Fan-out: deploy to several instances instead of the single [instance]
+	Instances   []deploy.Instance        `toml:"instances"`   // Optional: explicit list, project_id and zone default to [instance]
+	Selector    *deploy.InstanceSelector `toml:"selector"`    // Optional: every instance matching these labels
+	Concurrency int                      `toml:"concurrency"` // Optional: hosts deployed at once (default 1, serial)
+
+	// EnvName is the environment merged into this config, empty for the shared defaults
+	EnvName string `toml:"-"`
+	// Production is true when the selected environment is a production one
+	Production bool `toml:"-"`
+	// Path is the .gcd.toml file the config was loaded from
+	Path string `toml:"-"`
+	// Hash identifies the contents of the .gcd.toml file, to tell which version of it a deployment used
+	Hash string `toml:"-"`
+	// RollingBack is true when the deployment script was replaced by Rollback
+	RollingBack bool `toml:"-"`
+}
+
+// EnvProfile is a named environment from an [env.<name>] section
+// Fields that are set override the shared defaults at the top level of .gcd.toml
+type EnvProfile struct {
+	Instance        deploy.Instance  `toml:"instance"`         // Merged field by field over [instance]
+	Command         string           `toml:"command"`
+	Deployment      []DeploymentStep `toml:"deployment"`       // Replaces the shared deployment script when set
+	CredentialsPath string           `toml:"credentials_path"`
+	SSHKeyPath      string           `toml:"ssh_key_path"`
+	Resolver        string           `toml:"resolver"`
+	Vars            map[string]string `toml:"vars"`            // Merged key by key over [vars]
+	Production      bool             `toml:"production"`       // Mark as production (implied for "production" and "prod")
+
+	Instances   []deploy.Instance        `toml:"instances"`   // Replaces the shared instances and selector when set
+	Selector    *deploy.InstanceSelector `toml:"selector"`    // Replaces the shared instances and selector when set
+	Concurrency int                      `toml:"concurrency"`
+	Parallelism int                      `toml:"parallelism"`
+	RemoteHistory string                 `toml:"remote_history"`
+	LockPath      string                 `toml:"lock_path"`
+	Release       *Release               `toml:"release"` // Replaces the shared [release] section when set
+	HealthChecks  []HealthCheck          `toml:"healthcheck"` // Replaces the shared health checks when set
+	OnFailure     []DeploymentStep       `toml:"on_failure"`  // Replaces the shared on_failure steps when set
+	Hooks         Hooks                  `toml:"hooks"`       // Each hook list replaces the shared one when set
+}
+
+// LoadOptions are command line settings applied when loading .gcd.toml
+type LoadOptions struct {
+	Env  string            // Environment to merge over the shared defaults (--env)
+	Vars map[string]string // Variable overrides (--var key=value)
 }
 
 // Load reads and parses the .gcd.toml file from the current directory or parent directories
-func Load() (*Config, error) {
+// If opts.Env is not empty, the [env.<name>] profile is merged over the shared defaults
+// After Load, Vars holds every variable value known before connecting to an instance
+func Load(opts LoadOptions) (*Config, error) {
 	// Start from current directory and walk up to find .gcd.toml
 	dir, err := os.Getwd()
 	if err != nil {
@@ -50,36 +205,318 @@ func Load() (*Config, error) {
 		dir = parent
 	}
 
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", configPath, err)
+	}
 	var config Config
-	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+	if _, err := toml.Decode(string(data), &config); err != nil {
 		return nil, fmt.Errorf("failed to parse %s: %w", configPath, err)
 	}
+	config.Path = configPath
+	sum := sha256.Sum256(data)
+	config.Hash = hex.EncodeToString(sum[:])[:12]
 
-	// Validate required fields
-	if config.Instance.Name == "" {
-		return nil, fmt.Errorf("instance.name is required in %s", cfg_file)
+	// Merge the selected environment over the shared defaults
+	env := opts.Env
+	deploymentKey := "deployment"
+	if env != "" {
+		profile, ok := config.Env[env]
+		if !ok {
+			return nil, fmt.Errorf("environment %q not found in %s (available: %s)", env, cfg_file, envNames(config.Env))
+		}
+		if len(profile.Deployment) > 0 {
+			deploymentKey = "env." + env + ".deployment"
+		}
+		config.merge(env, profile)
 	}
-	if config.Instance.ProjectId == "" {
-		return nil, fmt.Errorf("instance.project_id is required in %s", cfg_file)
+
+	// Validate required fields
+	if err := config.validateTargets(); err != nil {
+		return nil, err
 	}
-	if config.Instance.Zone == "" {
-		return nil, fmt.Errorf("instance.zone is required in %s", cfg_file)
+	
+	// Validate instance resolver backend
+	switch config.Resolver {
+	case "", deploy.ResolverAuto, deploy.ResolverGcloud, deploy.ResolverAPI:
+	default:
+		return nil, fmt.Errorf("resolver must be '%s', '%s' or '%s' in %s", deploy.ResolverAuto, deploy.ResolverGcloud, deploy.ResolverAPI, cfg_file)
 	}
 	
 	// Command is required if no deployment script is provided
 	if config.Command == "" && len(config.Deployment) == 0 {
 		return nil, fmt.Errorf("either command or deployment is required in %s", cfg_file)
 	}
+
+	if config.RemoteHistory != "" && !path.IsAbs(config.RemoteHistory) {
+		return nil, fmt.Errorf("remote_history must be an absolute path on the VM in %s", cfg_file)
+	}
+	if config.LockPath == "" {
+		config.LockPath = defaultLockPath
+	} else if !path.IsAbs(config.LockPath) {
+		return nil, fmt.Errorf("lock_path must be an absolute path on the VM in %s", cfg_file)
+	}
+	if config.Scrollback < 0 {
+		return nil, fmt.Errorf("scrollback must not be negative in %s", cfg_file)
+	}
 	
 	// Validate deployment steps if provided
-	for i, step := range config.Deployment {
-		if step.Command == "" {
-			return nil, fmt.Errorf("deployment[%d].command is required in %s", i, cfg_file)
+	if err := validateSteps(config.Deployment, deploymentKey); err != nil {
+		return nil, err
+	}
+	if err := config.validateGraph(deploymentKey); err != nil {
+		return nil, err
+	}
+	if err := config.applyRelease(deploymentKey); err != nil {
+		return nil, err
+	}
+	if err := config.validateHealth(); err != nil {
+		return nil, err
+	}
+	if err := config.Hooks.validate(); err != nil {
+		return nil, err
+	}
+
+	// Resolve ${{ name }} variables; unknown names are an error
+	if err := config.resolveVars(filepath.Dir(configPath), opts.Vars, deploymentKey); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// merge applies an environment profile over the shared defaults
+func (c *Config) merge(name string, profile EnvProfile) {
+	c.EnvName = name
+	c.Production = profile.Production || name == "production" || name == "prod"
+
+	if profile.Instance.Name != "" {
+		c.Instance.Name = profile.Instance.Name
+	}
+	if profile.Instance.ProjectId != "" {
+		c.Instance.ProjectId = profile.Instance.ProjectId
+	}
+	if profile.Instance.Zone != "" {
+		c.Instance.Zone = profile.Instance.Zone
+	}
+	if profile.Command != "" {
+		c.Command = profile.Command
+	}
+	if len(profile.Deployment) > 0 {
+		c.Deployment = profile.Deployment
+	}
+	if profile.CredentialsPath != "" {
+		c.CredentialsPath = profile.CredentialsPath
+	}
+	if profile.SSHKeyPath != "" {
+		c.SSHKeyPath = profile.SSHKeyPath
+	}
+	if profile.Resolver != "" {
+		c.Resolver = profile.Resolver
+	}
+	if len(profile.Instances) > 0 || profile.Selector != nil {
+		c.Instances = profile.Instances
+		c.Selector = profile.Selector
+	}
+	if profile.Concurrency != 0 {
+		c.Concurrency = profile.Concurrency
+	}
+	if profile.Parallelism != 0 {
+		c.Parallelism = profile.Parallelism
+	}
+	if profile.RemoteHistory != "" {
+		c.RemoteHistory = profile.RemoteHistory
+	}
+	if profile.LockPath != "" {
+		c.LockPath = profile.LockPath
+	}
+	if profile.Release != nil {
+		c.Release = profile.Release
+	}
+	if len(profile.HealthChecks) > 0 {
+		c.HealthChecks = profile.HealthChecks
+	}
+	if len(profile.OnFailure) > 0 {
+		c.OnFailure = profile.OnFailure
+	}
+	c.Hooks.merge(profile.Hooks)
+	if len(profile.Vars) > 0 {
+		if c.Vars == nil {
+			c.Vars = make(map[string]string, len(profile.Vars))
 		}
-		if step.Target != "local" && step.Target != "remote" {
-			return nil, fmt.Errorf("deployment[%d].target must be 'local' or 'remote' in %s", i, cfg_file)
+		for name, value := range profile.Vars {
+			c.Vars[name] = value
 		}
 	}
+}
 
-	return &config, nil
+// Steps returns the deployment script, or the single command as a remote step
+func (c *Config) Steps() []DeploymentStep {
+	if len(c.Deployment) > 0 {
+		return c.Deployment
+	}
+	return []DeploymentStep{{Command: c.Command, Target: "remote"}}
+}
+
+// StatePath returns the file recording the progress of the last deployment (see runner.StateRecorder)
+func (c *Config) StatePath() string {
+	return filepath.Join(filepath.Dir(c.Path), StateDir, "state.json")
+}
+
+// HistoryPath returns the local deployment history file (see history.Recorder)
+func (c *Config) HistoryPath() string {
+	return filepath.Join(filepath.Dir(c.Path), StateDir, "history.jsonl")
+}
+
+// validateSteps checks the target and fields of each step
+// key names the steps in error messages, e.g. "deployment"
+func validateSteps(steps []DeploymentStep, key string) error {
+	for i, step := range steps {
+		switch step.Target {
+		case "local", "remote":
+			if step.Command == "" {
+				return fmt.Errorf("%s[%d].command is required in %s", key, i, cfg_file)
+			}
+		case "upload", "download":
+			if step.Src == "" {
+				return fmt.Errorf("%s[%d].src is required for %s steps in %s", key, i, step.Target, cfg_file)
+			}
+			if step.Dest == "" {
+				return fmt.Errorf("%s[%d].dest is required for %s steps in %s", key, i, step.Target, cfg_file)
+			}
+			if step.Command != "" {
+				return fmt.Errorf("%s[%d].command cannot be used with %s steps in %s", key, i, step.Target, cfg_file)
+			}
+			if mode, err := strconv.ParseUint(step.Mode, 8, 32); step.Mode != "" && (err != nil || mode > 0777) {
+				return fmt.Errorf("%s[%d].mode must be an octal file mode like \"0644\" in %s", key, i, cfg_file)
+			}
+		default:
+			return fmt.Errorf("%s[%d].target must be 'local', 'remote', 'upload' or 'download' in %s", key, i, cfg_file)
+		}
+		if err := step.validateExecution(fmt.Sprintf("%s[%d]", key, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateExecution checks the timeout, retry, env and workdir settings of a step
+// key is the step's key in .gcd.toml for error messages, e.g. "deployment[2]"
+func (s DeploymentStep) validateExecution(key string) error {
+	if s.Timeout != "" {
+		if timeout, err := time.ParseDuration(s.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("%s.timeout must be a positive duration like \"10m\" in %s", key, cfg_file)
+		}
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("%s.retries must not be negative in %s", key, cfg_file)
+	}
+	if s.RetryDelay != "" {
+		if delay, err := time.ParseDuration(s.RetryDelay); err != nil || delay < 0 {
+			return fmt.Errorf("%s.retry_delay must be a duration like \"5s\" in %s", key, cfg_file)
+		}
+	}
+	if s.IsTransfer() && (len(s.Env) > 0 || s.Workdir != "") {
+		return fmt.Errorf("%s: env and workdir cannot be used with %s steps in %s", key, s.Target, cfg_file)
+	}
+	for name := range s.Env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("%s.env: invalid variable name %q in %s", key, name, cfg_file)
+		}
+	}
+	return nil
+}
+
+// validateTargets checks the instance settings and fills in defaults from [instance]
+// With [[instances]], the first one is also used as Instance for the interactive shell
+func (c *Config) validateTargets() error {
+	if c.Concurrency < 0 {
+		return fmt.Errorf("concurrency must not be negative in %s", cfg_file)
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 1
+	}
+
+	switch {
+	case c.Selector != nil:
+		if len(c.Instances) > 0 {
+			return fmt.Errorf("instances and selector cannot both be set in %s", cfg_file)
+		}
+		if c.Selector.ProjectId == "" {
+			c.Selector.ProjectId = c.Instance.ProjectId
+		}
+		if c.Selector.Zone == "" {
+			c.Selector.Zone = c.Instance.Zone
+		}
+		if c.Selector.ProjectId == "" {
+			return fmt.Errorf("selector.project_id is required in %s", cfg_file)
+		}
+		if c.Selector.Zone == "" {
+			return fmt.Errorf("selector.zone is required in %s", cfg_file)
+		}
+		if len(c.Selector.Labels) == 0 {
+			return fmt.Errorf("selector.labels is required in %s", cfg_file)
+		}
+		return nil
+
+	case len(c.Instances) > 0:
+		for i := range c.Instances {
+			instance := &c.Instances[i]
+			if instance.ProjectId == "" {
+				instance.ProjectId = c.Instance.ProjectId
+			}
+			if instance.Zone == "" {
+				instance.Zone = c.Instance.Zone
+			}
+			if instance.Name == "" {
+				return fmt.Errorf("instances[%d].name is required in %s", i, cfg_file)
+			}
+			if instance.ProjectId == "" {
+				return fmt.Errorf("instances[%d].project_id is required in %s", i, cfg_file)
+			}
+			if instance.Zone == "" {
+				return fmt.Errorf("instances[%d].zone is required in %s", i, cfg_file)
+			}
+		}
+		if c.Instance.Name == "" {
+			c.Instance = c.Instances[0]
+		}
+		return nil
+	}
+
+	if c.Instance.Name == "" {
+		return fmt.Errorf("instance.name is required in %s", cfg_file)
+	}
+	if c.Instance.ProjectId == "" {
+		return fmt.Errorf("instance.project_id is required in %s", cfg_file)
+	}
+	if c.Instance.Zone == "" {
+		return fmt.Errorf("instance.zone is required in %s", cfg_file)
+	}
+	return nil
+}
+
+// Targets returns the instances to deploy to: the instances matching the selector,
+// the [[instances]] list, or just the single [instance]
+func (c *Config) Targets(ctx context.Context, resolver deploy.InstanceResolver) ([]deploy.Instance, error) {
+	if c.Selector != nil {
+		return deploy.SelectInstances(ctx, resolver, *c.Selector)
+	}
+	if len(c.Instances) > 0 {
+		return c.Instances, nil
+	}
+	return []deploy.Instance{c.Instance}, nil
+}
+
+// envNames returns the sorted environment names for error messages
+func envNames(envs map[string]EnvProfile) string {
+	if len(envs) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
 }
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay string
+		retry int
+		want  time.Duration
+	}{
+		{"default first retry", "", 1, 5 * time.Second},
+		{"default doubles", "", 3, 20 * time.Second},
+		{"configured delay", "2s", 4, 16 * time.Second},
+		{"capped", "5s", 10, maxRetryBackoff},
+		{"many retries do not overflow", "5s", 100, maxRetryBackoff},
+		{"large delay does not overflow", "1000h", 64, 1000 * time.Hour},
+		{"zero delay", "0s", 50, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := DeploymentStep{RetryDelay: tt.delay}
+			if got := step.RetryBackoff(tt.retry); got != tt.want {
+				t.Errorf("RetryBackoff(%d) = %v, want %v", tt.retry, got, tt.want)
+			}
+		})
+	}
+}
+
+// loadConfig writes contents to a .gcd.toml in a new directory and loads it from there
+func loadConfig(t *testing.T, contents string, opts LoadOptions) (*Config, error) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, cfg_file), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	return Load(opts)
+}
+
+const profilesConfig = `
+[instance]
+name = "app-staging"
+project_id = "proj"
+zone = "us-central1-a"
+
+[vars]
+app = "web"
+port = "8080"
+
+[[deployment]]
+command = "deploy ${{ app }} on ${{ port }}"
+target = "remote"
+
+[env.prod.instance]
+name = "app-prod"
+
+[env.prod.vars]
+port = "80"
+
+[env.canary]
+production = false
+command = "echo canary"
+
+[[env.canary.deployment]]
+command = "canary ${{ app }}"
+target = "remote"
+`
+
+func TestLoadEnvProfiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        string
+		vars       map[string]string
+		instance   string
+		command    string
+		production bool
+		wantVars   map[string]string
+		wantErr    string
+	}{
+		{
+			name:     "shared defaults",
+			instance: "app-staging",
+			command:  "deploy ${{ app }} on ${{ port }}",
+			wantVars: map[string]string{"app": "web", "port": "8080"},
+		},
+		{
+			name:       "profile merged over the defaults",
+			env:        "prod",
+			instance:   "app-prod",
+			command:    "deploy ${{ app }} on ${{ port }}",
+			production: true,
+			wantVars:   map[string]string{"app": "web", "port": "80"},
+		},
+		{
+			name:     "profile deployment replaces the script",
+			env:      "canary",
+			instance: "app-staging",
+			command:  "canary ${{ app }}",
+			wantVars: map[string]string{"app": "web", "port": "8080"},
+		},
+		{
+			name:       "--var overrides the profile",
+			env:        "prod",
+			vars:       map[string]string{"port": "443"},
+			instance:   "app-prod",
+			command:    "deploy ${{ app }} on ${{ port }}",
+			production: true,
+			wantVars:   map[string]string{"app": "web", "port": "443"},
+		},
+		{
+			name:    "unknown environment",
+			env:     "qa",
+			wantErr: `environment "qa" not found`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(t, profilesConfig, LoadOptions{Env: tt.env, Vars: tt.vars})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.EnvName != tt.env || cfg.Production != tt.production {
+				t.Errorf("EnvName, Production = %q, %v, want %q, %v", cfg.EnvName, cfg.Production, tt.env, tt.production)
+			}
+			if cfg.Instance.Name != tt.instance || cfg.Instance.ProjectId != "proj" {
+				t.Errorf("Instance = %+v, want %s in proj", cfg.Instance, tt.instance)
+			}
+			if steps := cfg.Steps(); len(steps) != 1 || steps[0].Command != tt.command {
+				t.Errorf("Steps() = %+v, want one step running %q", steps, tt.command)
+			}
+			if !reflect.DeepEqual(cfg.Vars, tt.wantVars) {
+				t.Errorf("Vars = %v, want %v", cfg.Vars, tt.wantVars)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultParallelism is the number of independent steps run at once when parallelism is not set
+const defaultParallelism = 4
+
+// validateGraph checks the parallelism setting and the dependencies of the deployment steps
+// deploymentKey names the deployment table in error messages
+func (c *Config) validateGraph(deploymentKey string) error {
+	if c.Parallelism < 0 {
+		return fmt.Errorf("parallelism must not be negative in %s", cfg_file)
+	}
+	if c.Parallelism == 0 {
+		c.Parallelism = defaultParallelism
+	}
+	return validateDependencies(c.Deployment, deploymentKey)
+}
+
+// validateDependencies checks step names and depends_on, and rejects dependency cycles
+// key names the steps in error messages, e.g. "deployment"
+func validateDependencies(steps []DeploymentStep, key string) error {
+	names := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if step.Name == "" {
+			continue
+		}
+		if first, ok := names[step.Name]; ok {
+			return fmt.Errorf("%s[%d].name %q is already used by %s[%d] in %s", key, i, step.Name, key, first, cfg_file)
+		}
+		names[step.Name] = i
+	}
+
+	for i, step := range steps {
+		for _, name := range step.DependsOn {
+			dep, ok := names[name]
+			if !ok {
+				return fmt.Errorf("%s[%d].depends_on: unknown step %q in %s", key, i, name, cfg_file)
+			}
+			if dep == i {
+				return fmt.Errorf("%s[%d].depends_on: step %q depends on itself in %s", key, i, name, cfg_file)
+			}
+		}
+	}
+
+	if cycle := findCycle(steps, names); cycle != nil {
+		return fmt.Errorf("%s has a dependency cycle: %s in %s", key, strings.Join(cycle, " → "), cfg_file)
+	}
+	return nil
+}
+
+// findCycle returns the step names along a depends_on cycle, starting and ending
+// with the same step, or nil when the steps form a DAG
+func findCycle(steps []DeploymentStep, names map[string]int) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(steps))
+	var path []string
+
+	var visit func(i int) []string
+	visit = func(i int) []string {
+		state[i] = visiting
+		path = append(path, steps[i].Name)
+		for _, name := range steps[i].DependsOn {
+			dep := names[name]
+			switch state[dep] {
+			case visiting:
+				// Cut the path back to where the cycle starts
+				for start, n := range path {
+					if n == name {
+						return append(append([]string(nil), path[start:]...), name)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range steps {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// graphConfig is a config with a %s slot for the top-level settings and one for the steps
+const graphConfig = `
+%s
+
+[instance]
+name = "app"
+project_id = "proj"
+zone = "us-central1-a"
+
+%s
+`
+
+func TestValidateGraph(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		steps    string
+		want     int // Parallelism after loading
+		wantErr  string
+	}{
+		{
+			name: "independent builds",
+			steps: `
+[[deployment]]
+name = "frontend"
+command = "npm run build"
+target = "local"
+
+[[deployment]]
+name = "backend"
+command = "go build ./..."
+target = "local"
+
+[[deployment]]
+command = "systemctl restart myapp"
+target = "remote"
+depends_on = ["frontend", "backend"]`,
+			want: defaultParallelism,
+		},
+		{
+			name:     "parallelism",
+			settings: "parallelism = 2",
+			steps:    "[[deployment]]\ncommand = \"true\"\ntarget = \"local\"",
+			want:     2,
+		},
+		{
+			name:     "negative parallelism",
+			settings: "parallelism = -1",
+			steps:    "[[deployment]]\ncommand = \"true\"\ntarget = \"local\"",
+			wantErr:  "parallelism must not be negative",
+		},
+		{
+			name: "duplicate name",
+			steps: `
+[[deployment]]
+name = "build"
+command = "make"
+target = "local"
+
+[[deployment]]
+name = "build"
+command = "make install"
+target = "local"`,
+			wantErr: `deployment[1].name "build" is already used by deployment[0]`,
+		},
+		{
+			name: "unknown dependency",
+			steps: `
+[[deployment]]
+command = "make"
+target = "local"
+depends_on = ["frontend"]`,
+			wantErr: `deployment[0].depends_on: unknown step "frontend"`,
+		},
+		{
+			name: "depends on itself",
+			steps: `
+[[deployment]]
+name = "build"
+command = "make"
+target = "local"
+depends_on = ["build"]`,
+			wantErr: `step "build" depends on itself`,
+		},
+		{
+			name: "cycle",
+			steps: `
+[[deployment]]
+name = "a"
+command = "true"
+target = "local"
+depends_on = ["c"]
+
+[[deployment]]
+name = "b"
+command = "true"
+target = "local"
+depends_on = ["a"]
+
+[[deployment]]
+name = "c"
+command = "true"
+target = "local"
+depends_on = ["b"]`,
+			wantErr: "dependency cycle: a → c → b → a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(t, fmt.Sprintf(graphConfig, tt.settings, tt.steps), LoadOptions{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.Parallelism != tt.want {
+				t.Errorf("Parallelism = %d, want %d", cfg.Parallelism, tt.want)
+			}
+		})
+	}
+}
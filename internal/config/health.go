@@ -0,0 +1,160 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Defaults for the optional [[healthcheck]] settings
+const (
+	defaultHealthInterval = 5 * time.Second
+	defaultHealthTimeout  = 10 * time.Second
+)
+
+// HealthCheck is a [[healthcheck]] entry, run once every deployment step has succeeded
+// The deployment only succeeds when every check passes
+// Exactly one of URL, TCP and Command is set
+type HealthCheck struct {
+	Name string `toml:"name"` // Optional: shown in messages instead of the check itself
+
+	URL    string `toml:"url"`    // HTTP(S) URL requested from the local machine
+	Status int    `toml:"status"` // Optional: expected HTTP status (default any 2xx)
+	Body   string `toml:"body"`   // Optional: regular expression the response body must match
+
+	TCP string `toml:"tcp"` // host:port that must accept connections from the local machine
+
+	Command string `toml:"command"` // Command run on the VM that must exit with status 0
+
+	Retries  int    `toml:"retries"`  // Optional: extra attempts after a failure
+	Interval string `toml:"interval"` // Optional: wait between attempts (default "5s")
+	Timeout  string `toml:"timeout"`  // Optional: limit for each attempt (default "10s")
+}
+
+// Kind returns "http", "tcp" or "command"
+func (h HealthCheck) Kind() string {
+	switch {
+	case h.URL != "":
+		return "http"
+	case h.TCP != "":
+		return "tcp"
+	default:
+		return "command"
+	}
+}
+
+// Description returns what the check tests, e.g. "GET http://10.0.0.2/health"
+func (h HealthCheck) Description() string {
+	switch h.Kind() {
+	case "http":
+		return "GET " + h.URL
+	case "tcp":
+		return "TCP " + h.TCP
+	default:
+		return h.Command
+	}
+}
+
+// Label names the check in messages: its name, or its description when it has none
+func (h HealthCheck) Label() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Description()
+}
+
+// IntervalDuration returns the wait between attempts
+func (h HealthCheck) IntervalDuration() time.Duration {
+	interval, err := time.ParseDuration(h.Interval)
+	if err != nil {
+		return defaultHealthInterval
+	}
+	return interval
+}
+
+// TimeoutDuration returns the limit for each attempt
+func (h HealthCheck) TimeoutDuration() time.Duration {
+	timeout, err := time.ParseDuration(h.Timeout)
+	if err != nil {
+		return defaultHealthTimeout
+	}
+	return timeout
+}
+
+// validate checks one [[healthcheck]] entry
+// key is the check's key in .gcd.toml for error messages, e.g. "healthcheck[0]"
+func (h HealthCheck) validate(key string) error {
+	kinds := 0
+	for _, set := range []bool{h.URL != "", h.TCP != "", h.Command != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("%s must set exactly one of url, tcp and command in %s", key, cfg_file)
+	}
+
+	if h.URL != "" {
+		// URLs with variables can only be checked once the instance is known
+		if len(References(h.URL)) == 0 {
+			if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s.url must be an http or https URL in %s", key, cfg_file)
+			}
+		}
+	} else if h.Status != 0 || h.Body != "" {
+		return fmt.Errorf("%s: status and body can only be used with url in %s", key, cfg_file)
+	}
+	if h.Status != 0 && (h.Status < 100 || h.Status > 599) {
+		return fmt.Errorf("%s.status must be an HTTP status code in %s", key, cfg_file)
+	}
+	if _, err := regexp.Compile(h.Body); err != nil {
+		return fmt.Errorf("%s.body is not a valid regular expression in %s: %w", key, cfg_file, err)
+	}
+	if h.TCP != "" && len(References(h.TCP)) == 0 {
+		if _, _, err := net.SplitHostPort(h.TCP); err != nil {
+			return fmt.Errorf("%s.tcp must be host:port in %s", key, cfg_file)
+		}
+	}
+
+	if h.Retries < 0 {
+		return fmt.Errorf("%s.retries must not be negative in %s", key, cfg_file)
+	}
+	if h.Interval != "" {
+		if interval, err := time.ParseDuration(h.Interval); err != nil || interval < 0 {
+			return fmt.Errorf("%s.interval must be a duration like \"5s\" in %s", key, cfg_file)
+		}
+	}
+	if h.Timeout != "" {
+		if timeout, err := time.ParseDuration(h.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("%s.timeout must be a positive duration like \"10s\" in %s", key, cfg_file)
+		}
+	}
+	return nil
+}
+
+// validateHealth checks the [[healthcheck]] entries and the [[on_failure]] steps
+// With [release] and no [[on_failure]] steps, a failed check rolls back to the previous release
+func (c *Config) validateHealth() error {
+	for i, check := range c.HealthChecks {
+		if err := check.validate(fmt.Sprintf("healthcheck[%d]", i)); err != nil {
+			return err
+		}
+	}
+	if len(c.OnFailure) > 0 && len(c.HealthChecks) == 0 {
+		return fmt.Errorf("on_failure steps only run when a [[healthcheck]] fails, but none is configured in %s", cfg_file)
+	}
+	if err := validateSteps(c.OnFailure, "on_failure"); err != nil {
+		return err
+	}
+	for i, step := range c.OnFailure {
+		if len(step.DependsOn) > 0 {
+			return fmt.Errorf("on_failure[%d].depends_on cannot be used, on_failure steps run in order in %s", i, cfg_file)
+		}
+	}
+	if len(c.OnFailure) == 0 && len(c.HealthChecks) > 0 && c.Release != nil {
+		c.OnFailure = c.rollbackSteps("", true)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHealthCheckValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   HealthCheck
+		wantErr string
+	}{
+		{name: "url", check: HealthCheck{URL: "https://example.com/health", Status: 204, Body: "ok|ready"}},
+		{name: "url with variables", check: HealthCheck{URL: "http://${{ external_ip }}/health"}},
+		{name: "tcp", check: HealthCheck{TCP: "10.0.0.2:5432", Retries: 3, Interval: "1s", Timeout: "2s"}},
+		{name: "command", check: HealthCheck{Command: "systemctl is-active app"}},
+		{name: "nothing to check", check: HealthCheck{}, wantErr: "exactly one of url, tcp and command"},
+		{name: "two kinds", check: HealthCheck{URL: "http://a/", TCP: "a:1"}, wantErr: "exactly one of url, tcp and command"},
+		{name: "not http", check: HealthCheck{URL: "ftp://example.com/"}, wantErr: "must be an http or https URL"},
+		{name: "status without url", check: HealthCheck{Command: "true", Status: 200}, wantErr: "can only be used with url"},
+		{name: "bad status", check: HealthCheck{URL: "http://a/", Status: 42}, wantErr: "must be an HTTP status code"},
+		{name: "bad body", check: HealthCheck{URL: "http://a/", Body: "("}, wantErr: "not a valid regular expression"},
+		{name: "tcp without port", check: HealthCheck{TCP: "10.0.0.2"}, wantErr: "must be host:port"},
+		{name: "negative retries", check: HealthCheck{Command: "true", Retries: -1}, wantErr: "must not be negative"},
+		{name: "bad interval", check: HealthCheck{Command: "true", Interval: "soon"}, wantErr: "interval must be a duration"},
+		{name: "zero timeout", check: HealthCheck{Command: "true", Timeout: "0s"}, wantErr: "timeout must be a positive duration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check.validate("healthcheck[0]")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateHealthOnFailure(t *testing.T) {
+	const instance = "[instance]\nname = \"app\"\nproject_id = \"proj\"\nzone = \"us-central1-a\"\n"
+	const check = "\n[[healthcheck]]\ncommand = \"curl -fs localhost/health\"\n"
+	const onFailure = "\n[[on_failure]]\ncommand = \"notify failed\"\ntarget = \"local\"\n"
+	tests := []struct {
+		name    string
+		config  string
+		want    []string // Names or commands of the on_failure steps
+		wantErr string
+	}{
+		{name: "release rolls back by default", config: fmt.Sprintf(releaseConfig, "", "") + check, want: []string{ReleaseRollbackStep, "restart"}},
+		{name: "configured steps replace the rollback", config: fmt.Sprintf(releaseConfig, "", "") + check + onFailure, want: []string{"notify failed"}},
+		{name: "no rollback without a health check", config: fmt.Sprintf(releaseConfig, "", ""), want: nil},
+		{name: "no rollback without [release]", config: "command = \"true\"\n" + instance + check, want: nil},
+		{name: "on_failure without a health check", config: fmt.Sprintf(releaseConfig, "", "") + onFailure, wantErr: "none is configured"},
+		{
+			name:    "on_failure with depends_on",
+			config:  fmt.Sprintf(releaseConfig, "", "") + check + onFailure + "depends_on = [\"x\"]\n",
+			wantErr: "on_failure[0].depends_on cannot be used",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(t, tt.config, LoadOptions{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			var got []string
+			for _, step := range cfg.OnFailure {
+				if step.Name != "" {
+					got = append(got, step.Name)
+				} else {
+					got = append(got, step.Command)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("OnFailure = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollbackSkipsDeploymentSteps(t *testing.T) {
+	contents := fmt.Sprintf(releaseConfig, "", "") + `
+[[healthcheck]]
+command = "curl -fs localhost/health"
+
+[hooks]
+pre_deploy = [{ command = "notify start", target = "local" }]
+`
+	cfg, err := loadConfig(t, contents, LoadOptions{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Hooks.PreDeploy) != 1 {
+		t.Fatalf("Hooks = %+v, want the pre_deploy hook", cfg.Hooks)
+	}
+	if !strings.Contains(cfg.OnFailure[0].Command, `rm -f "$current/`+activatedMarker+`"`) {
+		t.Errorf("automatic rollback does not discard the failed release: %q", cfg.OnFailure[0].Command)
+	}
+
+	if err := cfg.Rollback(""); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	if !cfg.RollingBack {
+		t.Error("RollingBack is not set")
+	}
+	if len(cfg.OnFailure) != 0 || len(cfg.Hooks.PreDeploy) != 0 {
+		t.Errorf("OnFailure = %+v, Hooks = %+v, want neither on a rollback", cfg.OnFailure, cfg.Hooks)
+	}
+	if strings.Contains(cfg.Deployment[0].Command, "rm -f") {
+		t.Errorf("rollback discards the release it rolls back from: %q", cfg.Deployment[0].Command)
+	}
+	if len(cfg.HealthChecks) != 1 {
+		t.Errorf("HealthChecks = %+v, want them kept", cfg.HealthChecks)
+	}
+}
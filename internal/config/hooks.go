@@ -0,0 +1,54 @@
+package config
+
+import "fmt"
+
+// Hooks are steps that always run around a deployment, from the [hooks] section
+// They take the same settings as deployment steps, except depends_on: each list runs in order
+type Hooks struct {
+	PreDeploy  []DeploymentStep `toml:"pre_deploy"`  // Before the first step; a failure stops the deployment
+	PostDeploy []DeploymentStep `toml:"post_deploy"` // After the deployment, whether it succeeded or not
+	OnFailure  []DeploymentStep `toml:"on_failure"`  // After a failed deployment, before post_deploy
+}
+
+// hookList is one list of hooks with its key in .gcd.toml
+type hookList struct {
+	key   string
+	steps []DeploymentStep
+}
+
+// lists returns every hook list, in the order they run on a failed deployment
+func (h *Hooks) lists() []hookList {
+	return []hookList{
+		{"hooks.pre_deploy", h.PreDeploy},
+		{"hooks.on_failure", h.OnFailure},
+		{"hooks.post_deploy", h.PostDeploy},
+	}
+}
+
+// merge replaces the hook lists that are set in other
+func (h *Hooks) merge(other Hooks) {
+	if len(other.PreDeploy) > 0 {
+		h.PreDeploy = other.PreDeploy
+	}
+	if len(other.PostDeploy) > 0 {
+		h.PostDeploy = other.PostDeploy
+	}
+	if len(other.OnFailure) > 0 {
+		h.OnFailure = other.OnFailure
+	}
+}
+
+// validate checks the steps of every hook
+func (h *Hooks) validate() error {
+	for _, list := range h.lists() {
+		if err := validateSteps(list.steps, list.key); err != nil {
+			return err
+		}
+		for i, step := range list.steps {
+			if len(step.DependsOn) > 0 {
+				return fmt.Errorf("%s[%d].depends_on cannot be used, hooks run in order in %s", list.key, i, cfg_file)
+			}
+		}
+	}
+	return nil
+}
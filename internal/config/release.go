@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Built-in variables set when a [release] section is configured
+const (
+	VarRelease    = "release"     // Release ID, e.g. 20240131154500
+	VarReleaseDir = "release_dir" // Directory of the release on the VM
+)
+
+// defaultKeepReleases is the number of releases kept when keep is not set
+const defaultKeepReleases = 5
+
+// Names of the steps added around the deployment script by a [release] section
+const (
+	ReleasePrepareStep  = "release-prepare"
+	ReleaseActivateStep = "release-activate"
+	ReleaseRollbackStep = "release-rollback"
+)
+
+// activatedMarker marks the releases that became current, so rollback and pruning
+// can tell them from releases whose deployment failed
+const activatedMarker = ".activated"
+
+// Release deploys into a new directory under Path/releases on every run and switches
+// the Path/current symlink to it once every step has succeeded
+type Release struct {
+	Path    string           `toml:"path"`    // Application directory on the VM, e.g. /opt/app
+	Keep    int              `toml:"keep"`    // Optional: releases kept, including the current one (default 5)
+	Restart []DeploymentStep `toml:"restart"` // Optional: steps run after switching, on deploy and on rollback
+
+	// ID names the release of this run
+	ID string `toml:"-"`
+}
+
+// Dir returns the directory of this run's release
+func (r *Release) Dir() string {
+	return path.Join(r.Path, "releases", r.ID)
+}
+
+// Current returns the symlink to the active release
+func (r *Release) Current() string {
+	return path.Join(r.Path, "current")
+}
+
+// validate checks the [release] section
+func (r *Release) validate() error {
+	if !path.IsAbs(r.Path) {
+		return fmt.Errorf("release.path must be an absolute path on the VM in %s", cfg_file)
+	}
+	if strings.ContainsAny(r.Path, "'\n") {
+		return fmt.Errorf("release.path cannot contain quotes or newlines in %s", cfg_file)
+	}
+	if r.Keep < 0 {
+		return fmt.Errorf("release.keep must not be negative in %s", cfg_file)
+	}
+	if r.Keep == 0 {
+		r.Keep = defaultKeepReleases
+	}
+	if err := validateSteps(r.Restart, "release.restart"); err != nil {
+		return err
+	}
+	return validateDependencies(r.Restart, "release.restart")
+}
+
+// applyRelease wraps the deployment script in the release steps when [release] is set:
+// a step creating the release directory, the script itself running in that directory,
+// a step switching the current symlink and pruning old releases, and the restart steps
+// deploymentKey names the deployment table in error messages
+func (c *Config) applyRelease(deploymentKey string) error {
+	if c.Release == nil {
+		return nil
+	}
+	release := c.Release
+	if err := release.validate(); err != nil {
+		return err
+	}
+	release.ID = time.Now().UTC().Format(timestampFormat)
+
+	steps := []DeploymentStep{{
+		Name:    ReleasePrepareStep,
+		Target:  "remote",
+		Command: fmt.Sprintf("mkdir -p '${{ %s }}'", VarReleaseDir),
+		Barrier: true,
+	}}
+	// Steps are named across the whole wrapped script, so depends_on must not be ambiguous
+	names := make(map[string]string)
+	for i, step := range c.Steps() {
+		if step.Name == ReleasePrepareStep || step.Name == ReleaseActivateStep {
+			return fmt.Errorf("%s[%d].name %q is reserved for the release steps in %s", deploymentKey, i, step.Name, cfg_file)
+		}
+		if step.Name != "" {
+			names[step.Name] = fmt.Sprintf("%s[%d]", deploymentKey, i)
+		}
+		steps = append(steps, inDir(step, "${{ "+VarReleaseDir+" }}"))
+	}
+	steps = append(steps, DeploymentStep{
+		Name:    ReleaseActivateStep,
+		Target:  "remote",
+		Command: activateCommand(release),
+		Barrier: true,
+	})
+	for i, step := range release.Restart {
+		switch {
+		case step.Name == ReleasePrepareStep || step.Name == ReleaseActivateStep || step.Name == ReleaseRollbackStep:
+			return fmt.Errorf("release.restart[%d].name %q is reserved for the release steps in %s", i, step.Name, cfg_file)
+		case step.Name != "" && names[step.Name] != "":
+			return fmt.Errorf("release.restart[%d].name %q is already used by %s in %s", i, step.Name, names[step.Name], cfg_file)
+		}
+		steps = append(steps, inDir(step, release.Current()))
+	}
+
+	c.Deployment = steps
+	return validateDependencies(steps, deploymentKey)
+}
+
+// activateCommand marks the release as activated, switches the current symlink to it
+// atomically with a rename, and removes all but the newest Keep activated releases
+func activateCommand(r *Release) string {
+	dir := "${{ " + VarReleaseDir + " }}"
+	return fmt.Sprintf(`set -e; ln -sfn "releases/${{ %[3]s }}" '%[4]s/.current.tmp'; mv -Tf '%[4]s/.current.tmp' '%[5]s'; touch '%[1]s/%[2]s'; `+
+		`cd '%[4]s/releases'; n=0; for d in $(ls -1 | sort -r); do if [ -f "$d/%[2]s" ] && [ $((n += 1)) -le %[6]d ]; then continue; fi; rm -rf "$d"; done`,
+		dir, activatedMarker, VarRelease, r.Path, r.Current(), r.Keep)
+}
+
+// Rollback replaces the deployment script with a step switching the current symlink
+// back to an earlier release, followed by the restart steps
+// An empty release rolls back to the activated release before the current one
+// The hooks and on_failure steps belong to deployments and do not run; the health checks
+// still do, but a failing one only fails the rollback rather than rolling back again
+func (c *Config) Rollback(release string) error {
+	if c.Release == nil {
+		return fmt.Errorf("rollback requires a [release] section in %s", cfg_file)
+	}
+	if strings.ContainsAny(release, "/'\n") || release == "." || release == ".." {
+		return fmt.Errorf("invalid release %q", release)
+	}
+	c.Deployment = c.rollbackSteps(release, false)
+	c.OnFailure = nil
+	c.Hooks = Hooks{}
+	c.RollingBack = true
+	return nil
+}
+
+// rollbackSteps returns the step switching the current symlink back to release, or to
+// the activated release before the current one when release is empty, and the restart steps
+// discard unmarks the release rolled back from, so that it is neither rolled back to nor
+// kept by pruning later
+func (c *Config) rollbackSteps(release string, discard bool) []DeploymentStep {
+	r := c.Release
+	unmark := ""
+	if discard {
+		unmark = fmt.Sprintf(`rm -f "$current/%s"; `, activatedMarker)
+	}
+	steps := []DeploymentStep{{
+		Name:   ReleaseRollbackStep,
+		Target: "remote",
+		Command: fmt.Sprintf(`set -e; cd '%[1]s/releases'; current=$(basename "$(readlink '%[2]s')"); target='%[3]s'; `+
+			`if [ -z "$target" ]; then for d in $(ls -1 | sort); do if [ "$d" = "$current" ]; then break; fi; if [ -f "$d/%[4]s" ]; then target=$d; fi; done; fi; `+
+			`if [ -z "$target" ]; then echo "no release before $current to roll back to" >&2; exit 1; fi; `+
+			`if [ ! -f "$target/%[4]s" ]; then echo "release $target not found in %[1]s/releases" >&2; exit 1; fi; `+
+			`ln -sfn "releases/$target" '%[1]s/.current.tmp'; mv -Tf '%[1]s/.current.tmp' '%[2]s'; %[5]secho "Rolled back from $current to $target"`,
+			r.Path, r.Current(), release, activatedMarker, unmark),
+	}}
+	for _, step := range r.Restart {
+		steps = append(steps, inDir(step, r.Current()))
+	}
+	return steps
+}
+
+// inDir makes the remote paths of a step relative to dir: the working directory of
+// remote commands and the remote side of transfers
+func inDir(step DeploymentStep, dir string) DeploymentStep {
+	join := func(p string) string {
+		if p == "" {
+			return dir
+		}
+		if path.IsAbs(p) || strings.HasPrefix(p, "~") || strings.HasPrefix(p, "${{") {
+			return p
+		}
+		// Keep the trailing "/" that marks a directory destination
+		joined := path.Join(dir, p)
+		if strings.HasSuffix(p, "/") {
+			joined += "/"
+		}
+		return joined
+	}
+
+	switch step.Target {
+	case "remote":
+		step.Workdir = join(step.Workdir)
+	case "upload":
+		step.Dest = join(step.Dest)
+	case "download":
+		step.Src = join(step.Src)
+	}
+	return step
+}
@@ -0,0 +1,317 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const releaseConfig = `
+[instance]
+name = "app"
+project_id = "proj"
+zone = "us-central1-a"
+
+[release]
+path = "/opt/app"
+keep = 3
+
+[[release.restart]]
+name = "restart"
+command = "sudo systemctl restart app"
+target = "remote"
+%s
+
+[[deployment]]
+name = "upload"
+target = "upload"
+src = "dist/"
+dest = "public/"
+
+[[deployment]]
+name = "install"
+command = "npm ci"
+target = "remote"
+depends_on = ["upload"]
+%s
+`
+
+func TestApplyRelease(t *testing.T) {
+	cfg, err := loadConfig(t, fmt.Sprintf(releaseConfig, "", ""), LoadOptions{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	releaseDir := "${{ " + VarReleaseDir + " }}"
+	want := []struct {
+		name    string
+		barrier bool
+		workdir string
+		dest    string
+	}{
+		{name: ReleasePrepareStep, barrier: true},
+		{name: "upload", dest: releaseDir + "/public/"},
+		{name: "install", workdir: releaseDir},
+		{name: ReleaseActivateStep, barrier: true},
+		{name: "restart", workdir: "/opt/app/current"},
+	}
+	if len(cfg.Deployment) != len(want) {
+		t.Fatalf("Deployment has %d steps, want %d: %+v", len(cfg.Deployment), len(want), cfg.Deployment)
+	}
+	for i, w := range want {
+		step := cfg.Deployment[i]
+		if step.Name != w.name || step.Barrier != w.barrier || step.Workdir != w.workdir || step.Dest != w.dest {
+			t.Errorf("step %d = %q barrier %v workdir %q dest %q, want %+v", i+1, step.Name, step.Barrier, step.Workdir, step.Dest, w)
+		}
+	}
+	if cfg.Release.Keep != 3 || cfg.Release.ID == "" {
+		t.Errorf("Release = %+v", cfg.Release)
+	}
+	if cfg.Release.Dir() != "/opt/app/releases/"+cfg.Release.ID || cfg.Vars[VarReleaseDir] != cfg.Release.Dir() {
+		t.Errorf("release_dir = %q, Dir() = %q", cfg.Vars[VarReleaseDir], cfg.Release.Dir())
+	}
+	if !strings.Contains(cfg.Deployment[3].Command, "mv -Tf '/opt/app/.current.tmp' '/opt/app/current'") {
+		t.Errorf("activate command = %q", cfg.Deployment[3].Command)
+	}
+}
+
+func TestApplyReleaseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		restart string // Appended to the restart step
+		script  string // Appended to the last deployment step
+		wantErr string
+	}{
+		{
+			name:    "restart name used by the script",
+			script:  "[[deployment]]\nname = \"restart\"\ncommand = \"true\"\ntarget = \"remote\"",
+			wantErr: `release.restart[0].name "restart" is already used by deployment[2]`,
+		},
+		{
+			name:    "restart depends on a script step",
+			restart: `depends_on = ["install"]`,
+			wantErr: `release.restart[0].depends_on: unknown step "install"`,
+		},
+		{
+			name:    "script step named like a release step",
+			script:  "[[deployment]]\nname = \"release-activate\"\ncommand = \"true\"\ntarget = \"remote\"",
+			wantErr: `deployment[2].name "release-activate" is reserved`,
+		},
+		{
+			name:    "restart step named like the rollback step",
+			restart: `name = "release-rollback"`,
+			wantErr: "is reserved for the release steps",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := fmt.Sprintf(releaseConfig, tt.restart, tt.script)
+			if strings.HasPrefix(tt.restart, "name =") {
+				// Replace the restart step's name rather than setting it twice
+				contents = strings.Replace(contents, "name = \"restart\"\n", "", 1)
+			}
+			_, err := loadConfig(t, contents, LoadOptions{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	cfg, err := loadConfig(t, fmt.Sprintf(releaseConfig, "", ""), LoadOptions{})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := cfg.Rollback("20240131154500"); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	if len(cfg.Deployment) != 2 || cfg.Deployment[0].Name != ReleaseRollbackStep || cfg.Deployment[1].Name != "restart" {
+		t.Errorf("Deployment = %+v, want the rollback and restart steps", cfg.Deployment)
+	}
+	if !strings.Contains(cfg.Deployment[0].Command, "target='20240131154500'") {
+		t.Errorf("rollback command = %q", cfg.Deployment[0].Command)
+	}
+	if cfg.Deployment[1].Workdir != "/opt/app/current" {
+		t.Errorf("restart step runs in %q, want the current release", cfg.Deployment[1].Workdir)
+	}
+
+	for _, release := range []string{"../etc", "it's", "..", "."} {
+		if err := cfg.Rollback(release); err == nil {
+			t.Errorf("Rollback(%q) succeeded", release)
+		}
+	}
+
+	cfg.Release = nil
+	if err := cfg.Rollback(""); err == nil || !strings.Contains(err.Error(), "requires a [release] section") {
+		t.Errorf("Rollback() without [release] error = %v", err)
+	}
+}
+
+// releaseTree creates the releases under dir/releases, marking the activated ones,
+// and points dir/current at current when it is set
+func releaseTree(t *testing.T, dir string, releases map[string]bool, current string) {
+	t.Helper()
+	for name, activated := range releases {
+		release := filepath.Join(dir, "releases", name)
+		if err := os.MkdirAll(release, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if activated {
+			if err := os.WriteFile(filepath.Join(release, activatedMarker), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if current != "" {
+		if err := os.Symlink("releases/"+current, filepath.Join(dir, "current")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runRemote runs a release command with the local shell, as the VM would
+func runRemote(t *testing.T, command string, vars map[string]string) (string, error) {
+	t.Helper()
+	command, err := Expand(command, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	return string(output), err
+}
+
+// releaseState returns the release current points at and the releases left, marking
+// the activated ones with a *
+func releaseState(t *testing.T, dir string) (string, []string) {
+	t.Helper()
+	current, _ := os.Readlink(filepath.Join(dir, "current"))
+	entries, err := os.ReadDir(filepath.Join(dir, "releases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var releases []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, err := os.Stat(filepath.Join(dir, "releases", name, activatedMarker)); err == nil {
+			name += "*"
+		}
+		releases = append(releases, name)
+	}
+	return current, releases
+}
+
+func TestActivateCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases map[string]bool // Existing releases, true when activated
+		keep     int
+		want     []string
+	}{
+		{
+			name:     "first release",
+			releases: map[string]bool{},
+			keep:     2,
+			want:     []string{"20240105000000*"},
+		},
+		{
+			name:     "oldest activated releases pruned",
+			releases: map[string]bool{"20240101000000": true, "20240102000000": true, "20240103000000": true},
+			keep:     3,
+			want:     []string{"20240102000000*", "20240103000000*", "20240105000000*"},
+		},
+		{
+			name:     "failed releases removed",
+			releases: map[string]bool{"20240101000000": true, "20240102000000": false, "20240104000000": false},
+			keep:     3,
+			want:     []string{"20240101000000*", "20240105000000*"},
+		},
+		{
+			name:     "keep one",
+			releases: map[string]bool{"20240101000000": true, "20240102000000": true},
+			keep:     1,
+			want:     []string{"20240105000000*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			releaseTree(t, dir, tt.releases, "")
+			release := &Release{Path: dir, Keep: tt.keep, ID: "20240105000000"}
+			if err := os.MkdirAll(release.Dir(), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			vars := map[string]string{VarRelease: release.ID, VarReleaseDir: release.Dir()}
+			if output, err := runRemote(t, activateCommand(release), vars); err != nil {
+				t.Fatalf("activate failed: %v\n%s", err, output)
+			}
+			current, releases := releaseState(t, dir)
+			if current != "releases/"+release.ID {
+				t.Errorf("current -> %q, want the new release", current)
+			}
+			if !reflect.DeepEqual(releases, tt.want) {
+				t.Errorf("releases = %v, want %v", releases, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollbackTarget(t *testing.T) {
+	releases := map[string]bool{
+		"20240101000000": true,
+		"20240102000000": true,
+		"20240103000000": false, // Failed deployment
+		"20240104000000": true,
+		"20240105000000": true,
+	}
+	tests := []struct {
+		name    string
+		current string
+		release string
+		discard bool
+		want    string
+		wantErr string
+	}{
+		{name: "previous activated release", current: "20240104000000", want: "20240102000000"},
+		{name: "from the newest release", current: "20240105000000", want: "20240104000000"},
+		{name: "named release", current: "20240102000000", release: "20240105000000", want: "20240105000000"},
+		{name: "discard unmarks the release rolled back from", current: "20240105000000", discard: true, want: "20240104000000"},
+		{name: "nothing before the oldest release", current: "20240101000000", wantErr: "no release before 20240101000000"},
+		{name: "failed release", current: "20240105000000", release: "20240103000000", wantErr: "release 20240103000000 not found"},
+		{name: "unknown release", current: "20240105000000", release: "20230101000000", wantErr: "release 20230101000000 not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			releaseTree(t, dir, releases, tt.current)
+			cfg := &Config{Release: &Release{Path: dir}}
+
+			output, err := runRemote(t, cfg.rollbackSteps(tt.release, tt.discard)[0].Command, nil)
+			current, _ := releaseState(t, dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(output, tt.wantErr) {
+					t.Fatalf("rollback error = %v, output %q, want %q", err, output, tt.wantErr)
+				}
+				if current != "releases/"+tt.current {
+					t.Errorf("current -> %q after a failed rollback, want it unchanged", current)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rollback failed: %v\n%s", err, output)
+			}
+			if current != "releases/"+tt.want {
+				t.Errorf("current -> %q, want releases/%s", current, tt.want)
+			}
+			_, err = os.Stat(filepath.Join(dir, "releases", tt.current, activatedMarker))
+			if discarded := os.IsNotExist(err); discarded != tt.discard {
+				t.Errorf("release rolled back from unmarked = %v, want %v", discarded, tt.discard)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// Built-in variables that commands can reference as ${{ name }}
+const (
+	VarInstance   = "instance"    // Instance name
+	VarExternalIP = "external_ip" // Instance external IP
+	VarInternalIP = "internal_ip" // Instance internal IP
+	VarRemoteUser = "remote_user" // SSH user on the instance
+	VarProject    = "project"     // Instance project ID
+	VarZone       = "zone"        // Instance zone
+	VarGitSHA     = "git_sha"     // HEAD commit of the repository holding .gcd.toml
+	VarGitBranch  = "git_branch"  // Current branch of that repository
+	VarTimestamp  = "timestamp"   // UTC time the config was loaded, e.g. 20240131154500
+)
+
+// envVarPrefix references the local environment, e.g. ${{ env.IMAGE_TAG }}
+const envVarPrefix = "env."
+
+// timestampFormat sorts lexically and is safe in file names
+const timestampFormat = "20060102150405"
+
+// varPattern matches ${{ name }} references; the double braces leave shell ${VAR}
+// and Go template {{ .Field }} syntax untouched
+var varPattern = regexp.MustCompile(`\$\{\{\s*([A-Za-z_][A-Za-z0-9_.\-]*)\s*\}\}`)
+
+// hostVars are the built-ins that are only known once an instance has been looked up
+var hostVars = map[string]bool{
+	VarInstance:   true,
+	VarExternalIP: true,
+	VarInternalIP: true,
+	VarRemoteUser: true,
+	VarProject:    true,
+	VarZone:       true,
+}
+
+// isBuiltinVar reports whether name is reserved for a built-in variable
+func isBuiltinVar(name string) bool {
+	return hostVars[name] || name == VarGitSHA || name == VarGitBranch || name == VarTimestamp || name == VarRelease || name == VarReleaseDir || strings.HasPrefix(name, envVarPrefix)
+}
+
+// resolveVars merges the [vars] table with CLI overrides, checks that every
+// reference in the commands is known, and fills in the built-ins that do not
+// depend on the instance
+// deploymentKey names the deployment table in error messages
+func (c *Config) resolveVars(configDir string, overrides map[string]string, deploymentKey string) error {
+	vars := make(map[string]string, len(c.Vars)+len(overrides))
+	for name, value := range c.Vars {
+		if isBuiltinVar(name) {
+			return fmt.Errorf("vars.%s shadows a built-in variable in %s", name, cfg_file)
+		}
+		vars[name] = value
+	}
+	for name, value := range overrides {
+		if isBuiltinVar(name) {
+			return fmt.Errorf("--var %s shadows a built-in variable", name)
+		}
+		vars[name] = value
+	}
+
+	for _, ref := range c.commandRefs(deploymentKey) {
+		for _, name := range References(ref.command) {
+			if _, ok := vars[name]; ok || hostVars[name] {
+				continue
+			}
+			switch {
+			case name == VarGitSHA || name == VarGitBranch:
+				if err := gitVars(configDir, vars); err != nil {
+					return fmt.Errorf("%s in %s references ${{ %s }}: %w", ref.key, cfg_file, name, err)
+				}
+			case name == VarTimestamp:
+				vars[VarTimestamp] = time.Now().UTC().Format(timestampFormat)
+			case name == VarRelease || name == VarReleaseDir:
+				if c.Release == nil {
+					return fmt.Errorf("%s in %s references ${{ %s }}, which requires a [release] section", ref.key, cfg_file, name)
+				}
+				vars[VarRelease] = c.Release.ID
+				vars[VarReleaseDir] = c.Release.Dir()
+			case strings.HasPrefix(name, envVarPrefix):
+				value, ok := os.LookupEnv(strings.TrimPrefix(name, envVarPrefix))
+				if !ok {
+					return fmt.Errorf("%s in %s references ${{ %s }}, but $%s is not set", ref.key, cfg_file, name, strings.TrimPrefix(name, envVarPrefix))
+				}
+				vars[name] = value
+			default:
+				return fmt.Errorf("unknown variable ${{ %s }} in %s in %s", name, ref.key, cfg_file)
+			}
+		}
+	}
+
+	c.Vars = vars
+	return nil
+}
+
+// commandRef is a command together with its key in .gcd.toml for error messages
+type commandRef struct {
+	key     string
+	command string
+}
+
+// commandRefs returns every command, transfer path and health check that may contain variable references
+func (c *Config) commandRefs(deploymentKey string) []commandRef {
+	var refs []commandRef
+	if c.Command != "" {
+		refs = append(refs, commandRef{key: "command", command: c.Command})
+	}
+	refs = append(refs, stepRefs(c.Deployment, deploymentKey)...)
+	refs = append(refs, stepRefs(c.OnFailure, "on_failure")...)
+	for _, list := range c.Hooks.lists() {
+		refs = append(refs, stepRefs(list.steps, list.key)...)
+	}
+	for i, check := range c.HealthChecks {
+		refs = append(refs,
+			commandRef{key: fmt.Sprintf("healthcheck[%d].url", i), command: check.URL},
+			commandRef{key: fmt.Sprintf("healthcheck[%d].tcp", i), command: check.TCP},
+			commandRef{key: fmt.Sprintf("healthcheck[%d].command", i), command: check.Command},
+		)
+	}
+	return refs
+}
+
+// stepRefs returns the commands and transfer paths of steps; key names them in error messages
+func stepRefs(steps []DeploymentStep, key string) []commandRef {
+	var refs []commandRef
+	for i, step := range steps {
+		refs = append(refs,
+			commandRef{key: fmt.Sprintf("%s[%d].command", key, i), command: step.Command},
+			commandRef{key: fmt.Sprintf("%s[%d].src", key, i), command: step.Src},
+			commandRef{key: fmt.Sprintf("%s[%d].dest", key, i), command: step.Dest},
+			commandRef{key: fmt.Sprintf("%s[%d].workdir", key, i), command: step.Workdir},
+		)
+		names := make([]string, 0, len(step.Env))
+		for name := range step.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			refs = append(refs, commandRef{key: fmt.Sprintf("%s[%d].env.%s", key, i, name), command: step.Env[name]})
+		}
+	}
+	return refs
+}
+
+// gitVars sets git_sha and git_branch for the repository in dir
+func gitVars(dir string, vars map[string]string) error {
+	if _, ok := vars[VarGitSHA]; ok {
+		return nil
+	}
+	sha, err := gitOutput(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	branch, err := gitOutput(dir, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+	vars[VarGitSHA] = sha
+	vars[VarGitBranch] = branch
+	return nil
+}
+
+// Revision returns the git commit and branch of the repository holding .gcd.toml
+// Both are empty when it is not in a git repository
+func (c *Config) Revision() (sha, branch string) {
+	vars := make(map[string]string, 2)
+	if sha, ok := c.Vars[VarGitSHA]; ok {
+		return sha, c.Vars[VarGitBranch]
+	}
+	if err := gitVars(filepath.Dir(c.Path), vars); err != nil {
+		return "", ""
+	}
+	return vars[VarGitSHA], vars[VarGitBranch]
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("failed to run git: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// References returns the variable names referenced in s, in order of appearance
+func References(s string) []string {
+	var names []string
+	for _, match := range varPattern.FindAllStringSubmatch(s, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// HostVars returns vars plus the built-ins describing the instance a step runs on
+// details may be nil if the instance has not been looked up
+func HostVars(vars map[string]string, instance deploy.Instance, details *deploy.InstanceDetails) map[string]string {
+	merged := make(map[string]string, len(vars)+len(hostVars))
+	for name, value := range vars {
+		merged[name] = value
+	}
+	merged[VarInstance] = instance.Name
+	merged[VarProject] = instance.ProjectId
+	merged[VarZone] = instance.Zone
+	if details != nil {
+		merged[VarExternalIP] = details.ExternalIP
+		merged[VarInternalIP] = details.InternalIP
+		merged[VarRemoteUser] = details.Username
+	}
+	return merged
+}
+
+// Expand replaces ${{ name }} references in s with their values
+// Returns an error naming the first variable that has no value
+func Expand(s string, vars map[string]string) (string, error) {
+	var missing string
+	expanded := varPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := varPattern.FindStringSubmatch(ref)[1]
+		value, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("variable ${{ %s }} has no value", missing)
+	}
+	return expanded, nil
+}
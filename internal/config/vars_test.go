@@ -0,0 +1,112 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadVars(t *testing.T) {
+	const instance = `
+[instance]
+name = "app"
+project_id = "proj"
+zone = "us-central1-a"
+`
+	t.Setenv("GCD_TEST_TAG", "v1.2.3")
+	tests := []struct {
+		name     string
+		config   string
+		vars     map[string]string
+		wantVars map[string]string
+		wantErr  string
+	}{
+		{
+			name:     "host variables are resolved when connecting",
+			config:   `command = "echo ${{ instance }} ${{ external_ip }}"`,
+			wantVars: map[string]string{},
+		},
+		{
+			name:     "local environment",
+			config:   `command = "docker pull app:${{ env.GCD_TEST_TAG }}"`,
+			wantVars: map[string]string{"env.GCD_TEST_TAG": "v1.2.3"},
+		},
+		{
+			name:     "--var without [vars]",
+			config:   `command = "echo ${{ greeting }}"`,
+			vars:     map[string]string{"greeting": "hi"},
+			wantVars: map[string]string{"greeting": "hi"},
+		},
+		{
+			name:    "unknown variable",
+			config:  `command = "echo ${{ missing }}"`,
+			wantErr: "unknown variable ${{ missing }} in command",
+		},
+		{
+			name:    "unset environment variable",
+			config:  `command = "echo ${{ env.GCD_TEST_UNSET }}"`,
+			wantErr: "$GCD_TEST_UNSET is not set",
+		},
+		{
+			name:    "built-in shadowed",
+			config:  "command = \"echo\"\n[vars]\ninstance = \"x\"",
+			wantErr: "vars.instance shadows a built-in variable",
+		},
+		{
+			name:    "release variable without [release]",
+			config:  `command = "cd ${{ release_dir }}"`,
+			wantErr: "requires a [release] section",
+		},
+		{
+			name:     "shell and template syntax are left alone",
+			config:   `command = "echo ${HOME} {{ .Name }}"`,
+			wantVars: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(t, tt.config+"\n"+instance, LoadOptions{Vars: tt.vars})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if !reflect.DeepEqual(cfg.Vars, tt.wantVars) {
+				t.Errorf("Vars = %v, want %v", cfg.Vars, tt.wantVars)
+			}
+		})
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"app": "web", "env.TAG": "v1", "port": "80"}
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "deploy ${{ app }}:${{env.TAG}}", want: "deploy web:v1"},
+		{in: "listen ${{   port   }} ${PORT} {{ .Port }}", want: "listen 80 ${PORT} {{ .Port }}"},
+		{in: "no references", want: "no references"},
+		{in: "${{ app }} ${{ missing }} ${{ other }}", wantErr: "variable ${{ missing }} has no value"},
+	}
+	for _, tt := range tests {
+		got, err := Expand(tt.in, vars)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Expand(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Expand(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if refs := References("${{ a }} ${{b.c}} ${{ a }}"); !reflect.DeepEqual(refs, []string{"a", "b.c", "a"}) {
+		t.Errorf("References() = %v", refs)
+	}
+}
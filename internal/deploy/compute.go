@@ -2,11 +2,17 @@ package deploy
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // Instance represents a GCP VM instance
@@ -16,8 +22,31 @@ type Instance struct {
 	Zone      string `toml:"zone"`
 }
 
+// InstanceSelector selects every instance in a project and zone carrying all of Labels
+type InstanceSelector struct {
+	ProjectId string            `toml:"project_id"`
+	Zone      string            `toml:"zone"`
+	Labels    map[string]string `toml:"labels"`
+}
+
+// String returns the selector as a label filter, e.g. "role=web,tier=app"
+func (s InstanceSelector) String() string {
+	keys := make([]string, 0, len(s.Labels))
+	for key := range s.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+s.Labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
 // InstanceDetails contains information about a VM instance needed for SSH connection
 type InstanceDetails struct {
+	ID         string
 	Name       string
 	ExternalIP string
 	InternalIP string
@@ -25,63 +54,36 @@ type InstanceDetails struct {
 	Status     string
 }
 
-// gcloudInstanceJSON represents the JSON structure returned by gcloud compute instances describe
-type gcloudInstanceJSON struct {
-	Name              string `json:"name"`
-	Status            string `json:"status"`
-	NetworkInterfaces []struct {
-		NetworkIP string `json:"networkIP"`
-		AccessConfigs []struct {
-			NatIP string `json:"natIP"`
-		} `json:"accessConfigs"`
-	} `json:"networkInterfaces"`
-}
-
-// GetInstanceDetails retrieves VM instance information including external IP using gcloud CLI
-func GetInstanceDetails(ctx context.Context, instance Instance, credentialsPath string) (*InstanceDetails, error) {
-	// Use gcloud compute instances describe to get instance details
-	// This uses the user's existing gcloud authentication, avoiding the need for OAuth keys
-	cmd := exec.CommandContext(ctx,
-		"gcloud",
-		"compute",
-		"instances",
-		"describe",
-		instance.Name,
-		"--zone", instance.Zone,
-		"--project", instance.ProjectId,
-		"--format", "json",
-	)
-
-	output, err := cmd.Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("gcloud command failed: %s: %w", string(exitErr.Stderr), err)
-		}
-		return nil, fmt.Errorf("failed to run gcloud command: %w", err)
-	}
-
-	var vmInstance gcloudInstanceJSON
-	if err := json.Unmarshal(output, &vmInstance); err != nil {
-		return nil, fmt.Errorf("failed to parse gcloud output: %w", err)
+// parseInstanceJSON parses an instance resource as printed by `gcloud compute instances
+// describe --format json`, which uses the field names of the Compute API
+func parseInstanceJSON(data []byte) (*computepb.Instance, error) {
+	var vmInstance computepb.Instance
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, &vmInstance); err != nil {
+		return nil, fmt.Errorf("failed to parse instance resource: %w", err)
 	}
+	return &vmInstance, nil
+}
 
+// instanceDetails converts an instance resource into InstanceDetails
+func instanceDetails(instance Instance, vmInstance *computepb.Instance) (*InstanceDetails, error) {
 	details := &InstanceDetails{
-		Name:     vmInstance.Name,
-		Status:   vmInstance.Status,
+		ID:       strconv.FormatUint(vmInstance.GetId(), 10),
+		Name:     vmInstance.GetName(),
+		Status:   vmInstance.GetStatus(),
 		Username: getDefaultUsername(),
 	}
 
 	// Extract IP addresses from network interfaces
-	for _, networkInterface := range vmInstance.NetworkInterfaces {
+	for _, networkInterface := range vmInstance.GetNetworkInterfaces() {
 		// Get internal IP
 		if details.InternalIP == "" {
-			details.InternalIP = networkInterface.NetworkIP
+			details.InternalIP = networkInterface.GetNetworkIP()
 		}
 
 		// Get external IP from access configs
-		for _, accessConfig := range networkInterface.AccessConfigs {
-			if accessConfig.NatIP != "" {
-				details.ExternalIP = accessConfig.NatIP
+		for _, accessConfig := range networkInterface.GetAccessConfigs() {
+			if accessConfig.GetNatIP() != "" {
+				details.ExternalIP = accessConfig.GetNatIP()
 				break
 			}
 		}
@@ -98,32 +100,33 @@ func GetInstanceDetails(ctx context.Context, instance Instance, credentialsPath
 }
 
 // VMConnect establishes an SSH connection to a GCP VM instance
+// Unknown host keys are trusted on first use and recorded in ~/.ssh/known_hosts
 func VMConnect(ctx context.Context, instance Instance) (*Session, error) {
-	return VMConnectWithKey(ctx, instance, "", "", "")
+	return VMConnectWithKey(ctx, instance, "", nil, "", NewHostKeyVerifier(HostKeyAcceptNew))
 }
 
 // VMConnectWithKey establishes an SSH connection to a GCP VM instance using a specific SSH key
+// The instance is looked up with resolver (gcloud CLI when nil)
 // If passphrase is empty and key is encrypted, returns ErrPassphraseRequired wrapped in error
-func VMConnectWithKey(ctx context.Context, instance Instance, sshKeyPath string, credentialsPath string, passphrase string) (*Session, error) {
+// If the host key is rejected by hostKeys, returns a *HostKeyError wrapped in error
+func VMConnectWithKey(ctx context.Context, instance Instance, sshKeyPath string, resolver InstanceResolver, passphrase string, hostKeys *HostKeyVerifier) (*Session, error) {
 	// Get instance details
-	details, err := GetInstanceDetails(ctx, instance, credentialsPath)
+	if resolver == nil {
+		resolver = GcloudResolver{}
+	}
+	details, err := resolver.Resolve(ctx, instance)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get instance details: %w", err)
 	}
 
-	// Determine SSH key path
-	if sshKeyPath == "" {
-		sshKeyPath = DefaultPrivateKeyPath()
-	}
-
-	// Load SSH private key
-	authMethod, err := PublicKeyFile(sshKeyPath, passphrase)
+	// Load SSH private key (or fall back to ssh-agent)
+	authMethod, err := loadAuthMethod(sshKeyPath, passphrase)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load SSH key: %w", err)
 	}
 
 	// Create SSH client
-	client, err := NewClient(details.ExternalIP, details.Username, authMethod)
+	client, err := NewClient(details.ExternalIP, details.Username, authMethod, hostKeyCallback(hostKeys, details))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SSH client: %w", err)
 	}
@@ -134,31 +137,32 @@ func VMConnectWithKey(ctx context.Context, instance Instance, sshKeyPath string,
 		client.Close()
 		return nil, fmt.Errorf("failed to create SSH session: %w", err)
 	}
+	session.Details = details
 
 	return session, nil
 }
 
 // VMConnectTerminal establishes an interactive terminal session to a GCP VM instance
-func VMConnectTerminal(ctx context.Context, instance Instance, sshKeyPath string, credentialsPath string, passphrase string) (*TerminalSession, error) {
+// The instance is looked up with resolver (gcloud CLI when nil)
+// If the host key is rejected by hostKeys, returns a *HostKeyError wrapped in error
+func VMConnectTerminal(ctx context.Context, instance Instance, sshKeyPath string, resolver InstanceResolver, passphrase string, hostKeys *HostKeyVerifier) (*TerminalSession, error) {
 	// Get instance details
-	details, err := GetInstanceDetails(ctx, instance, credentialsPath)
+	if resolver == nil {
+		resolver = GcloudResolver{}
+	}
+	details, err := resolver.Resolve(ctx, instance)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get instance details: %w", err)
 	}
 
-	// Determine SSH key path
-	if sshKeyPath == "" {
-		sshKeyPath = DefaultPrivateKeyPath()
-	}
-
-	// Load SSH private key
-	authMethod, err := PublicKeyFile(sshKeyPath, passphrase)
+	// Load SSH private key (or fall back to ssh-agent)
+	authMethod, err := loadAuthMethod(sshKeyPath, passphrase)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load SSH key: %w", err)
 	}
 
 	// Create SSH client
-	client, err := NewClient(details.ExternalIP, details.Username, authMethod)
+	client, err := NewClient(details.ExternalIP, details.Username, authMethod, hostKeyCallback(hostKeys, details))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SSH client: %w", err)
 	}
@@ -169,10 +173,43 @@ func VMConnectTerminal(ctx context.Context, instance Instance, sshKeyPath string
 		client.Close()
 		return nil, fmt.Errorf("failed to create terminal session: %w", err)
 	}
+	termSession.Details = details
 
 	return termSession, nil
 }
 
+// hostKeyCallback returns the host key callback for an instance, also matching
+// gcloud's "compute.<instance-id>" entries in google_compute_known_hosts
+func hostKeyCallback(hostKeys *HostKeyVerifier, details *InstanceDetails) ssh.HostKeyCallback {
+	if hostKeys == nil {
+		hostKeys = NewHostKeyVerifier(HostKeyStrict)
+	}
+	if details.ID == "" {
+		return hostKeys.Callback()
+	}
+	return hostKeys.Callback("compute." + details.ID)
+}
+
+// loadAuthMethod loads the SSH private key at sshKeyPath (or the default key)
+// If the key is encrypted and no passphrase is given, a running ssh-agent is used instead
+func loadAuthMethod(sshKeyPath string, passphrase string) (ssh.AuthMethod, error) {
+	if sshKeyPath == "" {
+		sshKeyPath = DefaultPrivateKeyPath()
+	}
+
+	authMethod, err := PublicKeyFile(sshKeyPath, passphrase)
+	if err == nil {
+		return authMethod, nil
+	}
+
+	if errors.Is(err, ErrPassphraseRequired) {
+		if agentAuth, agentErr := AgentAuth(); agentErr == nil {
+			return agentAuth, nil
+		}
+	}
+	return nil, err
+}
+
 // getDefaultUsername returns the default username for SSH connection
 // This can be overridden by checking GCP metadata or OS Login
 func getDefaultUsername() string {
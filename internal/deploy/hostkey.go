@@ -0,0 +1,221 @@
+package deploy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMode controls what happens when a host key is not in known_hosts
+type HostKeyMode int
+
+const (
+	// HostKeyPrompt rejects unknown and changed keys with a *HostKeyError so the caller can ask the user
+	HostKeyPrompt HostKeyMode = iota
+	// HostKeyAcceptNew records unknown keys (trust on first use) and rejects changed keys
+	HostKeyAcceptNew
+	// HostKeyStrict rejects any key that is not already known
+	HostKeyStrict
+)
+
+// HostKeyError is returned when a host key is unknown or does not match the recorded key
+type HostKeyError struct {
+	Host        string
+	Hostnames   []string // known_hosts entries to record if the key is accepted
+	Key         ssh.PublicKey
+	Fingerprint string
+	Changed     bool // true when a different key was recorded for this host
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Changed {
+		return fmt.Sprintf("host key for %s has changed (%s %s), possible man-in-the-middle attack", e.Host, e.Key.Type(), e.Fingerprint)
+	}
+	return fmt.Sprintf("host key for %s is unknown (%s %s)", e.Host, e.Key.Type(), e.Fingerprint)
+}
+
+// HostKeyVerifier checks SSH host keys against known_hosts files
+type HostKeyVerifier struct {
+	Mode HostKeyMode
+	// KnownHostsFiles are read for known keys; missing files are ignored
+	KnownHostsFiles []string
+	// RecordFile is where accepted keys are written (usually ~/.ssh/known_hosts)
+	RecordFile string
+}
+
+// NewHostKeyVerifier returns a verifier using ~/.ssh/known_hosts and gcloud's
+// ~/.ssh/google_compute_known_hosts, recording new keys in ~/.ssh/known_hosts
+func NewHostKeyVerifier(mode HostKeyMode) *HostKeyVerifier {
+	sshDir := "~/.ssh"
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		sshDir = filepath.Join(homeDir, ".ssh")
+	}
+	knownHosts := filepath.Join(sshDir, "known_hosts")
+	return &HostKeyVerifier{
+		Mode: mode,
+		KnownHostsFiles: []string{
+			knownHosts,
+			filepath.Join(sshDir, "google_compute_known_hosts"),
+		},
+		RecordFile: knownHosts,
+	}
+}
+
+// Callback returns an ssh.HostKeyCallback for this verifier
+// aliases are extra known_hosts names for the host, such as gcloud's "compute.<instance-id>"
+func (v *HostKeyVerifier) Callback(aliases ...string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		check, err := v.knownHostsCallback()
+		if err != nil {
+			return err
+		}
+
+		// Check aliases first since they survive external IP changes
+		names := append(append([]string{}, aliases...), hostname)
+		changed := false
+		for _, name := range names {
+			if _, _, err := net.SplitHostPort(name); err != nil {
+				name = net.JoinHostPort(name, "22")
+			}
+			err := check(name, remote, key)
+			if err == nil {
+				return nil
+			}
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				changed = true
+				break
+			}
+		}
+
+		hostErr := &HostKeyError{
+			Host:        knownhosts.Normalize(hostname),
+			Hostnames:   recordedNames(hostname, aliases),
+			Key:         key,
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Changed:     changed,
+		}
+
+		if !changed && v.Mode == HostKeyAcceptNew {
+			return v.Trust(hostErr)
+		}
+		return hostErr
+	}
+}
+
+// Trust records the key from a HostKeyError in the record file
+// Stale entries for the same names are removed first when the key has changed
+func (v *HostKeyVerifier) Trust(hostErr *HostKeyError) error {
+	if v.RecordFile == "" {
+		return fmt.Errorf("no known_hosts file to record host key in")
+	}
+	if err := os.MkdirAll(filepath.Dir(v.RecordFile), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(v.RecordFile), err)
+	}
+
+	if hostErr.Changed {
+		if err := removeKnownHosts(v.RecordFile, hostErr.Hostnames); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(v.RecordFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", v.RecordFile, err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line(hostErr.Hostnames, hostErr.Key)); err != nil {
+		return fmt.Errorf("failed to record host key in %s: %w", v.RecordFile, err)
+	}
+	return nil
+}
+
+// knownHostsCallback builds a knownhosts callback from the files that exist
+func (v *HostKeyVerifier) knownHostsCallback() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, file := range v.KnownHostsFiles {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		// Nothing is known yet: every key is unknown
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return &knownhosts.KeyError{}
+		}, nil
+	}
+
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+	return check, nil
+}
+
+// recordedNames returns the normalized names to write to known_hosts for a host
+func recordedNames(hostname string, aliases []string) []string {
+	names := []string{knownhosts.Normalize(hostname)}
+	for _, alias := range aliases {
+		names = append(names, knownhosts.Normalize(alias))
+	}
+	return names
+}
+
+// removeKnownHosts drops plain (unhashed) known_hosts lines for any of names
+func removeKnownHosts(path string, names []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	drop := make(map[string]bool, len(names))
+	for _, name := range names {
+		drop[name] = true
+	}
+
+	var kept []string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") && !strings.HasPrefix(fields[0], "@") {
+			matches := false
+			for _, host := range strings.Split(fields[0], ",") {
+				if drop[host] {
+					matches = true
+					break
+				}
+			}
+			if matches {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	content := strings.Join(kept, "\n")
+	if len(kept) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to update %s: %w", path, err)
+	}
+	return nil
+}
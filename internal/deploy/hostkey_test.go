@@ -0,0 +1,137 @@
+package deploy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	key, otherKey := newHostKey(t), newHostKey(t)
+	const host = "203.0.113.7"
+	const alias = "compute.1234567890"
+	remote := &net.TCPAddr{IP: net.ParseIP(host), Port: 22}
+
+	tests := []struct {
+		name        string
+		mode        HostKeyMode
+		known       []string // known_hosts lines
+		wantErr     string   // "" when the key is accepted
+		wantChanged bool
+		wantLines   int // known_hosts lines afterwards
+	}{
+		{name: "prompt: unknown", mode: HostKeyPrompt, wantErr: "is unknown"},
+		{name: "prompt: known", mode: HostKeyPrompt, known: []string{knownhosts.Line([]string{host}, key)}, wantLines: 1},
+		{name: "prompt: changed", mode: HostKeyPrompt, known: []string{knownhosts.Line([]string{host}, otherKey)}, wantErr: "has changed", wantChanged: true, wantLines: 1},
+		{name: "accept-new: unknown is recorded", mode: HostKeyAcceptNew, wantLines: 1},
+		{name: "accept-new: changed", mode: HostKeyAcceptNew, known: []string{knownhosts.Line([]string{host}, otherKey)}, wantErr: "has changed", wantChanged: true, wantLines: 1},
+		{name: "accept-new: known by alias after an IP change", mode: HostKeyAcceptNew, known: []string{knownhosts.Line([]string{alias}, key)}, wantLines: 1},
+		{name: "strict: unknown", mode: HostKeyStrict, wantErr: "is unknown"},
+		{name: "strict: known", mode: HostKeyStrict, known: []string{knownhosts.Line([]string{host}, key)}, wantLines: 1},
+		{name: "strict: changed", mode: HostKeyStrict, known: []string{knownhosts.Line([]string{alias}, otherKey)}, wantErr: "has changed", wantChanged: true, wantLines: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := filepath.Join(t.TempDir(), ".ssh", "known_hosts")
+			if len(tt.known) > 0 {
+				os.MkdirAll(filepath.Dir(record), 0700)
+				if err := os.WriteFile(record, []byte(strings.Join(tt.known, "\n")+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			v := &HostKeyVerifier{Mode: tt.mode, KnownHostsFiles: []string{record, record + ".missing"}, RecordFile: record}
+
+			err := v.Callback(alias)(host+":22", remote, key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Callback() error = %v", err)
+				}
+			} else {
+				var hostErr *HostKeyError
+				if !errors.As(err, &hostErr) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Callback() error = %v, want a *HostKeyError %q", err, tt.wantErr)
+				}
+				if hostErr.Changed != tt.wantChanged || hostErr.Fingerprint != ssh.FingerprintSHA256(key) {
+					t.Errorf("HostKeyError = %+v", hostErr)
+				}
+				if strings.Join(hostErr.Hostnames, ",") != host+","+alias {
+					t.Errorf("Hostnames = %v, want the host and its alias", hostErr.Hostnames)
+				}
+			}
+
+			data, _ := os.ReadFile(record)
+			if lines := strings.Count(string(data), "\n"); lines != tt.wantLines {
+				t.Errorf("known_hosts has %d lines, want %d:\n%s", lines, tt.wantLines, data)
+			}
+			if tt.wantErr == "" {
+				// Once recorded, the key is known in every mode
+				strict := &HostKeyVerifier{Mode: HostKeyStrict, KnownHostsFiles: []string{record}}
+				if err := strict.Callback(alias)(host+":22", remote, key); err != nil {
+					t.Errorf("key not known afterwards: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestHostKeyTrust(t *testing.T) {
+	key, oldKey := newHostKey(t), newHostKey(t)
+	const host = "203.0.113.7"
+	const alias = "compute.1234567890"
+	remote := &net.TCPAddr{IP: net.ParseIP(host), Port: 22}
+
+	record := filepath.Join(t.TempDir(), "known_hosts")
+	other := knownhosts.Line([]string{"198.51.100.1"}, oldKey)
+	known := "# comment\n" + knownhosts.Line([]string{host, alias}, oldKey) + "\n" + other + "\n"
+	if err := os.WriteFile(record, []byte(known), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v := &HostKeyVerifier{Mode: HostKeyPrompt, KnownHostsFiles: []string{record}, RecordFile: record}
+
+	// The user accepts the changed key when prompted
+	err := v.Callback(alias)(host+":22", remote, key)
+	var hostErr *HostKeyError
+	if !errors.As(err, &hostErr) || !hostErr.Changed {
+		t.Fatalf("Callback() error = %v, want a changed key", err)
+	}
+	if err := v.Trust(hostErr); err != nil {
+		t.Fatalf("Trust() error = %v", err)
+	}
+	if err := v.Callback(alias)(host+":22", remote, key); err != nil {
+		t.Errorf("Callback() after Trust() error = %v", err)
+	}
+
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# comment\n" + other + "\n" + knownhosts.Line([]string{host, alias}, key) + "\n"
+	if string(data) != want {
+		t.Errorf("known_hosts =\n%s\nwant the stale entry replaced:\n%s", data, want)
+	}
+
+	if err := (&HostKeyVerifier{}).Trust(hostErr); err == nil {
+		t.Error("Trust() without a record file succeeded")
+	}
+}
@@ -0,0 +1,118 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// CommandResult describes how a finished command exited
+type CommandResult struct {
+	ExitCode int
+	Duration time.Duration
+	Signal   string // Set when the command was terminated by a signal
+}
+
+// Success reports whether the command exited cleanly
+func (r CommandResult) Success() bool {
+	return r.ExitCode == 0 && r.Signal == ""
+}
+
+// String returns a short human readable summary, e.g. "exit code 1 after 2.5s"
+func (r CommandResult) String() string {
+	duration := r.Duration.Round(100 * time.Millisecond)
+	if r.Signal != "" {
+		return fmt.Sprintf("killed by signal %s after %s", r.Signal, duration)
+	}
+	return fmt.Sprintf("exit code %d after %s", r.ExitCode, duration)
+}
+
+// LocalShell returns the user's shell from $SHELL, falling back to /bin/sh
+func LocalShell() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return shell
+}
+
+// CommandOptions sets up the environment a deployment step command runs in
+type CommandOptions struct {
+	Env     map[string]string // Extra environment variables
+	Workdir string            // Directory to run in; the default directory when empty
+}
+
+// waitDelay is how long a cancelled local command may keep its output open before it is closed
+const waitDelay = 2 * time.Second
+
+// RunLocalCommand runs a command with the local shell and waits for it to exit
+// Output chunks (stdout and stderr) are sent to outputCh, which is NOT closed when done
+// A non-zero exit is reported in the result; an error means the command could not be run
+// Cancelling ctx kills the command and every process it started
+func RunLocalCommand(ctx context.Context, command string, opts CommandOptions, outputCh chan<- []byte) (CommandResult, error) {
+	cmd := exec.CommandContext(ctx, LocalShell(), "-c", command)
+	cmd.Stdout = chanWriter{outputCh}
+	cmd.Stderr = chanWriter{outputCh}
+	cmd.WaitDelay = waitDelay
+	setProcessGroup(cmd)
+
+	if opts.Workdir != "" {
+		cmd.Dir = expandHome(opts.Workdir)
+	}
+	if len(opts.Env) > 0 {
+		cmd.Env = os.Environ()
+		for _, name := range sortedKeys(opts.Env) {
+			cmd.Env = append(cmd.Env, name+"="+opts.Env[name])
+		}
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("failed to start command: %w", err)
+	}
+
+	err := cmd.Wait()
+	result := CommandResult{Duration: time.Since(start)}
+	if err == nil {
+		return result, nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		result.ExitCode = -1
+		return result, fmt.Errorf("failed to wait for command: %w", err)
+	}
+
+	result.ExitCode = exitErr.ExitCode()
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Signal = status.Signal().String()
+	}
+	return result, nil
+}
+
+// chanWriter sends a copy of every write to a channel
+type chanWriter struct {
+	ch chan<- []byte
+}
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	w.ch <- data
+	return len(p), nil
+}
+
+// sortedKeys returns the keys of m in sorted order, so commands see a stable environment
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
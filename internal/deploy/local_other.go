@@ -0,0 +1,9 @@
+//go:build !unix
+
+package deploy
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups are not available;
+// cancellation only kills the shell itself
+func setProcessGroup(cmd *exec.Cmd) {}
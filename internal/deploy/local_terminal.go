@@ -0,0 +1,69 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// LocalTerminalSession is an interactive shell on a local pseudo-terminal, the local
+// counterpart of TerminalSession
+type LocalTerminalSession struct {
+	cmd    *exec.Cmd
+	pty    *os.File
+	exited chan struct{}
+}
+
+// NewLocalTerminalSession starts the user's shell on a new pseudo-terminal of width x height
+// The shell leads its own session with the pseudo-terminal as its controlling terminal,
+// so an interrupt written to it reaches the foreground process group
+// Pseudo-terminals are not supported on Windows
+func NewLocalTerminalSession(width, height int) (*LocalTerminalSession, error) {
+	cmd := exec.Command(LocalShell())
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	size := &pty.Winsize{Cols: uint16(max(width, 1)), Rows: uint16(max(height, 1))}
+	ptmx, err := pty.StartWithSize(cmd, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start local shell: %w", err)
+	}
+
+	session := &LocalTerminalSession{cmd: cmd, pty: ptmx, exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(session.exited)
+	}()
+	return session, nil
+}
+
+// Write sends data to the shell as if typed
+func (ls *LocalTerminalSession) Write(data []byte) error {
+	if _, err := ls.pty.Write(data); err != nil {
+		return fmt.Errorf("failed to write to local shell: %w", err)
+	}
+	return nil
+}
+
+// Read reads the output of the shell and the programs it runs
+func (ls *LocalTerminalSession) Read(p []byte) (n int, err error) {
+	return ls.pty.Read(p)
+}
+
+// Resize resizes the terminal
+func (ls *LocalTerminalSession) Resize(width, height int) error {
+	return pty.Setsize(ls.pty, &pty.Winsize{Cols: uint16(max(width, 1)), Rows: uint16(max(height, 1))})
+}
+
+// Exited is closed once the shell has exited
+func (ls *LocalTerminalSession) Exited() <-chan struct{} {
+	return ls.exited
+}
+
+// Close hangs up the terminal and stops the shell
+func (ls *LocalTerminalSession) Close() error {
+	err := ls.pty.Close()
+	ls.cmd.Process.Kill()
+	<-ls.exited
+	return err
+}
@@ -0,0 +1,112 @@
+package deploy
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// terminalOutput collects everything a LocalTerminalSession writes
+type terminalOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// waitFor waits for s to appear in the output
+func (o *terminalOutput) waitFor(t *testing.T, s string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		o.mu.Lock()
+		found := strings.Contains(o.buf.String(), s)
+		o.mu.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	t.Fatalf("local shell output %q does not contain %q", o.buf.String(), s)
+}
+
+func TestLocalTerminalSession(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	session, err := NewLocalTerminalSession(80, 24)
+	if err != nil {
+		t.Fatalf("NewLocalTerminalSession() error = %v", err)
+	}
+	defer session.Close()
+
+	output := &terminalOutput{}
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := session.Read(buffer)
+			output.mu.Lock()
+			output.buf.Write(buffer[:n])
+			output.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Quoting keeps the expected output out of the echoed command
+	write := func(command string) {
+		t.Helper()
+		if err := session.Write([]byte(command + "\n")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	write(`stty size; echo "$TERM"'-ok'`)
+	output.waitFor(t, "24 80")
+	output.waitFor(t, "xterm-256color-ok")
+
+	// The shell keeps its state between commands
+	write("cd / && GCD_TEST=kept")
+	write(`echo "$PWD$GCD_TEST"'-ok'`)
+	output.waitFor(t, "/kept-ok")
+
+	if err := session.Resize(100, 30); err != nil {
+		t.Fatalf("Resize() error = %v", err)
+	}
+	write("stty size")
+	output.waitFor(t, "30 100")
+
+	// An interrupt stops the foreground command and leaves the shell running
+	// waitFor gives up long before sleep would finish on its own
+	write("sleep 10")
+	time.Sleep(100 * time.Millisecond)
+	if err := session.Write([]byte{3}); err != nil {
+		t.Fatalf("Write() of an interrupt error = %v", err)
+	}
+	write(`echo 'interrupted''-ok'`)
+	output.waitFor(t, "interrupted-ok")
+
+	write("exit")
+	select {
+	case <-session.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exited() not closed after the shell exited")
+	}
+}
+
+func TestLocalTerminalSessionClose(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	session, err := NewLocalTerminalSession(80, 24)
+	if err != nil {
+		t.Fatalf("NewLocalTerminalSession() error = %v", err)
+	}
+	session.Close()
+	select {
+	case <-session.Exited():
+	default:
+		t.Error("Exited() not closed after Close()")
+	}
+	if err := session.Write([]byte("true\n")); err == nil {
+		t.Error("Write() to a closed session succeeded")
+	}
+}
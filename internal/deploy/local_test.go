@@ -0,0 +1,94 @@
+package deploy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runLocal runs command with RunLocalCommand and returns its result and output
+func runLocal(t *testing.T, ctx context.Context, command string, opts CommandOptions) (CommandResult, string, error) {
+	t.Helper()
+	t.Setenv("SHELL", "/bin/sh")
+	outputCh := make(chan []byte)
+	done := make(chan string)
+	go func() {
+		var output strings.Builder
+		for data := range outputCh {
+			output.Write(data)
+		}
+		done <- output.String()
+	}()
+	result, err := RunLocalCommand(ctx, command, opts, outputCh)
+	close(outputCh)
+	return result, <-done, err
+}
+
+func TestRunLocalCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    string
+		wantResult CommandResult
+		wantOutput string
+	}{
+		{name: "success", command: "echo out; echo err >&2", wantOutput: "out\nerr\n"},
+		{name: "exit code", command: "echo failing; exit 3", wantResult: CommandResult{ExitCode: 3}, wantOutput: "failing\n"},
+		{name: "waits for the command", command: "sleep 0.2; echo done", wantOutput: "done\n"},
+		{name: "killed by a signal", command: "kill -TERM $$", wantResult: CommandResult{ExitCode: -1, Signal: "terminated"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, output, err := runLocal(t, context.Background(), tt.command, CommandOptions{})
+			if err != nil {
+				t.Fatalf("RunLocalCommand() error = %v", err)
+			}
+			if result.Duration <= 0 {
+				t.Errorf("Duration = %v", result.Duration)
+			}
+			result.Duration = 0
+			if result != tt.wantResult {
+				t.Errorf("RunLocalCommand() = %#v, want %#v", result, tt.wantResult)
+			}
+			if output != tt.wantOutput {
+				t.Errorf("output = %q, want %q", output, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestCommandResultString(t *testing.T) {
+	tests := []struct {
+		result CommandResult
+		want   string
+	}{
+		{CommandResult{Duration: 2540 * time.Millisecond}, "exit code 0 after 2.5s"},
+		{CommandResult{ExitCode: 1, Duration: time.Second}, "exit code 1 after 1s"},
+		{CommandResult{ExitCode: -1, Signal: "SIGKILL", Duration: 30 * time.Second}, "killed by signal SIGKILL after 30s"},
+	}
+	for _, tt := range tests {
+		if got := tt.result.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+		if success := tt.result.ExitCode == 0 && tt.result.Signal == ""; tt.result.Success() != success {
+			t.Errorf("%q: Success() = %v", tt.want, tt.result.Success())
+		}
+	}
+}
+
+func TestRunLocalCommandCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// The background sleep keeps the output open, so only killing the group returns early
+	result, _, err := runLocal(t, ctx, "sleep 10 & sleep 10", CommandOptions{})
+	if err != nil {
+		t.Fatalf("RunLocalCommand() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > waitDelay {
+		t.Errorf("cancelled command returned after %s", elapsed)
+	}
+	if result.Success() || result.Signal != "killed" {
+		t.Errorf("RunLocalCommand() = %#v, want killed", result)
+	}
+}
@@ -0,0 +1,361 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// Instance resolver backends selectable with `resolver` in .gcd.toml
+const (
+	ResolverAuto   = "auto"   // API when credentials_path is set or gcloud is missing, gcloud otherwise
+	ResolverGcloud = "gcloud" // Shell out to the gcloud CLI
+	ResolverAPI    = "api"    // Call the Compute Engine API with the Go client library
+)
+
+const computeReadOnlyScope = "https://www.googleapis.com/auth/compute.readonly"
+
+// Formats of one label term in an instance list filter, given the label key and value
+const (
+	gcloudLabelFilter = "labels.%s=%s"     // gcloud --filter
+	apiLabelFilter    = "(labels.%s = %q)" // instances.list filter
+)
+
+// InstanceResolver looks up the details needed to connect to a VM instance
+type InstanceResolver interface {
+	Resolve(ctx context.Context, instance Instance) (*InstanceDetails, error)
+}
+
+// InstanceLister is implemented by resolvers that can find instances by label
+type InstanceLister interface {
+	ListInstances(ctx context.Context, selector InstanceSelector) ([]Instance, error)
+}
+
+// SelectInstances returns the instances matching selector, sorted by name
+// Returns an error if the resolver cannot list instances or nothing matches
+func SelectInstances(ctx context.Context, resolver InstanceResolver, selector InstanceSelector) ([]Instance, error) {
+	lister, ok := resolver.(InstanceLister)
+	if !ok {
+		return nil, fmt.Errorf("instance resolver %T cannot list instances by label", resolver)
+	}
+	instances, err := lister.ListInstances(ctx, selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances in project %s zone %s match labels %s", selector.ProjectId, selector.Zone, selector)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name < instances[j].Name
+	})
+	return instances, nil
+}
+
+// NewInstanceResolver returns the resolver for a backend name
+// credentialsPath is an optional service account key used by the API backend
+func NewInstanceResolver(backend string, credentialsPath string) (InstanceResolver, error) {
+	switch backend {
+	case "", ResolverAuto:
+		if credentialsPath != "" {
+			return &APIResolver{CredentialsPath: credentialsPath}, nil
+		}
+		if _, err := exec.LookPath("gcloud"); err != nil {
+			return &APIResolver{}, nil
+		}
+		return GcloudResolver{}, nil
+	case ResolverGcloud:
+		return GcloudResolver{}, nil
+	case ResolverAPI:
+		return &APIResolver{CredentialsPath: credentialsPath}, nil
+	default:
+		return nil, fmt.Errorf("unknown instance resolver %q (expected %q, %q or %q)", backend, ResolverAuto, ResolverGcloud, ResolverAPI)
+	}
+}
+
+// GcloudResolver looks up instances with `gcloud compute instances describe`
+// This uses the user's existing gcloud authentication, avoiding the need for OAuth keys
+type GcloudResolver struct{}
+
+// Resolve implements InstanceResolver
+func (GcloudResolver) Resolve(ctx context.Context, instance Instance) (*InstanceDetails, error) {
+	cmd := exec.CommandContext(ctx,
+		"gcloud",
+		"compute",
+		"instances",
+		"describe",
+		instance.Name,
+		"--zone", instance.Zone,
+		"--project", instance.ProjectId,
+		"--format", "json",
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("gcloud command failed: %s: %w", string(exitErr.Stderr), err)
+		}
+		return nil, fmt.Errorf("failed to run gcloud command: %w", err)
+	}
+
+	vmInstance, err := parseInstanceJSON(output)
+	if err != nil {
+		return nil, err
+	}
+	return instanceDetails(instance, vmInstance)
+}
+
+// ListInstances implements InstanceLister with `gcloud compute instances list`
+func (GcloudResolver) ListInstances(ctx context.Context, selector InstanceSelector) ([]Instance, error) {
+	args := []string{
+		"compute",
+		"instances",
+		"list",
+		"--zones", selector.Zone,
+		"--project", selector.ProjectId,
+		"--format", "json",
+	}
+	if filter := labelFilter(selector, gcloudLabelFilter, " AND "); filter != "" {
+		args = append(args, "--filter", filter)
+	}
+	cmd := exec.CommandContext(ctx, "gcloud", args...)
+
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("gcloud command failed: %s: %w", string(exitErr.Stderr), err)
+		}
+		return nil, fmt.Errorf("failed to run gcloud command: %w", err)
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(output, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse instance list: %w", err)
+	}
+	instances := make([]Instance, 0, len(items))
+	for _, item := range items {
+		vmInstance, err := parseInstanceJSON(item)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, selectedInstance(selector, vmInstance))
+	}
+	return instances, nil
+}
+
+// APIResolver looks up instances with the Compute Engine API client library
+// It does not need the gcloud SDK, which makes it suitable for slim CI images
+type APIResolver struct {
+	// CredentialsPath is a service account key file
+	// When empty, application default credentials are used: $GOOGLE_APPLICATION_CREDENTIALS,
+	// gcloud's application default credentials file, then the metadata server on GCE and Cloud Build
+	CredentialsPath string
+
+	// clientOptions are appended to the options of the instances client, for tests
+	clientOptions []option.ClientOption
+
+	once   sync.Once
+	client *compute.InstancesClient
+	err    error
+}
+
+// instancesClient creates the instances client on first use
+func (r *APIResolver) instancesClient() (*compute.InstancesClient, error) {
+	r.once.Do(func() {
+		r.client, r.err = newInstancesClient(r.CredentialsPath, r.clientOptions...)
+	})
+	return r.client, r.err
+}
+
+// Resolve implements InstanceResolver
+func (r *APIResolver) Resolve(ctx context.Context, instance Instance) (*InstanceDetails, error) {
+	client, err := r.instancesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	vmInstance, err := client.Get(ctx, &computepb.GetInstanceRequest{
+		Project:  instance.ProjectId,
+		Zone:     instance.Zone,
+		Instance: instance.Name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance %s: %w", instance.Name, err)
+	}
+
+	return instanceDetails(instance, vmInstance)
+}
+
+// ListInstances implements InstanceLister with the instances.list API
+func (r *APIResolver) ListInstances(ctx context.Context, selector InstanceSelector) ([]Instance, error) {
+	client, err := r.instancesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &computepb.ListInstancesRequest{
+		Project: selector.ProjectId,
+		Zone:    selector.Zone,
+	}
+	if filter := labelFilter(selector, apiLabelFilter, " AND "); filter != "" {
+		req.Filter = &filter
+	}
+
+	var instances []Instance
+	it := client.List(ctx, req)
+	for {
+		vmInstance, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return instances, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, selectedInstance(selector, vmInstance))
+	}
+}
+
+// labelFilter builds a list filter from the selector labels in a stable order
+func labelFilter(selector InstanceSelector, format string, sep string) string {
+	keys := make([]string, 0, len(selector.Labels))
+	for key := range selector.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	terms := make([]string, 0, len(keys))
+	for _, key := range keys {
+		terms = append(terms, fmt.Sprintf(format, key, selector.Labels[key]))
+	}
+	return strings.Join(terms, sep)
+}
+
+// selectedInstance converts a listed instance resource into an Instance of the selector's project and zone
+func selectedInstance(selector InstanceSelector, vmInstance *computepb.Instance) Instance {
+	return Instance{
+		Name:      vmInstance.GetName(),
+		ProjectId: selector.ProjectId,
+		Zone:      selector.Zone,
+	}
+}
+
+// newInstancesClient returns a Compute Engine instances client with read-only scope
+// Without credentialsPath the client uses application default credentials
+func newInstancesClient(credentialsPath string, extra ...option.ClientOption) (*compute.InstancesClient, error) {
+	opts := []option.ClientOption{option.WithScopes(computeReadOnlyScope)}
+	if credentialsPath != "" {
+		path := expandHome(credentialsPath)
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to read credentials file: %w", err)
+		}
+		opts = append(opts, option.WithCredentialsFile(path))
+	}
+	opts = append(opts, extra...)
+
+	// The client refreshes tokens in the background, so it must not use a request context
+	client, err := compute.NewInstancesRESTClient(context.Background(), opts...)
+	if err != nil {
+		if credentialsPath == "" {
+			return nil, fmt.Errorf("no Google credentials found: set credentials_path or GOOGLE_APPLICATION_CREDENTIALS: %w", err)
+		}
+		return nil, fmt.Errorf("failed to create compute client: %w", err)
+	}
+	return client, nil
+}
+
+// expandHome expands a leading "~/" to the user's home directory
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, path[2:])
+}
+
+// FakeResolver is an in-memory InstanceResolver for tests
+type FakeResolver struct {
+	mu        sync.Mutex
+	instances map[string]InstanceDetails
+	labels    map[string]map[string]string
+	order     []Instance
+}
+
+// NewFakeResolver returns an empty FakeResolver
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		instances: make(map[string]InstanceDetails),
+		labels:    make(map[string]map[string]string),
+	}
+}
+
+// Add registers the details returned for an instance
+func (f *FakeResolver) Add(instance Instance, details InstanceDetails) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey(instance)
+	if _, ok := f.instances[key]; !ok {
+		f.order = append(f.order, instance)
+	}
+	f.instances[key] = details
+}
+
+// SetLabels sets the labels matched by ListInstances for a registered instance
+func (f *FakeResolver) SetLabels(instance Instance, labels map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.labels[fakeKey(instance)] = labels
+}
+
+// ListInstances implements InstanceLister
+func (f *FakeResolver) ListInstances(ctx context.Context, selector InstanceSelector) ([]Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var instances []Instance
+	for _, instance := range f.order {
+		if instance.ProjectId != selector.ProjectId || instance.Zone != selector.Zone {
+			continue
+		}
+		labels := f.labels[fakeKey(instance)]
+		matches := true
+		for key, value := range selector.Labels {
+			if labels[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// Resolve implements InstanceResolver
+func (f *FakeResolver) Resolve(ctx context.Context, instance Instance) (*InstanceDetails, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	details, ok := f.instances[fakeKey(instance)]
+	if !ok {
+		return nil, fmt.Errorf("instance %s not found in project %s zone %s", instance.Name, instance.ProjectId, instance.Zone)
+	}
+	return &details, nil
+}
+
+func fakeKey(instance Instance) string {
+	return instance.ProjectId + "/" + instance.Zone + "/" + instance.Name
+}
@@ -0,0 +1,280 @@
+package deploy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+func newTestResolver() *FakeResolver {
+	r := NewFakeResolver()
+	for _, vm := range []struct {
+		name   string
+		zone   string
+		labels map[string]string
+	}{
+		{"web-2", "us-central1-a", map[string]string{"role": "web", "env": "prod"}},
+		{"web-1", "us-central1-a", map[string]string{"role": "web", "env": "prod"}},
+		{"web-3", "us-central1-a", map[string]string{"role": "web", "env": "staging"}},
+		{"db-1", "us-central1-a", map[string]string{"role": "db", "env": "prod"}},
+		{"web-4", "us-east1-b", map[string]string{"role": "web", "env": "prod"}},
+	} {
+		instance := Instance{Name: vm.name, ProjectId: "proj", Zone: vm.zone}
+		r.Add(instance, InstanceDetails{Name: vm.name, ExternalIP: "203.0.113.1", Username: "deploy"})
+		r.SetLabels(instance, vm.labels)
+	}
+	return r
+}
+
+func TestSelectInstances(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector InstanceSelector
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "all labels must match, sorted by name",
+			selector: InstanceSelector{ProjectId: "proj", Zone: "us-central1-a", Labels: map[string]string{"role": "web", "env": "prod"}},
+			want:     []string{"web-1", "web-2"},
+		},
+		{
+			name:     "no labels selects the whole zone",
+			selector: InstanceSelector{ProjectId: "proj", Zone: "us-central1-a"},
+			want:     []string{"db-1", "web-1", "web-2", "web-3"},
+		},
+		{
+			name:     "other zones are not selected",
+			selector: InstanceSelector{ProjectId: "proj", Zone: "us-east1-b", Labels: map[string]string{"role": "web"}},
+			want:     []string{"web-4"},
+		},
+		{
+			name:     "nothing matches",
+			selector: InstanceSelector{ProjectId: "proj", Zone: "us-central1-a", Labels: map[string]string{"role": "cache"}},
+			wantErr:  "match labels role=cache",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := SelectInstances(context.Background(), newTestResolver(), tt.selector)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SelectInstances() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SelectInstances() error = %v", err)
+			}
+			var names []string
+			for _, instance := range instances {
+				names = append(names, instance.Name)
+				if instance.ProjectId != tt.selector.ProjectId || instance.Zone != tt.selector.Zone {
+					t.Errorf("instance %s in %s/%s, want %s/%s", instance.Name, instance.ProjectId, instance.Zone, tt.selector.ProjectId, tt.selector.Zone)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("SelectInstances() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectInstancesWithoutLister(t *testing.T) {
+	var resolver struct{ InstanceResolver }
+	_, err := SelectInstances(context.Background(), resolver, InstanceSelector{ProjectId: "proj", Zone: "us-central1-a"})
+	if err == nil || !strings.Contains(err.Error(), "cannot list instances") {
+		t.Fatalf("SelectInstances() error = %v, want a resolver that cannot list", err)
+	}
+}
+
+func TestFakeResolverResolve(t *testing.T) {
+	r := newTestResolver()
+	details, err := r.Resolve(context.Background(), Instance{Name: "web-1", ProjectId: "proj", Zone: "us-central1-a"})
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if details.Name != "web-1" || details.Username != "deploy" {
+		t.Errorf("Resolve() = %+v", details)
+	}
+
+	if _, err := r.Resolve(context.Background(), Instance{Name: "web-1", ProjectId: "proj", Zone: "us-east1-b"}); err == nil {
+		t.Error("Resolve() of an unknown instance succeeded")
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	selector := InstanceSelector{Labels: map[string]string{"role": "web", "env": "prod"}}
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{"gcloud", gcloudLabelFilter, "labels.env=prod AND labels.role=web"},
+		{"api", apiLabelFilter, `(labels.env = "prod") AND (labels.role = "web")`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := labelFilter(selector, tt.format, " AND "); got != tt.want {
+				t.Errorf("labelFilter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := labelFilter(InstanceSelector{}, gcloudLabelFilter, " AND "); got != "" {
+		t.Errorf("labelFilter() without labels = %q, want no filter", got)
+	}
+}
+
+// instanceResource is an instance as returned by the Compute API and printed by gcloud
+const instanceResource = `{
+	"id": "4567890123456789012",
+	"name": "web-1",
+	"status": "RUNNING",
+	"labels": {"role": "web"},
+	"networkInterfaces": [
+		{"networkIP": "10.128.0.2", "accessConfigs": [{"name": "External NAT", "natIP": "203.0.113.7"}]}
+	],
+	"cpuPlatform": "Intel Broadwell",
+	"someFutureField": {"nested": true}
+}`
+
+func TestInstanceDetails(t *testing.T) {
+	instance := Instance{Name: "web-1", ProjectId: "proj", Zone: "us-central1-a"}
+	tests := []struct {
+		name     string
+		resource string
+		want     InstanceDetails
+		wantErr  string
+	}{
+		{
+			name:     "external and internal IP",
+			resource: instanceResource,
+			want:     InstanceDetails{ID: "4567890123456789012", Name: "web-1", Status: "RUNNING", InternalIP: "10.128.0.2", ExternalIP: "203.0.113.7"},
+		},
+		{
+			name:     "no external IP",
+			resource: `{"name": "web-1", "networkInterfaces": [{"networkIP": "10.128.0.2"}]}`,
+			wantErr:  "does not have an external IP address",
+		},
+		{
+			name:     "invalid JSON",
+			resource: `{"name": `,
+			wantErr:  "failed to parse instance resource",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmInstance, err := parseInstanceJSON([]byte(tt.resource))
+			var details *InstanceDetails
+			if err == nil {
+				details, err = instanceDetails(instance, vmInstance)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("instanceDetails() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("instanceDetails() error = %v", err)
+			}
+			tt.want.Username = details.Username
+			if *details != tt.want {
+				t.Errorf("instanceDetails() = %+v, want %+v", *details, tt.want)
+			}
+		})
+	}
+}
+
+// newTestAPIResolver returns an APIResolver talking to a fake Compute API served by handler
+func newTestAPIResolver(t *testing.T, handler http.HandlerFunc) *APIResolver {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &APIResolver{clientOptions: []option.ClientOption{
+		option.WithEndpoint(server.URL),
+		option.WithoutAuthentication(),
+	}}
+}
+
+func TestAPIResolverResolve(t *testing.T) {
+	r := newTestAPIResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/compute/v1/projects/proj/zones/us-central1-a/instances/web-1":
+			io.WriteString(w, instanceResource)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error": {"code": 404, "message": "The resource was not found"}}`)
+		}
+	})
+
+	details, err := r.Resolve(context.Background(), Instance{Name: "web-1", ProjectId: "proj", Zone: "us-central1-a"})
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if details.ExternalIP != "203.0.113.7" || details.InternalIP != "10.128.0.2" {
+		t.Errorf("Resolve() = %+v", details)
+	}
+
+	_, err = r.Resolve(context.Background(), Instance{Name: "web-9", ProjectId: "proj", Zone: "us-central1-a"})
+	if err == nil || !strings.Contains(err.Error(), "The resource was not found") {
+		t.Errorf("Resolve() of an unknown instance error = %v, want the API error message", err)
+	}
+}
+
+func TestAPIResolverListInstances(t *testing.T) {
+	var filters []string
+	r := newTestAPIResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/compute/v1/projects/proj/zones/us-central1-a/instances" {
+			http.NotFound(w, req)
+			return
+		}
+		filters = append(filters, req.URL.Query().Get("filter"))
+		// Two pages exercise the iterator's page tokens
+		switch req.URL.Query().Get("pageToken") {
+		case "":
+			io.WriteString(w, `{"items": [{"name": "web-2"}, {"name": "web-1"}], "nextPageToken": "page-2"}`)
+		case "page-2":
+			io.WriteString(w, `{"items": [{"name": "web-3"}]}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error": {"code": 400, "message": "bad page token"}}`)
+		}
+	})
+
+	selector := InstanceSelector{ProjectId: "proj", Zone: "us-central1-a", Labels: map[string]string{"role": "web"}}
+	instances, err := SelectInstances(context.Background(), r, selector)
+	if err != nil {
+		t.Fatalf("SelectInstances() error = %v", err)
+	}
+	want := []Instance{
+		{Name: "web-1", ProjectId: "proj", Zone: "us-central1-a"},
+		{Name: "web-2", ProjectId: "proj", Zone: "us-central1-a"},
+		{Name: "web-3", ProjectId: "proj", Zone: "us-central1-a"},
+	}
+	if !reflect.DeepEqual(instances, want) {
+		t.Errorf("SelectInstances() = %v, want %v", instances, want)
+	}
+	for _, filter := range filters {
+		if filter != `(labels.role = "web")` {
+			t.Errorf("instances.list filter = %q, want the label filter", filter)
+		}
+	}
+}
+
+func TestAPIResolverMissingCredentials(t *testing.T) {
+	r := &APIResolver{CredentialsPath: filepath.Join(t.TempDir(), "missing.json")}
+	_, err := r.Resolve(context.Background(), Instance{Name: "web-1", ProjectId: "proj", Zone: "us-central1-a"})
+	if err == nil || !strings.Contains(err.Error(), "failed to read credentials file") {
+		t.Fatalf("Resolve() error = %v, want a missing credentials file", err)
+	}
+}
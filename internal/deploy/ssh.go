@@ -1,20 +1,28 @@
 package deploy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // Session represents an SSH session for executing commands
 type Session struct {
 	client  *ssh.Client
 	session *ssh.Session
+
+	// Details describes the instance the session is connected to (set by VMConnectWithKey)
+	Details *InstanceDetails
 }
 
 // TerminalSession represents an interactive terminal session
@@ -24,6 +32,9 @@ type TerminalSession struct {
 	stdinPipe   io.WriteCloser
 	stdoutPipe  io.Reader
 	stderrPipe  io.Reader
+
+	// Details describes the instance the session is connected to (set by VMConnectTerminal)
+	Details *InstanceDetails
 }
 
 // StderrPipe returns the stderr pipe for reading error output
@@ -32,11 +43,12 @@ func (ts *TerminalSession) StderrPipe() io.Reader {
 }
 
 // NewClient creates a new SSH client connection
-func NewClient(host, user string, authMethod ssh.AuthMethod) (*ssh.Client, error) {
+// hostKeyCallback verifies the server's host key (see HostKeyVerifier)
+func NewClient(host, user string, authMethod ssh.AuthMethod, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
 	config := &ssh.ClientConfig{
 		User:            user,
 		Auth:            []ssh.AuthMethod{authMethod},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // In production, use proper host key verification
+		HostKeyCallback: hostKeyCallback,
 	}
 
 	client, err := ssh.Dial("tcp", host+":22", config)
@@ -155,6 +167,12 @@ func (s *Session) ExecuteStream(command string, outputCh chan<- []byte) error {
 	return err
 }
 
+// ExecuteStep runs a command in a new session and waits for it to exit
+// Unlike ExecuteStream, outputCh is NOT closed so it can be shared across steps
+func (s *Session) ExecuteStep(ctx context.Context, command string, opts CommandOptions, outputCh chan<- []byte) (CommandResult, error) {
+	return executeStep(ctx, s.client, command, opts, outputCh)
+}
+
 // Close closes the SSH session and client
 func (s *Session) Close() error {
 	if s.session != nil {
@@ -205,6 +223,21 @@ func PublicKeyFile(file string, passphrase string) (ssh.AuthMethod, error) {
 	return ssh.PublicKeys(key), nil
 }
 
+// AgentAuth returns an ssh.AuthMethod backed by the running ssh-agent ($SSH_AUTH_SOCK)
+func AgentAuth() (ssh.AuthMethod, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), nil
+}
+
 // NewTerminalSession creates a new interactive terminal session
 func NewTerminalSession(client *ssh.Client) (*TerminalSession, error) {
 	session, err := client.NewSession()
@@ -295,6 +328,161 @@ func (ts *TerminalSession) Resize(width, height int) error {
 	return ts.session.WindowChange(height, width)
 }
 
+// ExecuteStep runs a command on its own exec channel alongside the interactive shell
+// Output chunks (stdout and stderr) are sent to outputCh, which is NOT closed when done
+// Returns the command's exit status once it has completely finished
+func (ts *TerminalSession) ExecuteStep(ctx context.Context, command string, opts CommandOptions, outputCh chan<- []byte) (CommandResult, error) {
+	return executeStep(ctx, ts.client, command, opts, outputCh)
+}
+
+// executeStep runs a command in a new session on client and waits for it to exit
+// Cancelling ctx kills the command and closes the session
+func executeStep(ctx context.Context, client *ssh.Client, command string, opts CommandOptions, outputCh chan<- []byte) (CommandResult, error) {
+	if client == nil {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("ssh client is nil")
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	stdoutPipe, err := session.StdoutPipe()
+	if err != nil {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+
+	stderrPipe, err := session.StderrPipe()
+	if err != nil {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+
+	// Nothing is written to stdin: closing it tells the remote watchdog to kill the command
+	stdinPipe, err := session.StdinPipe()
+	if err != nil {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+
+	start := time.Now()
+	if err := session.Start(processGroupCommand(remoteCommand(command, opts))); err != nil {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("failed to start command: %w", err)
+	}
+
+	// Kill the command and its children when ctx is cancelled; closing the session
+	// unblocks Wait even if the server ignores the signal
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stdinPipe.Close()
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-finished:
+		}
+	}()
+
+	// Stream stdout and stderr until both are drained
+	var wg sync.WaitGroup
+	for _, pipe := range []io.Reader{stdoutPipe, stderrPipe} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			buffer := make([]byte, 4096)
+			for {
+				n, err := r.Read(buffer)
+				if n > 0 {
+					data := make([]byte, n)
+					copy(data, buffer[:n])
+					outputCh <- data
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(pipe)
+	}
+
+	err = session.Wait()
+	wg.Wait()
+
+	result := CommandResult{ExitCode: ExitCode(err), Duration: time.Since(start)}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && exitErr.Signal() != "" {
+		result.Signal = "SIG" + exitErr.Signal()
+	}
+	if result.ExitCode < 0 && result.Signal == "" {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		return result, fmt.Errorf("command did not report an exit status: %w", err)
+	}
+	return result, nil
+}
+
+// remoteCommand prefixes command with the exports and cd that set up opts
+// Most SSH servers only accept a few variables through Setenv, so the
+// environment is set by the remote shell instead
+func remoteCommand(command string, opts CommandOptions) string {
+	var b strings.Builder
+	for _, name := range sortedKeys(opts.Env) {
+		fmt.Fprintf(&b, "export %s=%s\n", name, shellQuote(opts.Env[name]))
+	}
+	if opts.Workdir != "" {
+		dir := shellQuote(opts.Workdir)
+		if rest, ok := strings.CutPrefix(opts.Workdir, "~/"); ok {
+			// Leave the tilde unquoted so the remote shell expands it
+			dir = "~/" + shellQuote(rest)
+		}
+		fmt.Fprintf(&b, "cd %s || exit 1\n", dir)
+	}
+	return b.String() + command
+}
+
+// processGroupCommand runs script in a process group of its own, which is killed when
+// stdin reaches EOF. Without a PTY, sshd does not kill the command when the channel is
+// closed, and a signal would only reach the shell, leaving children such as apt-get running.
+// A command killed by a signal is reported with that signal.
+func processGroupCommand(script string) string {
+	// Background commands get /dev/null as stdin, so the watchdog reads a copy of it
+	return fmt.Sprintf(`exec 3<&0
+if command -v setsid >/dev/null 2>&1; then
+	setsid "${SHELL:-/bin/sh}" -c %[1]s </dev/null 3<&- &
+else
+	"${SHELL:-/bin/sh}" -c %[1]s </dev/null 3<&- &
+fi
+pid=$!
+(while read -r _; do :; done; kill -KILL -$pid || kill -KILL $pid) <&3 3<&- >/dev/null 2>&1 &
+watchdog=$!
+exec 3<&-
+wait $pid 2>/dev/null
+status=$?
+kill $watchdog 2>/dev/null
+if [ $status -gt 128 ]; then
+	kill -$((status - 128)) $$ 2>/dev/null
+fi
+exit $status`, shellQuote(script))
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ExitCode extracts the exit status from an error returned by an SSH session
+// Returns 0 for a nil error and -1 when the remote side did not report a status
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
+
 // DefaultPrivateKeyPath returns the default SSH private key path
 func DefaultPrivateKeyPath() string {
 	homeDir, err := os.UserHomeDir()
@@ -0,0 +1,447 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// IgnoreFile lists .gitignore-style patterns of paths that uploads and downloads skip
+const IgnoreFile = ".gcdignore"
+
+// progressInterval limits how often progress is reported while a file is copied
+const progressInterval = 250 * time.Millisecond
+
+// TransferOptions controls an upload or download
+type TransferOptions struct {
+	// Mode is applied to every transferred file; 0 keeps the source file's permissions
+	Mode os.FileMode
+	// Exclude are .gitignore-style patterns, matched against paths relative to the transfer root
+	Exclude []string
+}
+
+// TransferProgress reports how far an upload or download is
+type TransferProgress struct {
+	File       string // File currently being transferred
+	Files      int    // Files completed
+	TotalFiles int
+	Bytes      int64 // Bytes copied so far
+	TotalBytes int64
+}
+
+func (p TransferProgress) String() string {
+	return fmt.Sprintf("%d/%d files, %s of %s", p.Files, p.TotalFiles, formatBytes(p.Bytes), formatBytes(p.TotalBytes))
+}
+
+// Upload copies the local files matching the glob src to dest on the VM over SFTP
+// A single directory is copied into dest, a single file is copied to dest (or into it
+// when dest ends in "/"), and multiple matches are each copied into the dest directory
+func (s *Session) Upload(ctx context.Context, src, dest string, opts TransferOptions, progress func(TransferProgress)) (TransferProgress, error) {
+	return upload(ctx, s.client, src, dest, opts, progress)
+}
+
+// Download copies the files on the VM matching the glob src to the local dest
+// Paths are resolved the same way as for Upload
+func (s *Session) Download(ctx context.Context, src, dest string, opts TransferOptions, progress func(TransferProgress)) (TransferProgress, error) {
+	return download(ctx, s.client, src, dest, opts, progress)
+}
+
+// Upload copies local files to the VM over SFTP (see Session.Upload)
+func (ts *TerminalSession) Upload(ctx context.Context, src, dest string, opts TransferOptions, progress func(TransferProgress)) (TransferProgress, error) {
+	return upload(ctx, ts.client, src, dest, opts, progress)
+}
+
+// Download copies files from the VM over SFTP (see Session.Download)
+func (ts *TerminalSession) Download(ctx context.Context, src, dest string, opts TransferOptions, progress func(TransferProgress)) (TransferProgress, error) {
+	return download(ctx, ts.client, src, dest, opts, progress)
+}
+
+func upload(ctx context.Context, client *ssh.Client, src, dest string, opts TransferOptions, progress func(TransferProgress)) (TransferProgress, error) {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return TransferProgress{}, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+	defer sftpClient.Close()
+
+	return transfer(ctx, localFS{}, remoteFS{sftpClient}, expandHome(src), remotePath(dest), opts, progress)
+}
+
+func download(ctx context.Context, client *ssh.Client, src, dest string, opts TransferOptions, progress func(TransferProgress)) (TransferProgress, error) {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return TransferProgress{}, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+	defer sftpClient.Close()
+
+	return transfer(ctx, remoteFS{sftpClient}, localFS{}, remotePath(src), expandHome(dest), opts, progress)
+}
+
+// remotePath makes "~/" paths relative, since SFTP servers start in the home directory
+func remotePath(p string) string {
+	if p == "~" {
+		return "."
+	}
+	return strings.TrimPrefix(p, "~/")
+}
+
+// transferItem is one file or directory to create at the destination
+type transferItem struct {
+	src  string
+	dest string
+	info os.FileInfo
+}
+
+// transfer copies the files matching src on from to dest on to
+func transfer(ctx context.Context, from, to fileSystem, src, dest string, opts TransferOptions, progress func(TransferProgress)) (TransferProgress, error) {
+	var p TransferProgress
+
+	matches, err := from.Glob(src)
+	if err != nil {
+		return p, fmt.Errorf("invalid pattern %s: %w", src, err)
+	}
+	if len(matches) == 0 {
+		return p, fmt.Errorf("no files match %s", src)
+	}
+
+	ignore := ignoreMatcher(opts.Exclude)
+	var items []transferItem
+	if len(matches) == 1 {
+		info, err := from.Stat(matches[0])
+		if err != nil {
+			return p, err
+		}
+		switch {
+		case info.IsDir():
+			items, err = collect(from, to, matches[0], dest, "", info, ignore, nil)
+			if err != nil {
+				return p, err
+			}
+		case strings.HasSuffix(dest, "/"):
+			items = append(items, transferItem{src: matches[0], dest: to.Join(dest, from.Base(matches[0])), info: info})
+		default:
+			items = append(items, transferItem{src: matches[0], dest: dest, info: info})
+		}
+	} else {
+		items = append(items, transferItem{dest: dest})
+		for _, match := range matches {
+			info, err := from.Stat(match)
+			if err != nil {
+				return p, err
+			}
+			name := from.Base(match)
+			if ignore.match(name, info.IsDir()) {
+				continue
+			}
+			if !info.IsDir() {
+				items = append(items, transferItem{src: match, dest: to.Join(dest, name), info: info})
+				continue
+			}
+			dirItems, err := collect(from, to, match, to.Join(dest, name), name, info, ignore, nil)
+			if err != nil {
+				return p, err
+			}
+			items = append(items, dirItems...)
+		}
+	}
+
+	for _, item := range items {
+		if item.info != nil && !item.info.IsDir() {
+			p.TotalFiles++
+			p.TotalBytes += item.info.Size()
+		}
+	}
+	report := func() {
+		if progress != nil {
+			progress(p)
+		}
+	}
+	report()
+
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		if item.info == nil || item.info.IsDir() {
+			if err := to.MkdirAll(item.dest); err != nil {
+				return p, fmt.Errorf("failed to create directory %s: %w", item.dest, err)
+			}
+			continue
+		}
+
+		if err := to.MkdirAll(to.Dir(item.dest)); err != nil {
+			return p, fmt.Errorf("failed to create directory %s: %w", to.Dir(item.dest), err)
+		}
+		p.File = item.src
+		if err := copyFile(ctx, from, to, item, &p, report); err != nil {
+			return p, err
+		}
+
+		mode := opts.Mode
+		if mode == 0 {
+			mode = item.info.Mode().Perm()
+		}
+		if err := to.Chmod(item.dest, mode); err != nil {
+			return p, fmt.Errorf("failed to set mode of %s: %w", item.dest, err)
+		}
+		p.Files++
+		report()
+	}
+
+	p.File = ""
+	return p, nil
+}
+
+// collect lists a directory tree as transfer items, skipping ignored paths
+// rel is the directory's path relative to the transfer root, used for ignore patterns
+// parents are the resolved paths of the directories above src, so that a symlink back up
+// the tree is reported instead of followed forever
+func collect(from, to fileSystem, src, dest, rel string, info os.FileInfo, ignore ignoreMatcher, parents map[string]bool) ([]transferItem, error) {
+	real, err := from.RealPath(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", src, err)
+	}
+	if parents[real] {
+		return nil, fmt.Errorf("symlink cycle at %s, which leads back to %s; add it to %s to skip it", src, real, IgnoreFile)
+	}
+	if parents == nil {
+		parents = make(map[string]bool)
+	}
+	parents[real] = true
+	defer delete(parents, real)
+
+	items := []transferItem{{src: src, dest: dest, info: info}}
+
+	entries, err := from.ReadDir(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", src, err)
+	}
+	for _, entry := range entries {
+		entrySrc := from.Join(src, entry.Name())
+		entryDest := to.Join(dest, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+
+		if entry.Mode()&os.ModeSymlink != 0 {
+			// Follow symlinks
+			entry, err = from.Stat(entrySrc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ignore.match(entryRel, entry.IsDir()) {
+			continue
+		}
+
+		if entry.IsDir() {
+			dirItems, err := collect(from, to, entrySrc, entryDest, entryRel, entry, ignore, parents)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, dirItems...)
+		} else if entry.Mode().IsRegular() {
+			items = append(items, transferItem{src: entrySrc, dest: entryDest, info: entry})
+		}
+	}
+	return items, nil
+}
+
+// copyFile copies one file, updating p and reporting progress as bytes are written
+func copyFile(ctx context.Context, from, to fileSystem, item transferItem, p *TransferProgress, report func()) error {
+	in, err := from.Open(item.src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", item.src, err)
+	}
+	defer in.Close()
+
+	out, err := to.Create(item.dest)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", item.dest, err)
+	}
+
+	counter := &progressReader{ctx: ctx, r: in, p: p, report: report, last: time.Now()}
+	if _, err := io.Copy(out, counter); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s to %s: %w", item.src, item.dest, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", item.dest, err)
+	}
+	return nil
+}
+
+// progressReader counts bytes read into a TransferProgress and stops when ctx is cancelled
+type progressReader struct {
+	ctx    context.Context
+	r      io.Reader
+	p      *TransferProgress
+	report func()
+	last   time.Time
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(b)
+	r.p.Bytes += int64(n)
+	if time.Since(r.last) >= progressInterval {
+		r.last = time.Now()
+		r.report()
+	}
+	return n, err
+}
+
+// ReadIgnoreFile reads the patterns in a .gcdignore file
+// Blank lines and lines starting with # are skipped; a missing file has no patterns
+func ReadIgnoreFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return patterns, nil
+}
+
+// ignoreMatcher matches .gitignore-style patterns (without negation)
+// A trailing "/" matches directories only; a pattern containing "/" is matched against
+// the whole relative path, otherwise against the file name at any depth
+type ignoreMatcher []string
+
+func (m ignoreMatcher) match(rel string, isDir bool) bool {
+	for _, pattern := range m {
+		pattern = strings.TrimPrefix(pattern, "**/")
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+			name = rel
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// formatBytes formats a byte count for progress messages
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// fileSystem is the part of a file system a transfer needs, local or over SFTP
+type fileSystem interface {
+	Glob(pattern string) ([]string, error)
+	Stat(name string) (os.FileInfo, error)
+	RealPath(name string) (string, error) // Absolute path with symlinks resolved
+	ReadDir(name string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Join(elem ...string) string
+	Base(name string) string
+	Dir(name string) string
+}
+
+// localFS is the local file system
+type localFS struct{}
+
+func (localFS) Glob(pattern string) ([]string, error)   { return filepath.Glob(pattern) }
+func (localFS) Stat(name string) (os.FileInfo, error)   { return os.Stat(name) }
+func (localFS) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+func (localFS) MkdirAll(name string) error              { return os.MkdirAll(name, 0755) }
+func (localFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+func (localFS) Join(elem ...string) string { return filepath.Join(elem...) }
+func (localFS) Base(name string) string    { return filepath.Base(name) }
+func (localFS) Dir(name string) string     { return filepath.Dir(name) }
+
+func (localFS) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (localFS) RealPath(name string) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+func (localFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// remoteFS is the VM's file system over SFTP
+type remoteFS struct {
+	client *sftp.Client
+}
+
+func (fs remoteFS) Glob(pattern string) ([]string, error)      { return fs.client.Glob(pattern) }
+func (fs remoteFS) Stat(name string) (os.FileInfo, error)      { return fs.client.Stat(name) }
+func (fs remoteFS) ReadDir(name string) ([]os.FileInfo, error) { return fs.client.ReadDir(name) }
+func (fs remoteFS) RealPath(name string) (string, error)       { return fs.client.RealPath(name) }
+func (fs remoteFS) Open(name string) (io.ReadCloser, error)    { return fs.client.Open(name) }
+func (fs remoteFS) Create(name string) (io.WriteCloser, error) { return fs.client.Create(name) }
+func (fs remoteFS) MkdirAll(name string) error {
+	if name == "" || name == "." {
+		return nil
+	}
+	return fs.client.MkdirAll(name)
+}
+func (fs remoteFS) Chmod(name string, mode os.FileMode) error { return fs.client.Chmod(name, mode) }
+func (fs remoteFS) Join(elem ...string) string                { return path.Join(elem...) }
+func (fs remoteFS) Base(name string) string                   { return path.Base(name) }
+func (fs remoteFS) Dir(name string) string                    { return path.Dir(name) }
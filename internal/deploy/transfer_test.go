@@ -0,0 +1,101 @@
+package deploy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTree creates files under root; a value starting with "->" creates a symlink to it
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if target, ok := strings.CutPrefix(content, "->"); ok {
+			if err := os.Symlink(target, p); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTransferDirectory(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		exclude []string
+		want    []string // Files at the destination
+		wantErr string
+	}{
+		{
+			name:  "nested files",
+			files: map[string]string{"a.txt": "a", "sub/b.txt": "b"},
+			want:  []string{"a.txt", "sub/b.txt"},
+		},
+		{
+			name:    "excluded paths are skipped",
+			files:   map[string]string{"a.txt": "a", "node_modules/x.js": "x", "debug.log": "log"},
+			exclude: []string{"node_modules/", "*.log"},
+			want:    []string{"a.txt"},
+		},
+		{
+			name:  "symlinks are followed",
+			files: map[string]string{"real/b.txt": "b", "link": "->real", "file": "->real/b.txt"},
+			want:  []string{"file", "link/b.txt", "real/b.txt"},
+		},
+		{
+			name:    "a symlink cycle is an error",
+			files:   map[string]string{"sub/b.txt": "b", "sub/loop": "->.."},
+			wantErr: "symlink cycle",
+		},
+		{
+			name:    "an excluded symlink cycle is skipped",
+			files:   map[string]string{"sub/b.txt": "b", "sub/loop": "->.."},
+			exclude: []string{"loop"},
+			want:    []string{"sub/b.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "src")
+			writeTree(t, src, tt.files)
+			dest := filepath.Join(t.TempDir(), "dest")
+
+			p, err := transfer(context.Background(), localFS{}, localFS{}, src, dest, TransferOptions{Exclude: tt.exclude}, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("transfer() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("transfer() error = %v", err)
+			}
+
+			var got []string
+			filepath.WalkDir(dest, func(p string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(dest, p)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("transferred %v, want %v", got, tt.want)
+			}
+			if p.Files != len(tt.want) || p.Files != p.TotalFiles {
+				t.Errorf("progress %+v, want %d files", p, len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package headless
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+	"github.com/wclewett/gcdeploy/internal/history"
+	"github.com/wclewett/gcdeploy/internal/runner"
+)
+
+// PassphraseEnv is the environment variable read for the SSH key passphrase
+// If it is unset and the key is encrypted, a running ssh-agent is used instead
+const PassphraseEnv = "GCDEPLOY_SSH_PASSPHRASE"
+
+// progressInterval is the minimum time between transfer progress lines
+const progressInterval = time.Second
+
+// Options controls a headless run
+type Options struct {
+	// StrictHostKeys refuses host keys that are not already in known_hosts
+	// Otherwise unknown keys are trusted on first use and recorded
+	StrictHostKeys bool
+
+	// Selection chooses the steps to run (--only, --skip, --from-step, --resume)
+	Selection runner.Selection
+
+	// DryRun prints the deployment plan to stdout instead of deploying
+	DryRun bool
+	// PlanFormat is the format of the plan: PlanText or PlanJSON
+	PlanFormat string
+
+	// ForceUnlock removes a deployment lock left on the VM by another run before taking it
+	ForceUnlock bool
+
+	// Events receives the deployment as newline-delimited JSON (--events, --events-file)
+	Events *runner.EventWriter
+	// Output is where step output is printed; stdout when nil
+	Output io.Writer
+}
+
+// Plan output formats
+const (
+	PlanText = "text"
+	PlanJSON = "json"
+)
+
+// deployment is what every host of a headless run shares
+type deployment struct {
+	cfg      *config.Config
+	steps    []config.DeploymentStep
+	resolver deploy.InstanceResolver
+	hostKeys *deploy.HostKeyVerifier
+	skips    map[string]map[int]bool // Steps to skip, keyed by instance name
+	state    *runner.StateRecorder
+	history  *history.Recorder
+	events   *runner.EventWriter
+	output   io.Writer
+	force    bool // --force-unlock
+}
+
+// Run connects to the configured instances and executes the deployment script without the TUI
+// Command output is streamed to stdout with a per-step prefix, status messages go to stderr
+// With several instances, each host runs the whole script and a per-host summary is printed
+// Returns an error for the first step that fails
+func Run(ctx context.Context, cfg *config.Config, opts Options) error {
+	// Without a deployment script the single command runs as a remote step
+	steps := cfg.Steps()
+
+	if cfg.EnvName != "" {
+		fmt.Fprintf(os.Stderr, "[INFO] Environment: %s\n", cfg.EnvName)
+	}
+	hostKeyMode := deploy.HostKeyAcceptNew
+	if opts.StrictHostKeys {
+		hostKeyMode = deploy.HostKeyStrict
+	}
+	hostKeys := deploy.NewHostKeyVerifier(hostKeyMode)
+
+	resolver, err := deploy.NewInstanceResolver(cfg.Resolver, cfg.CredentialsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return err
+	}
+
+	targets, err := cfg.Targets(ctx, resolver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return err
+	}
+
+	skips, err := runner.Select(opts.Selection, steps, cfg.EnvName, targets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return err
+	}
+	if opts.DryRun {
+		return printPlan(ctx, cfg, steps, targets, resolver, skips, opts.PlanFormat)
+	}
+	if resume := opts.Selection.Resume; resume != nil {
+		fmt.Fprintf(os.Stderr, "[INFO] Resuming the deployment started at %s\n", resume.StartedAt.Local().Format(time.DateTime))
+	}
+
+	d := &deployment{
+		cfg:      cfg,
+		steps:    steps,
+		resolver: resolver,
+		hostKeys: hostKeys,
+		skips:    skips,
+		history:  history.NewRecorder(cfg, steps, targets),
+		events:   opts.Events,
+		output:   opts.Output,
+		force:    opts.ForceUnlock,
+	}
+	if d.output == nil {
+		d.output = os.Stdout
+	}
+	// A rollback is recorded in the history but leaves the state of the last deployment alone
+	if !cfg.RollingBack {
+		d.state = runner.NewStateRecorder(cfg.StatePath(), cfg.EnvName, steps, targets, opts.Selection.Resume)
+	}
+	if len(targets) == 1 {
+		return d.deployHost(ctx, targets[0], "")
+	}
+
+	fmt.Fprintf(os.Stderr, "[INFO] Deploying to %d instances, %d at a time\n", len(targets), min(cfg.Concurrency, len(targets)))
+	fleet := &runner.Fleet{
+		Instances:   targets,
+		Concurrency: cfg.Concurrency,
+		Deploy: func(ctx context.Context, index int, instance deploy.Instance) error {
+			return d.deployHost(ctx, instance, instance.Name)
+		},
+	}
+	results, err := fleet.Run(ctx)
+
+	fmt.Fprintf(os.Stderr, "[INFO] Deployment summary:\n")
+	for _, result := range results {
+		level := "[SUCCESS]"
+		if result.Status != runner.HostSucceeded {
+			level = "[ERROR]"
+		}
+		fmt.Fprintf(os.Stderr, "%s   %s\n", level, result)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+	}
+	return err
+}
+
+// printPlan looks up the instances and prints what the deployment would run, without connecting
+func printPlan(ctx context.Context, cfg *config.Config, steps []config.DeploymentStep, targets []deploy.Instance, resolver deploy.InstanceResolver, skips map[string]map[int]bool, format string) error {
+	plan, err := runner.NewPlan(ctx, cfg, steps, targets, resolver, skips)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+		return err
+	}
+	if format == PlanJSON {
+		return plan.WriteJSON(os.Stdout)
+	}
+	return plan.WriteText(os.Stdout)
+}
+
+// deployHost connects to one instance and runs the deployment steps on it
+// host labels output and status lines when deploying to several instances
+func (d *deployment) deployHost(ctx context.Context, instance deploy.Instance, host string) error {
+	cfg, steps := d.cfg, d.steps
+	tag := ""
+	if host != "" {
+		tag = "[" + host + "] "
+	}
+
+	fmt.Fprintf(os.Stderr, "[INFO] %sConnecting to %s (%s/%s)...\n", tag, instance.Name, instance.ProjectId, instance.Zone)
+	session, err := deploy.VMConnectWithKey(ctx, instance, cfg.SSHKeyPath, d.resolver, os.Getenv(PassphraseEnv), d.hostKeys)
+	if err != nil {
+		d.recordEvent(tag, d.events.Connection(instance, nil, err))
+		fmt.Fprintf(os.Stderr, "[ERROR] %sSSH connection failed: %v\n", tag, err)
+		return err
+	}
+	defer session.Close()
+	d.recordEvent(tag, d.events.Connection(instance, session.Details, nil))
+
+	// Hold the deployment lock until the run is recorded, even when it was interrupted
+	lock, broken, err := runner.AcquireLock(ctx, session, instance.Name, cfg.LockPath, cfg.EnvName, d.force)
+	if broken != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] %sRemoved the deployment lock held by %s\n", tag, broken)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] %s%v\n", tag, err)
+		return err
+	}
+	defer func() {
+		if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+			fmt.Fprintf(os.Stderr, "[WARN] %s%v\n", tag, err)
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "[INFO] %sAcquired deployment lock %s\n", tag, cfg.LockPath)
+	fmt.Fprintf(os.Stderr, "[SUCCESS] %sConnected to %s\n", tag, instance.Name)
+
+	hostPrefix := ""
+	if host != "" {
+		hostPrefix = host + " "
+	}
+
+	// Each step gets its own printer so that steps running at the same time keep their prefixes
+	type stepKey struct {
+		phase   string
+		stepNum int
+	}
+	var (
+		printersMu sync.Mutex
+		printers   = make(map[stepKey]*linePrinter)
+	)
+	printer := func(e runner.Event) *linePrinter {
+		printersMu.Lock()
+		defer printersMu.Unlock()
+		return printers[stepKey{e.Phase, e.StepNum}]
+	}
+
+	// Transfer progress is reported at most once per progressInterval to keep logs readable
+	lastProgress := make(map[int]time.Time)
+
+	r := &runner.Runner{
+		Steps:        steps,
+		Remote:       session,
+		Parallelism:  cfg.Parallelism,
+		Skip:         d.skips[instance.Name],
+		Vars:         config.HostVars(cfg.Vars, instance, session.Details),
+		HealthChecks: cfg.HealthChecks,
+		OnFailure:    cfg.OnFailure,
+		OutputEvents: d.events != nil,
+		Hooks:        cfg.Hooks,
+		ConfigDir:    filepath.Dir(cfg.Path),
+		StepOutput: func(started runner.Event) chan<- []byte {
+			p := newLinePrinter(d.output)
+			p.setPrefix(fmt.Sprintf("[%s%s %s] ", hostPrefix, started.Position(), started.Step.Target))
+			printersMu.Lock()
+			defer printersMu.Unlock()
+			printers[stepKey{started.Phase, started.StepNum}] = p
+			return p.ch
+		},
+		OnEvent: func(e runner.Event) {
+			if err := d.state.Record(instance.Name, e); err != nil {
+				fmt.Fprintf(os.Stderr, "[WARN] %sCould not save deployment state, --resume will not be available: %v\n", tag, err)
+			}
+			d.recordEvent(tag, d.events.Record(instance.Name, e))
+			d.history.Record(instance.Name, e)
+
+			switch e.Type {
+			case runner.StepSkipped:
+				fmt.Fprintf(os.Stderr, "[INFO] %s[%s] Skipping %s: %s\n", tag, e.Position(), e.Step.Target, e.Step.Description())
+			case runner.StepStarted:
+				fmt.Fprintf(os.Stderr, "[STEP] %s[%s] Running %s: %s%s\n", tag, e.Position(), e.Step.Target, e.Step.Description(), e.Concurrently())
+			case runner.StepProgress:
+				if time.Since(lastProgress[e.StepNum]) >= progressInterval {
+					lastProgress[e.StepNum] = time.Now()
+					fmt.Fprintf(os.Stderr, "[INFO] %s[%s] %s\n", tag, e.Position(), e.Progress)
+				}
+			case runner.StepRetrying:
+				printer(e).flush()
+				fmt.Fprintf(os.Stderr, "[WARN] %s[%s] %s %s failed (attempt %d of %d): %s; retrying in %s\n", tag, e.Position(), e.Step.Target, e.Kind(), e.Attempt, e.Step.Retries+1, e.Reason(), e.Delay)
+			case runner.StepFinished:
+				// Make sure all output of this step is printed before reporting on it
+				printer(e).close()
+				switch {
+				case e.Failed() && e.Step.ContinueOnError:
+					fmt.Fprintf(os.Stderr, "[WARN] %s[%s] %s %s failed, continuing: %s\n", tag, e.Position(), e.Step.Target, e.Kind(), e.Reason())
+				case e.Error != nil:
+					fmt.Fprintf(os.Stderr, "[ERROR] %s[%s] %s %s failed: %v\n", tag, e.Position(), e.Step.Target, e.Kind(), e.Error)
+				case !e.Result.Success():
+					fmt.Fprintf(os.Stderr, "[ERROR] %s[%s] %s %s failed: %s\n", tag, e.Position(), e.Step.Target, e.Kind(), e.Result)
+				case e.Step.IsTransfer():
+					fmt.Fprintf(os.Stderr, "[INFO] %s[%s] Transferred %s in %s\n", tag, e.Position(), e.Progress, e.Result.Duration.Round(100*time.Millisecond))
+				case e.IsHook():
+					fmt.Fprintf(os.Stderr, "[INFO] %s[%s] Hook finished in %s\n", tag, e.Position(), e.Result.Duration.Round(100*time.Millisecond))
+				default:
+					fmt.Fprintf(os.Stderr, "[INFO] %s[%s] Step finished in %s\n", tag, e.Position(), e.Result.Duration.Round(100*time.Millisecond))
+				}
+			case runner.HealthCheckStarted:
+				fmt.Fprintf(os.Stderr, "[STEP] %sHealth check %d/%d: %s\n", tag, e.StepNum, e.Total, e.Check.Label())
+			case runner.HealthCheckRetrying:
+				fmt.Fprintf(os.Stderr, "[WARN] %sHealth check %d/%d failed (attempt %d of %d): %s; retrying in %s\n", tag, e.StepNum, e.Total, e.Attempt, e.Check.Retries+1, e.Reason(), e.Delay)
+			case runner.HealthCheckFinished:
+				if e.Failed() {
+					fmt.Fprintf(os.Stderr, "[ERROR] %sHealth check %d/%d failed: %s\n", tag, e.StepNum, e.Total, e.Reason())
+				} else {
+					fmt.Fprintf(os.Stderr, "[SUCCESS] %sHealth check %d/%d passed: %s\n", tag, e.StepNum, e.Total, e.Check.Label())
+				}
+			case runner.DeploymentCompleted:
+				fmt.Fprintf(os.Stderr, "[SUCCESS] %sDeployment script completed (%d steps)\n", tag, e.Total)
+			case runner.DeploymentFailed:
+				fmt.Fprintf(os.Stderr, "[ERROR] %sDeployment stopped: %v\n", tag, e.Error)
+			}
+		},
+	}
+
+	err = r.Run(ctx)
+
+	// Record the run even when it was interrupted
+	if historyErr := d.history.Finish(context.WithoutCancel(ctx), instance.Name, session); historyErr != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] %sCould not record deployment history: %v\n", tag, historyErr)
+	}
+	return err
+}
+
+// recordEvent warns about the first event that could not be written
+func (d *deployment) recordEvent(tag string, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARN] %sCould not write deployment event: %v\n", tag, err)
+	}
+}
+
+// linePrinter writes output chunks to w line by line, prefixing each line with the current step label
+// A nil chunk on ch flushes any partial line and is acknowledged on ack
+type linePrinter struct {
+	w       io.Writer
+	ch      chan []byte
+	ack     chan struct{}
+	mu      sync.Mutex
+	prefix  string
+	partial []byte
+}
+
+func newLinePrinter(w io.Writer) *linePrinter {
+	p := &linePrinter{
+		w:   w,
+		ch:  make(chan []byte),
+		ack: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *linePrinter) run() {
+	for data := range p.ch {
+		if data == nil {
+			p.writePartial()
+			p.ack <- struct{}{}
+			continue
+		}
+		p.write(data)
+	}
+}
+
+func (p *linePrinter) write(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.partial = append(p.partial, data...)
+	for {
+		idx := bytes.IndexByte(p.partial, '\n')
+		if idx < 0 {
+			return
+		}
+		line := bytes.TrimRight(p.partial[:idx], "\r")
+		fmt.Fprintf(p.w, "%s%s\n", p.prefix, line)
+		p.partial = p.partial[idx+1:]
+	}
+}
+
+func (p *linePrinter) writePartial() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.partial) > 0 {
+		fmt.Fprintf(p.w, "%s%s\n", p.prefix, bytes.TrimRight(p.partial, "\r"))
+		p.partial = nil
+	}
+}
+
+func (p *linePrinter) setPrefix(prefix string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prefix = prefix
+}
+
+// flush blocks until every chunk sent so far has been written
+func (p *linePrinter) flush() {
+	p.ch <- nil
+	<-p.ack
+}
+
+func (p *linePrinter) close() {
+	p.flush()
+	close(p.ch)
+}
@@ -0,0 +1,51 @@
+package headless
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinePrinter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{name: "one line per chunk", chunks: []string{"one\n", "two\n"}, want: "[1/2 remote] one\n[1/2 remote] two\n"},
+		{name: "line split across chunks", chunks: []string{"o", "ne\ntw", "o\n"}, want: "[1/2 remote] one\n[1/2 remote] two\n"},
+		{name: "CRLF", chunks: []string{"one\r\ntwo\r\n"}, want: "[1/2 remote] one\n[1/2 remote] two\n"},
+		{name: "partial last line", chunks: []string{"one\nno newline"}, want: "[1/2 remote] one\n[1/2 remote] no newline\n"},
+		{name: "empty lines", chunks: []string{"\n\n"}, want: "[1/2 remote] \n[1/2 remote] \n"},
+		{name: "no output", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			p := newLinePrinter(&out)
+			p.setPrefix("[1/2 remote] ")
+			for _, chunk := range tt.chunks {
+				p.ch <- []byte(chunk)
+			}
+			p.close()
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinePrinterFlush(t *testing.T) {
+	var out strings.Builder
+	p := newLinePrinter(&out)
+	p.setPrefix("> ")
+	p.ch <- []byte("attempt 1 fail")
+	p.flush()
+	if got := out.String(); got != "> attempt 1 fail\n" {
+		t.Errorf("output after flush = %q, want the partial line", got)
+	}
+	p.ch <- []byte("ed\n")
+	p.close()
+	if got := out.String(); got != "> attempt 1 fail\n> ed\n" {
+		t.Errorf("output = %q", got)
+	}
+}
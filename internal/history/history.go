@@ -0,0 +1,289 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+	"github.com/wclewett/gcdeploy/internal/runner"
+)
+
+// Run outcomes recorded in Record.Status
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// KindRollback marks the runs of `gcdeploy rollback` in Record.Kind
+const KindRollback = "rollback"
+
+// idFormat names runs by their start time; it sorts lexically
+const idFormat = "20060102-150405"
+
+// Record is one deployment to one instance, stored as a line of the history file
+type Record struct {
+	ID         string       `json:"id"`             // Shared by every instance of a run
+	Kind       string       `json:"kind,omitempty"` // KindRollback, or empty for a deployment
+	Host       string       `json:"host"`           // Instance name
+	Project    string       `json:"project,omitempty"`
+	Zone       string       `json:"zone,omitempty"`
+	Env        string       `json:"env,omitempty"`
+	User       string       `json:"user"`       // Local user who ran gcdeploy
+	LocalHost  string       `json:"local_host"` // Machine gcdeploy ran on
+	GitSHA     string       `json:"git_sha,omitempty"`
+	GitBranch  string       `json:"git_branch,omitempty"`
+	ConfigHash string       `json:"config_hash"` // See config.Config.Hash
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Status     string       `json:"status"`
+	Error      string       `json:"error,omitempty"`
+	Steps      []StepRecord `json:"steps"`
+}
+
+// StepRecord is the result of one deployment step
+type StepRecord struct {
+	Step       int    `json:"step"` // 1-based
+	Name       string `json:"name,omitempty"`
+	Target     string `json:"target"`
+	Command    string `json:"command"` // Expanded command, or "src → dest" for transfers
+	Status     string `json:"status"`  // One of the runner.State* values
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Duration returns how long the deployment took
+func (r Record) Duration() time.Duration {
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+// Recorder collects the results of a deployment from runner events and appends
+// a Record per instance to the history files when the instance is finished
+// A nil *Recorder records nothing
+type Recorder struct {
+	path       string // Local history file
+	remotePath string // History file on the VM, empty to keep history locally only
+
+	mu      sync.Mutex
+	records map[string]*Record // Keyed by instance name
+}
+
+// NewRecorder prepares a Record for every instance the steps are deployed to
+func NewRecorder(cfg *config.Config, steps []config.DeploymentStep, instances []deploy.Instance) *Recorder {
+	now := time.Now().UTC()
+	sha, branch := cfg.Revision()
+	base := Record{
+		ID:         now.Format(idFormat),
+		Env:        cfg.EnvName,
+		User:       runner.LocalUser(),
+		LocalHost:  runner.LocalHost(),
+		GitSHA:     sha,
+		GitBranch:  branch,
+		ConfigHash: cfg.Hash,
+	}
+	if cfg.RollingBack {
+		base.Kind = KindRollback
+	}
+
+	r := &Recorder{
+		path:       cfg.HistoryPath(),
+		remotePath: cfg.RemoteHistory,
+		records:    make(map[string]*Record, len(instances)),
+	}
+	for _, instance := range instances {
+		record := base
+		record.Host = instance.Name
+		record.Project = instance.ProjectId
+		record.Zone = instance.Zone
+		record.Steps = make([]StepRecord, len(steps))
+		for i, step := range steps {
+			record.Steps[i] = StepRecord{Step: i + 1, Name: step.Name, Target: step.Target, Command: step.Description(), Status: runner.StatePending}
+		}
+		r.records[instance.Name] = &record
+	}
+	return r
+}
+
+// Record updates the record of host from a runner event
+func (r *Recorder) Record(host string, e runner.Event) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record := r.records[host]
+	if record == nil {
+		return
+	}
+	if record.StartedAt.IsZero() {
+		record.StartedAt = time.Now().UTC()
+	}
+
+	switch e.Type {
+	case runner.DeploymentCompleted:
+		record.Status = StatusSucceeded
+		return
+	case runner.DeploymentFailed:
+		record.Status = StatusFailed
+		record.Error = e.Error.Error()
+		return
+	}
+	if e.Phase != "" || e.StepNum < 1 || e.StepNum > len(record.Steps) {
+		return
+	}
+	step := &record.Steps[e.StepNum-1]
+	switch e.Type {
+	case runner.StepStarted:
+		step.Status = runner.StateRunning
+		step.Command = e.Step.Description()
+	case runner.StepSkipped:
+		step.Status = runner.StateSkipped
+	case runner.StepFinished:
+		exitCode := e.Result.ExitCode
+		step.ExitCode = &exitCode
+		step.DurationMS = e.Result.Duration.Milliseconds()
+		step.Attempts = e.Attempt
+		step.Status = runner.StateSucceeded
+		if e.Failed() {
+			step.Status = runner.StateFailed
+			step.Error = e.Reason()
+		}
+	}
+}
+
+// Finish appends the record of host to the local history file, and to the history
+// file on the VM through remote when remote_history is configured
+// The deployment has already finished, so callers should only warn about errors
+func (r *Recorder) Finish(ctx context.Context, host string, remote runner.RemoteExecutor) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	record := r.records[host]
+	if record == nil {
+		r.mu.Unlock()
+		return nil
+	}
+	record.FinishedAt = time.Now().UTC()
+	if record.StartedAt.IsZero() {
+		record.StartedAt = record.FinishedAt
+	}
+	if record.Status == "" {
+		record.Status = StatusFailed
+	}
+	line, err := json.Marshal(record)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if err := appendLine(r.path, line); err != nil {
+		errs = append(errs, fmt.Errorf("failed to write %s: %w", r.path, err))
+	}
+	if r.remotePath != "" && remote != nil {
+		if err := appendRemote(ctx, remote, r.remotePath, line); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s on %s: %w", r.remotePath, host, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// appendLine appends line to the file at path, creating it and its directory if needed
+func appendLine(path string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Remote commands get the history file and record through the environment (see runner.RunRemote)
+const (
+	remoteAppend = `mkdir -p "$(dirname "$GCDEPLOY_HISTORY")" && printf '%s\n' "$GCDEPLOY_RECORD" >> "$GCDEPLOY_HISTORY"`
+	remoteRead   = `cat "$GCDEPLOY_HISTORY" 2>/dev/null || true`
+)
+
+// appendRemote appends line to the file at path on the VM
+func appendRemote(ctx context.Context, remote runner.RemoteExecutor, path string, line []byte) error {
+	output, result, err := runner.RunRemote(ctx, remote, remoteAppend, map[string]string{
+		"GCDEPLOY_HISTORY": path,
+		"GCDEPLOY_RECORD":  string(line),
+	})
+	if err != nil {
+		return err
+	}
+	if !result.Success() {
+		return fmt.Errorf("%s: %s", result, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// ReadRemote reads the history file at path on the VM
+// A missing file is an empty history
+func ReadRemote(ctx context.Context, remote runner.RemoteExecutor, path string) ([]Record, error) {
+	output, result, err := runner.RunRemote(ctx, remote, remoteRead, map[string]string{"GCDEPLOY_HISTORY": path})
+	if err != nil {
+		return nil, err
+	}
+	if !result.Success() {
+		return nil, fmt.Errorf("failed to read %s: %s", path, result)
+	}
+	return Parse(bytes.NewReader(output))
+}
+
+// Load reads the local history file at path
+// A missing file is an empty history
+func Load(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	records, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// Parse reads history records, one JSON object per line, oldest first
+func Parse(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	// Records with long step output errors can exceed the default line limit
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,190 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+	"github.com/wclewett/gcdeploy/internal/runner"
+)
+
+// localExecutor runs "remote" commands with the local shell
+type localExecutor struct{}
+
+func (localExecutor) ExecuteStep(ctx context.Context, command string, opts deploy.CommandOptions, outputCh chan<- []byte) (deploy.CommandResult, error) {
+	return deploy.RunLocalCommand(ctx, command, opts, outputCh)
+}
+
+var testInstances = []deploy.Instance{
+	{Name: "web-1", ProjectId: "proj", Zone: "us-central1-a"},
+	{Name: "web-2", ProjectId: "proj", Zone: "us-central1-a"},
+}
+
+// testConfig returns a config whose history files are in a temporary directory
+func testConfig(t *testing.T) *config.Config {
+	dir := t.TempDir()
+	return &config.Config{
+		Path:          filepath.Join(dir, ".gcd.toml"),
+		EnvName:       "production",
+		Hash:          "c0ffee",
+		Resolver:      deploy.ResolverGcloud,
+		Instances:     testInstances,
+		RemoteHistory: filepath.Join(dir, "vm", "history.jsonl"),
+		Vars:          map[string]string{config.VarGitSHA: "1a2b3c4d5e6f", config.VarGitBranch: "main"},
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig(t)
+	steps := []config.DeploymentStep{
+		{Name: "build", Command: "make build", Target: "local"},
+		{Command: "systemctl restart myapp", Target: "remote"},
+	}
+	r := NewRecorder(cfg, steps, testInstances)
+
+	// web-1 fails its second step on the second attempt
+	r.Record("web-1", runner.Event{Type: runner.StepStarted, StepNum: 1, Total: 2, Step: steps[0]})
+	r.Record("web-1", runner.Event{Type: runner.StepFinished, StepNum: 1, Total: 2, Step: steps[0], Result: deploy.CommandResult{Duration: 1500 * time.Millisecond}, Attempt: 1})
+	r.Record("web-1", runner.Event{Type: runner.StepStarted, StepNum: 2, Total: 2, Step: steps[1]})
+	r.Record("web-1", runner.Event{Type: runner.StepFinished, StepNum: 2, Total: 2, Step: steps[1], Result: deploy.CommandResult{ExitCode: 3}, Attempt: 2})
+	// Hooks are not deployment steps
+	r.Record("web-1", runner.Event{Type: runner.StepFinished, StepNum: 1, Total: 1, Step: steps[1], Result: deploy.CommandResult{ExitCode: 1}, Phase: runner.PhasePostDeploy})
+	r.Record("web-1", runner.Event{Type: runner.DeploymentFailed, Error: errors.New("step 2 failed")})
+	// web-2 skips the build and succeeds
+	r.Record("web-2", runner.Event{Type: runner.StepSkipped, StepNum: 1, Total: 2, Step: steps[0]})
+	r.Record("web-2", runner.Event{Type: runner.StepStarted, StepNum: 2, Total: 2, Step: steps[1]})
+	r.Record("web-2", runner.Event{Type: runner.StepFinished, StepNum: 2, Total: 2, Step: steps[1], Attempt: 1})
+	r.Record("web-2", runner.Event{Type: runner.DeploymentCompleted})
+	// Unknown hosts are ignored
+	r.Record("db-1", runner.Event{Type: runner.DeploymentCompleted})
+
+	if err := r.Finish(ctx, "web-1", localExecutor{}); err != nil {
+		t.Fatalf("Finish(web-1) error = %v", err)
+	}
+	if err := r.Finish(ctx, "web-2", nil); err != nil {
+		t.Fatalf("Finish(web-2) error = %v", err)
+	}
+
+	records, err := Load(cfg.HistoryPath())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Load() = %d records, want 2", len(records))
+	}
+	failed, succeeded := records[0], records[1]
+	if failed.Host != "web-1" || succeeded.Host != "web-2" || failed.ID != succeeded.ID {
+		t.Errorf("records for %s (%s) and %s (%s), want web-1 and web-2 of one run", failed.Host, failed.ID, succeeded.Host, succeeded.ID)
+	}
+	if failed.Env != "production" || failed.ConfigHash != "c0ffee" || failed.GitSHA != "1a2b3c4d5e6f" || failed.GitBranch != "main" || failed.Zone != "us-central1-a" {
+		t.Errorf("web-1 record = %+v, want the run details", failed)
+	}
+	if failed.Status != StatusFailed || failed.Error != "step 2 failed" {
+		t.Errorf("web-1 status = %s %q, want failed", failed.Status, failed.Error)
+	}
+	if failed.Steps[0].Status != runner.StateSucceeded || failed.Steps[0].DurationMS != 1500 || failed.Steps[0].Name != "build" {
+		t.Errorf("web-1 step 1 = %+v, want succeeded after 1.5s", failed.Steps[0])
+	}
+	if step := failed.Steps[1]; step.Status != runner.StateFailed || step.ExitCode == nil || *step.ExitCode != 3 || step.Attempts != 2 || step.Error == "" {
+		t.Errorf("web-1 step 2 = %+v, want failed with exit code 3 after 2 attempts", step)
+	}
+	if succeeded.Status != StatusSucceeded || succeeded.Steps[0].Status != runner.StateSkipped || succeeded.Steps[1].Status != runner.StateSucceeded {
+		t.Errorf("web-2 record = %+v, want the build skipped and the run succeeded", succeeded)
+	}
+	if failed.FinishedAt.Before(failed.StartedAt) || failed.User == "" {
+		t.Errorf("web-1 ran %s to %s as %q", failed.StartedAt, failed.FinishedAt, failed.User)
+	}
+
+	// Only web-1 was finished with a remote
+	remote, err := ReadRemote(ctx, localExecutor{}, cfg.RemoteHistory)
+	if err != nil {
+		t.Fatalf("ReadRemote() error = %v", err)
+	}
+	if len(remote) != 1 || remote[0].Host != "web-1" || remote[0].Status != StatusFailed {
+		t.Errorf("ReadRemote() = %+v, want the web-1 record", remote)
+	}
+
+	var nilRecorder *Recorder
+	nilRecorder.Record("web-1", runner.Event{Type: runner.DeploymentCompleted})
+	if err := nilRecorder.Finish(ctx, "web-1", nil); err != nil {
+		t.Errorf("Finish() of a nil Recorder error = %v", err)
+	}
+}
+
+func TestRecorderUnfinishedRun(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RollingBack = true
+	r := NewRecorder(cfg, []config.DeploymentStep{{Command: "true", Target: "remote"}}, testInstances[:1])
+	// Cancelled before the runner reported an outcome
+	if err := r.Finish(context.Background(), "web-1", nil); err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	records, err := Load(cfg.HistoryPath())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(records) != 1 || records[0].Status != StatusFailed || records[0].Kind != KindRollback || records[0].Steps[0].Status != runner.StatePending {
+		t.Errorf("Load() = %+v, want a failed rollback with a pending step", records)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	records, err := Load(filepath.Join(t.TempDir(), "missing.jsonl"))
+	if err != nil || len(records) != 0 {
+		t.Errorf("Load() of a missing file = %v, %v, want an empty history", records, err)
+	}
+
+	_, err = Parse(strings.NewReader("{\"id\": \"1\"}\n\n{\"id\": \n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Parse() error = %v, want the line of the bad record", err)
+	}
+}
+
+func TestShow(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Instances = testInstances[:1]
+	older := time.Date(2024, 1, 30, 9, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, 1, 31, 15, 45, 0, 0, time.UTC)
+	for _, record := range []Record{
+		{ID: "20240130-090000", Host: "web-1", User: "alice", StartedAt: older, FinishedAt: older.Add(time.Minute), Status: StatusFailed},
+		{ID: "20240131-154500", Host: "web-1", User: "bob", GitSHA: "1a2b3c4d5e6f", StartedAt: newer, FinishedAt: newer.Add(83 * time.Second), Status: StatusSucceeded,
+			Steps: []StepRecord{{Step: 1, Target: "remote", Command: "systemctl restart myapp", Status: runner.StateSucceeded}}},
+		{ID: "20240131-154500", Host: "web-2", User: "bob", StartedAt: newer, FinishedAt: newer, Status: StatusSucceeded},
+	} {
+		r := &Recorder{path: cfg.HistoryPath(), records: map[string]*Record{record.Host: &record}}
+		if err := r.Finish(context.Background(), record.Host, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var list strings.Builder
+	if err := Show(context.Background(), cfg, &list, Options{Limit: 20}); err != nil {
+		t.Fatalf("Show() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(list.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "20240131-154500") || !strings.HasPrefix(lines[2], "20240130-090000") {
+		t.Errorf("Show() =\n%s\nwant the web-1 runs, newest first", list.String())
+	}
+	if strings.Contains(list.String(), "web-2") {
+		t.Errorf("Show() =\n%s\nwant only the configured instances", list.String())
+	}
+
+	var detail strings.Builder
+	if err := Show(context.Background(), cfg, &detail, Options{ID: "20240131-154500"}); err != nil {
+		t.Fatalf("Show() of one run error = %v", err)
+	}
+	if !strings.Contains(detail.String(), "systemctl restart myapp") {
+		t.Errorf("Show() of one run =\n%s\nwant its steps", detail.String())
+	}
+
+	err := Show(context.Background(), cfg, &detail, Options{ID: "20240101-000000"})
+	if err == nil || !strings.Contains(err.Error(), "no deployment 20240101-000000 to web-1") {
+		t.Errorf("Show() of an unknown run error = %v", err)
+	}
+}
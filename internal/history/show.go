@@ -0,0 +1,189 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+	"github.com/wclewett/gcdeploy/internal/runner"
+)
+
+// Options controls the history command
+type Options struct {
+	// ID shows the details of this run instead of listing runs
+	ID string
+	// Limit is the number of runs listed, newest first; 0 lists every run
+	Limit int
+	// Remote reads the history file on each VM (remote_history) instead of the local one
+	Remote bool
+	// Passphrase unlocks the SSH key when reading remote history
+	Passphrase string
+}
+
+// Show lists the past deployments to the configured instances, or shows one run in detail
+func Show(ctx context.Context, cfg *config.Config, w io.Writer, opts Options) error {
+	resolver, err := deploy.NewInstanceResolver(cfg.Resolver, cfg.CredentialsPath)
+	if err != nil {
+		return err
+	}
+	targets, err := cfg.Targets(ctx, resolver)
+	if err != nil {
+		return err
+	}
+
+	var records []Record
+	if opts.Remote {
+		if cfg.RemoteHistory == "" {
+			return fmt.Errorf("remote_history is not set in .gcd.toml")
+		}
+		hostKeys := deploy.NewHostKeyVerifier(deploy.HostKeyAcceptNew)
+		for _, instance := range targets {
+			session, err := deploy.VMConnectWithKey(ctx, instance, cfg.SSHKeyPath, resolver, opts.Passphrase, hostKeys)
+			if err != nil {
+				return fmt.Errorf("failed to connect to %s: %w", instance.Name, err)
+			}
+			remote, err := ReadRemote(ctx, session, cfg.RemoteHistory)
+			session.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %w", instance.Name, err)
+			}
+			records = append(records, remote...)
+		}
+	} else {
+		records, err = Load(cfg.HistoryPath())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the runs on the configured instances, newest first
+	var names []string
+	for _, instance := range targets {
+		names = append(names, instance.Name)
+	}
+	records = slices.DeleteFunc(records, func(r Record) bool {
+		return !slices.Contains(names, r.Host)
+	})
+	slices.SortStableFunc(records, func(a, b Record) int {
+		return b.StartedAt.Compare(a.StartedAt)
+	})
+
+	if opts.ID != "" {
+		found := false
+		for _, record := range records {
+			if record.ID == opts.ID {
+				found = true
+				writeRecord(w, record)
+			}
+		}
+		if !found {
+			return fmt.Errorf("no deployment %s to %s in the history", opts.ID, joinNames(names))
+		}
+		return nil
+	}
+
+	if len(records) == 0 {
+		fmt.Fprintf(w, "No deployments to %s recorded yet\n", joinNames(names))
+		return nil
+	}
+	if opts.Limit > 0 && len(records) > opts.Limit {
+		records = records[:opts.Limit]
+	}
+	writeList(w, records)
+	return nil
+}
+
+// writeList prints one line per run
+func writeList(w io.Writer, records []Record) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHOST\tENV\tUSER\tGIT\tSTARTED\tDURATION\tSTEPS\tSTATUS")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\t%s\n",
+			r.ID, r.Host, orDash(r.Env), r.User, orDash(shortSHA(r.GitSHA)),
+			r.StartedAt.Local().Format(time.DateTime), r.Duration().Round(time.Second),
+			r.succeededSteps(), len(r.Steps), r.status())
+	}
+	tw.Flush()
+}
+
+// writeRecord prints one run with the result of every step
+func writeRecord(w io.Writer, r Record) {
+	kind := "Deployment"
+	if r.Kind == KindRollback {
+		kind = "Rollback"
+	}
+	fmt.Fprintf(w, "%s %s to %s (%s/%s)\n", kind, r.ID, r.Host, r.Project, r.Zone)
+	fmt.Fprintf(w, "  Environment: %s\n", orDash(r.Env))
+	fmt.Fprintf(w, "  User:        %s@%s\n", r.User, r.LocalHost)
+	if r.GitSHA != "" {
+		fmt.Fprintf(w, "  Git:         %s (%s)\n", r.GitSHA, r.GitBranch)
+	}
+	fmt.Fprintf(w, "  Config:      %s\n", r.ConfigHash)
+	fmt.Fprintf(w, "  Started:     %s\n", r.StartedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "  Duration:    %s\n", r.Duration().Round(100*time.Millisecond))
+	if r.Error != "" {
+		fmt.Fprintf(w, "  Status:      %s: %s\n", r.Status, r.Error)
+	} else {
+		fmt.Fprintf(w, "  Status:      %s\n", r.Status)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, step := range r.Steps {
+		duration := ""
+		if step.ExitCode != nil {
+			duration = (time.Duration(step.DurationMS) * time.Millisecond).Round(100 * time.Millisecond).String()
+		}
+		detail := step.Command
+		if step.Error != "" {
+			detail += " (" + step.Error + ")"
+		}
+		fmt.Fprintf(tw, "  [%d/%d]\t%s\t%s\t%s\t%s\n", step.Step, len(r.Steps), step.Status, step.Target, duration, detail)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// status returns the outcome of the run, noting rollbacks
+func (r Record) status() string {
+	if r.Kind == KindRollback {
+		return r.Status + " (rollback)"
+	}
+	return r.Status
+}
+
+// succeededSteps counts the steps that ran successfully
+func (r Record) succeededSteps() int {
+	n := 0
+	for _, step := range r.Steps {
+		if step.Status == runner.StateSucceeded {
+			n++
+		}
+	}
+	return n
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func joinNames(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return fmt.Sprintf("%d instances", len(names))
+}
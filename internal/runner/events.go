@@ -0,0 +1,166 @@
+package runner
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// Event types written by an EventWriter
+const (
+	JSONConnected           = "connected"
+	JSONConnectionFailed    = "connection_failed"
+	JSONStepStarted         = "step_started"
+	JSONStepOutput          = "step_output"
+	JSONStepRetrying        = "step_retrying"
+	JSONStepSkipped         = "step_skipped"
+	JSONStepFinished        = "step_finished"
+	JSONDeploymentCompleted = "deployment_completed"
+	JSONDeploymentFailed    = "deployment_failed"
+	JSONHealthCheckStarted  = "health_check_started"
+	JSONHealthCheckRetrying = "health_check_retrying"
+	JSONHealthCheckFinished = "health_check_finished"
+)
+
+// JSONEvent is one line of the event stream
+type JSONEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Env        string    `json:"env,omitempty"`
+	Host       string    `json:"host"` // Instance name
+	ExternalIP string    `json:"external_ip,omitempty"`
+
+	Step    int    `json:"step,omitempty"` // 1-based; numbers the checks of health_check events
+	Total   int    `json:"total,omitempty"`
+	Phase   string `json:"phase,omitempty"` // Set for steps outside the deployment script, e.g. "on_failure"
+	Name    string `json:"name,omitempty"`
+	Target  string `json:"target,omitempty"`  // For health_check events: "http", "tcp" or "command"
+	Command string `json:"command,omitempty"` // Expanded command, "src → dest" for transfers, or what a health check tests
+
+	Output     string `json:"output,omitempty"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Success    *bool  `json:"success,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// EventWriter writes deployment events as newline-delimited JSON, one JSONEvent per line
+// It is safe for concurrent use by the runners of several hosts
+// A nil *EventWriter discards events, so callers need not check whether it is enabled
+type EventWriter struct {
+	env string
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error // First write error, reported once
+}
+
+// NewEventWriter returns an EventWriter writing to w
+// env is recorded in every event to tell deployments to different environments apart
+func NewEventWriter(w io.Writer, env string) *EventWriter {
+	return &EventWriter{env: env, enc: json.NewEncoder(w)}
+}
+
+// Connection records that the SSH connection to instance was established, or failed with err
+func (w *EventWriter) Connection(instance deploy.Instance, details *deploy.InstanceDetails, err error) error {
+	if w == nil {
+		return nil
+	}
+	event := JSONEvent{Type: JSONConnected, Host: instance.Name}
+	if details != nil {
+		event.ExternalIP = details.ExternalIP
+	}
+	if err != nil {
+		event.Type = JSONConnectionFailed
+		event.Error = err.Error()
+	}
+	return w.write(event)
+}
+
+// Record writes the JSON form of a runner event for host
+// Transfer progress is left out of the stream
+func (w *EventWriter) Record(host string, e Event) error {
+	if w == nil {
+		return nil
+	}
+	event := JSONEvent{Host: host, Step: e.StepNum, Total: e.Total, Phase: e.Phase}
+	if e.StepNum > 0 {
+		event.Name = e.Step.Name
+		event.Target = e.Step.Target
+		event.Command = e.Step.Description()
+	}
+	if e.Type == HealthCheckStarted || e.Type == HealthCheckRetrying || e.Type == HealthCheckFinished {
+		event.Name = e.Check.Name
+		event.Target = e.Check.Kind()
+		event.Command = e.Check.Description()
+	}
+
+	switch e.Type {
+	case StepStarted:
+		event.Type = JSONStepStarted
+	case StepOutput:
+		event.Type = JSONStepOutput
+		event.Command = ""
+		event.Output = string(e.Output)
+	case StepRetrying:
+		event.Type = JSONStepRetrying
+		event.Attempt = e.Attempt
+		event.Error = e.Reason()
+		event.DurationMS = e.Result.Duration.Milliseconds()
+	case StepSkipped:
+		event.Type = JSONStepSkipped
+	case StepFinished:
+		event.Type = JSONStepFinished
+		exitCode, success := e.Result.ExitCode, !e.Failed()
+		event.ExitCode = &exitCode
+		event.Success = &success
+		event.Signal = e.Result.Signal
+		event.DurationMS = e.Result.Duration.Milliseconds()
+		event.Attempt = e.Attempt
+		if !success {
+			event.Error = e.Reason()
+		}
+	case HealthCheckStarted:
+		event.Type = JSONHealthCheckStarted
+	case HealthCheckRetrying:
+		event.Type = JSONHealthCheckRetrying
+		event.Attempt = e.Attempt
+		event.Error = e.Reason()
+	case HealthCheckFinished:
+		event.Type = JSONHealthCheckFinished
+		success := !e.Failed()
+		event.Success = &success
+		event.Attempt = e.Attempt
+		if !success {
+			event.Error = e.Reason()
+		}
+	case DeploymentCompleted:
+		event.Type = JSONDeploymentCompleted
+	case DeploymentFailed:
+		event.Type = JSONDeploymentFailed
+		event.Error = e.Error.Error()
+	default:
+		return nil
+	}
+	return w.write(event)
+}
+
+// write stamps and encodes one event
+// Returns the error of the first failed write, and nil afterwards, so callers can
+// warn once without failing the deployment
+func (w *EventWriter) write(event JSONEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	event.Time = time.Now().UTC()
+	event.Env = w.env
+	if err := w.enc.Encode(event); err != nil && w.err == nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
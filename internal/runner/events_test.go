@@ -0,0 +1,150 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// readEvents decodes an event stream, failing the test on a line that is not a JSONEvent
+func readEvents(t *testing.T, stream string) []JSONEvent {
+	t.Helper()
+	var events []JSONEvent
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	for scanner.Scan() {
+		var event JSONEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("event %q is not valid JSON: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEventWriterRecord(t *testing.T) {
+	var stream strings.Builder
+	w := NewEventWriter(&stream, "production")
+	r := &Runner{
+		Steps: []config.DeploymentStep{
+			{Name: "greet", Command: "echo hello", Target: "local"},
+			{Command: "exit 3", Target: "local"},
+			{Command: "echo never", Target: "local"},
+		},
+		LocalOutput:  discard(t),
+		OutputEvents: true,
+		OnEvent: func(e Event) {
+			if err := w.Record("web-1", e); err != nil {
+				t.Errorf("Record() error = %v", err)
+			}
+		},
+	}
+	if err := r.Run(context.Background()); err == nil {
+		t.Fatal("Run() of a failing step succeeded")
+	}
+
+	var types []string
+	var output string
+	for _, event := range readEvents(t, stream.String()) {
+		if event.Host != "web-1" || event.Env != "production" || event.Time.IsZero() {
+			t.Errorf("event %+v, want the host, env and time set", event)
+		}
+		if event.Type == JSONStepOutput {
+			output += event.Output
+			// Output chunks are told apart by their step number alone
+			if event.Step != 1 || event.Command != "" {
+				t.Errorf("output event %+v, want step 1 without its command", event)
+			}
+			continue
+		}
+		types = append(types, event.Type)
+
+		switch {
+		case event.Type == JSONStepStarted && event.Step == 1:
+			if event.Name != "greet" || event.Target != "local" || event.Command != "echo hello" || event.Total != 3 {
+				t.Errorf("step_started = %+v, want step 1/3 (greet)", event)
+			}
+		case event.Type == JSONStepFinished && event.Step == 1:
+			if event.Success == nil || !*event.Success || event.ExitCode == nil || *event.ExitCode != 0 || event.Error != "" {
+				t.Errorf("step_finished = %+v, want success with exit code 0", event)
+			}
+		case event.Type == JSONStepFinished && event.Step == 2:
+			if event.Success == nil || *event.Success || event.ExitCode == nil || *event.ExitCode != 3 || event.Error == "" {
+				t.Errorf("step_finished = %+v, want failure with exit code 3", event)
+			}
+		case event.Type == JSONDeploymentFailed:
+			if !strings.Contains(event.Error, "step 2/3") {
+				t.Errorf("deployment_failed error = %q, want the failed step", event.Error)
+			}
+		}
+	}
+	want := []string{JSONStepStarted, JSONStepFinished, JSONStepStarted, JSONStepFinished, JSONDeploymentFailed}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("event types = %q, want %q", types, want)
+	}
+	if output != "hello\n" {
+		t.Errorf("step_output = %q, want %q", output, "hello\n")
+	}
+}
+
+func TestEventWriterConnection(t *testing.T) {
+	var stream strings.Builder
+	w := NewEventWriter(&stream, "")
+	instance := deploy.Instance{Name: "web-1", ProjectId: "proj", Zone: "us-central1-a"}
+	if err := w.Connection(instance, &deploy.InstanceDetails{ExternalIP: "203.0.113.1"}, nil); err != nil {
+		t.Fatalf("Connection() error = %v", err)
+	}
+	if err := w.Connection(instance, nil, errors.New("connection refused")); err != nil {
+		t.Fatalf("Connection() error = %v", err)
+	}
+	// Transfer progress is left out
+	if err := w.Record("web-1", Event{Type: StepProgress, StepNum: 1, Total: 1}); err != nil {
+		t.Fatalf("Record() error = %v", err)
+	}
+
+	events := readEvents(t, stream.String())
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2:\n%s", len(events), stream.String())
+	}
+	if got := events[0]; got.Type != JSONConnected || got.ExternalIP != "203.0.113.1" || got.Error != "" {
+		t.Errorf("connected event = %+v", got)
+	}
+	if got := events[1]; got.Type != JSONConnectionFailed || got.Error != "connection refused" {
+		t.Errorf("connection_failed event = %+v", got)
+	}
+	if strings.Contains(stream.String(), `"env"`) {
+		t.Errorf("events without an env = %s, want the field left out", stream.String())
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestEventWriterErrors(t *testing.T) {
+	w := NewEventWriter(failingWriter{}, "")
+	event := Event{Type: DeploymentCompleted}
+	if err := w.Record("web-1", event); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("first Record() error = %v, want the write error", err)
+	}
+	if err := w.Record("web-1", event); err != nil {
+		t.Errorf("second Record() error = %v, want the error reported once", err)
+	}
+
+	var disabled *EventWriter
+	if err := disabled.Record("web-1", event); err != nil {
+		t.Errorf("Record() on a nil EventWriter error = %v", err)
+	}
+	if err := disabled.Connection(deploy.Instance{Name: "web-1"}, nil, nil); err != nil {
+		t.Errorf("Connection() on a nil EventWriter error = %v", err)
+	}
+}
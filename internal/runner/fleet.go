@@ -0,0 +1,159 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// HostStatus is the state of one host in a fan-out deployment
+type HostStatus int
+
+const (
+	HostPending HostStatus = iota
+	HostRunning
+	HostSucceeded
+	HostFailed
+	HostSkipped // Not started because another host failed or the deployment was cancelled
+)
+
+func (s HostStatus) String() string {
+	switch s {
+	case HostRunning:
+		return "running"
+	case HostSucceeded:
+		return "succeeded"
+	case HostFailed:
+		return "failed"
+	case HostSkipped:
+		return "skipped"
+	default:
+		return "pending"
+	}
+}
+
+// HostResult is the outcome of the deployment on one host
+type HostResult struct {
+	Instance deploy.Instance
+	Status   HostStatus
+	Err      error
+	Duration time.Duration
+}
+
+func (r HostResult) String() string {
+	switch r.Status {
+	case HostSucceeded:
+		return fmt.Sprintf("%s: succeeded in %s", r.Instance.Name, r.Duration.Round(100*time.Millisecond))
+	case HostFailed:
+		return fmt.Sprintf("%s: failed after %s: %v", r.Instance.Name, r.Duration.Round(100*time.Millisecond), r.Err)
+	default:
+		return fmt.Sprintf("%s: %s", r.Instance.Name, r.Status)
+	}
+}
+
+// HostEvent is reported to Fleet.OnHost when a host starts and when it finishes
+type HostEvent struct {
+	Index  int // Index into Fleet.Instances
+	Result HostResult
+}
+
+// Fleet runs a deployment on several instances, at most Concurrency at a time
+// Once a host fails, hosts that have not started yet are skipped
+type Fleet struct {
+	Instances []deploy.Instance
+	// Concurrency is the number of hosts deployed at once
+	// 1 deploys one host after the other, values <= 0 deploy to all hosts at once
+	Concurrency int
+
+	// Deploy runs the deployment on one host
+	Deploy func(ctx context.Context, index int, instance deploy.Instance) error
+
+	// OnHost is called for every host event (optional)
+	// Calls are serialized, but come from the hosts' goroutines
+	OnHost func(HostEvent)
+
+	mu sync.Mutex
+}
+
+// Run deploys to every instance and returns the per-host results in Instances order
+// Returns an error if any host failed or was skipped
+func (f *Fleet) Run(ctx context.Context) ([]HostResult, error) {
+	limit := f.Concurrency
+	if limit <= 0 || limit > len(f.Instances) {
+		limit = len(f.Instances)
+	}
+
+	results := make([]HostResult, len(f.Instances))
+	for i, instance := range f.Instances {
+		results[i] = HostResult{Instance: instance, Status: HostPending}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		failed bool
+		sem    = make(chan struct{}, limit)
+	)
+	for i, instance := range f.Instances {
+		sem <- struct{}{}
+
+		f.mu.Lock()
+		skip := failed || ctx.Err() != nil
+		f.mu.Unlock()
+		if skip {
+			<-sem
+			results[i].Status = HostSkipped
+			f.emit(HostEvent{Index: i, Result: results[i]})
+			continue
+		}
+
+		results[i].Status = HostRunning
+		f.emit(HostEvent{Index: i, Result: results[i]})
+
+		wg.Add(1)
+		go func(i int, instance deploy.Instance) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			err := f.Deploy(ctx, i, instance)
+
+			result := HostResult{Instance: instance, Status: HostSucceeded, Err: err, Duration: time.Since(start)}
+			if err != nil {
+				result.Status = HostFailed
+			}
+
+			f.mu.Lock()
+			if err != nil {
+				failed = true
+			}
+			results[i] = result
+			f.mu.Unlock()
+			f.emit(HostEvent{Index: i, Result: result})
+		}(i, instance)
+	}
+	wg.Wait()
+
+	var notOK int
+	for _, result := range results {
+		if result.Status != HostSucceeded {
+			notOK++
+		}
+	}
+	if notOK > 0 {
+		return results, fmt.Errorf("deployment did not succeed on %d of %d hosts", notOK, len(results))
+	}
+	return results, nil
+}
+
+// emit serializes calls to OnHost
+func (f *Fleet) emit(e HostEvent) {
+	if f.OnHost == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.OnHost(e)
+}
@@ -0,0 +1,181 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// fleetInstances returns n instances named web-1 to web-n
+func fleetInstances(n int) []deploy.Instance {
+	instances := make([]deploy.Instance, n)
+	for i := range instances {
+		instances[i] = deploy.Instance{Name: fmt.Sprintf("web-%d", i+1), ProjectId: "proj", Zone: "us-central1-a"}
+	}
+	return instances
+}
+
+func TestFleetRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		hosts       int
+		concurrency int
+		fail        string // Host whose deployment fails
+		want        []HostStatus
+		wantErr     string
+	}{
+		{
+			name:        "every host succeeds",
+			hosts:       3,
+			concurrency: 2,
+			want:        []HostStatus{HostSucceeded, HostSucceeded, HostSucceeded},
+		},
+		{
+			name:        "hosts after a failure are skipped",
+			hosts:       4,
+			concurrency: 1,
+			fail:        "web-2",
+			want:        []HostStatus{HostSucceeded, HostFailed, HostSkipped, HostSkipped},
+			wantErr:     "did not succeed on 3 of 4 hosts",
+		},
+		{
+			name:        "hosts already running finish after a failure",
+			hosts:       3,
+			concurrency: 0,
+			fail:        "web-1",
+			want:        []HostStatus{HostFailed, HostSucceeded, HostSucceeded},
+			wantErr:     "did not succeed on 1 of 3 hosts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			// With every host at once, all of them start before any finishes
+			var started sync.WaitGroup
+			started.Add(tt.hosts)
+			f := &Fleet{
+				Instances:   fleetInstances(tt.hosts),
+				Concurrency: tt.concurrency,
+				Deploy: func(ctx context.Context, index int, instance deploy.Instance) error {
+					if tt.concurrency == 0 {
+						started.Done()
+						started.Wait()
+					}
+					if instance.Name == tt.fail {
+						return errors.New("step 1 failed")
+					}
+					return nil
+				},
+				OnHost: func(e HostEvent) {
+					events = append(events, fmt.Sprintf("%s %s", e.Result.Instance.Name, e.Result.Status))
+				},
+			}
+			results, err := f.Run(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+
+			var got []HostStatus
+			for i, result := range results {
+				got = append(got, result.Status)
+				if result.Instance != f.Instances[i] {
+					t.Errorf("result %d is for %s, want results in instance order", i, result.Instance.Name)
+				}
+				if result.Status == HostFailed && !strings.Contains(result.String(), "step 1 failed") {
+					t.Errorf("failed result = %q, want the error", result)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Run() statuses = %v, want %v", got, tt.want)
+			}
+			// Each started host reports running and then its outcome, skipped hosts only that
+			for i, status := range tt.want {
+				name := f.Instances[i].Name
+				want := []string{name + " running", fmt.Sprintf("%s %s", name, status)}
+				if status == HostSkipped {
+					want = want[1:]
+				}
+				var hostEvents []string
+				for _, e := range events {
+					if strings.HasPrefix(e, name+" ") {
+						hostEvents = append(hostEvents, e)
+					}
+				}
+				if !reflect.DeepEqual(hostEvents, want) {
+					t.Errorf("%s events = %q, want %q", name, hostEvents, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFleetRunConcurrency(t *testing.T) {
+	for _, tt := range []struct {
+		concurrency int
+		want        int
+	}{{1, 1}, {2, 2}, {0, 4}, {10, 4}} {
+		t.Run(fmt.Sprint(tt.concurrency), func(t *testing.T) {
+			var (
+				mu        sync.Mutex
+				active    int
+				maxActive int
+			)
+			f := &Fleet{
+				Instances:   fleetInstances(4),
+				Concurrency: tt.concurrency,
+				Deploy: func(ctx context.Context, index int, instance deploy.Instance) error {
+					mu.Lock()
+					active++
+					maxActive = max(maxActive, active)
+					mu.Unlock()
+					time.Sleep(20 * time.Millisecond)
+					mu.Lock()
+					active--
+					mu.Unlock()
+					return nil
+				},
+			}
+			if _, err := f.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if maxActive != tt.want {
+				t.Errorf("%d hosts deployed at once, want %d", maxActive, tt.want)
+			}
+		})
+	}
+}
+
+func TestFleetRunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Fleet{
+		Instances:   fleetInstances(3),
+		Concurrency: 1,
+		Deploy: func(ctx context.Context, index int, instance deploy.Instance) error {
+			// Ctrl+C during the first host
+			cancel()
+			return nil
+		},
+	}
+	results, err := f.Run(ctx)
+	if err == nil {
+		t.Fatal("Run() of a cancelled deployment succeeded")
+	}
+	var got []HostStatus
+	for _, result := range results {
+		got = append(got, result.Status)
+	}
+	if want := []HostStatus{HostSucceeded, HostSkipped, HostSkipped}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Run() statuses = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,154 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+)
+
+// maxHealthBody is how much of an HTTP response is matched against the expected body
+const maxHealthBody = 1 << 20
+
+// checkHealth runs the health checks with their retries and returns a *HealthCheckError
+// for the first one that fails
+func (r *Runner) checkHealth(ctx context.Context) *HealthCheckError {
+	total := len(r.HealthChecks)
+	for i, check := range r.HealthChecks {
+		checkNum := i + 1
+		check, err := r.expandCheck(check)
+		if err != nil {
+			return &HealthCheckError{CheckNum: checkNum, Total: total, Check: check, Err: err}
+		}
+		r.emit(Event{Type: HealthCheckStarted, StepNum: checkNum, Total: total, Check: check})
+
+		attempt := 1
+		for ; ; attempt++ {
+			err = r.probe(ctx, check)
+			if err == nil || attempt > check.Retries || ctx.Err() != nil {
+				break
+			}
+			delay := check.IntervalDuration()
+			r.emit(Event{Type: HealthCheckRetrying, StepNum: checkNum, Total: total, Check: check, Error: err, Attempt: attempt, Delay: delay})
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		r.emit(Event{Type: HealthCheckFinished, StepNum: checkNum, Total: total, Check: check, Error: err, Attempt: attempt})
+		if err != nil {
+			return &HealthCheckError{CheckNum: checkNum, Total: total, Check: check, Err: err}
+		}
+	}
+	return nil
+}
+
+// probe runs one attempt of a health check, limited to the check's timeout
+func (r *Runner) probe(ctx context.Context, check config.HealthCheck) error {
+	timeout := check.TimeoutDuration()
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var err error
+	switch check.Kind() {
+	case "http":
+		err = probeHTTP(probeCtx, check)
+	case "tcp":
+		var dialer net.Dialer
+		var conn net.Conn
+		if conn, err = dialer.DialContext(probeCtx, "tcp", check.TCP); err == nil {
+			conn.Close()
+		}
+	default:
+		err = r.probeCommand(probeCtx, check)
+	}
+	if err != nil && errors.Is(probeCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("no answer after %s", timeout)
+	}
+	return err
+}
+
+// probeHTTP requests the check URL and matches the status and body of the response
+func probeHTTP(ctx context.Context, check config.HealthCheck) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("failed to read the response: %w", err)
+	}
+
+	switch {
+	case check.Status != 0 && resp.StatusCode != check.Status:
+		return fmt.Errorf("HTTP status %d, expected %d", resp.StatusCode, check.Status)
+	case check.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299):
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	if check.Body != "" {
+		// Validated when the config was loaded
+		if !regexp.MustCompile(check.Body).Match(body) {
+			return fmt.Errorf("response body does not match %q", check.Body)
+		}
+	}
+	return nil
+}
+
+// probeCommand runs the check command on the VM; it passes when it exits with status 0
+func (r *Runner) probeCommand(ctx context.Context, check config.HealthCheck) error {
+	if r.Remote == nil {
+		return fmt.Errorf("command checks require SSH connection")
+	}
+	output, result, err := RunRemote(ctx, r.Remote, check.Command, nil)
+	if err != nil {
+		return err
+	}
+	if !result.Success() {
+		if output := lastLine(output); output != "" {
+			return fmt.Errorf("%s: %s", result, output)
+		}
+		return fmt.Errorf("%s", result)
+	}
+	return nil
+}
+
+// lastLine returns the last non-empty line of command output, to explain a failed check
+func lastLine(output []byte) string {
+	output = bytes.TrimSpace(output)
+	if i := bytes.LastIndexByte(output, '\n'); i >= 0 {
+		output = output[i+1:]
+	}
+	return string(bytes.TrimSpace(output))
+}
+
+// expandCheck substitutes Vars into the URL, address and command of a check
+func (r *Runner) expandCheck(check config.HealthCheck) (config.HealthCheck, error) {
+	if r.Vars == nil {
+		return check, nil
+	}
+	return ExpandCheck(check, r.Vars)
+}
+
+// ExpandCheck substitutes vars into the URL, address and command of a check
+func ExpandCheck(check config.HealthCheck, vars map[string]string) (config.HealthCheck, error) {
+	for _, field := range []*string{&check.URL, &check.TCP, &check.Command} {
+		expanded, err := config.Expand(*field, vars)
+		if err != nil {
+			return check, err
+		}
+		*field = expanded
+	}
+	return check, nil
+}
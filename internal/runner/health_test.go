@@ -0,0 +1,138 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// localExecutor runs "remote" commands with the local shell
+type localExecutor struct{}
+
+func (localExecutor) ExecuteStep(ctx context.Context, command string, opts deploy.CommandOptions, outputCh chan<- []byte) (deploy.CommandResult, error) {
+	return deploy.RunLocalCommand(ctx, command, opts, outputCh)
+}
+
+// discard returns a channel whose output is dropped until the test ends
+func discard(t *testing.T) chan []byte {
+	ch := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(done) })
+	return ch
+}
+
+func TestProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte(`{"status": "ready"}`))
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		check   config.HealthCheck
+		wantErr string
+	}{
+		{name: "any 2xx", check: config.HealthCheck{URL: server.URL + "/created"}},
+		{name: "body", check: config.HealthCheck{URL: server.URL + "/ok", Body: `"status": "ready"`}},
+		{name: "status", check: config.HealthCheck{URL: server.URL + "/down", Status: 503}},
+		{name: "unexpected status", check: config.HealthCheck{URL: server.URL + "/created", Status: 200}, wantErr: "HTTP status 201, expected 200"},
+		{name: "error status", check: config.HealthCheck{URL: server.URL + "/down"}, wantErr: "HTTP status 503"},
+		{name: "body does not match", check: config.HealthCheck{URL: server.URL + "/ok", Body: "healthy"}, wantErr: `does not match "healthy"`},
+		{name: "tcp", check: config.HealthCheck{TCP: strings.TrimPrefix(server.URL, "http://")}},
+		{name: "tcp refused", check: config.HealthCheck{TCP: closedAddr}, wantErr: "refused"},
+		{name: "command", check: config.HealthCheck{Command: "exit 0"}},
+		{name: "command fails", check: config.HealthCheck{Command: "exit 3"}, wantErr: "exit code 3"},
+		{name: "last line of output explains", check: config.HealthCheck{Command: "echo starting; echo not ready >&2; exit 3"}, wantErr: "s: not ready"},
+		{name: "timeout", check: config.HealthCheck{Command: "sleep 5", Timeout: "50ms"}, wantErr: "no answer after 50ms"},
+	}
+	r := &Runner{Remote: localExecutor{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.probe(context.Background(), tt.check)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("probe() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("probe() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunHealthCheckFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		onFailure     string
+		wantOnFailure bool // The on_failure step failed as well
+	}{
+		{name: "on_failure steps run", onFailure: "echo rolling back"},
+		{name: "failing on_failure step", onFailure: "exit 2", wantOnFailure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			r := &Runner{
+				Steps:        []config.DeploymentStep{{Command: "true", Target: "remote"}},
+				Remote:       localExecutor{},
+				RemoteOutput: discard(t),
+				HealthChecks: []config.HealthCheck{{Command: "exit 1", Retries: 1, Interval: "1ms"}},
+				OnFailure:    []config.DeploymentStep{{Command: tt.onFailure, Target: "remote"}},
+				OnEvent: func(e Event) {
+					switch e.Type {
+					case HealthCheckRetrying:
+						events = append(events, "retrying")
+					case HealthCheckFinished:
+						events = append(events, "check failed")
+					case StepFinished:
+						events = append(events, "finished "+e.Position())
+					}
+				},
+			}
+
+			err := r.Run(context.Background())
+			var healthErr *HealthCheckError
+			if !errors.As(err, &healthErr) || healthErr.CheckNum != 1 {
+				t.Fatalf("Run() error = %v, want a failed health check", err)
+			}
+			if got := healthErr.OnFailure != nil; got != tt.wantOnFailure {
+				t.Errorf("on_failure error = %v, want failed %v", healthErr.OnFailure, tt.wantOnFailure)
+			}
+			want := "finished 1/1,retrying,check failed,finished " + PhaseOnFailure + " 1/1"
+			if got := strings.Join(events, ","); got != want {
+				t.Errorf("events = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+)
+
+// localSteps returns a local step per command
+func localSteps(commands ...string) []config.DeploymentStep {
+	var steps []config.DeploymentStep
+	for _, command := range commands {
+		steps = append(steps, config.DeploymentStep{Command: command, Target: "local"})
+	}
+	return steps
+}
+
+func TestRunHooks(t *testing.T) {
+	tests := []struct {
+		name      string
+		hooks     config.Hooks
+		steps     []string
+		want      []string // Phase and command of every started step
+		wantPhase string   // Phase of the *HookError, "" for a *StepError
+		wantErr   bool
+	}{
+		{
+			name:  "successful deployment skips on_failure",
+			hooks: config.Hooks{PreDeploy: localSteps("true"), OnFailure: localSteps("echo failed"), PostDeploy: localSteps("echo done")},
+			steps: []string{"echo deploy"},
+			want:  []string{"hooks.pre_deploy: true", ": echo deploy", "hooks.post_deploy: echo done"},
+		},
+		{
+			name:    "failed step runs on_failure then post_deploy",
+			hooks:   config.Hooks{OnFailure: localSteps("echo failed"), PostDeploy: localSteps("echo done")},
+			steps:   []string{"false", "echo never"},
+			want:    []string{": false", "hooks.on_failure: echo failed", "hooks.post_deploy: echo done"},
+			wantErr: true,
+		},
+		{
+			name:      "failed pre_deploy hook stops before the steps",
+			hooks:     config.Hooks{PreDeploy: localSteps("false", "echo never"), OnFailure: localSteps("echo failed"), PostDeploy: localSteps("echo done")},
+			steps:     []string{"echo deploy"},
+			want:      []string{"hooks.pre_deploy: false", "hooks.on_failure: echo failed", "hooks.post_deploy: echo done"},
+			wantPhase: PhasePreDeploy,
+			wantErr:   true,
+		},
+		{
+			name:      "post_deploy hooks keep going and fail the deployment",
+			hooks:     config.Hooks{PostDeploy: localSteps("false", "echo done")},
+			steps:     []string{"echo deploy"},
+			want:      []string{": echo deploy", "hooks.post_deploy: false", "hooks.post_deploy: echo done"},
+			wantPhase: PhasePostDeploy,
+			wantErr:   true,
+		},
+		{
+			name:    "step failure is reported over hook failures",
+			hooks:   config.Hooks{OnFailure: localSteps("false", "echo failed"), PostDeploy: localSteps("false")},
+			steps:   []string{"false"},
+			want:    []string{": false", "hooks.on_failure: false", "hooks.on_failure: echo failed", "hooks.post_deploy: false"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var started []string
+			r := &Runner{
+				Steps:       localSteps(tt.steps...),
+				Hooks:       tt.hooks,
+				LocalOutput: discard(t),
+				OnEvent: func(e Event) {
+					if e.Type == StepStarted {
+						started = append(started, e.Phase+": "+e.Step.Command)
+					}
+				},
+			}
+			err := r.Run(context.Background())
+			if !reflect.DeepEqual(started, tt.want) {
+				t.Errorf("started steps = %q, want %q", started, tt.want)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+				return
+			}
+			var hookErr *HookError
+			var stepErr *StepError
+			switch {
+			case tt.wantPhase != "":
+				if !errors.As(err, &hookErr) || hookErr.Phase != tt.wantPhase {
+					t.Errorf("Run() error = %v, want a %s hook failure", err, tt.wantPhase)
+				}
+			case errors.As(err, &hookErr) || !errors.As(err, &stepErr):
+				t.Errorf("Run() error = %v, want a step failure", err)
+			}
+		})
+	}
+}
+
+func TestRunHooksAfterCancel(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &Runner{
+		Steps: localSteps("sleep 10"),
+		Hooks: config.Hooks{
+			OnFailure:  []config.DeploymentStep{{Command: "echo failed > on_failure", Target: "local", Workdir: dir}},
+			PostDeploy: []config.DeploymentStep{{Command: "echo done > post_deploy", Target: "local", Workdir: dir}},
+		},
+		LocalOutput: discard(t),
+		OnEvent: func(e Event) {
+			// Ctrl+C while the step runs
+			if e.Type == StepStarted && e.Phase == "" {
+				cancel()
+			}
+		},
+	}
+
+	start := time.Now()
+	err := r.Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() error = %v, want the deployment cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run() returned after %s, want the step killed", elapsed)
+	}
+	for _, name := range []string{"on_failure", "post_deploy"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s hook did not run after the deployment was cancelled: %v", name, err)
+		}
+	}
+}
+
+func TestAfterDeployContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hookCtx, hookCancel := afterDeployContext(ctx)
+	defer hookCancel()
+	cancel()
+	if hookCtx.Err() == nil {
+		t.Error("hooks of a running deployment were not cancelled with it")
+	}
+
+	hookCtx, hookCancel = afterDeployContext(ctx)
+	defer hookCancel()
+	if hookCtx.Err() != nil {
+		t.Errorf("hooks of a cancelled deployment got a done context: %v", hookCtx.Err())
+	}
+	if deadline, ok := hookCtx.Deadline(); !ok || time.Until(deadline) > cancelledHookTimeout {
+		t.Errorf("hooks of a cancelled deployment have deadline %v, want one within %s", deadline, cancelledHookTimeout)
+	}
+}
@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// lockHeldExit is the exit status of remoteAcquire when the lock is already held
+const lockHeldExit = 3
+
+// Remote lock commands get the lock directory and owner through the environment (see RunRemote)
+// mkdir is atomic, so only one deployment can create the directory
+// A failed mkdir only means the lock is held when the directory exists, e.g. not on a permission error
+const (
+	remoteAcquire = `mkdir -p "$(dirname "$GCDEPLOY_LOCK")" || exit 1
+if err=$(mkdir "$GCDEPLOY_LOCK" 2>&1); then
+	printf '%s\n' "$GCDEPLOY_LOCK_OWNER" > "$GCDEPLOY_LOCK/owner"
+elif [ -d "$GCDEPLOY_LOCK" ]; then
+	cat "$GCDEPLOY_LOCK/owner" 2>/dev/null
+	exit 3
+else
+	printf '%s\n' "$err" >&2
+	exit 1
+fi`
+	remoteRelease     = `if grep -qF "$GCDEPLOY_LOCK_ID" "$GCDEPLOY_LOCK/owner" 2>/dev/null; then rm -rf "$GCDEPLOY_LOCK"; fi`
+	remoteForceUnlock = `cat "$GCDEPLOY_LOCK/owner" 2>/dev/null; rm -rf "$GCDEPLOY_LOCK" 2>/dev/null || sudo -n rm -rf "$GCDEPLOY_LOCK"`
+)
+
+// LockOwner describes the deployment holding a lock, as stored in the lock directory
+type LockOwner struct {
+	ID        string    `json:"id"` // Random, so a deployment only releases its own lock
+	User      string    `json:"user"`
+	LocalHost string    `json:"local_host"`
+	PID       int       `json:"pid"`
+	Env       string    `json:"env,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+func (o LockOwner) String() string {
+	if o.User == "" {
+		return "an unknown deployment"
+	}
+	s := fmt.Sprintf("%s@%s (pid %d) since %s", o.User, o.LocalHost, o.PID, o.Since.Local().Format(time.DateTime))
+	if o.Env != "" {
+		s += ", deploying " + o.Env
+	}
+	return s
+}
+
+// LockedError is returned by AcquireLock when another deployment holds the lock
+type LockedError struct {
+	Host  string
+	Path  string
+	Owner LockOwner
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s (%s); rerun with --force-unlock if that deployment is no longer running", e.Host, e.Owner, e.Path)
+}
+
+// Lock is a deployment lock held on a VM
+type Lock struct {
+	remote RemoteExecutor
+	path   string
+	owner  LockOwner
+}
+
+// AcquireLock takes the deployment lock at path on the VM, so that two deployments
+// cannot run against it at the same time
+// With force, a lock left behind by another deployment is removed first and its owner
+// returned as broken
+// Returns a *LockedError when the lock is held by another deployment
+func AcquireLock(ctx context.Context, remote RemoteExecutor, host, path, env string, force bool) (lock *Lock, broken *LockOwner, err error) {
+	if force {
+		output, result, err := RunRemote(ctx, remote, remoteForceUnlock, map[string]string{"GCDEPLOY_LOCK": path})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to remove the deployment lock on %s: %w", host, err)
+		}
+		if !result.Success() {
+			return nil, nil, fmt.Errorf("failed to remove the deployment lock %s on %s: %s", path, host, result)
+		}
+		if len(bytes.TrimSpace(output)) > 0 {
+			owner := parseLockOwner(output)
+			broken = &owner
+		}
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	owner := LockOwner{
+		ID:        hex.EncodeToString(id),
+		User:      LocalUser(),
+		LocalHost: LocalHost(),
+		PID:       os.Getpid(),
+		Env:       env,
+		Since:     time.Now().UTC(),
+	}
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return nil, broken, err
+	}
+
+	output, result, err := RunRemote(ctx, remote, remoteAcquire, map[string]string{
+		"GCDEPLOY_LOCK":       path,
+		"GCDEPLOY_LOCK_OWNER": string(data),
+	})
+	if err != nil {
+		return nil, broken, fmt.Errorf("failed to acquire the deployment lock on %s: %w", host, err)
+	}
+	if result.ExitCode == lockHeldExit {
+		return nil, broken, &LockedError{Host: host, Path: path, Owner: parseLockOwner(output)}
+	}
+	if !result.Success() {
+		return nil, broken, fmt.Errorf("failed to acquire the deployment lock %s on %s: %s: %s", path, host, result, bytes.TrimSpace(output))
+	}
+	return &Lock{remote: remote, path: path, owner: owner}, broken, nil
+}
+
+// Release removes the lock, unless another deployment has taken it over with --force-unlock
+// A nil *Lock is already released
+func (l *Lock) Release(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	_, result, err := RunRemote(ctx, l.remote, remoteRelease, map[string]string{
+		"GCDEPLOY_LOCK":    l.path,
+		"GCDEPLOY_LOCK_ID": l.owner.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release the deployment lock %s: %w", l.path, err)
+	}
+	if !result.Success() {
+		return fmt.Errorf("failed to release the deployment lock %s: %s", l.path, result)
+	}
+	return nil
+}
+
+// parseLockOwner reads the owner file of a lock; an unreadable one yields an empty owner
+func parseLockOwner(data []byte) LockOwner {
+	var owner LockOwner
+	json.Unmarshal(bytes.TrimSpace(data), &owner)
+	return owner
+}
+
+// LocalUser returns the name of the local user, to record who deployed
+func LocalUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
+
+// LocalHost returns the name of the local machine, to record where a deployment ran
+func LocalHost() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,130 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "locks", "myapp.lock")
+
+	lock, broken, err := AcquireLock(ctx, localExecutor{}, "web-1", path, "production", false)
+	if err != nil {
+		t.Fatalf("AcquireLock() error = %v", err)
+	}
+	if broken != nil {
+		t.Errorf("AcquireLock() broke %v, want no lock to break", broken)
+	}
+	data, err := os.ReadFile(filepath.Join(path, "owner"))
+	if err != nil {
+		t.Fatalf("lock owner file: %v", err)
+	}
+	owner := parseLockOwner(data)
+	if owner.ID != lock.owner.ID || owner.User != LocalUser() || owner.PID != os.Getpid() || owner.Env != "production" {
+		t.Errorf("lock owner = %+v, want %+v", owner, lock.owner)
+	}
+
+	_, _, err = AcquireLock(ctx, localExecutor{}, "web-1", path, "staging", false)
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("second AcquireLock() error = %v, want a LockedError", err)
+	}
+	if locked.Owner.ID != owner.ID || locked.Path != path {
+		t.Errorf("LockedError = %+v, want the first deployment as owner", locked)
+	}
+	if !strings.Contains(err.Error(), "--force-unlock") {
+		t.Errorf("LockedError = %q, want a hint about --force-unlock", err)
+	}
+
+	// --force-unlock breaks the lock and takes it over
+	forced, broken, err := AcquireLock(ctx, localExecutor{}, "web-1", path, "staging", true)
+	if err != nil {
+		t.Fatalf("AcquireLock() with force error = %v", err)
+	}
+	if broken == nil || broken.ID != owner.ID {
+		t.Errorf("AcquireLock() with force broke %v, want %+v", broken, owner)
+	}
+
+	// The first deployment must not release the lock it lost
+	if err := lock.Release(ctx); err != nil {
+		t.Fatalf("Release() of a broken lock error = %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Release() of a broken lock removed the new lock: %v", err)
+	}
+	if err := forced.Release(ctx); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock directory after Release() = %v, want it removed", err)
+	}
+
+	var released *Lock
+	if err := released.Release(ctx); err != nil {
+		t.Errorf("Release() of a nil lock error = %v", err)
+	}
+}
+
+func TestAcquireLockErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, dir string) string // Returns the lock path
+		wantErr string
+	}{
+		{
+			name: "lock path is a file",
+			setup: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "myapp.lock")
+				if err := os.WriteFile(path, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantErr: "File exists",
+		},
+		{
+			name: "parent is a file",
+			setup: func(t *testing.T, dir string) string {
+				parent := filepath.Join(dir, "locks")
+				if err := os.WriteFile(parent, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(parent, "myapp.lock")
+			},
+			wantErr: "failed to acquire the deployment lock",
+		},
+		{
+			name: "parent is not writable",
+			setup: func(t *testing.T, dir string) string {
+				if os.Geteuid() == 0 {
+					t.Skip("root can write to any directory")
+				}
+				parent := filepath.Join(dir, "locks")
+				if err := os.Mkdir(parent, 0o555); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(parent, "myapp.lock")
+			},
+			wantErr: "Permission denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.setup(t, t.TempDir())
+			_, _, err := AcquireLock(context.Background(), localExecutor{}, "web-1", path, "", false)
+			var locked *LockedError
+			if errors.As(err, &locked) {
+				t.Fatalf("AcquireLock() error = %v, want a failure rather than a held lock", err)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("AcquireLock() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// Plan is what a deployment would do, with instances looked up and variables expanded
+type Plan struct {
+	Env         string     `json:"env,omitempty"`
+	Production  bool       `json:"production,omitempty"`
+	Concurrency int        `json:"concurrency"` // Hosts deployed at once
+	Parallelism int        `json:"parallelism"` // Independent steps run at once
+	Hosts       []HostPlan `json:"hosts"`
+}
+
+// HostPlan is the plan for one instance
+type HostPlan struct {
+	Instance   deploy.Instance `json:"instance"`
+	ExternalIP string          `json:"external_ip,omitempty"`
+	RemoteUser string          `json:"remote_user,omitempty"`
+	Steps      []PlannedStep   `json:"steps"`
+
+	HealthChecks []PlannedCheck `json:"health_checks,omitempty"`
+	OnFailure    []PlannedStep  `json:"on_failure,omitempty"` // Run when a health check fails
+	Hooks        *PlannedHooks  `json:"hooks,omitempty"`
+}
+
+// PlannedHooks are the hooks as they would run on a host (see config.Hooks)
+type PlannedHooks struct {
+	PreDeploy  []PlannedStep `json:"pre_deploy,omitempty"`
+	PostDeploy []PlannedStep `json:"post_deploy,omitempty"`
+	OnFailure  []PlannedStep `json:"on_failure,omitempty"`
+}
+
+// PlannedCheck is one health check as it would run for a host
+type PlannedCheck struct {
+	Num      int    `json:"num"`
+	Name     string `json:"name,omitempty"`
+	Kind     string `json:"kind"`  // "http", "tcp" or "command"
+	Check    string `json:"check"` // What the check tests, e.g. "GET http://10.0.0.2/health"
+	Retries  int    `json:"retries,omitempty"`
+	Interval string `json:"interval"`
+}
+
+// PlannedStep is one step as it would run on a host
+type PlannedStep struct {
+	Num             int               `json:"num"`
+	Name            string            `json:"name,omitempty"`
+	Target          string            `json:"target"`
+	Command         string            `json:"command,omitempty"`
+	Src             string            `json:"src,omitempty"`
+	Dest            string            `json:"dest,omitempty"`
+	Workdir         string            `json:"workdir,omitempty"`
+	Env             map[string]string `json:"env,omitempty"`
+	Timeout         string            `json:"timeout,omitempty"`
+	Retries         int               `json:"retries,omitempty"`
+	ContinueOnError bool              `json:"continue_on_error,omitempty"`
+	DependsOn       []string          `json:"depends_on,omitempty"`
+	Skipped         bool              `json:"skipped,omitempty"`
+}
+
+// NewPlan looks up every instance and expands the steps with its variables
+// skips holds the steps not to run on each instance, as returned by Select
+func NewPlan(ctx context.Context, cfg *config.Config, steps []config.DeploymentStep, instances []deploy.Instance, resolver deploy.InstanceResolver, skips map[string]map[int]bool) (*Plan, error) {
+	plan := &Plan{
+		Env:         cfg.EnvName,
+		Production:  cfg.Production,
+		Concurrency: min(max(cfg.Concurrency, 1), len(instances)),
+		Parallelism: max(cfg.Parallelism, 1),
+	}
+
+	for _, instance := range instances {
+		details, err := resolver.Resolve(ctx, instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %w", instance.Name, err)
+		}
+
+		host := HostPlan{
+			Instance:   instance,
+			ExternalIP: details.ExternalIP,
+			RemoteUser: details.Username,
+		}
+		vars := config.HostVars(cfg.Vars, instance, details)
+		for i, step := range steps {
+			planned, err := planStep(i+1, step, vars)
+			if err != nil {
+				return nil, fmt.Errorf("step %d on %s: %w", i+1, instance.Name, err)
+			}
+			planned.Skipped = skips[instance.Name][i]
+			host.Steps = append(host.Steps, planned)
+		}
+
+		for i, check := range cfg.HealthChecks {
+			check, err := ExpandCheck(check, vars)
+			if err != nil {
+				return nil, fmt.Errorf("health check %d on %s: %w", i+1, instance.Name, err)
+			}
+			host.HealthChecks = append(host.HealthChecks, PlannedCheck{
+				Num:      i + 1,
+				Name:     check.Name,
+				Kind:     check.Kind(),
+				Check:    check.Description(),
+				Retries:  check.Retries,
+				Interval: check.IntervalDuration().String(),
+			})
+		}
+		if host.OnFailure, err = planSteps(cfg.OnFailure, vars); err != nil {
+			return nil, fmt.Errorf("on_failure %w on %s", err, instance.Name)
+		}
+		if hooks := cfg.Hooks; len(hooks.PreDeploy)+len(hooks.PostDeploy)+len(hooks.OnFailure) > 0 {
+			host.Hooks = &PlannedHooks{}
+			if host.Hooks.PreDeploy, err = planSteps(hooks.PreDeploy, vars); err != nil {
+				return nil, fmt.Errorf("hooks.pre_deploy %w on %s", err, instance.Name)
+			}
+			if host.Hooks.PostDeploy, err = planSteps(hooks.PostDeploy, vars); err != nil {
+				return nil, fmt.Errorf("hooks.post_deploy %w on %s", err, instance.Name)
+			}
+			if host.Hooks.OnFailure, err = planSteps(hooks.OnFailure, vars); err != nil {
+				return nil, fmt.Errorf("hooks.on_failure %w on %s", err, instance.Name)
+			}
+		}
+		plan.Hosts = append(plan.Hosts, host)
+	}
+	return plan, nil
+}
+
+// planSteps expands a list of steps run in order with the variables of a host
+func planSteps(steps []config.DeploymentStep, vars map[string]string) ([]PlannedStep, error) {
+	var planned []PlannedStep
+	for i, step := range steps {
+		p, err := planStep(i+1, step, vars)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		planned = append(planned, p)
+	}
+	return planned, nil
+}
+
+// planStep expands a step with the variables of a host
+func planStep(num int, step config.DeploymentStep, vars map[string]string) (PlannedStep, error) {
+	step, err := ExpandStep(step, vars)
+	if err != nil {
+		return PlannedStep{}, err
+	}
+	return PlannedStep{
+		Num:             num,
+		Name:            step.Name,
+		Target:          step.Target,
+		Command:         step.Command,
+		Src:             step.Src,
+		Dest:            step.Dest,
+		Workdir:         step.Workdir,
+		Env:             step.Env,
+		Timeout:         step.Timeout,
+		Retries:         step.Retries,
+		ContinueOnError: step.ContinueOnError,
+		DependsOn:       step.DependsOn,
+	}, nil
+}
+
+// WriteJSON writes the plan as indented JSON
+func (p *Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// WriteText writes the plan in a human readable form, one block per instance
+func (p *Plan) WriteText(w io.Writer) error {
+	_, err := io.WriteString(w, strings.Join(p.Lines(), "\n")+"\n")
+	return err
+}
+
+// Lines returns the text form of the plan, line by line
+func (p *Plan) Lines() []string {
+	var lines []string
+	env := "default"
+	if p.Env != "" {
+		env = p.Env
+	}
+	if p.Production {
+		env += " (production)"
+	}
+	lines = append(lines, fmt.Sprintf("Deployment plan for environment %s", env))
+	if len(p.Hosts) > 1 {
+		lines = append(lines, fmt.Sprintf("%d instances, %d at a time", len(p.Hosts), p.Concurrency))
+	}
+
+	for _, host := range p.Hosts {
+		lines = append(lines, "")
+		lines = append(lines, fmt.Sprintf("%s (%s/%s) %s@%s", host.Instance.Name, host.Instance.ProjectId, host.Instance.Zone, host.RemoteUser, host.ExternalIP))
+		hooks := host.Hooks
+		if hooks == nil {
+			hooks = &PlannedHooks{}
+		}
+		lines = appendSteps(lines, "Before deploying (hooks.pre_deploy):", hooks.PreDeploy)
+		for _, step := range host.Steps {
+			lines = append(lines, step.lines(len(host.Steps))...)
+		}
+		for _, check := range host.HealthChecks {
+			heading := fmt.Sprintf("  [health %d/%d] %s", check.Num, len(host.HealthChecks), check.Check)
+			if check.Name != "" {
+				heading += " (" + check.Name + ")"
+			}
+			if check.Retries > 0 {
+				heading += fmt.Sprintf(", %d retries every %s", check.Retries, check.Interval)
+			}
+			lines = append(lines, heading)
+		}
+		lines = appendSteps(lines, "If a health check fails (on_failure):", host.OnFailure)
+		lines = appendSteps(lines, "If the deployment fails (hooks.on_failure):", hooks.OnFailure)
+		lines = appendSteps(lines, "After deploying (hooks.post_deploy):", hooks.PostDeploy)
+	}
+	return lines
+}
+
+// appendSteps appends a heading and the text form of steps run outside the deployment script
+func appendSteps(lines []string, heading string, steps []PlannedStep) []string {
+	if len(steps) == 0 {
+		return lines
+	}
+	lines = append(lines, "  "+heading)
+	for _, step := range steps {
+		lines = append(lines, step.lines(len(steps))...)
+	}
+	return lines
+}
+
+// lines returns the text form of the step: a heading followed by its settings
+func (s PlannedStep) lines(total int) []string {
+	heading := fmt.Sprintf("  [%d/%d] %s", s.Num, total, s.Target)
+	if s.Name != "" {
+		heading += " " + s.Name
+	}
+	if s.Skipped {
+		heading += " (skipped)"
+	}
+	lines := []string{heading}
+
+	detail := func(label, value string) {
+		if value != "" {
+			lines = append(lines, fmt.Sprintf("        %-10s %s", label+":", value))
+		}
+	}
+	if s.Command != "" {
+		detail("command", s.Command)
+	} else {
+		detail("copy", s.Src+" → "+s.Dest)
+	}
+	detail("workdir", s.Workdir)
+	for _, name := range sortedNames(s.Env) {
+		detail("env", name+"="+s.Env[name])
+	}
+	detail("timeout", s.Timeout)
+	if s.Retries > 0 {
+		detail("retries", fmt.Sprint(s.Retries))
+	}
+	if s.ContinueOnError {
+		detail("on error", "continue")
+	}
+	detail("after", strings.Join(s.DependsOn, ", "))
+	return lines
+}
+
+// sortedNames returns the keys of m in sorted order
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
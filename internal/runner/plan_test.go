@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// planResolver returns a FakeResolver knowing web-1 and web-2 of fleetInstances
+func planResolver() *deploy.FakeResolver {
+	resolver := deploy.NewFakeResolver()
+	for i, instance := range fleetInstances(2) {
+		ip := []string{"203.0.113.1", "203.0.113.2"}[i]
+		resolver.Add(instance, deploy.InstanceDetails{ExternalIP: ip, InternalIP: "10.0.0.1", Username: "deploy"})
+	}
+	return resolver
+}
+
+func TestNewPlan(t *testing.T) {
+	cfg := &config.Config{
+		EnvName:     "production",
+		Production:  true,
+		Concurrency: 5,
+		Vars:        map[string]string{"app": "myapp"},
+	}
+	steps := []config.DeploymentStep{
+		{Name: "build", Command: "make ${{ app }}", Target: "local", Env: map[string]string{"GOOS": "linux", "CGO_ENABLED": "0"}},
+		{Src: "bin/${{ app }}", Dest: "/opt/${{ app }}", Target: "remote"},
+		{Command: "systemctl restart ${{ app }} # ${{ instance }}", Target: "remote", Timeout: "1m", Retries: 2, ContinueOnError: true, DependsOn: []string{"build"}},
+	}
+	skips := map[string]map[int]bool{"web-2": {0: true}}
+
+	plan, err := NewPlan(context.Background(), cfg, steps, fleetInstances(2), planResolver(), skips)
+	if err != nil {
+		t.Fatalf("NewPlan() error = %v", err)
+	}
+	if plan.Concurrency != 2 || plan.Parallelism != 1 {
+		t.Errorf("NewPlan() concurrency %d, parallelism %d, want 2 and 1", plan.Concurrency, plan.Parallelism)
+	}
+	if len(plan.Hosts) != 2 {
+		t.Fatalf("NewPlan() = %d hosts, want 2", len(plan.Hosts))
+	}
+	web1, web2 := plan.Hosts[0], plan.Hosts[1]
+	if web2.ExternalIP != "203.0.113.2" || web2.RemoteUser != "deploy" {
+		t.Errorf("web-2 plan = %s@%s, want deploy@203.0.113.2", web2.RemoteUser, web2.ExternalIP)
+	}
+	if got := web1.Steps[1]; got.Src != "bin/myapp" || got.Dest != "/opt/myapp" {
+		t.Errorf("copy step = %s → %s, want the variables expanded", got.Src, got.Dest)
+	}
+	if got := web2.Steps[2].Command; got != "systemctl restart myapp # web-2" {
+		t.Errorf("web-2 step 3 = %q, want the host variables expanded", got)
+	}
+	if web1.Steps[0].Skipped || !web2.Steps[0].Skipped || web2.Steps[1].Skipped {
+		t.Errorf("skipped steps = %v on web-1 and %v on web-2, want only the build on web-2",
+			skippedNums(web1.Steps), skippedNums(web2.Steps))
+	}
+
+	var text strings.Builder
+	if err := plan.WriteText(&text); err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+	want := []string{
+		"Deployment plan for environment production (production)",
+		"2 instances, 2 at a time",
+		"",
+		"web-1 (proj/us-central1-a) deploy@203.0.113.1",
+		"  [1/3] local build",
+		"        command:   make myapp",
+		"        env:       CGO_ENABLED=0",
+		"        env:       GOOS=linux",
+		"  [2/3] remote",
+		"        copy:      bin/myapp → /opt/myapp",
+		"  [3/3] remote",
+		"        command:   systemctl restart myapp # web-1",
+		"        timeout:   1m",
+		"        retries:   2",
+		"        on error:  continue",
+		"        after:     build",
+		"",
+		"web-2 (proj/us-central1-a) deploy@203.0.113.2",
+		"  [1/3] local build (skipped)",
+	}
+	lines := strings.Split(text.String(), "\n")
+	if len(lines) < len(want) || !reflect.DeepEqual(lines[:len(want)], want) {
+		t.Errorf("WriteText() =\n%s\nwant it to start with\n%s", text.String(), strings.Join(want, "\n"))
+	}
+
+	var data strings.Builder
+	if err := plan.WriteJSON(&data); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+	var decoded Plan
+	if err := json.Unmarshal([]byte(data.String()), &decoded); err != nil {
+		t.Fatalf("WriteJSON() wrote invalid JSON: %v\n%s", err, data.String())
+	}
+	if !reflect.DeepEqual(&decoded, plan) {
+		t.Errorf("WriteJSON() round trip = %+v, want %+v", decoded, *plan)
+	}
+}
+
+func TestNewPlanErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		steps     []config.DeploymentStep
+		instances []deploy.Instance
+		wantErr   string
+	}{
+		{
+			name:      "unknown instance",
+			steps:     localSteps("true"),
+			instances: []deploy.Instance{{Name: "db-1", ProjectId: "proj", Zone: "us-central1-a"}},
+			wantErr:   "failed to look up db-1",
+		},
+		{
+			name:      "undefined variable",
+			steps:     localSteps("true", "echo ${{ release }}"),
+			instances: fleetInstances(1),
+			wantErr:   "step 2 on web-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPlan(context.Background(), &config.Config{}, tt.steps, tt.instances, planResolver(), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("NewPlan() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// skippedNums returns the numbers of the skipped steps
+func skippedNums(steps []PlannedStep) []int {
+	var nums []int
+	for _, step := range steps {
+		if step.Skipped {
+			nums = append(nums, step.Num)
+		}
+	}
+	return nums
+}
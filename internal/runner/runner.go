@@ -0,0 +1,677 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// RemoteExecutor runs a single command on the VM and waits for it to exit
+// Cancelling ctx must kill the command
+// Both deploy.Session and deploy.TerminalSession satisfy this interface
+type RemoteExecutor interface {
+	ExecuteStep(ctx context.Context, command string, opts deploy.CommandOptions, outputCh chan<- []byte) (deploy.CommandResult, error)
+}
+
+// ErrTimeout is wrapped by the error of a step attempt that ran past its timeout
+var ErrTimeout = errors.New("step timed out")
+
+// FileTransferer copies files to and from the VM
+// Both deploy.Session and deploy.TerminalSession satisfy this interface
+type FileTransferer interface {
+	Upload(ctx context.Context, src, dest string, opts deploy.TransferOptions, progress func(deploy.TransferProgress)) (deploy.TransferProgress, error)
+	Download(ctx context.Context, src, dest string, opts deploy.TransferOptions, progress func(deploy.TransferProgress)) (deploy.TransferProgress, error)
+}
+
+// RunRemote runs a helper command on the VM and returns its combined output
+// env is exported to the command, so values need no quoting
+func RunRemote(ctx context.Context, remote RemoteExecutor, command string, env map[string]string) ([]byte, deploy.CommandResult, error) {
+	outputCh := make(chan []byte)
+	done := make(chan struct{})
+	var output bytes.Buffer
+	go func() {
+		defer close(done)
+		for data := range outputCh {
+			output.Write(data)
+		}
+	}()
+	result, err := remote.ExecuteStep(ctx, command, deploy.CommandOptions{Env: env}, outputCh)
+	close(outputCh)
+	<-done
+	return output.Bytes(), result, err
+}
+
+// EventType identifies what happened during a deployment
+type EventType int
+
+const (
+	StepStarted EventType = iota
+	StepFinished
+	DeploymentCompleted
+	DeploymentFailed
+	StepProgress // Transfer progress of an upload or download step
+	StepRetrying // An attempt failed and the step will be run again after Delay
+	StepSkipped  // The step was not selected to run (see Runner.Skip)
+	StepOutput   // A chunk of command output, only reported with Runner.OutputEvents
+
+	// Health checks, run once every step has succeeded (see Runner.HealthChecks)
+	// StepNum and Total number the checks
+	HealthCheckStarted
+	HealthCheckRetrying // An attempt failed and the check will be run again after Delay
+	HealthCheckFinished // Error is set when the check failed
+)
+
+// Phases of a deployment that run steps outside the deployment script (see Event.Phase)
+// They are named after their key in .gcd.toml
+const (
+	PhasePreDeploy    = "hooks.pre_deploy"  // Runner.Hooks.PreDeploy, before the first step
+	PhaseOnFailure    = "on_failure"        // Runner.OnFailure steps, after a failed health check
+	PhaseFailureHooks = "hooks.on_failure"  // Runner.Hooks.OnFailure, after a failed deployment
+	PhasePostDeploy   = "hooks.post_deploy" // Runner.Hooks.PostDeploy, after every deployment
+)
+
+// Event is reported to Runner.OnEvent as the deployment progresses
+type Event struct {
+	Type    EventType
+	StepNum int // 1-based, 0 for deployment-level events
+	Total   int
+	Step    config.DeploymentStep
+	Result  deploy.CommandResult
+	Error   error
+
+	Progress deploy.TransferProgress // Set for StepProgress and for finished transfer steps
+
+	Attempt int           // Attempts made so far, set for StepRetrying and StepFinished
+	Delay   time.Duration // Wait before the next attempt, set for StepRetrying
+
+	Alongside []string // Labels of the steps still running when a step starts (see StepLabel)
+
+	Output []byte // Set for StepOutput
+
+	// Phase is set for the events of steps outside the deployment script, e.g. PhaseOnFailure
+	// StepNum and Total then number the steps of the phase
+	Phase string
+
+	Check config.HealthCheck // Set for the HealthCheck* events
+}
+
+// IsHook reports whether the event comes from a hook rather than a deployment step
+func (e Event) IsHook() bool {
+	return strings.HasPrefix(e.Phase, "hooks.")
+}
+
+// Kind names what the event is about in messages: "hook" or "step"
+func (e Event) Kind() string {
+	if e.IsHook() {
+		return "hook"
+	}
+	return "step"
+}
+
+// Position locates a step for messages, e.g. "3/5", or "on_failure 1/2" for a phase step
+func (e Event) Position() string {
+	if e.Phase != "" {
+		return fmt.Sprintf("%s %d/%d", e.Phase, e.StepNum, e.Total)
+	}
+	return fmt.Sprintf("%d/%d", e.StepNum, e.Total)
+}
+
+// Failed reports whether the step or attempt in a StepFinished or StepRetrying event failed
+func (e Event) Failed() bool {
+	return e.Error != nil || !e.Result.Success()
+}
+
+// Reason describes why the step or attempt failed, e.g. "exit code 1 after 2.5s"
+func (e Event) Reason() string {
+	return FailureReason(e.Result, e.Error)
+}
+
+// Concurrently describes the steps running alongside a starting step, e.g.
+// " (alongside frontend, step 3)", or "" when it runs on its own
+func (e Event) Concurrently() string {
+	if len(e.Alongside) == 0 {
+		return ""
+	}
+	return " (alongside " + strings.Join(e.Alongside, ", ") + ")"
+}
+
+// FailureReason describes a failed step from its result and run error
+func FailureReason(result deploy.CommandResult, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return result.String()
+}
+
+// StepError is returned by Run when a step fails
+type StepError struct {
+	StepNum int
+	Total   int
+	Step    config.DeploymentStep
+	Result  deploy.CommandResult
+	Err     error // Set when the step could not be run at all
+}
+
+func (e *StepError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("step %d/%d (%s) failed: %v", e.StepNum, e.Total, e.Step.Target, e.Err)
+	}
+	return fmt.Sprintf("step %d/%d (%s) failed: %s", e.StepNum, e.Total, e.Step.Target, e.Result)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// HealthCheckError is returned by Run when a health check fails
+type HealthCheckError struct {
+	CheckNum int
+	Total    int
+	Check    config.HealthCheck
+	Err      error
+
+	// OnFailure is set when one of the OnFailure steps failed as well
+	OnFailure *StepError
+}
+
+func (e *HealthCheckError) Error() string {
+	msg := fmt.Sprintf("health check %d/%d (%s) failed: %v", e.CheckNum, e.Total, e.Check.Label(), e.Err)
+	if e.OnFailure != nil {
+		msg += "; on_failure " + e.OnFailure.Error()
+	}
+	return msg
+}
+
+func (e *HealthCheckError) Unwrap() error {
+	return e.Err
+}
+
+// HookError is returned by Run when a hook fails (see config.Hooks)
+type HookError struct {
+	Phase string // PhasePreDeploy or PhasePostDeploy
+	Err   *StepError
+}
+
+func (e *HookError) Error() string {
+	if e.Err.Err != nil {
+		return fmt.Sprintf("%s hook %d/%d (%s) failed: %v", e.Phase, e.Err.StepNum, e.Err.Total, e.Err.Step.Target, e.Err.Err)
+	}
+	return fmt.Sprintf("%s hook %d/%d (%s) failed: %s", e.Phase, e.Err.StepNum, e.Err.Total, e.Err.Step.Target, e.Err.Result)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// Runner executes deployment steps, stopping at the first failure
+// Steps run in order unless some of them declare depends_on; then each step starts as
+// soon as the steps it depends on have finished, with at most Parallelism at a time
+// Steps are retried and timed out as configured, and steps with continue_on_error
+// do not stop the deployment when they fail
+type Runner struct {
+	Steps  []config.DeploymentStep
+	Remote RemoteExecutor
+
+	// Parallelism is the number of independent steps run at once
+	// Values <= 0 run one step at a time
+	Parallelism int
+
+	// Skip holds the indexes of steps that are not run (see Select)
+	// Skipped steps count as finished for the steps that depend on them
+	Skip map[int]bool
+
+	// Vars are substituted for ${{ name }} in step commands (see config.HostVars)
+	// Commands are run verbatim when nil
+	Vars map[string]string
+
+	// Output channels for command output; they are never closed by the runner
+	LocalOutput  chan<- []byte
+	RemoteOutput chan<- []byte
+
+	// StepOutput returns the channel for one step's output, given its StepStarted event (optional)
+	// When set it is used instead of LocalOutput and RemoteOutput, so that the
+	// output of steps running at the same time can be told apart
+	// All output has been sent by the time the step's StepFinished event is emitted
+	StepOutput func(started Event) chan<- []byte
+
+	// OutputEvents reports every chunk of command output as a StepOutput event
+	// before sending it on to the output channel
+	OutputEvents bool
+
+	// HealthChecks run one after the other once every step has succeeded
+	// The deployment fails with a *HealthCheckError when one of them fails
+	HealthChecks []config.HealthCheck
+
+	// OnFailure steps run one after the other when a health check fails, e.g. to roll back
+	// Their events carry PhaseOnFailure
+	OnFailure []config.DeploymentStep
+
+	// Hooks run before and after the deployment; their events carry the Phase* of the hook
+	Hooks config.Hooks
+
+	// ConfigDir is the directory holding .gcd.toml, where transfer steps read .gcdignore
+	// The working directory is used when empty
+	ConfigDir string
+
+	// OnEvent is called synchronously for every event (optional)
+	// Calls are serialized, but come from the steps' goroutines
+	OnEvent func(Event)
+
+	mu sync.Mutex
+}
+
+// stepDone reports a finished step to the scheduler in Run
+type stepDone struct {
+	index int
+	err   *StepError // Set when the step failed and the deployment must stop
+}
+
+// Run runs the pre_deploy hooks, every step and the health checks, and then the
+// on_failure hooks after a failure and the post_deploy hooks in any case
+// Returns the first failure: a *HookError, a *StepError or a *HealthCheckError
+// Hooks that fail after that are only reported as events
+func (r *Runner) Run(ctx context.Context) error {
+	var err error
+	if hookErr := r.runPhase(ctx, PhasePreDeploy, r.Hooks.PreDeploy, false); hookErr != nil {
+		err = &HookError{Phase: PhasePreDeploy, Err: hookErr}
+	} else if stepErr := r.runSteps(ctx); stepErr != nil {
+		err = stepErr
+	} else if healthErr := r.checkHealth(ctx); healthErr != nil {
+		if ctx.Err() == nil {
+			healthErr.OnFailure = r.runPhase(ctx, PhaseOnFailure, r.OnFailure, false)
+		}
+		err = healthErr
+	}
+
+	// The hooks after the deployment also run after it was cancelled, e.g. to send a notification
+	hookCtx, cancel := afterDeployContext(ctx)
+	defer cancel()
+	if err != nil {
+		r.runPhase(hookCtx, PhaseFailureHooks, r.Hooks.OnFailure, true)
+	}
+	if hookErr := r.runPhase(hookCtx, PhasePostDeploy, r.Hooks.PostDeploy, true); hookErr != nil && err == nil {
+		err = &HookError{Phase: PhasePostDeploy, Err: hookErr}
+	}
+
+	total := len(r.Steps)
+	if err != nil {
+		r.emit(Event{Type: DeploymentFailed, Total: total, Error: err})
+		return err
+	}
+	r.emit(Event{Type: DeploymentCompleted, Total: total})
+	return nil
+}
+
+// cancelledHookTimeout bounds the on_failure and post_deploy hooks of a cancelled deployment,
+// since the signal that cancelled it no longer stops them
+const cancelledHookTimeout = 30 * time.Second
+
+// afterDeployContext returns the context for the hooks that run after the deployment
+// Once ctx is cancelled they get a context of their own that expires after cancelledHookTimeout
+func afterDeployContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(context.WithoutCancel(ctx), cancelledHookTimeout)
+}
+
+// runSteps executes the deployment script and returns a *StepError for the first step that fails
+// After a failure no new steps are started, but steps already running are waited for
+func (r *Runner) runSteps(ctx context.Context) *StepError {
+	total := len(r.Steps)
+	deps := Dependencies(r.Steps)
+	limit := max(r.Parallelism, 1)
+
+	const (
+		pending = iota
+		running
+		finished
+	)
+	state := make([]int, total)
+	done := make(chan stepDone)
+	var (
+		active  int
+		failure *StepError
+	)
+
+	ready := func(i int) bool {
+		for _, dep := range deps[i] {
+			if state[dep] != finished {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		for i := 0; i < total; i++ {
+			step := r.Steps[i]
+			if failure != nil || active >= limit {
+				break
+			}
+			if state[i] != pending || !ready(i) {
+				continue
+			}
+			stepNum := i + 1
+			if r.Skip[i] {
+				state[i] = finished
+				r.emit(Event{Type: StepSkipped, StepNum: stepNum, Total: total, Step: step})
+				// Skipping may have made an earlier step ready, so scan again
+				i = -1
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				failure = &StepError{StepNum: stepNum, Total: total, Step: step, Err: err}
+				break
+			}
+
+			step, err := r.expand(step)
+			if err != nil {
+				failure = &StepError{StepNum: stepNum, Total: total, Step: step, Result: deploy.CommandResult{ExitCode: -1}, Err: err}
+				break
+			}
+
+			var alongside []string
+			for j := range r.Steps {
+				if state[j] == running {
+					alongside = append(alongside, StepLabel(j+1, r.Steps[j]))
+				}
+			}
+			state[i] = running
+			active++
+			started := Event{Type: StepStarted, StepNum: stepNum, Total: total, Step: step, Alongside: alongside}
+			r.emit(started)
+
+			output := r.outputFor(started)
+			go func() {
+				done <- stepDone{index: i, err: r.execute(ctx, "", stepNum, total, step, output)}
+			}()
+		}
+
+		if active == 0 {
+			break
+		}
+		d := <-done
+		active--
+		state[d.index] = finished
+		if d.err != nil && failure == nil {
+			failure = d.err
+		}
+	}
+
+	if failure == nil {
+		// Only reachable with a dependency cycle, which config.Load rejects
+		for i, step := range r.Steps {
+			if state[i] == pending {
+				failure = &StepError{StepNum: i + 1, Total: total, Step: step, Result: deploy.CommandResult{ExitCode: -1}, Err: fmt.Errorf("dependencies never finished")}
+				break
+			}
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+	return nil
+}
+
+// runPhase runs steps outside the deployment script one after the other and returns
+// the *StepError of the first step that failed
+// The remaining steps are skipped after a failure, or still run with keepGoing
+func (r *Runner) runPhase(ctx context.Context, phase string, steps []config.DeploymentStep, keepGoing bool) *StepError {
+	total := len(steps)
+	var failure *StepError
+	for i, step := range steps {
+		if failure != nil && !keepGoing {
+			break
+		}
+		stepNum := i + 1
+		step, err := r.expand(step)
+		if err != nil {
+			if failure == nil {
+				failure = &StepError{StepNum: stepNum, Total: total, Step: step, Result: deploy.CommandResult{ExitCode: -1}, Err: err}
+			}
+			continue
+		}
+		started := Event{Type: StepStarted, StepNum: stepNum, Total: total, Step: step, Phase: phase}
+		r.emit(started)
+		if err := r.execute(ctx, phase, stepNum, total, step, r.outputFor(started)); err != nil && failure == nil {
+			failure = err
+		}
+	}
+	return failure
+}
+
+// execute runs a started step with its retries and reports it finished
+// Returns a *StepError when the failure of the step stops the deployment
+func (r *Runner) execute(ctx context.Context, phase string, stepNum, total int, step config.DeploymentStep, output chan<- []byte) *StepError {
+	var progress deploy.TransferProgress
+	onProgress := func(p deploy.TransferProgress) {
+		progress = p
+		r.emit(Event{Type: StepProgress, StepNum: stepNum, Total: total, Step: step, Progress: p, Phase: phase})
+	}
+
+	output, flush := r.teeOutput(phase, stepNum, total, step, output)
+
+	var (
+		result deploy.CommandResult
+		err    error
+	)
+	attempt := 1
+	for ; ; attempt++ {
+		result, err = r.runAttempt(ctx, step, output, onProgress)
+		if (err == nil && result.Success()) || attempt > step.Retries || ctx.Err() != nil {
+			break
+		}
+		delay := step.RetryBackoff(attempt)
+		r.emit(Event{Type: StepRetrying, StepNum: stepNum, Total: total, Step: step, Result: result, Error: err, Attempt: attempt, Delay: delay, Phase: phase})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	flush()
+	r.emit(Event{Type: StepFinished, StepNum: stepNum, Total: total, Step: step, Result: result, Error: err, Progress: progress, Attempt: attempt, Phase: phase})
+
+	if (err != nil || !result.Success()) && (!step.ContinueOnError || ctx.Err() != nil) {
+		return &StepError{StepNum: stepNum, Total: total, Step: step, Result: result, Err: err}
+	}
+	return nil
+}
+
+// outputFor returns the channel the command output of a started step is sent to
+func (r *Runner) outputFor(started Event) chan<- []byte {
+	switch {
+	case r.StepOutput != nil:
+		return r.StepOutput(started)
+	case started.Step.Target == "local":
+		return r.LocalOutput
+	default:
+		return r.RemoteOutput
+	}
+}
+
+// teeOutput reports the chunks sent to the returned channel as StepOutput events when
+// OutputEvents is set, and passes them on to output
+// flush waits until every chunk has been passed on; the returned channel is unusable afterwards
+func (r *Runner) teeOutput(phase string, stepNum, total int, step config.DeploymentStep, output chan<- []byte) (chan<- []byte, func()) {
+	if !r.OutputEvents {
+		return output, func() {}
+	}
+	tee := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for data := range tee {
+			r.emit(Event{Type: StepOutput, StepNum: stepNum, Total: total, Step: step, Output: data, Phase: phase})
+			output <- data
+		}
+	}()
+	return tee, func() {
+		close(tee)
+		<-done
+	}
+}
+
+// Dependencies returns the indexes of the steps each step waits for
+// Without any depends_on, every step waits for the one before it
+// A barrier step (see config.DeploymentStep.Barrier) waits for every step before it,
+// and every step after it waits for it
+func Dependencies(steps []config.DeploymentStep) [][]int {
+	deps := make([][]int, len(steps))
+	graph := false
+	names := make(map[string]int, len(steps))
+	for i, step := range steps {
+		if len(step.DependsOn) > 0 {
+			graph = true
+		}
+		if step.Name != "" {
+			names[step.Name] = i
+		}
+	}
+
+	barrier := -1
+	for i, step := range steps {
+		if !graph {
+			if i > 0 {
+				deps[i] = []int{i - 1}
+			}
+			continue
+		}
+		if step.Barrier {
+			for j := 0; j < i; j++ {
+				deps[i] = append(deps[i], j)
+			}
+			barrier = i
+			continue
+		}
+		for _, name := range step.DependsOn {
+			if dep, ok := names[name]; ok {
+				deps[i] = append(deps[i], dep)
+			}
+		}
+		if barrier >= 0 {
+			deps[i] = append(deps[i], barrier)
+		}
+	}
+	return deps
+}
+
+// StepLabel names a step in messages: its name, or its number when it has none
+func StepLabel(stepNum int, step config.DeploymentStep) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("step %d", stepNum)
+}
+
+// runAttempt runs a step once, killing it when it exceeds the step timeout
+func (r *Runner) runAttempt(ctx context.Context, step config.DeploymentStep, output chan<- []byte, progress func(deploy.TransferProgress)) (deploy.CommandResult, error) {
+	timeout := step.TimeoutDuration()
+	if timeout == 0 {
+		return r.runStep(ctx, step, output, progress)
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result, err := r.runStep(stepCtx, step, output, progress)
+	if errors.Is(stepCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return result, fmt.Errorf("%w after %s", ErrTimeout, timeout)
+	}
+	return result, err
+}
+
+// runStep dispatches a step to the local shell, the remote executor or a file transfer
+func (r *Runner) runStep(ctx context.Context, step config.DeploymentStep, output chan<- []byte, progress func(deploy.TransferProgress)) (deploy.CommandResult, error) {
+	if step.Target == "local" {
+		return deploy.RunLocalCommand(ctx, step.Command, step.CommandOptions(), output)
+	}
+	if r.Remote == nil {
+		return deploy.CommandResult{ExitCode: -1}, fmt.Errorf("%s step requires SSH connection", step.Target)
+	}
+	if step.IsTransfer() {
+		return r.transferStep(ctx, step, progress)
+	}
+	return r.Remote.ExecuteStep(ctx, step.Command, step.CommandOptions(), output)
+}
+
+// transferStep runs an upload or download step over SFTP
+func (r *Runner) transferStep(ctx context.Context, step config.DeploymentStep, progress func(deploy.TransferProgress)) (deploy.CommandResult, error) {
+	start := time.Now()
+	failed := func(err error) (deploy.CommandResult, error) {
+		return deploy.CommandResult{ExitCode: -1, Duration: time.Since(start)}, err
+	}
+
+	transferer, ok := r.Remote.(FileTransferer)
+	if !ok {
+		return failed(fmt.Errorf("%s step requires an SFTP capable connection", step.Target))
+	}
+
+	ignored, err := deploy.ReadIgnoreFile(filepath.Join(r.ConfigDir, deploy.IgnoreFile))
+	if err != nil {
+		return failed(err)
+	}
+	opts := deploy.TransferOptions{
+		Mode:    step.FileMode(),
+		Exclude: append(ignored, step.Exclude...),
+	}
+
+	if step.Target == "upload" {
+		_, err = transferer.Upload(ctx, step.Src, step.Dest, opts, progress)
+	} else {
+		_, err = transferer.Download(ctx, step.Src, step.Dest, opts, progress)
+	}
+	if err != nil {
+		return failed(err)
+	}
+	return deploy.CommandResult{Duration: time.Since(start)}, nil
+}
+
+// expand substitutes Vars into the step command, paths and environment
+func (r *Runner) expand(step config.DeploymentStep) (config.DeploymentStep, error) {
+	if r.Vars == nil {
+		return step, nil
+	}
+	return ExpandStep(step, r.Vars)
+}
+
+// ExpandStep substitutes vars into the step command, paths and environment
+func ExpandStep(step config.DeploymentStep, vars map[string]string) (config.DeploymentStep, error) {
+	for _, field := range []*string{&step.Command, &step.Src, &step.Dest, &step.Workdir} {
+		expanded, err := config.Expand(*field, vars)
+		if err != nil {
+			return step, err
+		}
+		*field = expanded
+	}
+	if len(step.Env) > 0 {
+		// Copy so expanding for one host does not change the shared steps
+		env := make(map[string]string, len(step.Env))
+		for name, value := range step.Env {
+			expanded, err := config.Expand(value, vars)
+			if err != nil {
+				return step, err
+			}
+			env[name] = expanded
+		}
+		step.Env = env
+	}
+	return step, nil
+}
+
+// emit serializes calls to OnEvent
+func (r *Runner) emit(e Event) {
+	if r.OnEvent == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.OnEvent(e)
+}
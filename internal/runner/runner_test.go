@@ -0,0 +1,509 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// collect gathers the output sent to ch
+type collect struct {
+	ch       chan []byte
+	stop     chan struct{}
+	finished chan struct{}
+	data     []byte
+}
+
+func newCollect() *collect {
+	c := &collect{ch: make(chan []byte), stop: make(chan struct{}), finished: make(chan struct{})}
+	go func() {
+		defer close(c.finished)
+		for {
+			select {
+			case data := <-c.ch:
+				c.data = append(c.data, data...)
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// String stops collecting and returns the output, once every send on ch has returned
+func (c *collect) String() string {
+	close(c.stop)
+	<-c.finished
+	return string(c.data)
+}
+
+func TestRunRemoteStepExitStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		commands   []string
+		wantStep   int // Step that fails, 0 when the deployment succeeds
+		wantResult deploy.CommandResult
+		wantOutput string
+	}{
+		{
+			name:       "every step succeeds",
+			commands:   []string{"echo one", "echo two >&2"},
+			wantOutput: "one\ntwo\n",
+		},
+		{
+			name:       "non-zero exit stops the deployment",
+			commands:   []string{"echo one", "echo failing; exit 7", "echo never"},
+			wantStep:   2,
+			wantResult: deploy.CommandResult{ExitCode: 7},
+			wantOutput: "one\nfailing\n",
+		},
+		{
+			name:       "killed by a signal",
+			commands:   []string{"kill -TERM $$"},
+			wantStep:   1,
+			wantResult: deploy.CommandResult{ExitCode: 128 + 15, Signal: "SIGTERM"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var steps []config.DeploymentStep
+			for _, command := range tt.commands {
+				steps = append(steps, config.DeploymentStep{Command: command, Target: "remote"})
+			}
+			output := newCollect()
+			var started []int
+			r := &Runner{
+				Steps:        steps,
+				Remote:       startSSHServer(t),
+				RemoteOutput: output.ch,
+				OnEvent: func(e Event) {
+					if e.Type == StepStarted {
+						started = append(started, e.StepNum)
+					}
+				},
+			}
+
+			err := r.Run(context.Background())
+			if tt.wantStep == 0 {
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+			} else {
+				var stepErr *StepError
+				if !errors.As(err, &stepErr) {
+					t.Fatalf("Run() error = %v, want a *StepError", err)
+				}
+				result := stepErr.Result
+				result.Duration = 0
+				if stepErr.StepNum != tt.wantStep || stepErr.Total != len(steps) || result != tt.wantResult || stepErr.Err != nil {
+					t.Errorf("Run() error = step %d/%d %#v %v, want step %d %#v", stepErr.StepNum, stepErr.Total, result, stepErr.Err, tt.wantStep, tt.wantResult)
+				}
+				if len(started) != tt.wantStep {
+					t.Errorf("started steps %v, want none after step %d", started, tt.wantStep)
+				}
+			}
+			if got := output.String(); got != tt.wantOutput {
+				t.Errorf("output = %q, want %q", got, tt.wantOutput)
+			}
+		})
+	}
+}
+
+// startSSHServer starts an SSH server that runs exec requests with the local shell,
+// like sshd without a PTY, and returns a session connected to it
+func startSSHServer(t *testing.T) *deploy.Session {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "deploy",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := deploy.NewSession(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// serveSSH handles the session channels of one connection
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSession(channel, requests)
+	}
+}
+
+// serveSession runs the command of an exec request and reports how it exited
+// Closing the channel closes the command's stdin but, as with sshd, does not kill it
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go func() {
+			for req := range requests {
+				req.Reply(false, nil)
+			}
+		}()
+
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{127}))
+			channel.Close()
+			return
+		}
+		go func() {
+			io.Copy(stdin, channel)
+			stdin.Close()
+		}()
+
+		err = cmd.Wait()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				signal := strings.TrimPrefix(unixSignalName(status.Signal()), "SIG")
+				channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+					Signal     string
+					CoreDumped bool
+					Error      string
+					Lang       string
+				}{Signal: signal}))
+			} else {
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(exitErr.ExitCode())}))
+			}
+		} else {
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		}
+		channel.Close()
+		return
+	}
+}
+
+// unixSignalName returns the name sshd reports for a signal, e.g. "SIGTERM"
+func unixSignalName(signal syscall.Signal) string {
+	switch signal {
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	case syscall.SIGKILL:
+		return "SIGKILL"
+	case syscall.SIGHUP:
+		return "SIGHUP"
+	case syscall.SIGINT:
+		return "SIGINT"
+	}
+	return signal.String()
+}
+
+func TestRunStepTimeoutAndRetry(t *testing.T) {
+	for _, target := range []string{"local", "remote"} {
+		t.Run(target, func(t *testing.T) {
+			dir := t.TempDir()
+			pidFile := filepath.Join(dir, "pids")
+			steps := []config.DeploymentStep{
+				{
+					// The background sleep stands in for a child such as apt-get, which must not survive
+					Command:    `sleep 30 & echo $! >> "$PID_FILE"; wait`,
+					Target:     target,
+					Timeout:    "300ms",
+					Retries:    1,
+					RetryDelay: "10ms",
+					Env:        map[string]string{"PID_FILE": pidFile},
+				},
+				{Command: "echo cleanup > cleanup; exit 1", Target: target, Workdir: dir, ContinueOnError: true},
+			}
+			var retries int
+			r := &Runner{
+				Steps:        steps,
+				Remote:       startSSHServer(t),
+				LocalOutput:  discard(t),
+				RemoteOutput: discard(t),
+				OnEvent: func(e Event) {
+					if e.Type == StepRetrying {
+						retries++
+					}
+				},
+			}
+
+			start := time.Now()
+			err := r.Run(context.Background())
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatalf("Run() error = %v, want %v", err, ErrTimeout)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Run() returned after %s, want the step killed at its timeout", elapsed)
+			}
+			if retries != 1 {
+				t.Errorf("retried %d times, want 1", retries)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "cleanup")); !os.IsNotExist(err) {
+				t.Errorf("step after the timed out step ran: %v", err)
+			}
+
+			data, err := os.ReadFile(pidFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pids := strings.Fields(string(data))
+			if len(pids) != 2 {
+				t.Fatalf("started children %v, want one per attempt", pids)
+			}
+			for _, pid := range pids {
+				waitProcessGone(t, pid)
+			}
+		})
+	}
+}
+
+func TestRunContinueOnError(t *testing.T) {
+	for _, target := range []string{"local", "remote"} {
+		t.Run(target, func(t *testing.T) {
+			dir := t.TempDir()
+			r := &Runner{
+				Steps: []config.DeploymentStep{
+					{Command: "exit 4", Target: target, ContinueOnError: true},
+					{Command: `printf '%s' "$GREETING" > out`, Target: target, Workdir: dir, Env: map[string]string{"GREETING": "it's done"}},
+				},
+				Remote:       startSSHServer(t),
+				LocalOutput:  discard(t),
+				RemoteOutput: discard(t),
+			}
+			if err := r.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "out"))
+			if err != nil {
+				t.Fatalf("step after a continue_on_error failure did not run in its workdir: %v", err)
+			}
+			if string(data) != "it's done" {
+				t.Errorf("step output = %q, want the step env", data)
+			}
+		})
+	}
+}
+
+// waitProcessGone fails the test unless process pid exits, or is left a zombie, within a few seconds
+func waitProcessGone(t *testing.T, pid string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		stat, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+		if err != nil {
+			return
+		}
+		// The state follows the parenthesised command name
+		if fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:])); len(fields) > 0 && fields[0] == "Z" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("process %s is still running after the step timed out", pid)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// transferRecorder records the options of the transfers it is asked to make
+type transferRecorder struct {
+	localExecutor
+	excludes [][]string
+}
+
+func (r *transferRecorder) Upload(ctx context.Context, src, dest string, opts deploy.TransferOptions, progress func(deploy.TransferProgress)) (deploy.TransferProgress, error) {
+	r.excludes = append(r.excludes, opts.Exclude)
+	return deploy.TransferProgress{}, nil
+}
+
+func (r *transferRecorder) Download(ctx context.Context, src, dest string, opts deploy.TransferOptions, progress func(deploy.TransferProgress)) (deploy.TransferProgress, error) {
+	r.excludes = append(r.excludes, opts.Exclude)
+	return deploy.TransferProgress{}, nil
+}
+
+func TestTransferStepIgnoreFile(t *testing.T) {
+	configDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(configDir, deploy.IgnoreFile), []byte("# Build output\nnode_modules/\n\n*.log\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// gcdeploy may be run from a subdirectory of the project
+	workDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workDir, deploy.IgnoreFile), []byte("wrong\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(workDir)
+
+	remote := &transferRecorder{}
+	r := &Runner{
+		Steps: []config.DeploymentStep{
+			{Target: "upload", Src: "dist/", Dest: "/srv/myapp/", Exclude: []string{"*.tmp"}},
+			{Target: "download", Src: "/var/log/myapp/", Dest: "logs/"},
+		},
+		Remote:    remote,
+		ConfigDir: configDir,
+	}
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := [][]string{{"node_modules/", "*.log", "*.tmp"}, {"node_modules/", "*.log"}}
+	if !reflect.DeepEqual(remote.excludes, want) {
+		t.Errorf("transfer excludes = %q, want %q", remote.excludes, want)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []config.DeploymentStep
+		want  [][]int
+	}{
+		{
+			name:  "without depends_on steps run in order",
+			steps: []config.DeploymentStep{{Name: "build"}, {}, {}},
+			want:  [][]int{nil, {0}, {1}},
+		},
+		{
+			name: "depends_on",
+			steps: []config.DeploymentStep{
+				{Name: "frontend"},
+				{Name: "backend"},
+				{Name: "upload", DependsOn: []string{"frontend", "backend"}},
+				{Name: "migrate"},
+			},
+			want: [][]int{nil, nil, {0, 1}, nil},
+		},
+		{
+			name: "barrier steps wait for everything before and hold back everything after",
+			steps: []config.DeploymentStep{
+				{Name: "release-prepare", Barrier: true},
+				{Name: "frontend"},
+				{Name: "backend", DependsOn: []string{"frontend"}},
+				{Name: "release-activate", Barrier: true},
+				{Name: "restart"},
+			},
+			want: [][]int{nil, {0}, {1, 0}, {0, 1, 2}, {3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Dependencies(tt.steps); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Dependencies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunParallelSteps(t *testing.T) {
+	tests := []struct {
+		name        string
+		parallelism int
+		want        []string // Started and finished steps, and the steps running alongside
+	}{
+		{
+			name:        "independent steps overlap",
+			parallelism: 2,
+			want:        []string{"start frontend", "start backend (alongside frontend)", "finish backend", "finish frontend", "start upload"},
+		},
+		{
+			name:        "parallelism 1 runs one step at a time",
+			parallelism: 1,
+			want:        []string{"start frontend", "finish frontend", "start backend", "finish backend", "start upload"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			r := &Runner{
+				Steps: []config.DeploymentStep{
+					{Name: "frontend", Command: "sleep 0.3", Target: "local"},
+					{Name: "backend", Command: "true", Target: "local"},
+					{Name: "upload", Command: "true", Target: "local", DependsOn: []string{"frontend", "backend"}},
+				},
+				Parallelism: tt.parallelism,
+				LocalOutput: discard(t),
+				OnEvent: func(e Event) {
+					switch e.Type {
+					case StepStarted:
+						events = append(events, "start "+e.Step.Name+e.Concurrently())
+					case StepFinished:
+						events = append(events, "finish "+e.Step.Name)
+					}
+				},
+			}
+			if err := r.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := events[:len(events)-1]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
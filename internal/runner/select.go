@@ -0,0 +1,122 @@
+package runner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// Selection chooses which deployment steps run
+// Steps are referred to by their 1-based number or their name
+type Selection struct {
+	Only     []string // Run only these steps; every step when empty
+	Skip     []string // Do not run these steps
+	FromStep string   // Skip the steps before this one, e.g. to retry a failed deployment
+
+	// Resume skips the steps that succeeded or were skipped on each host in this
+	// earlier run, so the deployment continues where it stopped
+	Resume *RunState
+}
+
+// Empty reports whether every step runs
+func (s Selection) Empty() bool {
+	return len(s.Only) == 0 && len(s.Skip) == 0 && s.FromStep == "" && s.Resume == nil
+}
+
+// Select returns the indexes of the steps to skip on each instance, keyed by instance name
+// Returns an error for unknown step references, or when Resume does not match the
+// environment, instances or steps of this deployment
+func Select(sel Selection, steps []config.DeploymentStep, env string, instances []deploy.Instance) (map[string]map[int]bool, error) {
+	skip := make(map[int]bool)
+
+	if len(sel.Only) > 0 {
+		only, err := stepIndexes(steps, sel.Only, "--only")
+		if err != nil {
+			return nil, err
+		}
+		for i := range steps {
+			skip[i] = !only[i]
+		}
+	}
+	skipped, err := stepIndexes(steps, sel.Skip, "--skip")
+	if err != nil {
+		return nil, err
+	}
+	for i := range skipped {
+		skip[i] = true
+	}
+	if sel.FromStep != "" {
+		from, err := stepIndex(steps, sel.FromStep)
+		if err != nil {
+			return nil, fmt.Errorf("--from-step: %w", err)
+		}
+		for i := 0; i < from; i++ {
+			skip[i] = true
+		}
+	}
+
+	skips := make(map[string]map[int]bool, len(instances))
+	for _, instance := range instances {
+		skips[instance.Name] = skip
+	}
+	if sel.Resume == nil {
+		return skips, nil
+	}
+
+	if err := sel.Resume.matches(steps, env, instances); err != nil {
+		return nil, err
+	}
+	remaining := 0
+	for _, instance := range instances {
+		hostSkip := make(map[int]bool, len(steps))
+		for i := range steps {
+			hostSkip[i] = skip[i] || sel.Resume.Hosts[instance.Name].Steps[i].done()
+			if !hostSkip[i] {
+				remaining++
+			}
+		}
+		skips[instance.Name] = hostSkip
+	}
+	if remaining == 0 {
+		return nil, fmt.Errorf("nothing to resume: every step of the last deployment finished")
+	}
+	return skips, nil
+}
+
+// stepIndexes resolves a list of step references, accepting comma separated lists
+func stepIndexes(steps []config.DeploymentStep, refs []string, flag string) (map[int]bool, error) {
+	indexes := make(map[int]bool)
+	for _, ref := range refs {
+		for _, part := range strings.Split(ref, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			i, err := stepIndex(steps, part)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", flag, err)
+			}
+			indexes[i] = true
+		}
+	}
+	return indexes, nil
+}
+
+// stepIndex resolves a step number or name to its index in steps
+func stepIndex(steps []config.DeploymentStep, ref string) (int, error) {
+	for i, step := range steps {
+		if step.Name != "" && step.Name == ref {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n < 1 || n > len(steps) {
+			return 0, fmt.Errorf("step %d out of range (the deployment has %d steps)", n, len(steps))
+		}
+		return n - 1, nil
+	}
+	return 0, fmt.Errorf("no step named %q", ref)
+}
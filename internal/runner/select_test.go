@@ -0,0 +1,232 @@
+package runner
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+var testSteps = []config.DeploymentStep{
+	{Name: "build", Command: "make", Target: "local"},
+	{Name: "upload", Src: "dist/", Dest: "/srv/app/", Target: "upload"},
+	{Command: "npm ci", Target: "remote"},
+	{Name: "restart", Command: "systemctl restart app", Target: "remote"},
+}
+
+var testInstances = []deploy.Instance{{Name: "web-1"}, {Name: "web-2"}}
+
+// skipped lists the 1-based numbers of the steps skipped in skip
+func skipped(skip map[int]bool) []int {
+	var nums []int
+	for i := range testSteps {
+		if skip[i] {
+			nums = append(nums, i+1)
+		}
+	}
+	return nums
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name    string
+		sel     Selection
+		want    []int // Skipped step numbers on every host
+		wantErr string
+	}{
+		{name: "everything runs", want: nil},
+		{name: "only by name and number", sel: Selection{Only: []string{"upload", "3"}}, want: []int{1, 4}},
+		{name: "comma separated", sel: Selection{Only: []string{"build, restart"}}, want: []int{2, 3}},
+		{name: "skip", sel: Selection{Skip: []string{"1", "restart"}}, want: []int{1, 4}},
+		{name: "skip wins over only", sel: Selection{Only: []string{"1,2"}, Skip: []string{"2"}}, want: []int{2, 3, 4}},
+		{name: "from step", sel: Selection{FromStep: "3"}, want: []int{1, 2}},
+		{name: "from step with skip", sel: Selection{FromStep: "upload", Skip: []string{"restart"}}, want: []int{1, 4}},
+		{name: "out of range", sel: Selection{Only: []string{"5"}}, wantErr: "--only: step 5 out of range (the deployment has 4 steps)"},
+		{name: "zero", sel: Selection{Skip: []string{"0"}}, wantErr: "--skip: step 0 out of range"},
+		{name: "unknown name", sel: Selection{FromStep: "deploy"}, wantErr: `--from-step: no step named "deploy"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skips, err := Select(tt.sel, testSteps, "", testInstances)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Select() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Select() error = %v", err)
+			}
+			for _, instance := range testInstances {
+				if got := skipped(skips[instance.Name]); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s skips steps %v, want %v", instance.Name, got, tt.want)
+				}
+			}
+			if tt.sel.Empty() != (tt.want == nil) {
+				t.Errorf("Empty() = %v", tt.sel.Empty())
+			}
+		})
+	}
+}
+
+// recordState records a deployment where web-1 fails at failStep and web-2 finishes
+func recordState(t *testing.T, path string, failStep int) *RunState {
+	t.Helper()
+	r := NewStateRecorder(path, "prod", testSteps, testInstances, nil)
+	for i := range testSteps {
+		for _, host := range []string{"web-1", "web-2"} {
+			if host == "web-1" && i+1 > failStep {
+				continue
+			}
+			e := Event{StepNum: i + 1, Total: len(testSteps), Step: testSteps[i]}
+			e.Type = StepStarted
+			if err := r.Record(host, e); err != nil {
+				t.Fatalf("Record() error = %v", err)
+			}
+			e.Type = StepFinished
+			if host == "web-1" && i+1 == failStep {
+				e.Result.ExitCode = 1
+			}
+			if err := r.Record(host, e); err != nil {
+				t.Fatalf("Record() error = %v", err)
+			}
+		}
+	}
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState() error = %v", err)
+	}
+	return state
+}
+
+func TestStateRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "state.json")
+	state := recordState(t, path, 2)
+
+	want := map[string][]string{
+		"web-1": {StateSucceeded, StateFailed, StatePending, StatePending},
+		"web-2": {StateSucceeded, StateSucceeded, StateSucceeded, StateSucceeded},
+	}
+	for host, statuses := range want {
+		var got []string
+		for _, step := range state.Hosts[host].Steps {
+			got = append(got, step.Status)
+		}
+		if !reflect.DeepEqual(got, statuses) {
+			t.Errorf("%s steps = %v, want %v", host, got, statuses)
+		}
+	}
+	if step := state.Hosts["web-1"].Steps[1]; step.Step != "dist/ → /srv/app/" || step.Error == "" {
+		t.Errorf("failed step = %+v", step)
+	}
+
+	// Resuming skips what finished on each host, and the resumed run carries it over
+	skips, err := Select(Selection{Resume: state}, testSteps, "prod", testInstances)
+	if err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	if got := skipped(skips["web-1"]); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("web-1 resumes skipping %v, want [1]", got)
+	}
+	if got := skipped(skips["web-2"]); !reflect.DeepEqual(got, []int{1, 2, 3, 4}) {
+		t.Errorf("web-2 resumes skipping %v, want every step", got)
+	}
+
+	r := NewStateRecorder(path, "prod", testSteps, testInstances, state)
+	r.Record("web-1", Event{Type: StepSkipped, StepNum: 1, Step: testSteps[0]})
+	r.Record("web-1", Event{Type: StepStarted, StepNum: 2, Step: testSteps[1]})
+	r.Record("web-1", Event{Type: StepFinished, StepNum: 2, Step: testSteps[1]})
+	r.Record("web-1", Event{Type: StepStarted, StepNum: 1, Phase: "on_failure"})
+	resumed, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState() error = %v", err)
+	}
+	if got := resumed.Hosts["web-1"].Steps; got[0].Status != StateSucceeded || got[1].Status != StateSucceeded || got[1].Error != "" {
+		t.Errorf("resumed web-1 steps = %+v", got)
+	}
+}
+
+func TestStateRecorderUserSkippedSteps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	// The first run leaves step 2 out with --skip and fails at step 4 on web-1
+	r := NewStateRecorder(path, "prod", testSteps, testInstances, nil)
+	for _, host := range []string{"web-1", "web-2"} {
+		for i, step := range testSteps {
+			e := Event{StepNum: i + 1, Total: len(testSteps), Step: step}
+			if i == 1 {
+				e.Type = StepSkipped
+				r.Record(host, e)
+				continue
+			}
+			e.Type = StepStarted
+			r.Record(host, e)
+			e.Type = StepFinished
+			if host == "web-1" && i == 3 {
+				e.Result.ExitCode = 1
+			}
+			r.Record(host, e)
+		}
+	}
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState() error = %v", err)
+	}
+	if got := state.Hosts["web-1"].Steps[1].Status; got != StateSkipped {
+		t.Errorf("step left out with --skip recorded as %s, want %s", got, StateSkipped)
+	}
+
+	skips, err := Select(Selection{Resume: state}, testSteps, "prod", testInstances)
+	if err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	if got := skipped(skips["web-1"]); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("web-1 resumes skipping %v, want [1 3]", got)
+	}
+	if got := skipped(skips["web-2"]); !reflect.DeepEqual(got, []int{1, 3, 4}) {
+		t.Errorf("web-2 resumes skipping %v, want [1 3 4]", got)
+	}
+}
+
+func TestSelectResumeErrors(t *testing.T) {
+	changed := append([]config.DeploymentStep(nil), testSteps...)
+	changed[2].Command = "npm install"
+
+	tests := []struct {
+		name      string
+		failStep  int
+		env       string
+		steps     []config.DeploymentStep
+		instances []deploy.Instance
+		wantErr   string
+	}{
+		{name: "other environment", failStep: 2, env: "staging", wantErr: `environment "prod", not "staging"`},
+		{name: "other instances", failStep: 2, env: "prod", instances: []deploy.Instance{{Name: "web-1"}}, wantErr: "against web-1, web-2, not web-1"},
+		{name: "step added", failStep: 2, env: "prod", steps: testSteps[:3], wantErr: "(3 steps, was 4)"},
+		{name: "step changed", failStep: 2, env: "prod", steps: changed, wantErr: "step 3 changed"},
+		{name: "everything finished", failStep: len(testSteps) + 1, env: "prod", wantErr: "nothing to resume"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := recordState(t, filepath.Join(t.TempDir(), "state.json"), tt.failStep)
+			steps, instances := testSteps, testInstances
+			if tt.steps != nil {
+				steps = tt.steps
+			}
+			if tt.instances != nil {
+				instances = tt.instances
+			}
+			_, err := Select(Selection{Resume: state}, steps, tt.env, instances)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Select() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := LoadState(filepath.Join(t.TempDir(), "state.json")); err == nil || !strings.Contains(err.Error(), "no previous deployment") {
+		t.Errorf("LoadState() error = %v, want a missing state file", err)
+	}
+}
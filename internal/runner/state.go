@@ -0,0 +1,197 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// Step states recorded in the state file
+const (
+	StatePending   = "pending"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateSkipped   = "skipped"
+)
+
+// RunState is the progress of a deployment, as saved in the state file
+type RunState struct {
+	Env       string                `json:"env,omitempty"`
+	StartedAt time.Time             `json:"started_at"`
+	UpdatedAt time.Time             `json:"updated_at"`
+	Hosts     map[string]*HostState `json:"hosts"` // Keyed by instance name
+}
+
+// HostState is the progress of the deployment on one instance
+type HostState struct {
+	Steps []StepState `json:"steps"`
+}
+
+// StepState is the progress of one step on one instance
+type StepState struct {
+	Step   string `json:"step"` // Description of the step, to notice when the script has changed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// done reports whether a resumed deployment can leave the step out
+// Steps left out with --only or --skip have not run, so --resume runs them
+func (s StepState) done() bool {
+	return s.Status == StateSucceeded
+}
+
+// LoadState reads the state file written by a StateRecorder
+func LoadState(path string) (*RunState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no previous deployment to resume (%s not found)", path)
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var state RunState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// matches checks that a deployment can be resumed from this state
+func (s *RunState) matches(steps []config.DeploymentStep, env string, instances []deploy.Instance) error {
+	if s.Env != env {
+		return fmt.Errorf("cannot resume: the last deployment was to environment %q, not %q", s.Env, env)
+	}
+
+	names := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	previous := make([]string, 0, len(s.Hosts))
+	for name := range s.Hosts {
+		previous = append(previous, name)
+	}
+	sort.Strings(names)
+	sort.Strings(previous)
+	if strings.Join(names, ",") != strings.Join(previous, ",") {
+		return fmt.Errorf("cannot resume: the last deployment was against %s, not %s", strings.Join(previous, ", "), strings.Join(names, ", "))
+	}
+
+	for name, host := range s.Hosts {
+		if len(host.Steps) != len(steps) {
+			return fmt.Errorf("cannot resume: the deployment script changed since the last run (%d steps, was %d)", len(steps), len(host.Steps))
+		}
+		for i, step := range steps {
+			if host.Steps[i].Step != step.Description() {
+				return fmt.Errorf("cannot resume: step %d changed since the last run on %s", i+1, name)
+			}
+		}
+	}
+	return nil
+}
+
+// StateRecorder saves the progress of a deployment to the state file as events arrive,
+// so that an interrupted or failed deployment can be resumed
+type StateRecorder struct {
+	path  string
+	mu    sync.Mutex
+	state RunState
+	err   error // First write error, reported once
+}
+
+// NewStateRecorder starts recording a deployment of steps to instances at path
+// When resuming, the progress in previous is carried over so that a second
+// failure can be resumed as well
+func NewStateRecorder(path, env string, steps []config.DeploymentStep, instances []deploy.Instance, previous *RunState) *StateRecorder {
+	now := time.Now().UTC()
+	r := &StateRecorder{
+		path: path,
+		state: RunState{
+			Env:       env,
+			StartedAt: now,
+			UpdatedAt: now,
+			Hosts:     make(map[string]*HostState, len(instances)),
+		},
+	}
+	for _, instance := range instances {
+		host := &HostState{Steps: make([]StepState, len(steps))}
+		for i, step := range steps {
+			host.Steps[i] = StepState{Step: step.Description(), Status: StatePending}
+			if previous != nil && previous.Hosts[instance.Name] != nil {
+				host.Steps[i].Status = previous.Hosts[instance.Name].Steps[i].Status
+			}
+		}
+		r.state.Hosts[instance.Name] = host
+	}
+	return r
+}
+
+// Record updates the progress of host from a runner event and saves the state file
+// Returns the error of the first failed write, and nil afterwards, so callers can
+// warn once without failing the deployment
+func (r *StateRecorder) Record(host string, e Event) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state := r.state.Hosts[host]
+	if state == nil || e.Phase != "" || e.StepNum < 1 || e.StepNum > len(state.Steps) {
+		return nil
+	}
+	step := &state.Steps[e.StepNum-1]
+	switch e.Type {
+	case StepStarted:
+		step.Status = StateRunning
+		step.Error = ""
+	case StepFinished:
+		step.Status = StateSucceeded
+		if e.Failed() {
+			step.Status = StateFailed
+			step.Error = e.Reason()
+		}
+	case StepSkipped:
+		// Steps carried over from a resumed run keep their status
+		if !step.done() {
+			step.Status = StateSkipped
+		}
+	default:
+		return nil
+	}
+	r.state.UpdatedAt = time.Now().UTC()
+
+	if err := r.save(); err != nil && r.err == nil {
+		r.err = err
+		return err
+	}
+	return nil
+}
+
+// save writes the state file atomically so an interrupted write cannot corrupt it
+func (r *StateRecorder) save() error {
+	data, err := json.MarshalIndent(r.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// detachKey returns from attach mode to the split-pane view
+const detachKey = tea.KeyCtrlCloseBracket
+
+// cursorKeys are the final characters of the cursor keys, sent as CSI sequences or as SS3
+// sequences when the remote program asks for application cursor keys
+var cursorKeys = map[tea.KeyType]string{
+	tea.KeyUp:    "A",
+	tea.KeyDown:  "B",
+	tea.KeyRight: "C",
+	tea.KeyLeft:  "D",
+	tea.KeyHome:  "H",
+	tea.KeyEnd:   "F",
+}
+
+// keySequences are the xterm sequences of the other special keys
+var keySequences = map[tea.KeyType]string{
+	tea.KeyShiftTab:       "\x1b[Z",
+	tea.KeyInsert:         "\x1b[2~",
+	tea.KeyDelete:         "\x1b[3~",
+	tea.KeyPgUp:           "\x1b[5~",
+	tea.KeyPgDown:         "\x1b[6~",
+	tea.KeyCtrlPgUp:       "\x1b[5;5~",
+	tea.KeyCtrlPgDown:     "\x1b[6;5~",
+	tea.KeyShiftUp:        "\x1b[1;2A",
+	tea.KeyShiftDown:      "\x1b[1;2B",
+	tea.KeyShiftRight:     "\x1b[1;2C",
+	tea.KeyShiftLeft:      "\x1b[1;2D",
+	tea.KeyShiftHome:      "\x1b[1;2H",
+	tea.KeyShiftEnd:       "\x1b[1;2F",
+	tea.KeyCtrlUp:         "\x1b[1;5A",
+	tea.KeyCtrlDown:       "\x1b[1;5B",
+	tea.KeyCtrlRight:      "\x1b[1;5C",
+	tea.KeyCtrlLeft:       "\x1b[1;5D",
+	tea.KeyCtrlHome:       "\x1b[1;5H",
+	tea.KeyCtrlEnd:        "\x1b[1;5F",
+	tea.KeyCtrlShiftUp:    "\x1b[1;6A",
+	tea.KeyCtrlShiftDown:  "\x1b[1;6B",
+	tea.KeyCtrlShiftRight: "\x1b[1;6C",
+	tea.KeyCtrlShiftLeft:  "\x1b[1;6D",
+	tea.KeyCtrlShiftHome:  "\x1b[1;6H",
+	tea.KeyCtrlShiftEnd:   "\x1b[1;6F",
+	tea.KeyF1:             "\x1bOP",
+	tea.KeyF2:             "\x1bOQ",
+	tea.KeyF3:             "\x1bOR",
+	tea.KeyF4:             "\x1bOS",
+	tea.KeyF5:             "\x1b[15~",
+	tea.KeyF6:             "\x1b[17~",
+	tea.KeyF7:             "\x1b[18~",
+	tea.KeyF8:             "\x1b[19~",
+	tea.KeyF9:             "\x1b[20~",
+	tea.KeyF10:            "\x1b[21~",
+	tea.KeyF11:            "\x1b[23~",
+	tea.KeyF12:            "\x1b[24~",
+}
+
+// keyBytes returns the bytes a terminal sends for a key, nil for keys it cannot send
+// appCursor selects the application mode sequences of the cursor keys
+func keyBytes(msg tea.KeyMsg, appCursor bool) []byte {
+	var seq string
+	switch {
+	case msg.Type == tea.KeyRunes:
+		seq = string(msg.Runes)
+	case msg.Type == tea.KeySpace:
+		seq = " "
+	case msg.Type >= 0:
+		// Control keys are their own bytes, e.g. ctrl+a is 1, enter 13 and backspace 127
+		seq = string(rune(msg.Type))
+	case cursorKeys[msg.Type] != "":
+		if appCursor {
+			seq = "\x1bO" + cursorKeys[msg.Type]
+		} else {
+			seq = "\x1b[" + cursorKeys[msg.Type]
+		}
+	default:
+		seq = keySequences[msg.Type]
+	}
+	if seq == "" {
+		return nil
+	}
+	if msg.Alt {
+		seq = "\x1b" + seq
+	}
+	return []byte(seq)
+}
+
+// attach switches to attach mode: the remote shell gets the whole window and every key
+func (m *Model) attach() {
+	if m.terminalSession == nil {
+		m.logContent.WriteString("[WARN] The remote shell is not connected yet\n")
+		return
+	}
+	m.stopCopy()
+	m.attached = true
+	m.activeHost = 0
+	m.resizeRemoteTerminal()
+	m.logContent.WriteString("[INFO] Attached to the remote shell (Ctrl+] to detach)\n")
+}
+
+// detach returns from attach mode to the split-pane view, leaving the remote shell running
+func (m *Model) detach() {
+	m.attached = false
+	m.resizeRemoteTerminal()
+	m.logContent.WriteString("[INFO] Detached from the remote shell\n")
+}
+
+// passthrough reports whether keys go straight to the remote shell
+// Host key and plan confirmations still take the keyboard while attached
+func (m *Model) passthrough() bool {
+	return m.attached && m.pendingHostKey == nil && !m.awaitingPlanConfirm
+}
+
+// handleAttachedKey forwards a key to the remote shell, or detaches on the detach key
+func (m *Model) handleAttachedKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if msg.Type == detachKey {
+		m.detach()
+		return m, nil
+	}
+	data := keyBytes(msg, m.remoteScreen.AppCursor())
+	if data == nil {
+		return m, nil
+	}
+	if err := m.terminalSession.Write(data); err != nil {
+		m.detach()
+		fmt.Fprintf(m.logContent, "[ERROR] %v\n", err)
+	}
+	return m, nil
+}
+
+// remoteTerminalSize returns the size of the remote shell's terminal: the whole window
+// above the status line when attached, the remote pane without its border and padding otherwise
+func (m *Model) remoteTerminalSize() (cols, rows int) {
+	if m.attached {
+		return m.width, m.height - 1
+	}
+	style := m.remoteViewport.Style
+	return m.remoteViewport.Width - style.GetHorizontalFrameSize(), m.remoteViewport.Height - style.GetVerticalFrameSize()
+}
+
+// resizeRemoteTerminal resizes the emulated terminal and the PTY of the remote shell
+func (m *Model) resizeRemoteTerminal() {
+	m.remoteScreen.Resize(m.remoteTerminalSize())
+	if m.terminalSession != nil {
+		m.terminalSession.Resize(m.remoteScreen.Size())
+	}
+}
+
+// renderAttachedView renders the remote shell's screen over the whole window, with a status line
+func (m *Model) renderAttachedView() string {
+	_, rows := m.remoteScreen.Size()
+	screen := strings.Join(m.remoteScreen.Window(rows), "\n")
+
+	status := fmt.Sprintf(" Attached to %s • Ctrl+]: Detach ", m.instance.Name)
+	statusStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#FFFFFF")).
+		Background(lipgloss.Color(gopherBlue)).
+		Width(m.width).
+		MaxWidth(m.width)
+	if m.production {
+		statusStyle = statusStyle.Background(lipgloss.Color(productionRed))
+	}
+	return screen + "\n" + statusStyle.Render(status)
+}
@@ -0,0 +1,83 @@
+package tui
+
+import (
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestKeyBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       tea.KeyMsg
+		appCursor bool
+		want      string
+	}{
+		{name: "runes", key: tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("héllo")}, want: "héllo"},
+		{name: "space", key: tea.KeyMsg{Type: tea.KeySpace}, want: " "},
+		{name: "enter", key: tea.KeyMsg{Type: tea.KeyEnter}, want: "\r"},
+		{name: "ctrl+c", key: tea.KeyMsg{Type: tea.KeyCtrlC}, want: "\x03"},
+		{name: "backspace", key: tea.KeyMsg{Type: tea.KeyBackspace}, want: "\x7f"},
+		{name: "escape", key: tea.KeyMsg{Type: tea.KeyEscape}, want: "\x1b"},
+		{name: "alt+b", key: tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("b"), Alt: true}, want: "\x1bb"},
+		{name: "up", key: tea.KeyMsg{Type: tea.KeyUp}, want: "\x1b[A"},
+		{name: "up in application mode", key: tea.KeyMsg{Type: tea.KeyUp}, appCursor: true, want: "\x1bOA"},
+		{name: "end in application mode", key: tea.KeyMsg{Type: tea.KeyEnd}, appCursor: true, want: "\x1bOF"},
+		{name: "shift+up ignores application mode", key: tea.KeyMsg{Type: tea.KeyShiftUp}, appCursor: true, want: "\x1b[1;2A"},
+		{name: "page down", key: tea.KeyMsg{Type: tea.KeyPgDown}, want: "\x1b[6~"},
+		{name: "f1", key: tea.KeyMsg{Type: tea.KeyF1}, want: "\x1bOP"},
+		{name: "f12", key: tea.KeyMsg{Type: tea.KeyF12}, want: "\x1b[24~"},
+		{name: "unknown key", key: tea.KeyMsg{Type: tea.KeyF20}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(keyBytes(tt.key, tt.appCursor)); got != tt.want {
+				t.Errorf("keyBytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttach(t *testing.T) {
+	m, err := New(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.terminalMode = true
+	m.width, m.height = 120, 40
+
+	log := func() string { return strings.Join(lines(m.logContent), "\n") }
+
+	// Nothing to attach to before the remote shell connects
+	m.attach()
+	if m.attached || !strings.Contains(log(), "not connected yet") {
+		t.Errorf("attach() without a remote shell: attached = %v, log %q", m.attached, log())
+	}
+
+	m.attached = true
+	if cols, rows := m.remoteTerminalSize(); cols != 120 || rows != 39 {
+		t.Errorf("remoteTerminalSize() attached = %dx%d, want the window above the status line", cols, rows)
+	}
+	if !m.passthrough() {
+		t.Error("passthrough() = false while attached")
+	}
+	m.awaitingPlanConfirm = true
+	if m.passthrough() {
+		t.Error("passthrough() = true while the plan waits for confirmation")
+	}
+	m.awaitingPlanConfirm = false
+
+	m.remoteScreen.Write([]byte("top\r\n"))
+	if view := m.View(); !strings.Contains(view, "top") || !strings.Contains(view, "Ctrl+]: Detach") {
+		t.Errorf("View() attached =\n%s\nwant the remote screen and the status line", view)
+	}
+
+	m.Update(tea.KeyMsg{Type: detachKey})
+	if m.attached {
+		t.Error("still attached after the detach key")
+	}
+	if !strings.Contains(log(), "Detached from the remote shell") {
+		t.Errorf("log = %q, want the detach reported", log())
+	}
+}
@@ -0,0 +1,466 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/aymanbagabas/go-osc52/v2"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+var (
+	matchStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("#FFFFFF")).Background(lipgloss.Color(rustCrab))
+	selectionStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#FFFFFF")).Background(lipgloss.Color(gopherBlue))
+	cursorStyle    = lipgloss.NewStyle().Reverse(true)
+)
+
+// How a cell of a row is highlighted, in increasing priority
+const (
+	cellPlain = iota
+	cellMatch
+	cellSelected
+	cellCursor
+)
+
+// copyMode is pane navigation in vim normal mode: a cursor over the rows of the focused
+// pane for scrolling, searching and copying
+// The pane is frozen when navigation starts, so rows keep their place while output
+// keeps arriving; G takes in the output that arrived since
+type copyMode struct {
+	local  bool     // Navigating the local pane, otherwise the remote pane or its tab
+	styled []string // Rows as the pane renders them
+	plain  [][]rune // The same rows without escape sequences
+	top    int      // First row shown
+	row    int      // Cursor
+	col    int
+
+	visual    bool // v: the selection runs from the anchor to the cursor
+	anchorRow int
+	anchorCol int
+
+	pattern   string // Last search
+	backward  bool   // The last search was ? rather than /
+	searching bool   // A search is being typed
+	query     string
+	pendingG  bool // The first g of gg
+}
+
+// startCopy freezes the focused pane for navigation, keeping the last search
+func (m *Model) startCopy() {
+	c := &copyMode{local: m.shellMode == LocalShell}
+	if m.copy != nil {
+		c.pattern, c.backward = m.copy.pattern, m.copy.backward
+	}
+	host := m.activeHostPane()
+	switch {
+	case c.local:
+		c.styled, c.row = m.localScreen.Rows()
+	case host != nil:
+		cols, _ := m.remoteTerminalSize()
+		c.styled = host.content.Rows(max(cols, 1))
+		c.row = len(c.styled) - 1
+	default:
+		c.styled, c.row = m.remoteScreen.Rows()
+	}
+	c.plain = make([][]rune, len(c.styled))
+	for i, row := range c.styled {
+		c.plain[i] = []rune(ansi.Strip(row))
+	}
+	if host != nil && !c.local {
+		// Start on the last line of output rather than the empty line after it
+		for c.row > 0 && len(c.plain[c.row]) == 0 {
+			c.row--
+		}
+	}
+	c.top = len(c.styled)
+	m.copy = c
+	c.moveTo(c.row, 0, m.paneHeight())
+}
+
+// stopCopy returns the panes to following their output
+func (m *Model) stopCopy() {
+	m.copy = nil
+}
+
+// paneHeight returns the number of rows a pane shows
+func (m *Model) paneHeight() int {
+	return max(m.remoteViewport.Height-m.remoteViewport.Style.GetVerticalFrameSize(), 1)
+}
+
+// handleCopyKey moves the cursor, searches or copies in normal mode
+// Returns false for keys that are not navigation keys
+func (m *Model) handleCopyKey(keyStr string) bool {
+	switch keyStr {
+	case "j", "k", "h", "l", "up", "down", "left", "right", "0", "$", "home", "end", "w", "b", "e",
+		"ctrl+d", "ctrl+u", "g", "G", "/", "?", "n", "N", "v", "y":
+	default:
+		return false
+	}
+	if m.copy == nil || keyStr == "G" {
+		m.startCopy()
+	}
+	c := m.copy
+	height := m.paneHeight()
+	pendingG := c.pendingG
+	c.pendingG = false
+
+	switch keyStr {
+	case "j", "down":
+		c.moveTo(c.row+1, c.col, height)
+	case "k", "up":
+		c.moveTo(c.row-1, c.col, height)
+	case "h", "left":
+		c.moveTo(c.row, c.col-1, height)
+	case "l", "right":
+		c.moveTo(c.row, c.col+1, height)
+	case "0", "home":
+		c.moveTo(c.row, 0, height)
+	case "$", "end":
+		c.moveTo(c.row, len(c.plain[c.row])-1, height)
+	case "w", "b", "e":
+		row, col := c.wordMotion(keyStr)
+		c.moveTo(row, col, height)
+	case "ctrl+d", "ctrl+u":
+		// Scroll half a page, taking the cursor along
+		delta := max(height/2, 1)
+		if keyStr == "ctrl+u" {
+			delta = -delta
+		}
+		c.top = max(min(c.top+delta, len(c.plain)-height), 0)
+		c.moveTo(c.row+delta, c.col, height)
+	case "g":
+		if pendingG {
+			c.moveTo(0, 0, height)
+		} else {
+			c.pendingG = true
+		}
+	case "G":
+		c.moveTo(len(c.plain)-1, 0, height)
+	case "/", "?":
+		c.searching = true
+		c.backward = keyStr == "?"
+		c.query = ""
+	case "n", "N":
+		m.searchNext(keyStr == "N")
+	case "v":
+		c.visual = !c.visual
+		c.anchorRow, c.anchorCol = c.row, c.col
+	case "y":
+		m.yank()
+	}
+	return true
+}
+
+// handleSearchKey edits the search being typed after / or ?
+func (m *Model) handleSearchKey(msg tea.KeyMsg) {
+	c := m.copy
+	switch msg.Type {
+	case tea.KeyEnter:
+		c.searching = false
+		if c.query != "" {
+			c.pattern = c.query
+		}
+		m.searchNext(false)
+	case tea.KeyEsc, tea.KeyCtrlC:
+		c.searching = false
+	case tea.KeyBackspace:
+		if c.query == "" {
+			c.searching = false
+			return
+		}
+		query := []rune(c.query)
+		c.query = string(query[:len(query)-1])
+	case tea.KeyRunes, tea.KeySpace:
+		c.query += string(msg.Runes)
+	}
+}
+
+// searchNext moves the cursor to the next match of the last search, in its direction
+// or the opposite one with reverse, wrapping around at the top and bottom
+func (m *Model) searchNext(reverse bool) {
+	c := m.copy
+	if c.pattern == "" {
+		return
+	}
+	pattern := []rune(c.pattern)
+	fold := !hasUpper(pattern)
+	backward := c.backward != reverse
+	rows := len(c.plain)
+	for i := 0; i <= rows; i++ {
+		var row, col int
+		if backward {
+			row = ((c.row-i)%rows + rows) % rows
+			before := len(c.plain[row]) + 1
+			if i == 0 {
+				before = c.col
+			}
+			col = lastIndexRunes(c.plain[row], pattern, before, fold)
+		} else {
+			row = (c.row + i) % rows
+			from := 0
+			if i == 0 {
+				from = c.col + 1
+			}
+			col = indexRunes(c.plain[row], pattern, from, fold)
+		}
+		if col >= 0 {
+			c.moveTo(row, col, m.paneHeight())
+			return
+		}
+	}
+	fmt.Fprintf(m.logContent, "[WARN] Pattern not found: %s\n", c.pattern)
+}
+
+// yank copies the selection, or the cursor's row without one, to the system clipboard
+// with an OSC 52 sequence, which terminals pass to the clipboard even over SSH
+func (m *Model) yank() {
+	c := m.copy
+	text := c.selectedText()
+	c.visual = false
+
+	seq := osc52.New(text)
+	if os.Getenv("TMUX") != "" {
+		seq = seq.Tmux()
+	} else if strings.HasPrefix(os.Getenv("TERM"), "screen") {
+		seq = seq.Screen()
+	}
+	if _, err := seq.WriteTo(os.Stdout); err != nil {
+		fmt.Fprintf(m.logContent, "[ERROR] Failed to copy to the clipboard: %v\n", err)
+		return
+	}
+	fmt.Fprintf(m.logContent, "[INFO] Copied %d characters to the clipboard\n", len([]rune(text)))
+}
+
+// selection returns the ends of the selection, in order; without one, the cursor's row
+func (c *copyMode) selection() (startRow, startCol, endRow, endCol int) {
+	if !c.visual {
+		return c.row, 0, c.row, len(c.plain[c.row]) - 1
+	}
+	startRow, startCol, endRow, endCol = c.anchorRow, c.anchorCol, c.row, c.col
+	if endRow < startRow || endRow == startRow && endCol < startCol {
+		startRow, startCol, endRow, endCol = endRow, endCol, startRow, startCol
+	}
+	return startRow, startCol, endRow, endCol
+}
+
+// selectedText returns the text of the selection, with a line feed between rows
+func (c *copyMode) selectedText() string {
+	startRow, startCol, endRow, endCol := c.selection()
+	lines := make([]string, 0, endRow-startRow+1)
+	for r := startRow; r <= endRow; r++ {
+		row := c.plain[r]
+		from, to := 0, len(row)
+		if r == startRow {
+			from = min(startCol, len(row))
+		}
+		if r == endRow {
+			to = min(endCol+1, len(row))
+		}
+		lines = append(lines, string(row[from:max(from, to)]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// moveTo moves the cursor to row and col, within the rows, and scrolls it into view
+func (c *copyMode) moveTo(row, col, height int) {
+	c.row = max(min(row, len(c.plain)-1), 0)
+	c.col = max(min(col, len(c.plain[c.row])-1), 0)
+	if c.row < c.top {
+		c.top = c.row
+	} else if c.row >= c.top+height {
+		c.top = c.row - height + 1
+	}
+	c.top = max(min(c.top, len(c.plain)-height), 0)
+}
+
+// wordMotion returns where w, b or e moves the cursor
+// Words are separated by blanks and line ends, like vim's WORDs, so a URL is one word
+func (c *copyMode) wordMotion(motion string) (row, col int) {
+	row, col = c.row, c.col
+	switch motion {
+	case "w":
+		for r := row; c.step(&row, &col, 1) && row == r && !c.blank(row, col); {
+		}
+		for c.blank(row, col) && c.step(&row, &col, 1) {
+		}
+	case "e":
+		c.step(&row, &col, 1)
+		for c.blank(row, col) && c.step(&row, &col, 1) {
+		}
+		for r, k := row, col; c.step(&r, &k, 1) && r == row && !c.blank(r, k); {
+			col = k
+		}
+	case "b":
+		c.step(&row, &col, -1)
+		for c.blank(row, col) && c.step(&row, &col, -1) {
+		}
+		for r, k := row, col; c.step(&r, &k, -1) && r == row && !c.blank(r, k); {
+			col = k
+		}
+	}
+	return row, col
+}
+
+// step moves a position one cell forward or backward, across row ends
+// Every row has at least one cell; returns false at either end of the rows
+func (c *copyMode) step(row, col *int, dir int) bool {
+	r, k := *row, *col+dir
+	if k < 0 {
+		if r == 0 {
+			return false
+		}
+		r--
+		k = max(len(c.plain[r]), 1) - 1
+	} else if k >= max(len(c.plain[r]), 1) {
+		if r == len(c.plain)-1 {
+			return false
+		}
+		r, k = r+1, 0
+	}
+	*row, *col = r, k
+	return true
+}
+
+// blank reports whether the cell at row, col is blank; the cell of an empty row is
+func (c *copyMode) blank(row, col int) bool {
+	return col >= len(c.plain[row]) || unicode.IsSpace(c.plain[row][col])
+}
+
+// window renders the rows shown in the pane, with search matches, the selection and the
+// cursor highlighted
+func (c *copyMode) window(height int) []string {
+	var pattern []rune
+	if c.pattern != "" {
+		pattern = []rune(c.pattern)
+	}
+	fold := !hasUpper(pattern)
+	startRow, startCol, endRow, endCol := c.selection()
+
+	lines := make([]string, 0, height)
+	for r := c.top; r < min(c.top+height, len(c.plain)); r++ {
+		row := c.plain[r]
+		size := len(row)
+		if r == c.row {
+			size = max(size, c.col+1)
+		}
+		cells := make([]int, size)
+		highlighted := false
+		if len(pattern) > 0 {
+			for from := 0; ; {
+				i := indexRunes(row, pattern, from, fold)
+				if i < 0 {
+					break
+				}
+				for j := i; j < i+len(pattern); j++ {
+					cells[j] = cellMatch
+				}
+				highlighted = true
+				from = i + len(pattern)
+			}
+		}
+		if c.visual && r >= startRow && r <= endRow {
+			from, to := 0, len(row)-1
+			if r == startRow {
+				from = startCol
+			}
+			if r == endRow {
+				to = endCol
+			}
+			for j := from; j <= to && j < len(cells); j++ {
+				cells[j] = cellSelected
+			}
+			highlighted = true
+		}
+		if r == c.row {
+			cells[c.col] = cellCursor
+			highlighted = true
+		}
+
+		if !highlighted {
+			lines = append(lines, c.styled[r])
+			continue
+		}
+		lines = append(lines, renderCells(row, cells))
+	}
+	return lines
+}
+
+// renderCells renders the text of a row with each cell in the style of its highlight
+// Cells past the end of the text, e.g. the cursor on an empty row, are spaces
+func renderCells(row []rune, cells []int) string {
+	var b strings.Builder
+	for start := 0; start < len(cells); {
+		end := start + 1
+		for end < len(cells) && cells[end] == cells[start] {
+			end++
+		}
+		text := make([]rune, 0, end-start)
+		for j := start; j < end; j++ {
+			if j < len(row) {
+				text = append(text, row[j])
+			} else {
+				text = append(text, ' ')
+			}
+		}
+		switch cells[start] {
+		case cellMatch:
+			b.WriteString(matchStyle.Render(string(text)))
+		case cellSelected:
+			b.WriteString(selectionStyle.Render(string(text)))
+		case cellCursor:
+			b.WriteString(cursorStyle.Render(string(text)))
+		default:
+			b.WriteString(string(text))
+		}
+		start = end
+	}
+	return b.String()
+}
+
+// hasUpper reports whether a search pattern has upper case letters, which makes it case sensitive
+func hasUpper(pattern []rune) bool {
+	for _, r := range pattern {
+		if unicode.IsUpper(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAt reports whether pattern occurs in row at i, ignoring case with fold
+func matchAt(row, pattern []rune, i int, fold bool) bool {
+	for j, p := range pattern {
+		r := row[i+j]
+		if fold {
+			r, p = unicode.ToLower(r), unicode.ToLower(p)
+		}
+		if r != p {
+			return false
+		}
+	}
+	return true
+}
+
+// indexRunes returns the first column at or after from where pattern occurs in row, or -1
+func indexRunes(row, pattern []rune, from int, fold bool) int {
+	for i := max(from, 0); i+len(pattern) <= len(row); i++ {
+		if matchAt(row, pattern, i, fold) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastIndexRunes returns the last column before before where pattern occurs in row, or -1
+func lastIndexRunes(row, pattern []rune, before int, fold bool) int {
+	for i := min(before-1, len(row)-len(pattern)); i >= 0; i-- {
+		if matchAt(row, pattern, i, fold) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,170 @@
+package tui
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+// newCopyMode returns copy mode over rows with the cursor at the top left
+func newCopyMode(rows ...string) *copyMode {
+	c := &copyMode{styled: rows, plain: make([][]rune, len(rows))}
+	for i, row := range rows {
+		c.plain[i] = []rune(row)
+	}
+	return c
+}
+
+type position struct{ row, col int }
+
+func TestCopyMoveTo(t *testing.T) {
+	rows := []string{"zero", "", "two", "three", "four"}
+	tests := []struct {
+		name     string
+		from     position
+		to       position
+		want     position
+		wantTop  int
+		startTop int
+	}{
+		{name: "within the rows", to: position{2, 1}, want: position{2, 1}},
+		{name: "clamped to the line end", to: position{3, 99}, want: position{3, 4}, wantTop: 1},
+		{name: "empty row", to: position{1, 3}, want: position{1, 0}},
+		{name: "clamped to the rows", to: position{-1, -1}, want: position{0, 0}},
+		{name: "past the bottom", to: position{9, 0}, want: position{4, 0}, wantTop: 2},
+		{name: "scrolls up to the cursor", startTop: 2, to: position{1, 0}, want: position{1, 0}, wantTop: 1},
+		{name: "stays in view", startTop: 1, to: position{2, 0}, want: position{2, 0}, wantTop: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCopyMode(rows...)
+			c.top = tt.startTop
+			c.moveTo(tt.to.row, tt.to.col, 3)
+			if got := (position{c.row, c.col}); got != tt.want || c.top != tt.wantTop {
+				t.Errorf("cursor %v top %d, want %v top %d", got, c.top, tt.want, tt.wantTop)
+			}
+		})
+	}
+}
+
+func TestCopyWordMotion(t *testing.T) {
+	rows := []string{"see https://example.com/a  now", "", "  next line"}
+	tests := []struct {
+		motion string
+		from   position
+		want   position
+	}{
+		{"w", position{0, 0}, position{0, 4}},
+		{"w", position{0, 5}, position{0, 27}}, // A URL is one word
+		{"w", position{0, 27}, position{2, 2}}, // Across the empty row
+		{"w", position{2, 7}, position{2, 10}}, // Stops at the end of the last row
+		{"e", position{0, 0}, position{0, 2}},
+		{"e", position{0, 2}, position{0, 24}},
+		{"e", position{0, 29}, position{2, 5}},
+		{"b", position{0, 27}, position{0, 4}},
+		{"b", position{2, 2}, position{0, 27}},
+		{"b", position{0, 1}, position{0, 0}},
+		{"b", position{0, 0}, position{0, 0}},
+	}
+	for _, tt := range tests {
+		c := newCopyMode(rows...)
+		c.row, c.col = tt.from.row, tt.from.col
+		if row, col := c.wordMotion(tt.motion); (position{row, col}) != tt.want {
+			t.Errorf("%s from %v = %v, want %v", tt.motion, tt.from, position{row, col}, tt.want)
+		}
+	}
+}
+
+func TestCopySelectedText(t *testing.T) {
+	rows := []string{"first line", "", "third line"}
+	tests := []struct {
+		name   string
+		visual bool
+		anchor position
+		cursor position
+		want   string
+	}{
+		{name: "cursor row without a selection", cursor: position{2, 3}, want: "third line"},
+		{name: "within a row", visual: true, anchor: position{0, 6}, cursor: position{0, 9}, want: "line"},
+		{name: "across rows", visual: true, anchor: position{0, 6}, cursor: position{2, 4}, want: "line\n\nthird"},
+		{name: "cursor before the anchor", visual: true, anchor: position{2, 4}, cursor: position{0, 6}, want: "line\n\nthird"},
+		{name: "empty row", visual: true, anchor: position{1, 0}, cursor: position{1, 0}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCopyMode(rows...)
+			c.visual = tt.visual
+			c.anchorRow, c.anchorCol = tt.anchor.row, tt.anchor.col
+			c.row, c.col = tt.cursor.row, tt.cursor.col
+			if got := c.selectedText(); got != tt.want {
+				t.Errorf("selectedText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopySearch(t *testing.T) {
+	m, err := New(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []string{"Error: disk full", "retrying", "error again", "done"}
+	tests := []struct {
+		name     string
+		pattern  string
+		backward bool
+		reverse  bool
+		from     position
+		want     position
+	}{
+		{name: "forward, ignoring case", pattern: "error", from: position{0, 0}, want: position{2, 0}},
+		{name: "wraps at the bottom", pattern: "error", from: position{2, 0}, want: position{0, 0}},
+		{name: "upper case is case sensitive", pattern: "Error", from: position{0, 0}, want: position{0, 0}},
+		{name: "later in the same row", pattern: "i", from: position{0, 0}, want: position{0, 8}},
+		{name: "backward", pattern: "r", backward: true, from: position{1, 0}, want: position{0, 4}},
+		{name: "backward wraps at the top", pattern: "done", backward: true, from: position{0, 0}, want: position{3, 0}},
+		{name: "N reverses the direction", pattern: "error", reverse: true, from: position{2, 0}, want: position{0, 0}},
+		{name: "no match keeps the cursor", pattern: "panic", from: position{1, 2}, want: position{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCopyMode(rows...)
+			c.pattern, c.backward = tt.pattern, tt.backward
+			c.row, c.col = tt.from.row, tt.from.col
+			m.copy = c
+			m.searchNext(tt.reverse)
+			if got := (position{c.row, c.col}); got != tt.want {
+				t.Errorf("cursor at %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !strings.Contains(strings.Join(m.logContent.Tail(2), "\n"), "Pattern not found: panic") {
+		t.Errorf("no warning for a pattern without matches, log %q", m.logContent.Tail(2))
+	}
+}
+
+func TestCopyWindow(t *testing.T) {
+	c := newCopyMode("\x1b[31mred\x1b[0m", "plain", "last")
+	c.plain[0] = []rune("red")
+	c.pattern = "a"
+	c.row, c.col = 2, 0
+	c.moveTo(2, 0, 2)
+
+	window := c.window(2)
+	if len(window) != 2 || c.top != 1 {
+		t.Fatalf("window() = %q from row %d, want the last 2 rows", window, c.top)
+	}
+	for i, want := range []string{"plain", "last"} {
+		if got := ansi.Strip(window[i]); got != want {
+			t.Errorf("row %d = %q, want %q", i, got, want)
+		}
+	}
+
+	// Rows without highlights keep their styling
+	c.pattern = ""
+	c.moveTo(2, 0, 3)
+	if window := c.window(3); window[0] != c.styled[0] {
+		t.Errorf("unhighlighted row = %q, want %q", window[0], c.styled[0])
+	}
+}
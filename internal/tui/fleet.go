@@ -0,0 +1,368 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+	"github.com/wclewett/gcdeploy/internal/runner"
+)
+
+// hostPane holds the connection, output and status of one host in a fan-out deployment
+type hostPane struct {
+	instance   deploy.Instance
+	session    *deploy.Session
+	connectErr error // Set when the host could not be connected; the host fails when its turn comes
+	outputCh   chan []byte
+	content    *scrollback
+	status     runner.HostStatus
+	stepNum    int
+	total      int
+}
+
+// label returns the tab label with the host's progress
+func (h *hostPane) label() string {
+	switch h.status {
+	case runner.HostRunning:
+		if h.stepNum > 0 {
+			return fmt.Sprintf("%s %d/%d", h.instance.Name, h.stepNum, h.total)
+		}
+		return h.instance.Name + " …"
+	case runner.HostSucceeded:
+		return h.instance.Name + " ✓"
+	case runner.HostFailed:
+		return h.instance.Name + " ✗"
+	case runner.HostSkipped:
+		return h.instance.Name + " –"
+	default:
+		return h.instance.Name
+	}
+}
+
+// HostConnectedMsg is sent when a fan-out host's SSH session is established
+type HostConnectedMsg struct {
+	Host    int
+	Session *deploy.Session
+}
+
+// HostConnectErrorMsg is sent when connecting to a fan-out host fails
+type HostConnectErrorMsg struct {
+	Host  int
+	Error error
+}
+
+// HostDeploymentMsg carries a deployment step event from one fan-out host
+type HostDeploymentMsg struct {
+	Host  int
+	Event runner.Event
+}
+
+// HostStatusMsg is sent when a fan-out host starts or finishes its deployment
+type HostStatusMsg struct {
+	Event runner.HostEvent
+}
+
+// FleetCompleteMsg is sent when every fan-out host has finished or was skipped
+type FleetCompleteMsg struct {
+	Results []runner.HostResult
+	Error   error
+}
+
+// SetTargets sets the instances the deployment script runs on
+// With more than one instance, each host gets a tab showing its deployment output
+// The interactive shell stays connected to the primary instance
+func (m *Model) SetTargets(instances []deploy.Instance, concurrency int) {
+	m.hosts = nil
+	m.concurrency = concurrency
+	if len(instances) < 2 {
+		return
+	}
+	for _, instance := range instances {
+		m.hosts = append(m.hosts, &hostPane{
+			instance: instance,
+			outputCh: make(chan []byte, 100),
+			content:  newScrollback(defaultScrollback, wrapLine),
+			status:   runner.HostPending,
+		})
+	}
+}
+
+// fanOut reports whether the deployment runs on several hosts
+func (m *Model) fanOut() bool {
+	return len(m.hosts) > 0
+}
+
+// connectHost connects to the fan-out host at index, or starts the deployment
+// once every host has been tried
+func (m *Model) connectHost(index int) tea.Cmd {
+	if index >= len(m.hosts) {
+		return m.StartFleetDeployment()
+	}
+
+	ctx := m.ctx
+	instance := m.hosts[index].instance
+	sshKeyPath := m.sshKeyPath
+	resolver := m.resolver
+	passphrase := m.pendingPassphrase
+	hostKeys := m.hostKeys
+	return func() tea.Msg {
+		session, err := deploy.VMConnectWithKey(ctx, instance, sshKeyPath, resolver, passphrase, hostKeys)
+		if err != nil {
+			return HostConnectErrorMsg{Host: index, Error: err}
+		}
+		return HostConnectedMsg{Host: index, Session: session}
+	}
+}
+
+// StartFleetDeployment runs the deployment script on every host in the background
+// Progress is reported back to Update as host messages
+func (m *Model) StartFleetDeployment() tea.Cmd {
+	steps := m.deploymentSteps
+	if len(steps) == 0 {
+		// No deployment script, run the single command remotely on every host
+		steps = []config.DeploymentStep{{Command: m.command, Target: "remote"}}
+	}
+
+	m.deploymentRunning = true
+	events := make(chan tea.Msg, 16)
+	m.deploymentEventCh = events
+
+	instances := make([]deploy.Instance, len(m.hosts))
+	for i, host := range m.hosts {
+		instances[i] = host.instance
+	}
+	hosts := m.hosts
+	vars := m.vars
+	parallelism := m.parallelism
+	healthChecks, onFailure, hooks := m.healthChecks, m.onFailure, m.hooks
+	skips := m.skips
+	state := m.state
+	eventWriter := m.events
+	recorder := m.history
+	locks := m.locks
+	lockPath, force, env := m.lockPath, m.forceUnlock, m.envName
+	configDir := m.configDir
+
+	fleet := &runner.Fleet{
+		Instances:   instances,
+		Concurrency: m.concurrency,
+		Deploy: func(ctx context.Context, index int, instance deploy.Instance) error {
+			host := hosts[index]
+			if host.connectErr != nil {
+				return host.connectErr
+			}
+			if err := locks.acquire(ctx, host.session, instance.Name, lockPath, env, force, events); err != nil {
+				return err
+			}
+			defer func() {
+				if err := locks.release(instance.Name); err != nil {
+					events <- DeploymentWarningMsg{Message: fmt.Sprintf("[%s] %v", instance.Name, err)}
+				}
+			}()
+			r := &runner.Runner{
+				Steps:        steps,
+				Remote:       host.session,
+				Parallelism:  parallelism,
+				Skip:         skips[instance.Name],
+				Vars:         config.HostVars(vars, instance, host.session.Details),
+				HealthChecks: healthChecks,
+				OnFailure:    onFailure,
+				Hooks:        hooks,
+				ConfigDir:    configDir,
+				LocalOutput:  host.outputCh,
+				RemoteOutput: host.outputCh,
+				OutputEvents: eventWriter != nil,
+				OnEvent: func(e runner.Event) {
+					if err := state.Record(instance.Name, e); err != nil {
+						events <- DeploymentWarningMsg{Message: fmt.Sprintf("[%s] Could not save deployment state, --resume will not be available: %v", instance.Name, err)}
+					}
+					if err := eventWriter.Record(instance.Name, e); err != nil {
+						events <- DeploymentWarningMsg{Message: fmt.Sprintf("[%s] Could not write deployment event: %v", instance.Name, err)}
+					}
+					if e.Type == runner.StepOutput {
+						// Output reaches the host pane through its output channel
+						return
+					}
+					recorder.Record(instance.Name, e)
+					events <- HostDeploymentMsg{Host: index, Event: e}
+				},
+			}
+			err := r.Run(ctx)
+			if historyErr := recorder.Finish(ctx, instance.Name, host.session); historyErr != nil {
+				events <- DeploymentWarningMsg{Message: fmt.Sprintf("[%s] Could not record deployment history: %v", instance.Name, historyErr)}
+			}
+			return err
+		},
+		OnHost: func(e runner.HostEvent) {
+			events <- HostStatusMsg{Event: e}
+		},
+	}
+
+	fmt.Fprintf(m.logContent, "[INFO] Deploying to %d instances, %d at a time\n", len(instances), min(max(m.concurrency, 1), len(instances)))
+
+	ctx := m.ctx
+	locks.running.Add(1)
+	go func() {
+		defer locks.running.Done()
+		results, err := fleet.Run(ctx)
+		events <- FleetCompleteMsg{Results: results, Error: err}
+		close(events)
+	}()
+
+	return waitForDeploymentEvent(events)
+}
+
+// updateFleet handles the fan-out messages
+func (m *Model) updateFleet(msg tea.Msg) tea.Cmd {
+	switch msg := msg.(type) {
+	case HostConnectedMsg:
+		host := m.hosts[msg.Host]
+		host.session = msg.Session
+		fmt.Fprintf(host.content, "Connected to %s\n", host.instance.Name)
+		m.recordEvent(m.events.Connection(host.instance, msg.Session.Details, nil))
+		return m.connectHost(msg.Host + 1)
+
+	case HostConnectErrorMsg:
+		host := m.hosts[msg.Host]
+		if m.promptHostKey(msg.Error, msg.Host) {
+			return nil
+		}
+		host.connectErr = msg.Error
+		fmt.Fprintf(host.content, "[ERROR] SSH connection failed: %v\n", msg.Error)
+		m.recordEvent(m.events.Connection(host.instance, nil, msg.Error))
+		fmt.Fprintf(m.logContent, "[ERROR] [%s] SSH connection failed: %v\n", host.instance.Name, msg.Error)
+		return m.connectHost(msg.Host + 1)
+
+	case HostDeploymentMsg:
+		host := m.hosts[msg.Host]
+		e := msg.Event
+		tag := "[" + host.instance.Name + "] "
+		if outsideScript(e) {
+			if line := phaseLogLine(e); line != "" {
+				host.content.WriteString(line + "\n")
+				m.logContent.WriteString(tag + line + "\n")
+			}
+			return waitForDeploymentEvent(m.deploymentEventCh)
+		}
+		switch e.Type {
+		case runner.StepStarted:
+			host.stepNum = e.StepNum
+			host.total = e.Total
+			line := fmt.Sprintf("[STEP] [%d/%d] Running %s: %s%s\n", e.StepNum, e.Total, e.Step.Target, e.Step.Description(), e.Concurrently())
+			host.content.WriteString(line)
+			m.logContent.WriteString(tag + line)
+		case runner.StepSkipped:
+			line := fmt.Sprintf("[INFO] [%d/%d] Skipping %s: %s\n", e.StepNum, e.Total, e.Step.Target, e.Step.Description())
+			host.content.WriteString(line)
+			m.logContent.WriteString(tag + line)
+		case runner.StepRetrying:
+			line := fmt.Sprintf("[WARN] [%d/%d] %s step failed (attempt %d of %d): %s; retrying in %s\n", e.StepNum, e.Total, targetName(e.Step), e.Attempt, e.Step.Retries+1, e.Reason(), e.Delay)
+			host.content.WriteString(line)
+			m.logContent.WriteString(tag + line)
+		case runner.StepProgress:
+			prefix := fmt.Sprintf("[INFO] [%d/%d] %sing: ", e.StepNum, e.Total, targetName(e.Step))
+			host.content.ReplaceLastLine(prefix, prefix+e.Progress.String())
+			m.logContent.ReplaceLastLine(tag+prefix, tag+prefix+e.Progress.String())
+		case runner.StepFinished:
+			var line string
+			switch {
+			case e.Failed() && e.Step.ContinueOnError:
+				line = fmt.Sprintf("[WARN] [%d/%d] %s step failed, continuing: %s\n", e.StepNum, e.Total, targetName(e.Step), e.Reason())
+			case e.Error != nil:
+				line = fmt.Sprintf("[ERROR] [%d/%d] %s step failed: %v\n", e.StepNum, e.Total, targetName(e.Step), e.Error)
+			case !e.Result.Success():
+				line = fmt.Sprintf("[ERROR] [%d/%d] %s step failed: %s\n", e.StepNum, e.Total, targetName(e.Step), e.Result)
+			default:
+				line = fmt.Sprintf("[INFO] [%d/%d] %s step finished in %s\n", e.StepNum, e.Total, targetName(e.Step), e.Result.Duration.Round(100*time.Millisecond))
+			}
+			host.content.WriteString(line)
+			m.logContent.WriteString(tag + line)
+		}
+		return waitForDeploymentEvent(m.deploymentEventCh)
+
+	case HostStatusMsg:
+		host := m.hosts[msg.Event.Index]
+		host.status = msg.Event.Result.Status
+		switch host.status {
+		case runner.HostRunning:
+			fmt.Fprintf(m.logContent, "[INFO] [%s] Deployment started\n", host.instance.Name)
+		case runner.HostSucceeded:
+			fmt.Fprintf(host.content, "[SUCCESS] %s\n", msg.Event.Result)
+		default:
+			fmt.Fprintf(host.content, "[ERROR] %s\n", msg.Event.Result)
+		}
+		return waitForDeploymentEvent(m.deploymentEventCh)
+
+	case FleetCompleteMsg:
+		m.deploymentRunning = false
+		m.deploymentComplete = msg.Error == nil
+		m.logContent.WriteString("[INFO] Deployment summary:\n")
+		for _, result := range msg.Results {
+			level := "[SUCCESS]"
+			if result.Status != runner.HostSucceeded {
+				level = "[ERROR]"
+			}
+			fmt.Fprintf(m.logContent, "%s   %s\n", level, result)
+		}
+		if msg.Error != nil {
+			fmt.Fprintf(m.logContent, "[ERROR] %v\n", msg.Error)
+		} else {
+			m.logContent.WriteString("[SUCCESS] Deployment script completed on all hosts. SSH session preserved for manual use.\n")
+		}
+		return nil
+	}
+	return nil
+}
+
+// switchHostTab moves the remote pane delta tabs to the right (wrapping around)
+// Tab 0 is the interactive shell, tab i is fan-out host i-1
+func (m *Model) switchHostTab(delta int) {
+	tabs := len(m.hosts) + 1
+	m.activeHost = ((m.activeHost+delta)%tabs + tabs) % tabs
+}
+
+// activeHostPane returns the host of the selected remote tab, nil for the interactive shell
+func (m *Model) activeHostPane() *hostPane {
+	if m.activeHost == 0 || m.activeHost > len(m.hosts) {
+		return nil
+	}
+	return m.hosts[m.activeHost-1]
+}
+
+// renderHostTabs renders the remote tab bar: the interactive shell followed by one tab per host
+func (m *Model) renderHostTabs() string {
+	active := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("#FFFFFF")).Background(lipgloss.Color(gopherBlue))
+	inactive := lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+	failed := lipgloss.NewStyle().Foreground(lipgloss.Color(productionRed))
+
+	tabs := []string{" shell "}
+	for _, host := range m.hosts {
+		tabs = append(tabs, " "+host.label()+" ")
+	}
+
+	rendered := make([]string, len(tabs))
+	for i, tab := range tabs {
+		switch {
+		case i == m.activeHost:
+			rendered[i] = active.Render(tab)
+		case i > 0 && m.hosts[i-1].status == runner.HostFailed:
+			rendered[i] = failed.Render(tab)
+		default:
+			rendered[i] = inactive.Render(tab)
+		}
+	}
+	return lipgloss.JoinHorizontal(lipgloss.Top, rendered...)
+}
+
+// closeHosts closes the fan-out SSH sessions
+func (m *Model) closeHosts() {
+	for _, host := range m.hosts {
+		if host.session != nil {
+			host.session.Close()
+		}
+	}
+}
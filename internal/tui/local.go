@@ -0,0 +1,163 @@
+package tui
+
+import (
+	"fmt"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+)
+
+// LocalShellStartedMsg is sent when the local shell has started on its pseudo-terminal
+type LocalShellStartedMsg struct {
+	Session *deploy.LocalTerminalSession
+	Error   error
+}
+
+// LocalShellExitedMsg is sent when the local shell has exited, e.g. after `exit`
+type LocalShellExitedMsg struct {
+	Session *deploy.LocalTerminalSession
+}
+
+// startLocalShell starts the local shell on a pseudo-terminal of the local pane's size
+// Its output is streamed to the local pane until it exits
+func (m *Model) startLocalShell() tea.Cmd {
+	m.localStarting = true
+	ctx := m.ctx
+	outputCh := m.localOutputCh
+	cols, rows := m.localScreen.Size()
+	return func() tea.Msg {
+		session, err := deploy.NewLocalTerminalSession(cols, rows)
+		if err != nil {
+			return LocalShellStartedMsg{Error: err}
+		}
+
+		go func() {
+			buffer := make([]byte, 4096)
+			for {
+				n, err := session.Read(buffer)
+				if n > 0 {
+					data := make([]byte, n)
+					copy(data, buffer[:n])
+					select {
+					case outputCh <- data:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if err != nil {
+					// The pseudo-terminal is closed or the shell has exited
+					return
+				}
+			}
+		}()
+
+		return LocalShellStartedMsg{Session: session}
+	}
+}
+
+// waitForLocalShellExit waits for the local shell to exit
+func waitForLocalShellExit(session *deploy.LocalTerminalSession) tea.Cmd {
+	return func() tea.Msg {
+		<-session.Exited()
+		return LocalShellExitedMsg{Session: session}
+	}
+}
+
+// handleLocalShellStarted stores the started shell and sends it the commands typed while it started
+// When the shell cannot start, local commands fall back to running one at a time
+func (m *Model) handleLocalShellStarted(msg LocalShellStartedMsg) tea.Cmd {
+	m.localStarting = false
+	if msg.Error != nil {
+		m.localOneShot = true
+		fmt.Fprintf(m.logContent, "[WARN] %v, local commands will run one at a time\n", msg.Error)
+		pending := m.localPending
+		m.localPending = nil
+		cmds := make([]tea.Cmd, 0, len(pending))
+		for _, command := range pending {
+			cmds = append(cmds, m.runLocalCommand(command))
+		}
+		return tea.Batch(cmds...)
+	}
+
+	m.localSession = msg.Session
+	m.resizeLocalTerminal()
+	for _, command := range m.localPending {
+		if err := m.localSession.Write([]byte(command + "\n")); err != nil {
+			fmt.Fprintf(m.logContent, "[ERROR] %v\n", err)
+			break
+		}
+	}
+	m.localPending = nil
+	return waitForLocalShellExit(msg.Session)
+}
+
+// handleLocalShellExited cleans up after the local shell exits
+// The next local command starts a new shell
+func (m *Model) handleLocalShellExited(msg LocalShellExitedMsg) {
+	msg.Session.Close()
+	if msg.Session != m.localSession {
+		return
+	}
+	m.localSession = nil
+	m.logContent.WriteString("[INFO] Local shell exited, the next local command starts a new one\n")
+}
+
+// sendLocalCommand types a command into the local shell, starting the shell if it is not running
+func (m *Model) sendLocalCommand(command string) tea.Cmd {
+	switch {
+	case m.localSession != nil:
+		if err := m.localSession.Write([]byte(command + "\n")); err != nil {
+			fmt.Fprintf(m.logContent, "[ERROR] %v\n", err)
+		}
+		return nil
+	case m.localOneShot:
+		return m.runLocalCommand(command)
+	}
+	m.localPending = append(m.localPending, command)
+	if m.localStarting {
+		return nil
+	}
+	return m.startLocalShell()
+}
+
+// runLocalCommand runs a single command without the local shell, echoing a prompt before it
+func (m *Model) runLocalCommand(command string) tea.Cmd {
+	m.localScreen.Write([]byte(fmt.Sprintf("%s@%s $ %s\r\n", m.localUser, m.localHost, command)))
+	return m.StartLocalCommand(command)
+}
+
+// interruptLocal sends an interrupt to the foreground process of the local shell
+func (m *Model) interruptLocal() {
+	if m.localSession != nil {
+		m.localSession.Write([]byte{3})
+	}
+}
+
+// resizeLocalTerminal resizes the emulated terminal and the PTY of the local shell to the local pane
+func (m *Model) resizeLocalTerminal() {
+	style := m.localViewport.Style
+	m.localScreen.Resize(m.localViewport.Width-style.GetHorizontalFrameSize(), m.localViewport.Height-style.GetVerticalFrameSize())
+	if m.localSession != nil {
+		m.localSession.Resize(m.localScreen.Size())
+	}
+}
+
+// closeLocalShell stops the local shell
+func (m *Model) closeLocalShell() {
+	if m.localSession != nil {
+		m.localSession.Close()
+		m.localSession = nil
+	}
+}
+
+// onlcrOutput returns a channel whose output is forwarded to out with carriage returns
+// added, for output that does not go through a PTY; the returned channel must be closed
+func onlcrOutput(out chan<- []byte) chan<- []byte {
+	in := make(chan []byte, 100)
+	go func() {
+		for data := range in {
+			out <- onlcr(data)
+		}
+	}()
+	return in
+}
@@ -0,0 +1,98 @@
+package tui
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLocalModel returns a model whose local pane is 40x10
+func newLocalModel(t *testing.T) *Model {
+	t.Helper()
+	m, err := New(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m.ctx = ctx
+	m.localViewport.Width, m.localViewport.Height = 40, 10
+	return m
+}
+
+func TestLocalShell(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	m := newLocalModel(t)
+	defer m.closeLocalShell()
+
+	// Commands typed while the shell starts are sent once it is running
+	start := m.sendLocalCommand("cd / && GCD_TEST=kept")
+	if start == nil || !m.localStarting {
+		t.Fatal("sendLocalCommand() did not start the local shell")
+	}
+	if cmd := m.sendLocalCommand(`echo "$PWD$GCD_TEST"'-ok'`); cmd != nil {
+		t.Error("sendLocalCommand() started a second shell while the first was starting")
+	}
+	msg, ok := start().(LocalShellStartedMsg)
+	if !ok || msg.Error != nil {
+		t.Fatalf("starting the local shell = %+v", msg)
+	}
+	wait := m.handleLocalShellStarted(msg)
+	if m.localSession == nil || len(m.localPending) != 0 {
+		t.Fatalf("local shell not running with the pending commands sent: %d left", len(m.localPending))
+	}
+
+	// Both commands ran in the same shell
+	var output strings.Builder
+	deadline := time.After(5 * time.Second)
+	for !strings.Contains(output.String(), "/kept-ok") {
+		select {
+		case data := <-m.localOutputCh:
+			output.Write(data)
+		case <-deadline:
+			t.Fatalf("local pane output %q, want the commands run in one shell", output.String())
+		}
+	}
+
+	m.sendLocalCommand("exit")
+	exited, ok := wait().(LocalShellExitedMsg)
+	if !ok {
+		t.Fatal("waitForLocalShellExit() did not report the shell exiting")
+	}
+	m.handleLocalShellExited(exited)
+	if m.localSession != nil {
+		t.Error("local shell still set after it exited")
+	}
+	if log := strings.Join(lines(m.logContent), "\n"); !strings.Contains(log, "Local shell exited") {
+		t.Errorf("log = %q, want the exit reported", log)
+	}
+}
+
+func TestLocalShellFallback(t *testing.T) {
+	m := newLocalModel(t)
+	m.localUser, m.localHost = "dev", "laptop"
+	m.sendLocalCommand("make build")
+	m.sendLocalCommand("make test")
+
+	// Without a pseudo-terminal the pending commands run one at a time
+	if cmd := m.handleLocalShellStarted(LocalShellStartedMsg{Error: errors.New("no pty")}); cmd == nil {
+		t.Error("handleLocalShellStarted() did not run the pending commands")
+	}
+	if !m.localOneShot || m.localStarting || len(m.localPending) != 0 {
+		t.Errorf("after the shell failed to start: one shot %v, starting %v, pending %q", m.localOneShot, m.localStarting, m.localPending)
+	}
+	if log := strings.Join(lines(m.logContent), "\n"); !strings.Contains(log, "no pty, local commands will run one at a time") {
+		t.Errorf("log = %q, want the fallback reported", log)
+	}
+
+	m.sendLocalCommand("make install")
+	if m.localStarting {
+		t.Error("sendLocalCommand() started a shell after falling back")
+	}
+	screen, _ := plainRows(m.localScreen)
+	if got := strings.Join(screen, "\n"); !strings.Contains(got, "dev@laptop $ make install") {
+		t.Errorf("local pane = %q, want each command echoed after a prompt", got)
+	}
+}
@@ -0,0 +1,114 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/wclewett/gcdeploy/internal/runner"
+)
+
+// lockReleaseTimeout bounds releasing the locks when quitting, so a dead connection cannot hang the TUI
+const lockReleaseTimeout = 5 * time.Second
+
+// deploymentStopTimeout bounds waiting for cancelled deployments to finish when quitting
+const deploymentStopTimeout = 10 * time.Second
+
+// heldLocks tracks the deployment locks taken by the deployments running in the background
+type heldLocks struct {
+	mu      sync.Mutex
+	locks   map[string]*runner.Lock // Keyed by instance name
+	running sync.WaitGroup          // Deployments that may take or hold a lock
+}
+
+// acquire takes the deployment lock on host, reporting a lock removed with force on events
+func (h *heldLocks) acquire(ctx context.Context, remote runner.RemoteExecutor, host, path, env string, force bool, events chan<- tea.Msg) error {
+	lock, broken, err := runner.AcquireLock(ctx, remote, host, path, env, force)
+	if broken != nil {
+		events <- DeploymentWarningMsg{Message: fmt.Sprintf("[%s] Removed the deployment lock held by %s", host, broken)}
+	}
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.locks[host] = lock
+	return nil
+}
+
+// release releases the lock on host, if it is still held
+func (h *heldLocks) release(host string) error {
+	h.mu.Lock()
+	lock := h.locks[host]
+	delete(h.locks, host)
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+	defer cancel()
+	return lock.Release(ctx)
+}
+
+// releaseAll releases every lock still held, when quitting mid-deployment
+func (h *heldLocks) releaseAll() {
+	h.mu.Lock()
+	hosts := make([]string, 0, len(h.locks))
+	for host := range h.locks {
+		hosts = append(hosts, host)
+	}
+	h.mu.Unlock()
+
+	for _, host := range hosts {
+		h.release(host)
+	}
+}
+
+// stopDeployments cancels the deployments running in the background when quitting and
+// waits for them to finish, so that each releases its lock after its last remote command
+// Locks still held after deploymentStopTimeout are released regardless
+func (m *Model) stopDeployments() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		m.locks.running.Wait()
+		close(done)
+	}()
+
+	// Update no longer reads the deployment messages and output, so drain them here to keep
+	// the deployments from blocking on a full channel
+	events := m.deploymentEventCh
+	outputs := []chan []byte{m.localOutputCh, m.terminalOutputCh}
+	for _, host := range m.hosts {
+		outputs = append(outputs, host.outputCh)
+	}
+	for _, ch := range outputs {
+		go func() {
+			for {
+				select {
+				case <-ch:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	timeout := time.After(deploymentStopTimeout)
+wait:
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case <-done:
+			break wait
+		case <-timeout:
+			break wait
+		}
+	}
+	m.locks.releaseAll()
+}
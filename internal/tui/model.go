@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"os/user"
 	"regexp"
 	"strings"
@@ -19,6 +18,8 @@ import (
 	"github.com/muesli/reflow/wordwrap"
 	"github.com/wclewett/gcdeploy/internal/config"
 	"github.com/wclewett/gcdeploy/internal/deploy"
+	"github.com/wclewett/gcdeploy/internal/history"
+	"github.com/wclewett/gcdeploy/internal/runner"
 )
 
 var helpStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("241")).Render
@@ -27,6 +28,8 @@ var helpStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("241")).Render
 const gopherBlue = "#00ADD8"
 // Rust crab orange color (#CE412B)
 const rustCrab = "#CE412B"
+// Production warning red (#FF3B30)
+const productionRed = "#FF3B30"
 const gutter = 2
 
 // ShellMode represents the current shell mode
@@ -68,6 +71,7 @@ type PassphraseSubmittedMsg struct {
 // TerminalConnectedMsg is sent when terminal session is established
 type TerminalConnectedMsg struct {
 	Session *deploy.TerminalSession
+	Details *deploy.InstanceDetails // Nil if the instance could not be resolved after connecting
 }
 
 // DeploymentStepMsg is sent when a deployment step starts
@@ -75,27 +79,81 @@ type DeploymentStepMsg struct {
 	StepNum int
 	Total   int
 	Step    config.DeploymentStep
+
+	Concurrently string // Steps still running alongside this one, see runner.Event.Concurrently
+}
+
+// DeploymentStepDoneMsg is sent when a deployment step has finished running
+type DeploymentStepDoneMsg struct {
+	StepNum int
+	Total   int
+	Step    config.DeploymentStep
+	Result  deploy.CommandResult
+	Error   error
+}
+
+// DeploymentSkippedMsg is sent when a deployment step is not selected to run
+type DeploymentSkippedMsg struct {
+	StepNum int
+	Total   int
+	Step    config.DeploymentStep
+}
+
+// DeploymentWarningMsg reports a problem that does not stop the deployment
+type DeploymentWarningMsg struct {
+	Message string
+}
+
+// DeploymentProgressMsg is sent while an upload or download step transfers files
+type DeploymentProgressMsg struct {
+	StepNum  int
+	Total    int
+	Step     config.DeploymentStep
+	Progress deploy.TransferProgress
+}
+
+// DeploymentRetryMsg is sent when a step attempt failed and the step will be retried
+type DeploymentRetryMsg struct {
+	StepNum int
+	Total   int
+	Step    config.DeploymentStep
+	Result  deploy.CommandResult
+	Error   error
+	Attempt int
+	Delay   time.Duration
+}
+
+// DeploymentFailedMsg is sent when the deployment script stops because a step failed
+type DeploymentFailedMsg struct {
+	Error error
 }
 
 // DeploymentCompleteMsg is sent when deployment script completes
 type DeploymentCompleteMsg struct{}
 
-// tickMsg is sent periodically to check for new output
-type tickMsg struct{}
+// DeploymentFinishedMsg is sent when the deployment goroutine closes its event channel,
+// after the lock is released and the history recorded
+type DeploymentFinishedMsg struct{}
+
+// DeploymentPhaseMsg reports a hook, a health check or an on_failure step, which run
+// around the deployment steps
+type DeploymentPhaseMsg struct {
+	Event runner.Event
+}
 
 type Model struct {
 	// Split pane viewports
 	localViewport  viewport.Model
 	remoteViewport viewport.Model
-	localContent   string
-	remoteContent  string
+	localScreen    *terminalScreen // Emulated terminal of the local shell
+	remoteScreen   *terminalScreen // Emulated terminal of the interactive shell
 	
 	// Log area at bottom
-	logContent string
+	logContent *scrollback
 	
 	// Legacy single viewport (for non-terminal mode)
 	viewport viewport.Model
-	content  string
+	content  *scrollback
 	
 	width  int
 	height int
@@ -106,15 +164,28 @@ type Model struct {
 	terminalSession *deploy.TerminalSession
 	instance        deploy.Instance
 	command         string
-	credentialsPath string
+	resolver        deploy.InstanceResolver
 	sshKeyPath      string
 	ctx             context.Context
+	cancel          context.CancelFunc // Cancels ctx when quitting, stopping the deployments
+	
+	// Environment selected with --env (empty for the shared defaults)
+	envName    string
+	production bool
+	
+	// Variables for ${{ name }} references in commands
+	vars map[string]string
 	
 	// Passphrase input state
 	passphraseInput textinput.Model
 	needsPassphrase bool
 	pendingPassphrase string
 	
+	// Host key verification state
+	hostKeys           *deploy.HostKeyVerifier
+	pendingHostKey     *deploy.HostKeyError
+	pendingHostKeyHost int // Fan-out host the pending key belongs to, -1 for the interactive shell
+	
 	// Terminal mode
 	terminalMode bool
 	terminalInputCh chan []byte
@@ -127,16 +198,44 @@ type Model struct {
 	
 	// Vim mode (insert vs normal)
 	vimMode VimMode
+	copy    *copyMode // Navigation of the focused pane in normal mode, nil while the panes follow their output
+	
+	// Attach mode: every key goes to the remote shell, which fills the window
+	attached bool
 	
 	// Deployment script state
 	deploymentSteps []config.DeploymentStep
+	parallelism int // Independent steps run at once
+	healthChecks []config.HealthCheck // Run once every step has succeeded
+	onFailure []config.DeploymentStep // Run when a health check fails
+	hooks config.Hooks // Run before and after the deployment steps
+	skips map[string]map[int]bool // Steps not to run, keyed by instance name
+	plan *runner.Plan // Set with --dry-run: shown for confirmation before deploying
+	awaitingPlanConfirm bool
+	planConfirmed bool
+	state *runner.StateRecorder // Saves progress for --resume
+	events *runner.EventWriter // Streams the deployment as JSON (--events-file)
+	history *history.Recorder // Appends the deployment to the history files
+	lockPath string // Deployment lock directory on the VM
+	configDir string // Directory holding .gcd.toml, where .gcdignore is read from
+	forceUnlock bool // Remove a lock left by another deployment (--force-unlock)
+	locks *heldLocks // Locks held by running deployments, released on quit
 	currentStep int
 	deploymentRunning bool
+	deploymentEventCh chan tea.Msg
 	deploymentComplete bool
 	
+	// Fan-out deployment state (empty with a single instance)
+	hosts       []*hostPane
+	activeHost  int // Remote tab: 0 is the interactive shell, i is hosts[i-1]
+	concurrency int
+	
 	// Local shell output
 	localOutputCh chan []byte
-	localErrCh chan error
+	localSession  *deploy.LocalTerminalSession // Nil until the local shell starts and after it exits
+	localStarting bool                         // The local shell is starting
+	localPending  []string                     // Commands typed while the local shell starts
+	localOneShot  bool                         // No pseudo-terminal: local commands run one at a time
 	
 	// TUI status messages (shown below command prompt)
 	statusMessage string
@@ -202,15 +301,17 @@ func New(debug bool) (*Model, error) {
 	
 	return &Model{
 		viewport:         vp,
-		content:          "",
+		content:          newScrollback(defaultScrollback, wrapContentLine),
 		localViewport:    localVp,
 		remoteViewport:   remoteVp,
-		localContent:     "",
-		remoteContent:    "",
-		logContent:       "",
+		localScreen:      newTerminalScreen(80, 24),
+		remoteScreen:     newTerminalScreen(80, 24),
+		logContent:       newScrollback(defaultScrollback, wrapLine),
 		passphraseInput:  passphraseTi,
 		commandInput:     commandTi,
 		needsPassphrase:  false,
+		hostKeys:         deploy.NewHostKeyVerifier(deploy.HostKeyPrompt),
+		pendingHostKeyHost: -1,
 		terminalMode:     false,
 		terminalInputCh:  make(chan []byte, 100),
 		terminalOutputCh: make(chan []byte, 100),
@@ -222,13 +323,13 @@ func New(debug bool) (*Model, error) {
 		deploymentRunning: false,
 		deploymentComplete: false,
 		localOutputCh:    make(chan []byte, 100),
-		localErrCh:       make(chan error, 1),
 		statusMessage:    "",
 		localUser:        localUser,
 		localHost:        localHost,
 		remoteUser:       "user", // Default, will be updated when SSH connects
 		remoteHost:       "remote",
 		debug:            debug,
+		locks:            &heldLocks{locks: make(map[string]*runner.Lock)},
 	}, nil
 }
 
@@ -272,29 +373,30 @@ func (m *Model) checkPassphraseNeeded() bool {
 func (m *Model) Init() tea.Cmd {
 	// Always start in terminal mode with both panes visible
 	m.terminalMode = true
-	m.localContent = fmt.Sprintf("Local Shell Ready\n%s@%s\n", m.localUser, m.localHost)
-	m.remoteContent = "Waiting for connection...\n"
+	m.setRemoteStatus("Waiting for connection...")
+	// Start the local shell and deliver the output of every pane as it arrives
+	background := tea.Batch(m.startLocalShell(), m.waitForAllOutput())
 	
 	// Check if passphrase is needed BEFORE attempting connection
 	if m.checkPassphraseNeeded() {
 		m.needsPassphrase = true
 		m.commandInput.EchoMode = textinput.EchoPassword
 		m.commandInput.Focus()
-		m.logContent += "[INFO] SSH key requires a passphrase. Enter it below and press Enter.\n"
-		m.remoteContent = "Passphrase required for SSH key...\n"
+		m.logContent.WriteString("[INFO] SSH key requires a passphrase. Enter it below and press Enter.\n")
+		m.setRemoteStatus("Passphrase required for SSH key...")
 		return tea.Batch(
 			tea.EnterAltScreen,
-			tick(),
+			background,
 			textinput.Blink,
 		)
 	}
 	
 	// No passphrase needed, attempt connection immediately
-	m.remoteContent = "Connecting to remote terminal...\n"
+	m.setRemoteStatus("Connecting to remote terminal...")
 	return tea.Batch(
 		tea.EnterAltScreen,
-		m.StartTerminalSession(m.ctx, m.instance, m.command, m.credentialsPath, m.sshKeyPath, ""),
-		tick(),
+		m.StartTerminalSession(m.ctx, m.instance, m.command, m.resolver, m.sshKeyPath, ""),
+		background,
 		textinput.Blink,
 	)
 }
@@ -304,29 +406,134 @@ func (m *Model) SetInstanceAndCommand(
 	ctx context.Context,
 	instance deploy.Instance,
 	command string,
-	credentialsPath string,
+	resolver deploy.InstanceResolver,
 	sshKeyPath string,
 	deploymentSteps []config.DeploymentStep,
 ) {
-	m.ctx = ctx
+	m.ctx, m.cancel = context.WithCancel(ctx)
 	m.instance = instance
 	m.command = command
-	m.credentialsPath = credentialsPath
+	m.resolver = resolver
+	if m.resolver == nil {
+		m.resolver = deploy.GcloudResolver{}
+	}
 	m.sshKeyPath = sshKeyPath
 	m.deploymentSteps = deploymentSteps
 
 		// Initialize content
 		if len(deploymentSteps) > 0 {
-			m.logContent += "[INFO] Deployment script detected. Starting deployment...\n"
-			m.content = ""
+			m.logContent.WriteString("[INFO] Deployment script detected. Starting deployment...\n")
+			m.content.Reset()
 		} else {
 		// Initialize content with the command displayed at the top
 		// Use a default width for separator, will be updated on window resize
-		m.content = fmt.Sprintf("$ %s\n", command)
-		m.content += strings.Repeat("─", 80) + "\n\n"
+		m.content.Reset()
+		fmt.Fprintf(m.content, "$ %s\n", command)
+		m.content.WriteString(strings.Repeat("─", 80) + "\n\n")
+	}
+}
+
+// SetEnvironment sets the environment shown in the header
+// Production environments get a red header and remote pane border
+func (m *Model) SetEnvironment(name string, production bool) {
+	m.envName = name
+	m.production = production
+	if production {
+		m.remoteViewport.Style = m.remoteViewport.Style.BorderForeground(lipgloss.Color(productionRed))
+	}
+}
+
+// SetVars sets the values substituted for ${{ name }} in the command and deployment steps
+func (m *Model) SetVars(vars map[string]string) {
+	m.vars = vars
+}
+
+// SetEventWriter streams connection and deployment events to events
+func (m *Model) SetEventWriter(events *runner.EventWriter) {
+	m.events = events
+}
+
+// SetHistory records the deployment in the history files once it has finished
+func (m *Model) SetHistory(recorder *history.Recorder) {
+	m.history = recorder
+}
+
+// SetLock sets the deployment lock taken on each VM before deploying
+// With force, a lock held by another deployment is removed first
+func (m *Model) SetLock(path string, force bool) {
+	m.lockPath = path
+	m.forceUnlock = force
+}
+
+// SetConfigDir sets the directory holding .gcd.toml, where transfer steps read .gcdignore
+func (m *Model) SetConfigDir(dir string) {
+	m.configDir = dir
+}
+
+// SetScrollback sets how many lines of output each pane keeps, 0 for the default
+func (m *Model) SetScrollback(lines int) {
+	if lines == 0 {
+		lines = defaultScrollback
+	}
+	m.localScreen.SetScrollback(lines)
+	m.remoteScreen.SetScrollback(lines)
+	m.logContent.SetLimit(lines)
+	m.content.SetLimit(lines)
+	for _, host := range m.hosts {
+		host.content.SetLimit(lines)
 	}
 }
 
+// recordEvent warns about the first event that could not be written
+func (m *Model) recordEvent(err error) {
+	if err != nil {
+		fmt.Fprintf(m.logContent, "[WARN] Could not write deployment event: %v\n", err)
+	}
+}
+
+// SetParallelism sets how many independent deployment steps (see depends_on) run at once
+func (m *Model) SetParallelism(parallelism int) {
+	m.parallelism = parallelism
+}
+
+// SetSelection sets the steps to skip on each instance and where to save progress
+func (m *Model) SetSelection(skips map[string]map[int]bool, state *runner.StateRecorder) {
+	m.skips = skips
+	m.state = state
+}
+
+// SetHealthChecks sets the checks run once every deployment step has succeeded, and the
+// steps run when one of them fails
+func (m *Model) SetHealthChecks(checks []config.HealthCheck, onFailure []config.DeploymentStep) {
+	m.healthChecks = checks
+	m.onFailure = onFailure
+}
+
+// SetHooks sets the steps run before and after the deployment steps
+func (m *Model) SetHooks(hooks config.Hooks) {
+	m.hooks = hooks
+}
+
+// SetPlan makes the TUI show the deployment plan and wait for confirmation before deploying
+func (m *Model) SetPlan(plan *runner.Plan) {
+	m.plan = plan
+}
+
+// setRemoteStatus replaces the remote pane with a status line, until the shell is connected
+func (m *Model) setRemoteStatus(status string) {
+	m.remoteScreen.Reset()
+	m.remoteScreen.Write([]byte(status + "\r\n"))
+}
+
+// hostVars returns the variables for commands run on the interactive shell's instance
+func (m *Model) hostVars() map[string]string {
+	var details *deploy.InstanceDetails
+	if m.terminalSession != nil {
+		details = m.terminalSession.Details
+	}
+	return config.HostVars(m.vars, m.instance, details)
+}
+
 // buildContentHeader builds the command header with separator
 func (m Model) buildContentHeader() string {
 	width := m.viewport.Width
@@ -350,6 +557,14 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		// Handle host key confirmation before anything else
+		if m.pendingHostKey != nil {
+			return m.handleHostKeyConfirm(msg)
+		}
+		if m.awaitingPlanConfirm {
+			return m.handlePlanConfirm(msg)
+		}
+
 		// Handle passphrase input in terminal mode (show in command prompt area)
 		if m.needsPassphrase && m.terminalMode {
 			// In terminal mode, passphrase input is handled via command input
@@ -365,12 +580,11 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.needsPassphrase = false
 				m.commandInput.EchoMode = textinput.EchoNormal // Reset to normal mode
 				m.commandInput.SetValue("")
-				m.logContent += "[INFO] Passphrase received. Connecting...\n"
-				m.remoteContent = "Connecting to remote terminal...\n"
+				m.logContent.WriteString("[INFO] Passphrase received. Connecting...\n")
+				m.setRemoteStatus("Connecting to remote terminal...")
 				// Retry connection with passphrase
 				return m, tea.Batch(
-					m.StartTerminalSession(m.ctx, m.instance, m.command, m.credentialsPath, m.sshKeyPath, m.pendingPassphrase),
-					tick(),
+					m.StartTerminalSession(m.ctx, m.instance, m.command, m.resolver, m.sshKeyPath, m.pendingPassphrase),
 					textinput.Blink,
 				)
 			case "esc":
@@ -378,7 +592,7 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.needsPassphrase = false
 				m.commandInput.EchoMode = textinput.EchoNormal // Reset to normal mode
 				m.commandInput.SetValue("")
-				m.logContent += "[INFO] Passphrase input cancelled\n"
+				m.logContent.WriteString("[INFO] Passphrase input cancelled\n")
 				return m, nil
 			default:
 				// Update command input (used for passphrase)
@@ -402,22 +616,17 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.passphraseInput.SetValue("")
 				m.passphraseInput.Blur()
 				// Show connecting message in content (non-terminal mode)
-				m.content += "[INFO] Passphrase received. Connecting...\n"
-				m.viewport.SetContent(m.wrapContent(m.content))
-				m.viewport.GotoBottom()
+				m.content.WriteString("[INFO] Passphrase received. Connecting...\n")
+				m.content.GotoBottom()
 				// Retry connection with passphrase
-				return m, tea.Batch(
-					m.StartSSHStream(m.ctx, m.instance, m.command, m.credentialsPath, m.sshKeyPath),
-					tick(),
-				)
+				return m, m.StartSSHStream(m.ctx, m.instance, m.command, m.resolver, m.sshKeyPath)
 			case "esc":
 				// Cancel passphrase input
 				m.needsPassphrase = false
 				m.passphraseInput.SetValue("")
 				m.passphraseInput.Blur()
-				m.content += "[INFO] Passphrase input cancelled\n"
-				m.viewport.SetContent(m.wrapContent(m.content))
-				m.viewport.GotoBottom()
+				m.content.WriteString("[INFO] Passphrase input cancelled\n")
+				m.content.GotoBottom()
 				return m, nil
 			default:
 				// Update passphrase input
@@ -427,45 +636,80 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		
 		
+		// Forward every key to the remote shell when attached
+		if m.terminalMode && m.passthrough() {
+			return m.handleAttachedKey(msg)
+		}
+		
 		// Handle terminal mode input with command input field
 		if m.terminalMode {
 			keyStr := msg.String()
 			
+			// A search being typed takes every key, and Escape cancels a selection first
+			if m.vimMode == NormalMode && m.copy != nil {
+				if m.copy.searching {
+					m.handleSearchKey(msg)
+					return m, nil
+				}
+				if keyStr == "esc" && m.copy.visual {
+					m.copy.visual = false
+					return m, nil
+				}
+			}
+			
 			// Handle vim mode toggle (Escape key)
 			if keyStr == "esc" {
+				m.stopCopy()
 				if m.vimMode == InsertMode {
 					m.vimMode = NormalMode
-					m.logContent += "[INFO] Normal mode (press 'i' to insert, 'q' to quit)\n"
+					m.logContent.WriteString("[INFO] Normal mode (press 'i' to insert, 'q' to quit)\n")
 					m.commandInput.Blur()
 				} else {
 					m.vimMode = InsertMode
-					m.logContent += "[INFO] Insert mode\n"
+					m.logContent.WriteString("[INFO] Insert mode\n")
 					// Focus command input when entering insert mode
 					m.commandInput.Focus()
 				}
-				return m, tick()
+				return m, nil
 			}
 			
 			// Handle quit only in normal mode
 			if keyStr == "q" && m.vimMode == NormalMode {
-				if m.terminalSession != nil {
-					m.terminalSession.Close()
-				}
-				if m.session != nil {
-					m.session.Close()
+				return m, m.quit()
+			}
+			
+			// Handle host tab switching in normal mode
+			if (keyStr == "[" || keyStr == "]") && m.vimMode == NormalMode && m.fanOut() {
+				m.stopCopy()
+				if keyStr == "]" {
+					m.switchHostTab(1)
+				} else {
+					m.switchHostTab(-1)
 				}
-				return m, tea.Quit
+				return m, nil
 			}
 			
 			// Handle 'i' key in normal mode to enter insert mode
 			if keyStr == "i" && m.vimMode == NormalMode {
+				m.stopCopy()
 				m.vimMode = InsertMode
-				m.logContent += "[INFO] Insert mode\n"
+				m.logContent.WriteString("[INFO] Insert mode\n")
 				m.commandInput.Focus()
-				return m, tick()
+				return m, nil
+			}
+			
+			// Handle 'a' key in normal mode to attach to the remote shell
+			if keyStr == "a" && m.vimMode == NormalMode {
+				m.attach()
+				return m, nil
 			}
 			
-			// In normal mode, only allow special keys (quit, insert, mode toggle)
+			// Handle pane navigation, search and copy in normal mode
+			if m.vimMode == NormalMode && m.handleCopyKey(keyStr) {
+				return m, nil
+			}
+			
+			// In normal mode, only allow special keys (quit, insert, attach, mode toggle)
 			// All other keys are ignored
 			if m.vimMode == NormalMode {
 				// Allow Shift+Tab for shell mode switching
@@ -480,12 +724,13 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			// Handle mode toggle (Shift+Tab)
 			if keyStr == "shift+tab" {
 				// Toggle between local and remote shell
+				m.stopCopy()
 				if m.shellMode == RemoteShell {
 					m.shellMode = LocalShell
-					m.logContent += "[INFO] Switched to local shell mode\n"
+					m.logContent.WriteString("[INFO] Switched to local shell mode\n")
 				} else {
 					m.shellMode = RemoteShell
-					m.logContent += "[INFO] Switched to remote shell mode\n"
+					m.logContent.WriteString("[INFO] Switched to remote shell mode\n")
 				}
 				// Clear command input when switching modes
 				m.commandInput.SetValue("")
@@ -517,53 +762,41 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					
 					// Route command based on shell mode
 					if m.shellMode == LocalShell {
-						// Prepend prompt to local shell before command
-						prompt := fmt.Sprintf("%s@%s $ %s\n", m.localUser, m.localHost, commandText)
-						m.localContent += prompt
-						// Execute locally
+						// Type the command into the local shell, which echoes it after its prompt
 						return m, tea.Batch(
-							m.StartLocalCommand(commandText),
-							tick(),
+							m.sendLocalCommand(commandText),
 							inputCmd,
 						)
 					} else {
-						// Execute remotely
+						// Execute remotely in the interactive shell, so show its tab
+						m.activeHost = 0
 						if m.terminalSession == nil {
-							// Send error to output channel
-							select {
-							case m.terminalOutputCh <- []byte(fmt.Sprintf("\n[ERROR] Terminal session is nil\n")):
-							default:
-							}
+							m.remoteScreen.Write([]byte("\r\n[ERROR] Terminal session is nil\r\n"))
 						} else {
 							// Send command to terminal (terminal will echo it)
 							commandWithNewline := commandText + "\n"
 							if err := m.terminalSession.Write([]byte(commandWithNewline)); err != nil {
-								// Send error to output channel so it displays
-								select {
-								case m.terminalOutputCh <- []byte(fmt.Sprintf("\n[ERROR] Failed to send command: %v\n", err)):
-								default:
-								}
+								m.remoteScreen.Write([]byte(fmt.Sprintf("\r\n[ERROR] Failed to send command: %v\r\n", err)))
 							} else if m.debug {
 								// Debug: confirm command was sent
-								select {
-								case m.terminalOutputCh <- []byte(fmt.Sprintf("\n[DEBUG] Sent command: %s\n", commandText)):
-								default:
-								}
+								m.remoteScreen.Write([]byte(fmt.Sprintf("\r\n[DEBUG] Sent command: %s\r\n", commandText)))
 							}
 						}
 					}
 				}
-				return m, tea.Batch(tick(), inputCmd)
+				return m, inputCmd
 			case "ctrl+c":
-				// Send interrupt to terminal
-				if m.terminalSession != nil {
+				// Send interrupt to the foreground process of the focused shell
+				if m.shellMode == LocalShell {
+					m.interruptLocal()
+				} else if m.terminalSession != nil {
 					m.terminalSession.Write([]byte{3})
 				}
 				// Clear command input
 				m.commandInput.SetValue("")
 				var inputCmd tea.Cmd
 				m.commandInput, inputCmd = m.commandInput.Update(msg)
-				return m, tea.Batch(tick(), inputCmd)
+				return m, inputCmd
 			case "up":
 				// Navigate command history
 				if len(m.commandHistory) > 0 {
@@ -582,25 +815,22 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		
 		switch msg.String() {
 		case "ctrl+c", "q":
-			if m.session != nil {
-				m.session.Close()
-			}
-			return m, tea.Quit
+			return m, m.quit()
 		case "up":
 			if !m.needsPassphrase && !m.terminalMode {
-				m.viewport.ScrollUp(1)
+				m.content.ScrollUp(1)
 			}
 		case "down":
 			if !m.needsPassphrase && !m.terminalMode {
-				m.viewport.ScrollDown(1)
+				m.content.ScrollDown(1)
 			}
 		case "ctrl+u":
 			if !m.needsPassphrase && !m.terminalMode {
-				m.viewport.PageUp()
+				m.content.ScrollUp(m.viewport.Height)
 			}
 		case "ctrl+d":
 			if !m.needsPassphrase && !m.terminalMode {
-				m.viewport.PageDown()
+				m.content.ScrollDown(m.viewport.Height)
 			}
 		}
 
@@ -610,10 +840,11 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		if m.terminalMode {
 			// Terminal mode: calculate split pane sizes
+			headerHeight := 1
 			logAreaHeight := 4
 			commandAreaHeight := 1 // Always single line
 			helpHeight := 1
-			reservedHeight := logAreaHeight + commandAreaHeight + helpHeight
+			reservedHeight := headerHeight + logAreaHeight + commandAreaHeight + helpHeight
 			
 			paneHeight := msg.Height - reservedHeight
 			if paneHeight < 5 {
@@ -636,15 +867,11 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.commandInput.Width = 1
 			}
 			
-			// Resize terminal PTY to match remote pane width
-			if m.terminalSession != nil && paneWidth > 0 && paneHeight > 0 {
-				// Account for border padding
-				borderWidth := m.remoteViewport.Style.GetHorizontalFrameSize()
-				termWidth := paneWidth - borderWidth
-				if termWidth > 0 {
-					m.terminalSession.Resize(termWidth, paneHeight)
-				}
-			}
+			// Resize the emulated terminals and the PTYs to the panes, or the window when attached
+			// Rows being navigated were laid out for the old size
+			m.stopCopy()
+			m.resizeLocalTerminal()
+			m.resizeRemoteTerminal()
 		} else {
 			// Non-terminal mode: single viewport
 			borderStyle := m.viewport.Style
@@ -665,172 +892,181 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.viewport.Height = availableHeight
 
 			// Ensure content has command header
-			if !strings.HasPrefix(m.content, "$ ") {
-				m.content = m.buildContentHeader() + m.content
+			if !strings.HasPrefix(m.content.Line(0), "$ ") {
+				m.content.Prepend(m.buildContentHeader())
 			}
-			
-			m.viewport.SetContent(m.wrapContent(m.content))
 		}
 
-	case tickMsg:
-		// Handle terminal mode output
-		if m.terminalMode {
-			// Read output from both local and remote channels
-			maxReads := 10 // Limit reads per tick to avoid blocking
-			reads := 0
-			
-			// Read from remote terminal output
-			for reads < maxReads {
-				select {
-				case data, ok := <-m.terminalOutputCh:
-					if ok {
-						m.remoteContent += string(data)
-						reads++
-					} else {
-						goto doneRemoteReading
-					}
-				default:
-					goto doneRemoteReading
-				}
-			}
-		doneRemoteReading:
-			
-			// Read from local command output
-			for reads < maxReads {
-				select {
-				case data, ok := <-m.localOutputCh:
-					if ok {
-						m.localContent += string(data)
-						reads++
-					} else {
-						goto doneLocalReading
-					}
-				default:
-					goto doneLocalReading
-				}
-			}
-		doneLocalReading:
-			
-			// Check for local errors
-			select {
-			case err := <-m.localErrCh:
-				m.localContent += fmt.Sprintf("\n[ERROR] %v\n", err)
-			default:
-			}
-			
-			// No need to update viewports here - View() will handle it
-		} else {
-			// Check for new output from channels (command execution mode)
-			select {
-			case data, ok := <-m.outputCh:
-				if ok {
-					m.content += string(data)
-					m.viewport.SetContent(m.wrapContent(m.content))
-					m.viewport.GotoBottom()
-				}
-			case err := <-m.errCh:
-				m.content += fmt.Sprintf("\n[ERROR] %v\n", err)
-				m.viewport.SetContent(m.wrapContent(m.content))
-				m.viewport.GotoBottom()
-			default:
-				// No new data
-			}
-		}
-		return m, tick()
+	case RemoteOutputMsg:
+		m.remoteScreen.Write(msg.Data)
+		return m, waitForRemoteOutput(m.terminalOutputCh)
+
+	case HostOutputMsg:
+		m.hosts[msg.Host].content.WriteString(string(msg.Data))
+		return m, waitForHostOutput(msg.Host, m.hosts[msg.Host].outputCh)
 	
 	case LocalOutputMsg:
 		// Append local command output to local pane
 		if m.terminalMode {
-			m.localContent += string(msg.Data)
+			m.localScreen.Write(msg.Data)
 		} else {
-			m.content += string(msg.Data)
-			m.viewport.SetContent(m.wrapContent(m.content))
-			m.viewport.GotoBottom()
+			m.content.WriteString(string(msg.Data))
+			m.content.GotoBottom()
 		}
 		// Status messages are now in log pane
-		
-		// If deployment is running and this is a local step, check if we should continue
-		// (We'll continue after a delay to allow output to finish)
-		if m.deploymentRunning {
-			return m, tea.Sequence(
-				tick(),
-				tea.Tick(500*time.Millisecond, func(time.Time) tea.Msg {
-					return tickMsg{}
-				}),
-				m.ContinueDeployment(),
-			)
-		}
-		return m, tick()
-	
-	case LocalErrorMsg:
-		// Handle local command error
-		if m.terminalMode {
-			m.localContent += fmt.Sprintf("\n[ERROR] %v\n", msg.Error)
-			m.logContent += fmt.Sprintf("[ERROR] Local command failed: %v\n", msg.Error)
-		} else {
-			m.content += fmt.Sprintf("\n[ERROR] Local command failed: %v\n", msg.Error)
-			m.viewport.SetContent(m.wrapContent(m.content))
-			m.viewport.GotoBottom()
-		}
-		// If deployment is running, stop it
-		if m.deploymentRunning {
-			m.deploymentRunning = false
-			m.logContent += "[INFO] Deployment stopped due to error\n"
+		return m, waitForLocalOutput(m.localOutputCh)
+
+	case LocalCommandDoneMsg:
+		// Report failures of interactive local commands in the local pane
+		if msg.Error != nil {
+			m.localScreen.Write([]byte(fmt.Sprintf("\r\n[ERROR] %v\r\n", msg.Error)))
+		} else if !msg.Result.Success() {
+			m.localScreen.Write([]byte(fmt.Sprintf("\r\n[ERROR] Command failed: %s\r\n", msg.Result)))
 		}
-		return m, tick()
-	
+		return m, nil
+
+	case LocalShellStartedMsg:
+		return m, m.handleLocalShellStarted(msg)
+
+	case LocalShellExitedMsg:
+		m.handleLocalShellExited(msg)
+		return m, nil
+
 	case DeploymentStepMsg:
 		// If this is a trigger message (StepNum == 0 and empty step), start deployment
 		if msg.StepNum == 0 && msg.Step.Command == "" && !m.deploymentRunning {
+			if m.plan != nil && !m.planConfirmed {
+				m.showPlan()
+				return m, nil
+			}
+			if len(m.deploymentSteps) == 0 && !m.fanOut() {
+				return m, m.runInitialCommand()
+			}
+			if m.fanOut() {
+				// Connect to every host before deploying so host keys can be confirmed one by one
+				m.deploymentRunning = true
+				fmt.Fprintf(m.logContent, "[INFO] Connecting to %d instances...\n", len(m.hosts))
+				return m, m.connectHost(0)
+			}
 			return m, m.StartDeploymentScript()
 		}
 		
 		// Show deployment step info in log area
-		targetLabel := "local"
-		if msg.Step.Target == "remote" {
-			targetLabel = "remote"
-		}
-		logMsg := fmt.Sprintf("[STEP] [%d/%d] Running %s: %s", msg.StepNum, msg.Total, targetLabel, msg.Step.Command)
+		logMsg := fmt.Sprintf("[STEP] [%d/%d] Running %s: %s%s", msg.StepNum, msg.Total, msg.Step.Target, msg.Step.Description(), msg.Concurrently)
 		if m.terminalMode {
-			m.logContent += logMsg + "\n"
+			m.logContent.WriteString(logMsg + "\n")
 		} else {
-			m.content += logMsg + "\n"
-			m.viewport.SetContent(m.wrapContent(m.content))
-			m.viewport.GotoBottom()
+			m.content.WriteString(logMsg + "\n")
+			m.content.GotoBottom()
 		}
 		
-		// For remote steps, wait a bit then continue to next step
-		// For local steps, wait for command completion (handled in LocalOutputMsg)
-		if msg.Step.Target == "remote" {
-			return m, tea.Sequence(
-				tea.Tick(2*time.Second, func(time.Time) tea.Msg {
-					return tickMsg{}
-				}),
-				m.ContinueDeployment(),
-			)
+		m.currentStep = msg.StepNum - 1
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentStepDoneMsg:
+		var logMsg string
+		switch {
+		case msg.Step.ContinueOnError && (msg.Error != nil || !msg.Result.Success()):
+			logMsg = fmt.Sprintf("[WARN] [%d/%d] %s step failed, continuing: %s", msg.StepNum, msg.Total, targetName(msg.Step), runner.FailureReason(msg.Result, msg.Error))
+		case msg.Error != nil:
+			logMsg = fmt.Sprintf("[ERROR] [%d/%d] %s step failed: %v", msg.StepNum, msg.Total, targetName(msg.Step), msg.Error)
+		case !msg.Result.Success():
+			logMsg = fmt.Sprintf("[ERROR] [%d/%d] %s step failed: %s", msg.StepNum, msg.Total, targetName(msg.Step), msg.Result)
+		default:
+			logMsg = fmt.Sprintf("[INFO] [%d/%d] %s step finished in %s", msg.StepNum, msg.Total, targetName(msg.Step), msg.Result.Duration.Round(100*time.Millisecond))
 		}
-		return m, tick()
-	
+		if m.terminalMode {
+			m.logContent.WriteString(logMsg + "\n")
+		} else {
+			m.content.WriteString(logMsg + "\n")
+			m.content.GotoBottom()
+		}
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentSkippedMsg:
+		logMsg := fmt.Sprintf("[INFO] [%d/%d] Skipping %s: %s", msg.StepNum, msg.Total, msg.Step.Target, msg.Step.Description())
+		if m.terminalMode {
+			m.logContent.WriteString(logMsg + "\n")
+		} else {
+			m.content.WriteString(logMsg + "\n")
+			m.content.GotoBottom()
+		}
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentWarningMsg:
+		if m.terminalMode {
+			m.logContent.WriteString("[WARN] " + msg.Message + "\n")
+		} else {
+			m.content.WriteString("[WARN] " + msg.Message + "\n")
+			m.content.GotoBottom()
+		}
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentRetryMsg:
+		logMsg := fmt.Sprintf("[WARN] [%d/%d] %s step failed (attempt %d of %d): %s; retrying in %s", msg.StepNum, msg.Total, targetName(msg.Step), msg.Attempt, msg.Step.Retries+1, runner.FailureReason(msg.Result, msg.Error), msg.Delay)
+		if m.terminalMode {
+			m.logContent.WriteString(logMsg + "\n")
+		} else {
+			m.content.WriteString(logMsg + "\n")
+			m.content.GotoBottom()
+		}
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentProgressMsg:
+		// Keep a single progress line per step by replacing the previous report
+		prefix := fmt.Sprintf("[INFO] [%d/%d] %sing: ", msg.StepNum, msg.Total, targetName(msg.Step))
+		if m.terminalMode {
+			m.logContent.ReplaceLastLine(prefix, prefix+msg.Progress.String())
+		} else {
+			m.content.ReplaceLastLine(prefix, prefix+msg.Progress.String())
+			m.content.GotoBottom()
+		}
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentFailedMsg:
+		// Step failures have already been reported; anything else, e.g. a held lock, has not
+		var stepErr *runner.StepError
+		if msg.Error != nil && !errors.As(msg.Error, &stepErr) {
+			fmt.Fprintf(m.logContent, "[ERROR] %v\n", msg.Error)
+		}
+		// Lock release and history warnings follow until the channel is closed
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentPhaseMsg:
+		if line := phaseLogLine(msg.Event); line != "" {
+			if m.terminalMode {
+				m.logContent.WriteString(line + "\n")
+			} else {
+				m.content.WriteString(line + "\n")
+				m.content.GotoBottom()
+			}
+		}
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
 	case DeploymentCompleteMsg:
-		// Deployment complete
-		m.deploymentRunning = false
 		m.deploymentComplete = true
+		return m, waitForDeploymentEvent(m.deploymentEventCh)
+
+	case DeploymentFinishedMsg:
+		m.deploymentRunning = false
+		logMsg := "[INFO] Deployment stopped due to error\n"
+		if m.deploymentComplete {
+			logMsg = "[SUCCESS] Deployment script completed. SSH session preserved for manual use.\n"
+		}
 		if m.terminalMode {
-			m.logContent += "[SUCCESS] Deployment script completed. SSH session preserved for manual use.\n"
+			m.logContent.WriteString(logMsg)
 		} else {
-			m.content += "[SUCCESS] Deployment script completed. SSH session preserved for manual use.\n"
-			m.viewport.SetContent(m.wrapContent(m.content))
-			m.viewport.GotoBottom()
+			m.content.WriteString(logMsg)
+			m.content.GotoBottom()
 		}
-		return m, tick()
+		return m, nil
 
 	case SSHOutputMsg:
 		// Append new output to content
-		m.content += string(msg.Data)
-		m.viewport.SetContent(m.wrapContent(m.content))
+		m.content.WriteString(string(msg.Data))
 		// Auto-scroll to bottom
-		m.viewport.GotoBottom()
-		return m, tick()
+		m.content.GotoBottom()
+		return m, waitForStreamOutput(m.outputCh, m.errCh)
 	
 	case TerminalConnectedMsg:
 		// Store the terminal session from the message
@@ -838,28 +1074,30 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.terminalMode = true
 		
 		// Log connection success
-		m.logContent += "[SUCCESS] Terminal connected. Waiting for shell...\n"
+		m.logContent.WriteString("[SUCCESS] Terminal connected. Waiting for shell...\n")
 		
 		// Update remote user/host from instance details
-		// Try to get instance details to set remote hostname
-		if details, err := deploy.GetInstanceDetails(m.ctx, m.instance, m.credentialsPath); err == nil {
+		if details := msg.Details; details != nil {
 			m.remoteHost = details.Name
 			m.remoteUser = details.Username
+			m.recordEvent(m.events.Connection(m.instance, details, nil))
 		} else {
+			m.recordEvent(m.events.Connection(m.instance, nil, nil))
 			// Fallback to instance name if we can't get details
 			m.remoteHost = m.instance.Name
 		}
 		
-		// Resize terminal PTY will be handled by window resize message
+		// Size the PTY to the remote pane's emulated terminal
+		m.terminalSession.Resize(m.remoteScreen.Size())
 		// Focus command input
 		m.commandInput.Focus()
 		
 		// If deployment script exists, start it after a short delay
 		// Otherwise, execute the initial command
-		if len(m.deploymentSteps) > 0 {
+		// With a plan to confirm, the trigger message shows it and waits for the user
+		if len(m.deploymentSteps) > 0 || m.fanOut() || m.plan != nil {
 			// Start deployment script after shell initializes
 			return m, tea.Batch(
-				tick(),
 				textinput.Blink,
 				tea.Tick(1000*time.Millisecond, func(time.Time) tea.Msg {
 					// Start deployment
@@ -871,27 +1109,15 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				}),
 			)
 		} else {
-			// Execute the initial command if provided
-			if m.terminalSession != nil && m.command != "" {
-				go func() {
-					// Wait for shell to initialize
-					time.Sleep(800 * time.Millisecond)
-					
-					commandWithNewline := m.command + "\n"
-					if err := m.terminalSession.Write([]byte(commandWithNewline)); err != nil {
-						select {
-						case m.terminalOutputCh <- []byte(fmt.Sprintf("\n[ERROR] Failed to send command: %v\n", err)):
-						default:
-						}
-					}
-					// Don't echo command here - let the terminal handle it naturally
-				}()
-			}
-			return m, tea.Batch(tick(), textinput.Blink)
+			return m, tea.Batch(textinput.Blink, m.runInitialCommand())
 		}
-	
 
 	case SSHErrorMsg:
+		// Unknown or changed host key: ask the user before connecting
+		if m.promptHostKey(msg.Error, -1) {
+			return m, nil
+		}
+
 		// Check if error is due to missing passphrase
 		if errors.Is(msg.Error, deploy.ErrPassphraseRequired) || 
 		   strings.Contains(msg.Error.Error(), "passphrase required") {
@@ -901,32 +1127,32 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					// In terminal mode, use command input for passphrase
 					m.commandInput.EchoMode = textinput.EchoPassword
 					m.commandInput.Focus()
-					m.logContent += "[INFO] SSH key requires a passphrase. Enter it below and press Enter.\n"
+					m.logContent.WriteString("[INFO] SSH key requires a passphrase. Enter it below and press Enter.\n")
 				} else {
 					// Non-terminal mode, use passphrase input
 					m.passphraseInput.Focus()
-					m.content += "[INFO] SSH key requires a passphrase. Please enter it below.\n"
-					m.viewport.SetContent(m.wrapContent(m.content))
-					m.viewport.GotoBottom()
+					m.content.WriteString("[INFO] SSH key requires a passphrase. Please enter it below.\n")
+					m.content.GotoBottom()
 				}
 				return m, textinput.Blink
 			}
 		} else {
 			if m.terminalMode {
-				m.logContent += fmt.Sprintf("[ERROR] SSH connection failed: %v\n", msg.Error)
+				fmt.Fprintf(m.logContent, "[ERROR] SSH connection failed: %v\n", msg.Error)
 			} else {
-				m.content += fmt.Sprintf("[ERROR] %v\n", msg.Error)
-				m.viewport.SetContent(m.wrapContent(m.content))
-				m.viewport.GotoBottom()
+				fmt.Fprintf(m.content, "[ERROR] %v\n", msg.Error)
+				m.content.GotoBottom()
 			}
 		}
 
+	case HostConnectedMsg, HostConnectErrorMsg, HostDeploymentMsg, HostStatusMsg, FleetCompleteMsg:
+		return m, m.updateFleet(msg)
+
 	case PassphraseNeededMsg:
 		m.needsPassphrase = true
 		m.passphraseInput.Focus()
-		m.content += fmt.Sprintf("[INFO] SSH key at %s requires a passphrase. Please enter it below.\n", msg.KeyPath)
-		m.viewport.SetContent(m.wrapContent(m.content))
-		m.viewport.GotoBottom()
+		fmt.Fprintf(m.content, "[INFO] SSH key at %s requires a passphrase. Please enter it below.\n", msg.KeyPath)
+		m.content.GotoBottom()
 		return m, textinput.Blink
 	}
 
@@ -943,13 +1169,173 @@ func (m *Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	}
 }
 
+// promptHostKey asks the user to confirm an unknown or changed host key
+// host is the fan-out host being connected, -1 for the interactive shell
+// Returns false if err is not a host key error
+func (m *Model) promptHostKey(err error, host int) bool {
+	var hostKeyErr *deploy.HostKeyError
+	if !errors.As(err, &hostKeyErr) {
+		return false
+	}
+
+	m.pendingHostKey = hostKeyErr
+	m.pendingHostKeyHost = host
+	var logMsg string
+	if hostKeyErr.Changed {
+		logMsg = fmt.Sprintf("[ERROR] WARNING: host key for %s has CHANGED. %s key fingerprint is %s\n", hostKeyErr.Host, hostKeyErr.Key.Type(), hostKeyErr.Fingerprint)
+		logMsg += "[ERROR] Someone could be eavesdropping on you. Accept the new key only if you expected this change.\n"
+	} else {
+		logMsg = fmt.Sprintf("[INFO] The authenticity of host %s can't be established. %s key fingerprint is %s\n", hostKeyErr.Host, hostKeyErr.Key.Type(), hostKeyErr.Fingerprint)
+	}
+	logMsg += "[INFO] Press y to accept and record the key, n to reject\n"
+	if m.terminalMode {
+		m.logContent.WriteString(logMsg)
+		if host < 0 {
+			m.setRemoteStatus("Waiting for host key confirmation...")
+		}
+	} else {
+		m.content.WriteString(logMsg)
+		m.content.GotoBottom()
+	}
+	return true
+}
+
+// handleHostKeyConfirm handles y/n while a host key is awaiting confirmation
+func (m *Model) handleHostKeyConfirm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	var logMsg string
+	var cmd tea.Cmd
+
+	switch msg.String() {
+	case "y", "Y":
+		hostKeyErr := m.pendingHostKey
+		m.pendingHostKey = nil
+		if err := m.hostKeys.Trust(hostKeyErr); err != nil {
+			logMsg = fmt.Sprintf("[ERROR] Failed to record host key: %v\n", err)
+			break
+		}
+		logMsg = fmt.Sprintf("[INFO] Host key for %s recorded in %s. Connecting...\n", hostKeyErr.Host, m.hostKeys.RecordFile)
+		if m.pendingHostKeyHost >= 0 {
+			cmd = m.connectHost(m.pendingHostKeyHost)
+		} else if m.terminalMode {
+			m.setRemoteStatus("Connecting to remote terminal...")
+			cmd = m.StartTerminalSession(m.ctx, m.instance, m.command, m.resolver, m.sshKeyPath, m.pendingPassphrase)
+		} else {
+			cmd = m.StartSSHStreamWithPassphrase(m.ctx, m.instance, m.command, m.resolver, m.sshKeyPath, m.pendingPassphrase)
+		}
+	case "n", "N", "esc":
+		hostKeyErr := m.pendingHostKey
+		m.pendingHostKey = nil
+		logMsg = "[ERROR] Host key rejected. Not connecting.\n"
+		if m.pendingHostKeyHost >= 0 {
+			// Skip this host and carry on with the others
+			host := m.hosts[m.pendingHostKeyHost]
+			host.connectErr = fmt.Errorf("host key rejected: %w", hostKeyErr)
+			logMsg = fmt.Sprintf("[ERROR] [%s] Host key rejected. Not connecting.\n", host.instance.Name)
+			cmd = m.connectHost(m.pendingHostKeyHost + 1)
+		} else if m.terminalMode {
+			m.setRemoteStatus("Host key rejected.")
+		}
+	case "ctrl+c":
+		return m, m.quit()
+	default:
+		return m, nil
+	}
+
+	if m.terminalMode {
+		m.logContent.WriteString(logMsg)
+	} else {
+		m.content.WriteString(logMsg)
+		m.content.GotoBottom()
+	}
+	return m, cmd
+}
+
+// quit stops the running deployments, closes every session and the local shell, and exits
+func (m *Model) quit() tea.Cmd {
+	m.stopDeployments()
+	if m.terminalSession != nil {
+		m.terminalSession.Close()
+	}
+	if m.session != nil {
+		m.session.Close()
+	}
+	m.closeLocalShell()
+	m.closeHosts()
+	return tea.Quit
+}
+
+// showPlan writes the deployment plan to the log and waits for the user to confirm it
+func (m *Model) showPlan() {
+	m.awaitingPlanConfirm = true
+	m.logContent.WriteString("[INFO] Deployment plan (--dry-run):\n")
+	for _, line := range m.plan.Lines() {
+		m.logContent.WriteString(line + "\n")
+	}
+	m.logContent.WriteString("[INFO] Press y to start the deployment, n to cancel\n")
+}
+
+// handlePlanConfirm handles the y/n answer to the deployment plan
+func (m *Model) handlePlanConfirm(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "y", "Y":
+		m.awaitingPlanConfirm = false
+		m.planConfirmed = true
+		m.logContent.WriteString("[INFO] Plan confirmed. Starting deployment...\n")
+		return m, func() tea.Msg {
+			return DeploymentStepMsg{StepNum: 0, Total: len(m.deploymentSteps)}
+		}
+	case "n", "N", "esc":
+		m.awaitingPlanConfirm = false
+		m.logContent.WriteString("[INFO] Deployment cancelled. SSH session preserved for manual use.\n")
+		return m, nil
+	case "ctrl+c":
+		return m, m.quit()
+	}
+	return m, nil
+}
+
+// runInitialCommand sends the configured command to the terminal session once the shell is ready
+func (m *Model) runInitialCommand() tea.Cmd {
+	if m.terminalSession == nil || m.command == "" {
+		return nil
+	}
+	command, err := config.Expand(m.command, m.hostVars())
+	if err != nil {
+		fmt.Fprintf(m.logContent, "[ERROR] %v\n", err)
+		return nil
+	}
+	go func() {
+		// Wait for shell to initialize
+		time.Sleep(800 * time.Millisecond)
+
+		commandWithNewline := command + "\n"
+		if err := m.terminalSession.Write([]byte(commandWithNewline)); err != nil {
+			m.terminalOutputCh <- []byte(fmt.Sprintf("\r\n[ERROR] Failed to send command: %v\r\n", err))
+		}
+		// Don't echo command here - let the terminal handle it naturally
+	}()
+	return nil
+}
+
 func (m *Model) View() string {
 	// Terminal mode: show split panes (passphrase handled in command area)
+	// or the remote shell alone when attached
+	if m.terminalMode && m.passthrough() {
+		return m.renderAttachedView()
+	}
 	if m.terminalMode {
 		return m.renderSplitPaneView()
 	}
 	
-	// Non-terminal mode: show single viewport
+	// Non-terminal mode: show single viewport, filled with the rows of content it shows
+	width := m.viewport.Width
+	if width <= 0 {
+		// Fallback to a reasonable default if width not set
+		width = 80
+	}
+	m.viewport.SetContent(strings.Join(m.content.Window(width, m.viewport.Height), "\n"))
+	m.viewport.GotoBottom()
+	
 	// Show passphrase input if needed (legacy non-terminal mode)
 	if m.needsPassphrase {
 		view := m.viewport.View()
@@ -975,13 +1361,15 @@ func (m *Model) renderSplitPaneView() string {
 	
 	// Calculate available space
 	// Reserve space for:
+	// - Header with instance and environment (1 line)
 	// - Log area at bottom (4 lines)
 	// - Command prompt (1 line - always single line)
 	// - Help text (1 line)
+	headerHeight := 1
 	logAreaHeight := 4
 	commandAreaHeight := 1 // Always single line
 	helpHeight := 1
-	reservedHeight := logAreaHeight + commandAreaHeight + helpHeight
+	reservedHeight := headerHeight + logAreaHeight + commandAreaHeight + helpHeight
 	
 	// Calculate pane heights
 	paneHeight := m.height - reservedHeight
@@ -1016,49 +1404,39 @@ func (m *Model) renderSplitPaneView() string {
 	m.remoteViewport.Height = paneHeight
 	
 	// Get border widths for content wrapping
-	localBorderWidth := m.localViewport.Style.GetHorizontalFrameSize()
 	remoteBorderWidth := m.remoteViewport.Style.GetHorizontalFrameSize()
 	
 	// Wrap content for viewports (content width excludes borders)
-	localContentWidth := paneWidth - localBorderWidth
 	remoteContentWidth := paneWidth - remoteBorderWidth
 	
 	// Ensure content width is valid
-	if localContentWidth < 1 {
-		localContentWidth = 1
-	}
 	if remoteContentWidth < 1 {
 		remoteContentWidth = 1
 	}
 	
-	// Helper function to wrap content for a specific width
-	wrapForWidth := func(content string, maxWidth int) string {
-		width := maxWidth
-		if width <= 0 {
-			width = 20
-		}
-		content = strings.ReplaceAll(content, "\r\n", "\n")
-		content = strings.ReplaceAll(content, "\r", "\n")
-		lines := strings.Split(content, "\n")
-		wrappedLines := make([]string, 0, len(lines))
-		for _, line := range lines {
-			if len(line) == 0 {
-				wrappedLines = append(wrappedLines, "")
-				continue
-			}
-			wrapped := wordwrap.String(line, width)
-			wrappedLines = append(wrappedLines, wrapped)
-		}
-		return strings.Join(wrappedLines, "\n")
-	}
+	// Only the rows that fit in the panes are rendered, however long the output is
+	contentHeight := paneHeight - m.remoteViewport.Style.GetVerticalFrameSize()
 	
-	// Set content - don't call GotoBottom here as it can panic if viewport isn't ready
-	// GotoBottom will be called in Update() when content changes
-	localWrapped := wrapForWidth(m.localContent, localContentWidth)
-	m.localViewport.SetContent(localWrapped)
+	// Both shells are rendered from their emulated terminals, which are sized to the panes
+	m.localViewport.SetContent(strings.Join(m.localScreen.Window(contentHeight), "\n"))
+	m.localViewport.GotoBottom()
 	
-	remoteWrapped := wrapForWidth(m.remoteContent, remoteContentWidth)
-	m.remoteViewport.SetContent(remoteWrapped)
+	// The interactive shell is rendered from its emulated terminal, which is sized to the pane
+	if host := m.activeHostPane(); host != nil {
+		m.remoteViewport.SetContent(strings.Join(host.content.Window(remoteContentWidth, contentHeight), "\n"))
+	} else {
+		m.remoteViewport.SetContent(strings.Join(m.remoteScreen.Window(contentHeight), "\n"))
+	}
+	
+	// A pane being navigated in normal mode shows its frozen rows instead
+	if m.copy != nil {
+		viewport := &m.remoteViewport
+		if m.copy.local {
+			viewport = &m.localViewport
+		}
+		viewport.SetContent(strings.Join(m.copy.window(contentHeight), "\n"))
+	}
+	m.remoteViewport.GotoBottom()
 	
 	// Render panes side by side
 	localPane := m.localViewport.View()
@@ -1091,11 +1469,47 @@ func (m *Model) renderSplitPaneView() string {
 	// Build command prompt area
 	commandArea := m.renderCommandArea(fullWidth)
 	
+	// Build header
+	header := m.renderHeader(fullWidth)
+	
 	// Combine everything with proper spacing
-	view := panes + "\n" + logArea + "\n" + commandArea + "\n" + m.helpView()
+	view := header + "\n" + panes + "\n" + logArea + "\n" + commandArea + "\n" + m.helpView()
 	return view
 }
 
+// renderHeader renders the single line header with the instance and environment
+func (m *Model) renderHeader(width int) string {
+	title := fmt.Sprintf(" gcdeploy • %s (%s/%s) ", m.instance.Name, m.instance.ProjectId, m.instance.Zone)
+	if m.fanOut() {
+		title = " gcdeploy • " + m.renderHostTabs() + " "
+	}
+	
+	envColor := gopherBlue
+	if m.production {
+		envColor = productionRed
+	}
+	envName := m.envName
+	if envName == "" {
+		envName = "default"
+	}
+	badge := lipgloss.NewStyle().
+		Bold(true).
+		Foreground(lipgloss.Color("#FFFFFF")).
+		Background(lipgloss.Color(envColor)).
+		Render(" " + strings.ToUpper(envName) + " ")
+	
+	titleWidth := width - lipgloss.Width(badge)
+	if titleWidth < 0 {
+		titleWidth = 0
+	}
+	titleStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("241")).
+		Width(titleWidth).
+		MaxWidth(titleWidth)
+	
+	return lipgloss.JoinHorizontal(lipgloss.Top, titleStyle.Render(title), badge)
+}
+
 // renderLogArea renders the log area at the bottom
 func (m *Model) renderLogArea(width int) string {
 	// Ensure width doesn't exceed window width
@@ -1115,11 +1529,7 @@ func (m *Model) renderLogArea(width int) string {
 		Height(4)
 	
 	// Wrap log content
-	logLines := strings.Split(m.logContent, "\n")
-	if len(logLines) > 4 {
-		logLines = logLines[len(logLines)-4:] // Show last 4 lines
-	}
-	logText := strings.Join(logLines, "\n")
+	logText := strings.Join(m.logContent.Tail(4), "\n") // Show last 4 lines
 	
 	return logStyle.Render(logText)
 }
@@ -1134,10 +1544,25 @@ func (m *Model) renderCommandArea(width int) string {
 	var promptColor string
 	var promptText string
 	
-	if m.needsPassphrase {
+	if m.pendingHostKey != nil {
+		// Show host key confirmation prompt
+		promptColor = rustCrab
+		promptText = fmt.Sprintf("Accept %s host key %s? (y/n) ", m.pendingHostKey.Key.Type(), m.pendingHostKey.Fingerprint)
+	} else if m.awaitingPlanConfirm {
+		// Show deployment plan confirmation prompt
+		promptColor = rustCrab
+		promptText = "Start the deployment? (y/n) "
+	} else if m.needsPassphrase {
 		// Show passphrase prompt
 		promptColor = "241"
 		promptText = "Enter passphrase: "
+	} else if m.copy != nil && m.copy.searching {
+		// Show the search being typed in normal mode
+		promptColor = rustCrab
+		promptText = "/"
+		if m.copy.backward {
+			promptText = "?"
+		}
 	} else {
 		// Show regular command prompt
 		if m.shellMode == LocalShell {
@@ -1158,7 +1583,11 @@ func (m *Model) renderCommandArea(width int) string {
 	
 	var result strings.Builder
 	result.WriteString(lipgloss.NewStyle().Foreground(lipgloss.Color(promptColor)).Render(promptText))
-	result.WriteString(m.commandInput.View())
+	if m.copy != nil && m.copy.searching {
+		result.WriteString(m.copy.query + cursorStyle.Render(" "))
+	} else if m.pendingHostKey == nil {
+		result.WriteString(m.commandInput.View())
+	}
 	
 	// Always single line - no status messages here
 	commandHeight := 1
@@ -1187,7 +1616,11 @@ func (m Model) helpView() string {
 		if m.vimMode == NormalMode {
 			vimHint = "Normal"
 		}
-		return helpStyle(fmt.Sprintf("\n  %s Mode (%s): Type commands • Shift+Tab: Switch shell • Esc: Vim mode • Ctrl+C: Interrupt • q: Quit (normal mode)\n", modeHint, vimHint))
+		tabHint := ""
+		if len(m.hosts) > 0 {
+			tabHint = " • [/]: Switch host (normal mode)"
+		}
+		return helpStyle(fmt.Sprintf("\n  %s Mode (%s): Type commands • Shift+Tab: Switch shell • Esc: Vim mode • Ctrl+C: Interrupt • a: Attach, j/k, /: Navigate, v/y: Copy, q: Quit (normal mode)%s\n", modeHint, vimHint, tabHint))
 	}
 	return helpStyle("\n  ↑/↓: Scroll • ctrl+u/ctrl+d: Page • q: Quit\n")
 }
@@ -1195,39 +1628,13 @@ func (m Model) helpView() string {
 // URL pattern to detect URLs
 var urlPattern = regexp.MustCompile(`https?://[^\s]+`)
 
-// wrapContent wraps the content to fit within the viewport width
+// wrapContentLine wraps a line of content to fit within the viewport width
 // URLs are preserved and not broken across lines
-func (m Model) wrapContent(content string) string {
-	width := m.viewport.Width
-	if width <= 0 {
-		// Fallback to a reasonable default if width not set
-		width = 80
+func wrapContentLine(line string, width int) []string {
+	if urlPattern.MatchString(line) {
+		return strings.Split(wrapLinePreservingURLs(line, width), "\n")
 	}
-
-	// Split content by lines, wrap each line, then rejoin
-	lines := strings.Split(content, "\n")
-	wrappedLines := make([]string, 0, len(lines))
-
-	for _, line := range lines {
-		if len(line) == 0 {
-			wrappedLines = append(wrappedLines, "")
-			continue
-		}
-
-		// Check if line contains URLs
-		urls := urlPattern.FindAllString(line, -1)
-		if len(urls) > 0 {
-			// Preserve URLs - wrap around them
-			wrapped := wrapLinePreservingURLs(line, width)
-			wrappedLines = append(wrappedLines, wrapped)
-		} else {
-			// Regular wrapping for lines without URLs
-			wrapped := wordwrap.String(line, width)
-			wrappedLines = append(wrappedLines, wrapped)
-		}
-	}
-
-	return strings.Join(wrappedLines, "\n")
+	return wrapLine(line, width)
 }
 
 // wrapLinePreservingURLs wraps a line while preserving URLs intact
@@ -1298,55 +1705,15 @@ func wrapLinePreservingURLs(line string, width int) string {
 	return result.String()
 }
 
-// wrapTerminalContent wraps terminal content to fit within the viewport width
-// Filters out problematic control sequences and wraps content
-func (m Model) wrapTerminalContent(content string) string {
-	width := m.viewport.Width
-	if width <= 0 {
-		// Fallback to a reasonable default if width not set
-		width = 80
-	}
-
-	// Filter out carriage returns that might reset cursor position
-	// Replace \r\n with \n, and standalone \r with \n
-	content = strings.ReplaceAll(content, "\r\n", "\n")
-	content = strings.ReplaceAll(content, "\r", "\n")
-
-	// Split by lines and process each line
-	lines := strings.Split(content, "\n")
-	wrappedLines := make([]string, 0, len(lines))
-
-	for _, line := range lines {
-		if len(line) == 0 {
-			wrappedLines = append(wrappedLines, "")
-			continue
-		}
-
-		// Use wordwrap to wrap the line
-		// This handles ANSI codes better than simple character counting
-		wrapped := wordwrap.String(line, width)
-		wrappedLines = append(wrappedLines, wrapped)
-	}
-
-	return strings.Join(wrappedLines, "\n")
-}
-
-// tick returns a command that sends a tick message after a short delay
-func tick() tea.Cmd {
-	return tea.Tick(50*time.Millisecond, func(time.Time) tea.Msg {
-		return tickMsg{}
-	})
-}
-
 // StartSSHStream starts streaming SSH output in the background
 func (m *Model) StartSSHStream(
 	ctx context.Context,
 	instance deploy.Instance,
 	command string,
-	credentialsPath string,
+	resolver deploy.InstanceResolver,
 	sshKeyPath string,
 ) tea.Cmd {
-	return m.StartSSHStreamWithPassphrase(ctx, instance, command, credentialsPath, sshKeyPath, "")
+	return m.StartSSHStreamWithPassphrase(ctx, instance, command, resolver, sshKeyPath, "")
 }
 
 // StartSSHStreamWithPassphrase starts streaming SSH output with a passphrase
@@ -1354,12 +1721,12 @@ func (m *Model) StartSSHStreamWithPassphrase(
 	ctx context.Context,
 	instance deploy.Instance,
 	command string,
-	credentialsPath string,
+	resolver deploy.InstanceResolver,
 	sshKeyPath string,
 	passphrase string,
 ) tea.Cmd {
 	return func() tea.Msg {
-		session, err := deploy.VMConnectWithKey(ctx, instance, sshKeyPath, credentialsPath, passphrase)
+		session, err := deploy.VMConnectWithKey(ctx, instance, sshKeyPath, resolver, passphrase, m.hostKeys)
 		if err != nil {
 			return SSHErrorMsg{Error: err}
 		}
@@ -1370,10 +1737,7 @@ func (m *Model) StartSSHStreamWithPassphrase(
 
 		// Start streaming in background
 		go func() {
-			err := session.ExecuteStream(command, m.outputCh)
-			if err != nil {
-				m.errCh <- err
-			}
+			m.errCh <- session.ExecuteStream(command, m.outputCh)
 		}()
 
 		// Return a success message to indicate connection was established
@@ -1386,12 +1750,12 @@ func (m *Model) StartTerminalSession(
 	ctx context.Context,
 	instance deploy.Instance,
 	command string,
-	credentialsPath string,
+	resolver deploy.InstanceResolver,
 	sshKeyPath string,
 	passphrase string,
 ) tea.Cmd {
 	return func() tea.Msg {
-		termSession, err := deploy.VMConnectTerminal(ctx, instance, sshKeyPath, credentialsPath, passphrase)
+		termSession, err := deploy.VMConnectTerminal(ctx, instance, sshKeyPath, resolver, passphrase, m.hostKeys)
 		if err != nil {
 			return SSHErrorMsg{Error: err}
 		}
@@ -1418,16 +1782,14 @@ func (m *Model) StartTerminalSession(
 					case m.terminalOutputCh <- data:
 					case <-ctx.Done():
 						return
-					default:
-						// Channel full, skip this chunk (shouldn't happen with buffered channel)
 					}
 				}
 				if err != nil {
 					if err != io.EOF && m.debug {
 						// Log error for debugging (but not EOF which is normal on close)
 						select {
-						case m.terminalOutputCh <- []byte(fmt.Sprintf("\n[TERMINAL READ ERROR] %v\n", err)):
-						default:
+						case m.terminalOutputCh <- []byte(fmt.Sprintf("\r\n[TERMINAL READ ERROR] %v\r\n", err)):
+						case <-ctx.Done():
 						}
 					}
 					return
@@ -1463,7 +1825,14 @@ func (m *Model) StartTerminalSession(
 			}
 		}()
 
-		return TerminalConnectedMsg{Session: termSession}
+		// Get instance details to set the remote user and hostname, off the UI thread
+		msg := TerminalConnectedMsg{Session: termSession}
+		if resolver != nil {
+			if details, err := resolver.Resolve(ctx, instance); err == nil {
+				msg.Details = details
+			}
+		}
+		return msg
 	}
 }
 
@@ -1477,179 +1846,198 @@ type LocalErrorMsg struct {
 	Error error
 }
 
+// LocalCommandDoneMsg is sent when a command typed into the local shell has exited
+type LocalCommandDoneMsg struct {
+	Result deploy.CommandResult
+	Error  error
+}
+
 // StartLocalCommand executes a command in the local shell and streams output
 func (m *Model) StartLocalCommand(command string) tea.Cmd {
+	ctx := m.ctx
+	outputCh := onlcrOutput(m.localOutputCh)
 	return func() tea.Msg {
-		// Get shell from environment or use default
-		shell := os.Getenv("SHELL")
-		if shell == "" {
-			shell = "/bin/sh"
-		}
-
-		// Create command with shell -c
-		cmd := exec.Command(shell, "-c", command)
-		
-		// Get stdout pipe
-		stdoutPipe, err := cmd.StdoutPipe()
-		if err != nil {
-			return LocalErrorMsg{Error: fmt.Errorf("failed to create stdout pipe: %w", err)}
-		}
-		
-		// Get stderr pipe
-		stderrPipe, err := cmd.StderrPipe()
-		if err != nil {
-			return LocalErrorMsg{Error: fmt.Errorf("failed to create stderr pipe: %w", err)}
-		}
-
-		// Start the command
-		if err := cmd.Start(); err != nil {
-			return LocalErrorMsg{Error: fmt.Errorf("failed to start command: %w", err)}
-		}
-
-		// Stream stdout in background
-		go func() {
-			defer stdoutPipe.Close()
-			buffer := make([]byte, 4096)
-			for {
-				n, err := stdoutPipe.Read(buffer)
-				if n > 0 {
-					data := make([]byte, n)
-					copy(data, buffer[:n])
-					select {
-					case m.localOutputCh <- data:
-					case <-m.ctx.Done():
-						return
-					}
-				}
-				if err != nil {
-					if err != io.EOF {
-						select {
-						case m.localErrCh <- err:
-						default:
-						}
-					}
-					return
-				}
-			}
-		}()
-
-		// Stream stderr in background
-		go func() {
-			defer stderrPipe.Close()
-			buffer := make([]byte, 4096)
-			for {
-				n, err := stderrPipe.Read(buffer)
-				if n > 0 {
-					data := make([]byte, n)
-					copy(data, buffer[:n])
-					select {
-					case m.localOutputCh <- data:
-					case <-m.ctx.Done():
-						return
-					}
-				}
-				if err != nil {
-					return
-				}
-			}
-		}()
-
-		// Wait for command to complete in background
-		go func() {
-			err := cmd.Wait()
-			if err != nil {
-				select {
-				case m.localErrCh <- err:
-				default:
-				}
-			}
-		}()
-
-		// Don't echo command in LocalOutputMsg - the terminal output will show it naturally
-		return LocalOutputMsg{Data: []byte{}}
+		defer close(outputCh)
+		result, err := deploy.RunLocalCommand(ctx, command, deploy.CommandOptions{}, outputCh)
+		return LocalCommandDoneMsg{Result: result, Error: err}
 	}
 }
 
-// StartDeploymentScript executes deployment steps sequentially
+// StartDeploymentScript runs the deployment steps in the background
+// Progress is reported back to Update as deployment messages
 func (m *Model) StartDeploymentScript() tea.Cmd {
 	if len(m.deploymentSteps) == 0 {
 		// No deployment steps, mark as complete immediately
 		m.deploymentComplete = true
 		return func() tea.Msg {
-			return DeploymentCompleteMsg{}
+			return DeploymentFinishedMsg{}
 		}
 	}
 
 	m.deploymentRunning = true
 	m.currentStep = 0
 
-	// Start with first step
-	return m.executeDeploymentStep(0)
-}
-
-// executeDeploymentStep executes a single deployment step
-func (m *Model) executeDeploymentStep(stepIndex int) tea.Cmd {
-	if stepIndex >= len(m.deploymentSteps) {
-		// All steps complete
-		m.deploymentRunning = false
-		m.deploymentComplete = true
-		return func() tea.Msg {
-			return DeploymentCompleteMsg{}
-		}
+	events := make(chan tea.Msg, 16)
+	m.deploymentEventCh = events
+	state := m.state
+	eventWriter := m.events
+	recorder := m.history
+	locks := m.locks
+	lockPath, force, env := m.lockPath, m.forceUnlock, m.envName
+	host := m.instance.Name
+
+	// Step output does not go through the PTYs, so its line feeds lack the carriage
+	// returns the panes' terminals expect
+	localOutput := onlcrOutput(m.localOutputCh)
+	remoteOutput := onlcrOutput(m.terminalOutputCh)
+
+	r := &runner.Runner{
+		Steps:        m.deploymentSteps,
+		Parallelism:  m.parallelism,
+		Skip:         m.skips[m.instance.Name],
+		LocalOutput:  localOutput,
+		RemoteOutput: remoteOutput,
+		Vars:         m.hostVars(),
+		HealthChecks: m.healthChecks,
+		OnFailure:    m.onFailure,
+		Hooks:        m.hooks,
+		ConfigDir:    m.configDir,
+		OutputEvents: eventWriter != nil,
+		OnEvent: func(e runner.Event) {
+			if err := state.Record(host, e); err != nil {
+				events <- DeploymentWarningMsg{Message: fmt.Sprintf("Could not save deployment state, --resume will not be available: %v", err)}
+			}
+			if err := eventWriter.Record(host, e); err != nil {
+				events <- DeploymentWarningMsg{Message: fmt.Sprintf("Could not write deployment event: %v", err)}
+			}
+			if e.Type == runner.StepOutput {
+				// Output reaches the panes through the output channels
+				return
+			}
+			recorder.Record(host, e)
+			events <- deploymentEventToMsg(e)
+		},
 	}
-
-	step := m.deploymentSteps[stepIndex]
-	m.currentStep = stepIndex
-
-	// Send step start message
-	stepMsg := DeploymentStepMsg{
-		StepNum: stepIndex + 1,
-		Total:   len(m.deploymentSteps),
-		Step:    step,
+	// Avoid storing a typed nil pointer in the interface
+	if m.terminalSession != nil {
+		r.Remote = m.terminalSession
 	}
 
-	// Execute the step based on target
-	if step.Target == "local" {
-		// Execute locally
-		return tea.Batch(
-			func() tea.Msg { return stepMsg },
-			m.StartLocalCommand(step.Command),
-		)
-	} else {
-		// Execute remotely via SSH terminal
-		if m.terminalSession == nil {
-			// Terminal not ready yet, return error
-			return func() tea.Msg {
-				return LocalErrorMsg{Error: fmt.Errorf("remote step requires SSH connection")}
+	ctx := m.ctx
+	remote := r.Remote
+	locks.running.Add(1)
+	go func() {
+		defer locks.running.Done()
+		defer close(events)
+		defer close(localOutput)
+		defer close(remoteOutput)
+		if remote != nil {
+			if err := locks.acquire(ctx, remote, host, lockPath, env, force, events); err != nil {
+				events <- DeploymentFailedMsg{Error: err}
+				return
 			}
+			defer func() {
+				if err := locks.release(host); err != nil {
+					events <- DeploymentWarningMsg{Message: err.Error()}
+				}
+			}()
 		}
-		
-		// Send command to remote terminal
-		commandWithNewline := step.Command + "\n"
-		if err := m.terminalSession.Write([]byte(commandWithNewline)); err != nil {
-			return func() tea.Msg {
-				return LocalErrorMsg{Error: fmt.Errorf("failed to send remote command: %w", err)}
-			}
+		r.Run(ctx)
+		if err := recorder.Finish(ctx, host, remote); err != nil {
+			events <- DeploymentWarningMsg{Message: fmt.Sprintf("Could not record deployment history: %v", err)}
 		}
+	}()
 
-		return func() tea.Msg {
-			return stepMsg
+	return waitForDeploymentEvent(events)
+}
+
+// deploymentEventToMsg converts a runner event into the matching Bubble Tea message
+func deploymentEventToMsg(e runner.Event) tea.Msg {
+	if outsideScript(e) {
+		return DeploymentPhaseMsg{Event: e}
+	}
+	switch e.Type {
+	case runner.StepStarted:
+		return DeploymentStepMsg{StepNum: e.StepNum, Total: e.Total, Step: e.Step, Concurrently: e.Concurrently()}
+	case runner.StepFinished:
+		return DeploymentStepDoneMsg{StepNum: e.StepNum, Total: e.Total, Step: e.Step, Result: e.Result, Error: e.Error}
+	case runner.StepSkipped:
+		return DeploymentSkippedMsg{StepNum: e.StepNum, Total: e.Total, Step: e.Step}
+	case runner.StepRetrying:
+		return DeploymentRetryMsg{StepNum: e.StepNum, Total: e.Total, Step: e.Step, Result: e.Result, Error: e.Error, Attempt: e.Attempt, Delay: e.Delay}
+	case runner.StepProgress:
+		return DeploymentProgressMsg{StepNum: e.StepNum, Total: e.Total, Step: e.Step, Progress: e.Progress}
+	case runner.DeploymentFailed:
+		return DeploymentFailedMsg{Error: e.Error}
+	default:
+		return DeploymentCompleteMsg{}
+	}
+}
+
+// outsideScript reports whether an event comes from the hooks, the health checks or the
+// on_failure steps rather than from the deployment script
+func outsideScript(e runner.Event) bool {
+	switch e.Type {
+	case runner.HealthCheckStarted, runner.HealthCheckRetrying, runner.HealthCheckFinished:
+		return true
+	}
+	return e.Phase != ""
+}
+
+// phaseLogLine returns the log line for an event of the hooks, the health checks or the
+// on_failure steps, or "" when the event is not logged
+func phaseLogLine(e runner.Event) string {
+	switch e.Type {
+	case runner.HealthCheckStarted:
+		return fmt.Sprintf("[STEP] Health check %d/%d: %s", e.StepNum, e.Total, e.Check.Label())
+	case runner.HealthCheckRetrying:
+		return fmt.Sprintf("[WARN] Health check %d/%d failed (attempt %d of %d): %s; retrying in %s", e.StepNum, e.Total, e.Attempt, e.Check.Retries+1, e.Reason(), e.Delay)
+	case runner.HealthCheckFinished:
+		if e.Failed() {
+			return fmt.Sprintf("[ERROR] Health check %d/%d failed: %s", e.StepNum, e.Total, e.Reason())
 		}
+		return fmt.Sprintf("[SUCCESS] Health check %d/%d passed: %s", e.StepNum, e.Total, e.Check.Label())
+	case runner.StepStarted:
+		return fmt.Sprintf("[STEP] [%s] Running %s: %s", e.Position(), e.Step.Target, e.Step.Description())
+	case runner.StepRetrying:
+		return fmt.Sprintf("[WARN] [%s] %s %s failed (attempt %d of %d): %s; retrying in %s", e.Position(), targetName(e.Step), e.Kind(), e.Attempt, e.Step.Retries+1, e.Reason(), e.Delay)
+	case runner.StepFinished:
+		switch {
+		case e.Failed() && e.Step.ContinueOnError:
+			return fmt.Sprintf("[WARN] [%s] %s %s failed, continuing: %s", e.Position(), targetName(e.Step), e.Kind(), e.Reason())
+		case e.Failed():
+			return fmt.Sprintf("[ERROR] [%s] %s %s failed: %s", e.Position(), targetName(e.Step), e.Kind(), e.Reason())
+		}
+		return fmt.Sprintf("[INFO] [%s] %s %s finished in %s", e.Position(), targetName(e.Step), e.Kind(), e.Result.Duration.Round(100*time.Millisecond))
 	}
+	return ""
 }
 
-// ContinueDeployment moves to the next deployment step
-func (m *Model) ContinueDeployment() tea.Cmd {
-	if !m.deploymentRunning {
+// waitForDeploymentEvent waits for the next deployment message from the runner
+// It returns DeploymentFinishedMsg once the channel is closed
+func waitForDeploymentEvent(events <-chan tea.Msg) tea.Cmd {
+	if events == nil {
 		return nil
 	}
-
-	// Wait a bit for current step output to finish, then continue
-	return tea.Sequence(
-		tea.Tick(500*time.Millisecond, func(time.Time) tea.Msg {
-			return tickMsg{}
-		}),
-		m.executeDeploymentStep(m.currentStep + 1),
-	)
+	return func() tea.Msg {
+		msg, ok := <-events
+		if !ok {
+			return DeploymentFinishedMsg{}
+		}
+		return msg
+	}
 }
 
+// targetName returns a display label for a step target
+func targetName(step config.DeploymentStep) string {
+	switch step.Target {
+	case "remote":
+		return "Remote"
+	case "upload":
+		return "Upload"
+	case "download":
+		return "Download"
+	default:
+		return "Local"
+	}
+}
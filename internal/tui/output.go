@@ -0,0 +1,96 @@
+package tui
+
+import tea "github.com/charmbracelet/bubbletea"
+
+// maxOutputBatch is how much pending output one message delivers to Update
+// Chunks that are already waiting are batched, so heavy output costs a render per batch
+// rather than per chunk, while idle output costs nothing
+const maxOutputBatch = 64 << 10
+
+// RemoteOutputMsg is sent when output of the interactive shell arrives
+type RemoteOutputMsg struct {
+	Data []byte
+}
+
+// HostOutputMsg is sent when deployment output of a fan-out host arrives
+type HostOutputMsg struct {
+	Host int // Index in hosts
+	Data []byte
+}
+
+// readOutput waits for output on ch and batches the chunks already waiting behind it
+// Returns false once ch is closed and drained
+func readOutput(ch <-chan []byte) ([]byte, bool) {
+	data, ok := <-ch
+	if !ok {
+		return nil, false
+	}
+	// Copy before appending so the sender's buffer is never written to
+	data = data[:len(data):len(data)]
+	for len(data) < maxOutputBatch {
+		select {
+		case more, ok := <-ch:
+			if !ok {
+				return data, true
+			}
+			data = append(data, more...)
+		default:
+			return data, true
+		}
+	}
+	return data, true
+}
+
+// waitForOutput waits for the next batch of output on ch and wraps it in a message
+// The handler of the message waits for the next batch, so exactly one read is pending per
+// channel: writers block while the channel is full instead of losing output
+func waitForOutput(ch <-chan []byte, wrap func([]byte) tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		data, ok := readOutput(ch)
+		if !ok {
+			return nil
+		}
+		return wrap(data)
+	}
+}
+
+// waitForRemoteOutput waits for output of the interactive shell
+func waitForRemoteOutput(ch <-chan []byte) tea.Cmd {
+	return waitForOutput(ch, func(data []byte) tea.Msg { return RemoteOutputMsg{Data: data} })
+}
+
+// waitForLocalOutput waits for output of the local shell and local deployment steps
+func waitForLocalOutput(ch <-chan []byte) tea.Cmd {
+	return waitForOutput(ch, func(data []byte) tea.Msg { return LocalOutputMsg{Data: data} })
+}
+
+// waitForHostOutput waits for deployment output of the fan-out host at index
+func waitForHostOutput(index int, ch <-chan []byte) tea.Cmd {
+	return waitForOutput(ch, func(data []byte) tea.Msg { return HostOutputMsg{Host: index, Data: data} })
+}
+
+// waitForStreamOutput waits for output of the command streamed outside terminal mode
+// Once the output ends, an error of the stream is reported as an SSHErrorMsg
+func waitForStreamOutput(outputCh <-chan []byte, errCh <-chan error) tea.Cmd {
+	return func() tea.Msg {
+		if data, ok := readOutput(outputCh); ok {
+			return SSHOutputMsg{Data: data}
+		}
+		if err := <-errCh; err != nil {
+			return SSHErrorMsg{Error: err}
+		}
+		return nil
+	}
+}
+
+// waitForAllOutput starts waiting for output of the shells and of every fan-out host
+func (m *Model) waitForAllOutput() tea.Cmd {
+	cmds := []tea.Cmd{
+		waitForRemoteOutput(m.terminalOutputCh),
+		waitForLocalOutput(m.localOutputCh),
+	}
+	for i, host := range m.hosts {
+		cmds = append(cmds, waitForHostOutput(i, host.outputCh))
+	}
+	return tea.Batch(cmds...)
+}
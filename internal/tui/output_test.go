@@ -0,0 +1,87 @@
+package tui
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadOutput(t *testing.T) {
+	ch := make(chan []byte, 10)
+	first := []byte("one\n")
+	ch <- first
+	ch <- []byte("two\n")
+	ch <- []byte("three\n")
+
+	// Chunks already waiting are delivered together
+	data, ok := readOutput(ch)
+	if !ok || string(data) != "one\ntwo\nthree\n" {
+		t.Errorf("readOutput() = %q, %v, want the waiting chunks batched", data, ok)
+	}
+	if string(first) != "one\n" {
+		t.Errorf("sender's buffer = %q, want it untouched", first)
+	}
+
+	// A batch stops at maxOutputBatch, leaving the rest for the next read
+	chunk := bytes.Repeat([]byte("x"), maxOutputBatch/2)
+	for i := 0; i < 3; i++ {
+		ch <- chunk
+	}
+	if data, _ := readOutput(ch); len(data) != maxOutputBatch {
+		t.Errorf("readOutput() of 3 half batches = %d bytes, want %d", len(data), maxOutputBatch)
+	}
+	if data, _ := readOutput(ch); len(data) != len(chunk) {
+		t.Errorf("next readOutput() = %d bytes, want the last chunk", len(data))
+	}
+
+	ch <- []byte("last")
+	close(ch)
+	if data, ok := readOutput(ch); !ok || string(data) != "last" {
+		t.Errorf("readOutput() before the end = %q, %v, want the last chunk", data, ok)
+	}
+	if _, ok := readOutput(ch); ok {
+		t.Error("readOutput() of a closed channel reported output")
+	}
+}
+
+func TestWaitForStreamOutput(t *testing.T) {
+	outputCh := make(chan []byte, 1)
+	errCh := make(chan error, 1)
+	outputCh <- []byte("done\n")
+	close(outputCh)
+	errCh <- errors.New("exit status 1")
+
+	// Output is delivered before the stream's error
+	if msg, ok := waitForStreamOutput(outputCh, errCh)().(SSHOutputMsg); !ok || string(msg.Data) != "done\n" {
+		t.Errorf("first message = %+v, want the output", msg)
+	}
+	if msg, ok := waitForStreamOutput(outputCh, errCh)().(SSHErrorMsg); !ok || msg.Error.Error() != "exit status 1" {
+		t.Errorf("second message = %+v, want the error", msg)
+	}
+}
+
+func TestOutputMessages(t *testing.T) {
+	m, err := New(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.terminalMode = true
+
+	// Each message is handled by waiting for the next batch on its own channel
+	_, cmd := m.Update(RemoteOutputMsg{Data: []byte("remote$ ")})
+	m.terminalOutputCh <- []byte("ls\r\n")
+	if msg, ok := cmd().(RemoteOutputMsg); !ok || string(msg.Data) != "ls\r\n" {
+		t.Errorf("next remote message = %+v, want the next output", msg)
+	}
+	_, cmd = m.Update(LocalOutputMsg{Data: []byte("local$ ")})
+	m.localOutputCh <- []byte("pwd\r\n")
+	if msg, ok := cmd().(LocalOutputMsg); !ok || string(msg.Data) != "pwd\r\n" {
+		t.Errorf("next local message = %+v, want the next output", msg)
+	}
+
+	remote, _ := plainRows(m.remoteScreen)
+	local, _ := plainRows(m.localScreen)
+	if remote[0] != "remote$" || local[0] != "local$" {
+		t.Errorf("panes = %q and %q, want the output written to its own pane", remote[0], local[0])
+	}
+}
@@ -0,0 +1,233 @@
+package tui
+
+import (
+	"strings"
+
+	"github.com/muesli/reflow/wordwrap"
+)
+
+// defaultScrollback is how many lines of output each pane keeps unless scrollback is set
+const defaultScrollback = 5000
+
+// wrapFunc wraps one line of output into rows of at most width cells
+type wrapFunc func(line string, width int) []string
+
+// scrollback is the output shown in a pane: the last limit lines in a ring buffer, followed
+// by the line still being written
+// Lines are wrapped once per pane width and the wrapped rows are cached, so rendering the
+// bottom of a long session costs no more than rendering a short one
+type scrollback struct {
+	lines   []string // Complete lines, lines[start] is the oldest
+	start   int
+	partial string // The line being written, after the last line feed
+	cr      bool   // The last write ended in a carriage return
+	limit   int
+	offset  int // Rows scrolled up from the bottom, 0 follows new output
+
+	wrap  wrapFunc   // Nil for lines that are already as wide as the pane
+	width int        // Width the cached rows are wrapped to
+	rows  [][]string // Cached rows of each line, parallel to lines; nil until wrapped
+}
+
+// newScrollback returns an empty scrollback keeping limit lines, wrapped with wrap
+func newScrollback(limit int, wrap wrapFunc) *scrollback {
+	return &scrollback{limit: max(limit, 1), wrap: wrap}
+}
+
+// SetLimit changes how many lines are kept, dropping the oldest lines beyond the new limit
+func (b *scrollback) SetLimit(limit int) {
+	limit = max(limit, 1)
+	if limit == b.limit {
+		return
+	}
+	n := min(len(b.lines), limit)
+	lines := make([]string, 0, limit)
+	rows := make([][]string, 0, limit)
+	for i := len(b.lines) - n; i < len(b.lines); i++ {
+		lines = append(lines, b.lines[b.index(i)])
+		rows = append(rows, b.rows[b.index(i)])
+	}
+	b.lines, b.rows, b.start, b.limit = lines, rows, 0, limit
+}
+
+// Reset drops every line
+func (b *scrollback) Reset() {
+	*b = scrollback{limit: b.limit, wrap: b.wrap}
+}
+
+// WriteString appends output, ending a line at every line feed, carriage return or both
+func (b *scrollback) WriteString(s string) {
+	if b.cr && s != "" {
+		// The carriage return already ended the line
+		b.cr = false
+		s = strings.TrimPrefix(s, "\n")
+	}
+	for {
+		i := strings.IndexAny(s, "\r\n")
+		if i < 0 {
+			b.partial += s
+			return
+		}
+		b.partial += s[:i]
+		b.endLine()
+		if s[i] == '\r' {
+			if i+1 == len(s) {
+				b.cr = true
+				return
+			}
+			if s[i+1] == '\n' {
+				i++
+			}
+		}
+		s = s[i+1:]
+	}
+}
+
+// Write appends output, so that fmt.Fprintf can write to the scrollback
+func (b *scrollback) Write(p []byte) (int, error) {
+	b.WriteString(string(p))
+	return len(p), nil
+}
+
+// endLine moves the line being written into the ring, over the oldest line when it is full
+func (b *scrollback) endLine() {
+	if len(b.lines) < b.limit {
+		b.lines = append(b.lines, b.partial)
+		b.rows = append(b.rows, nil)
+	} else {
+		b.lines[b.start] = b.partial
+		b.rows[b.start] = nil
+		b.start = (b.start + 1) % b.limit
+	}
+	b.partial = ""
+	if b.offset > 0 {
+		// Keep the rows on screen where they are while new output arrives below them
+		b.offset++
+	}
+}
+
+// ReplaceLastLine replaces the last line with line if it starts with prefix, or appends line
+func (b *scrollback) ReplaceLastLine(prefix, line string) {
+	if b.partial == "" && len(b.lines) > 0 {
+		i := b.index(len(b.lines) - 1)
+		if strings.HasPrefix(b.lines[i], prefix) {
+			b.lines[i] = line
+			b.rows[i] = nil
+			return
+		}
+	} else if strings.HasPrefix(b.partial, prefix) {
+		b.partial = ""
+	}
+	b.WriteString(line + "\n")
+}
+
+// Prepend inserts text before the output, dropping the oldest lines beyond the limit
+func (b *scrollback) Prepend(s string) {
+	rebuilt := newScrollback(b.limit, b.wrap)
+	rebuilt.WriteString(s)
+	for i := range b.lines {
+		rebuilt.WriteString(b.lines[b.index(i)] + "\n")
+	}
+	rebuilt.WriteString(b.partial)
+	rebuilt.cr = b.cr
+	*b = *rebuilt
+}
+
+// Len returns the number of lines, counting the line being written even when it is empty
+func (b *scrollback) Len() int {
+	return len(b.lines) + 1
+}
+
+// Line returns line i, 0 being the oldest line kept
+func (b *scrollback) Line(i int) string {
+	if i == len(b.lines) {
+		return b.partial
+	}
+	return b.lines[b.index(i)]
+}
+
+// Tail returns the last n lines, oldest first
+func (b *scrollback) Tail(n int) []string {
+	n = min(n, b.Len())
+	lines := make([]string, 0, n)
+	for i := b.Len() - n; i < b.Len(); i++ {
+		lines = append(lines, b.Line(i))
+	}
+	return lines
+}
+
+// index returns the position of line i in the ring
+func (b *scrollback) index(i int) int {
+	return (b.start + i) % len(b.lines)
+}
+
+// wrapped returns the rows of line i at width, from the cache for complete lines
+func (b *scrollback) wrapped(i, width int) []string {
+	if b.wrap == nil {
+		return []string{b.Line(i)}
+	}
+	if i == len(b.lines) {
+		return b.wrap(b.partial, width)
+	}
+	if width != b.width {
+		clear(b.rows)
+		b.width = width
+	}
+	j := b.index(i)
+	if b.rows[j] == nil {
+		b.rows[j] = b.wrap(b.lines[j], width)
+	}
+	return b.rows[j]
+}
+
+// Window returns the height rows at the scroll offset, wrapped to width, oldest first
+// Only the lines from the bottom up to the window are wrapped
+func (b *scrollback) Window(width, height int) []string {
+	need := b.offset + height
+	var rows []string // Newest first
+	for i := b.Len() - 1; i >= 0 && len(rows) < need; i-- {
+		wrapped := b.wrapped(i, width)
+		for j := len(wrapped) - 1; j >= 0 && len(rows) < need; j-- {
+			rows = append(rows, wrapped[j])
+		}
+	}
+	// Stop at the top of the output
+	b.offset = max(min(b.offset, len(rows)-height), 0)
+	window := rows[b.offset:min(b.offset+height, len(rows))]
+	for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+		window[i], window[j] = window[j], window[i]
+	}
+	return window
+}
+
+// Rows returns every row wrapped to width, oldest first
+func (b *scrollback) Rows(width int) []string {
+	rows := make([]string, 0, b.Len())
+	for i := 0; i < b.Len(); i++ {
+		rows = append(rows, b.wrapped(i, width)...)
+	}
+	return rows
+}
+
+// ScrollUp scrolls n rows towards older output
+func (b *scrollback) ScrollUp(n int) {
+	b.offset += n
+}
+
+// ScrollDown scrolls n rows towards newer output
+func (b *scrollback) ScrollDown(n int) {
+	b.offset = max(b.offset-n, 0)
+}
+
+// GotoBottom scrolls to the newest output, which is then followed as it arrives
+func (b *scrollback) GotoBottom() {
+	b.offset = 0
+}
+
+// wrapLine word wraps a line to width
+func wrapLine(line string, width int) []string {
+	if line == "" {
+		return []string{""}
+	}
+	return strings.Split(wordwrap.String(line, width), "\n")
+}
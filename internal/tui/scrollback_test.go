@@ -0,0 +1,160 @@
+package tui
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chunk wraps a line into rows of exactly width characters, the last one shorter
+func chunk(line string, width int) []string {
+	var rows []string
+	for len(line) > width {
+		rows = append(rows, line[:width])
+		line = line[width:]
+	}
+	return append(rows, line)
+}
+
+// lines returns every line in b, oldest first, including the one being written
+func lines(b *scrollback) []string {
+	return b.Tail(b.Len())
+}
+
+func TestScrollbackWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		want   []string
+	}{
+		{name: "partial line", limit: 10, writes: []string{"abc"}, want: []string{"abc"}},
+		{name: "line feeds", limit: 10, writes: []string{"a\nb\n"}, want: []string{"a", "b", ""}},
+		{name: "line split across writes", limit: 10, writes: []string{"ab", "c\nd"}, want: []string{"abc", "d"}},
+		{name: "CRLF", limit: 10, writes: []string{"a\r\nb\r\n"}, want: []string{"a", "b", ""}},
+		{name: "CRLF split across writes", limit: 10, writes: []string{"a\r", "\nb"}, want: []string{"a", "b"}},
+		{name: "bare CR", limit: 10, writes: []string{"a\rb"}, want: []string{"a", "b"}},
+		{name: "oldest lines dropped", limit: 2, writes: []string{"1\n2\n3\n4\npartial"}, want: []string{"3", "4", "partial"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newScrollback(tt.limit, nil)
+			for _, s := range tt.writes {
+				b.WriteString(s)
+			}
+			if got := lines(b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrollbackEdits(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(b *scrollback)
+		want []string
+	}{
+		{
+			name: "replace the last line",
+			edit: func(b *scrollback) { b.ReplaceLastLine("3", "three") },
+			want: []string{"2", "three", ""},
+		},
+		{
+			name: "append when the last line does not match",
+			edit: func(b *scrollback) { b.ReplaceLastLine("x", "x1") },
+			want: []string{"3", "x1", ""},
+		},
+		{
+			name: "prepend keeps the limit",
+			edit: func(b *scrollback) { b.Prepend("header\n") },
+			want: []string{"2", "3", ""},
+		},
+		{
+			name: "shrink the limit",
+			edit: func(b *scrollback) { b.SetLimit(1) },
+			want: []string{"3", ""},
+		},
+		{
+			name: "grow the limit and keep writing",
+			edit: func(b *scrollback) { b.SetLimit(4); b.WriteString("4\n5\n") },
+			want: []string{"2", "3", "4", "5", ""},
+		},
+		{
+			name: "reset",
+			edit: func(b *scrollback) { b.Reset(); b.WriteString("new") },
+			want: []string{"new"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A full ring that has wrapped around once
+			b := newScrollback(2, chunk)
+			b.WriteString("1\n2\n3\n")
+			b.Window(10, 3) // Fill the row cache, which every edit must keep in step
+			tt.edit(b)
+			if got := lines(b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines = %q, want %q", got, tt.want)
+			}
+			if got := b.Rows(10); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Rows() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrollbackWindow(t *testing.T) {
+	b := newScrollback(100, chunk)
+	b.WriteString("aaaaaa\nbb\ncccccccc\nd") // Wrapped to 4: aaaa aa bb cccc cccc d
+
+	tests := []struct {
+		name   string
+		scroll func(b *scrollback)
+		width  int
+		want   string
+	}{
+		{name: "bottom", width: 4, want: "cccc cccc d"},
+		{name: "scrolled up", scroll: func(b *scrollback) { b.ScrollUp(2) }, width: 4, want: "aa bb cccc"},
+		{name: "stops at the top", scroll: func(b *scrollback) { b.ScrollUp(100) }, width: 4, want: "aaaa aa bb"},
+		{name: "scrolled down", scroll: func(b *scrollback) { b.ScrollUp(3); b.ScrollDown(2) }, width: 4, want: "bb cccc cccc"},
+		{name: "rewrapped to a new width", width: 8, want: "bb cccccccc d"},
+		{name: "back to the bottom", scroll: func(b *scrollback) { b.ScrollUp(2); b.GotoBottom() }, width: 4, want: "cccc cccc d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.GotoBottom()
+			if tt.scroll != nil {
+				tt.scroll(b)
+			}
+			if got := strings.Join(b.Window(tt.width, 3), " "); got != tt.want {
+				t.Errorf("Window() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// New output does not move a scrolled up window
+	b.GotoBottom()
+	b.ScrollUp(1)
+	before := b.Window(4, 3)
+	b.WriteString("\ne\nf\n")
+	if after := b.Window(4, 3); !reflect.DeepEqual(after, before) {
+		t.Errorf("Window() moved from %q to %q while scrolled up", before, after)
+	}
+}
+
+func TestWrapLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		width int
+		want  []string
+	}{
+		{"", 10, []string{""}},
+		{"short", 10, []string{"short"}},
+		{"hello wide world", 10, []string{"hello wide", "world"}},
+	}
+	for _, tt := range tests {
+		if got := wrapLine(tt.line, tt.width); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wrapLine(%q, %d) = %q, want %q", tt.line, tt.width, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hinshun/vt10x"
+)
+
+// sgrReset selects the default colors and attributes
+const sgrReset = "\x1b[0m"
+
+// clearScreen clears the whole screen (ED 2); it follows every reset (RIS), as the
+// vt10x reset swaps rows and columns and clears only part of a wide screen
+const clearScreen = "\x1b[2J"
+
+// Glyph attributes and cursor state of vt10x, which does not export them
+const (
+	glyphUnderline = 1 << 1
+	glyphBold      = 1 << 2
+	glyphItalic    = 1 << 4
+	glyphBlink     = 1 << 5
+
+	cursorWrapNext = 1 << 1
+)
+
+// escState tracks where the output is in an escape sequence, mirroring the vt10x parser
+type escState int
+
+const (
+	escGround    escState = iota
+	escStart              // After ESC
+	escCharset            // After ESC ( or ESC #, which take one more character
+	escCSI                // Control sequence: ESC [ params final
+	escString             // OSC, DCS, APC and PM strings, ended by BEL or ESC \
+	escStringEnd          // ESC inside a string
+)
+
+// terminalScreen emulates the terminal a PTY writes to: a VT100/xterm screen grid kept
+// by vt10x, plus the lines that scrolled off the top of it
+// vt10x has no scrollback, so output is fed to it in pieces that each scroll at most
+// as far as can be predicted, and the lines about to scroll off are saved beforehand
+type terminalScreen struct {
+	vt    vt10x.Terminal
+	saved *scrollback // Rendered lines that scrolled off the top
+
+	state   escState
+	params  []byte // Parameters of the current control sequence
+	top     int    // Scroll region set with DECSTBM
+	bottom  int
+	partial []byte // Incomplete UTF-8 sequence at the end of the last write
+}
+
+// newTerminalScreen returns an empty screen of cols x rows cells
+func newTerminalScreen(cols, rows int) *terminalScreen {
+	cols, rows = max(cols, 1), max(rows, 1)
+	return &terminalScreen{
+		vt:     vt10x.New(vt10x.WithSize(cols, rows)),
+		saved:  newScrollback(defaultScrollback, nil),
+		bottom: rows - 1,
+	}
+}
+
+// SetScrollback sets how many lines are kept after they scroll off the top
+func (s *terminalScreen) SetScrollback(lines int) {
+	s.saved.SetLimit(lines)
+}
+
+// Size returns the size of the screen
+func (s *terminalScreen) Size() (cols, rows int) {
+	return s.vt.Size()
+}
+
+// Resize changes the size of the screen
+// Lines pushed off the top when it gets shorter are kept in the scrollback
+func (s *terminalScreen) Resize(cols, rows int) {
+	cols, rows = max(cols, 1), max(rows, 1)
+	oldCols, oldRows := s.vt.Size()
+	if cols == oldCols && rows == oldRows {
+		return
+	}
+	if slide := s.vt.Cursor().Y - rows + 1; slide > 0 && s.vt.Mode()&vt10x.ModeAltScreen == 0 {
+		s.save(0, slide)
+	}
+	s.vt.Resize(cols, rows)
+	s.top, s.bottom = 0, rows-1
+}
+
+// AppCursor reports whether the program asked for application cursor keys (DECCKM)
+func (s *terminalScreen) AppCursor() bool {
+	return s.vt.Mode()&vt10x.ModeAppCursor != 0
+}
+
+// Reset clears the screen and the scrollback
+func (s *terminalScreen) Reset() {
+	s.vt.Write([]byte("\x1bc" + clearScreen))
+	s.saved.Reset()
+	s.state = escGround
+	s.params = nil
+	s.partial = nil
+	_, rows := s.vt.Size()
+	s.top, s.bottom = 0, rows-1
+}
+
+// Write feeds terminal output to the screen
+func (s *terminalScreen) Write(p []byte) (int, error) {
+	data := p
+	if len(s.partial) > 0 {
+		data = append(s.partial, p...)
+		s.partial = nil
+	}
+
+	run := -1 // Start of a run of printable characters, written together
+	for i := 0; i < len(data); {
+		c, size := utf8.DecodeRune(data[i:])
+		if c == utf8.RuneError && size <= 1 && !utf8.FullRune(data[i:]) {
+			s.partial = append([]byte(nil), data[i:]...)
+			data = data[:i]
+			break
+		}
+		if s.state == escGround && c >= 0x20 && c != 0x7f {
+			if run < 0 {
+				run = i
+			}
+			i += size
+			continue
+		}
+		if run >= 0 {
+			s.writeText(data[run:i])
+			run = -1
+		}
+		s.writeRune(c, data[i:i+size])
+		i += size
+	}
+	if run >= 0 {
+		s.writeText(data[run:])
+	}
+	return len(p), nil
+}
+
+// writeText writes printable characters, one screen line at a time so that each piece
+// wraps at most once, at its first character
+func (s *terminalScreen) writeText(text []byte) {
+	for len(text) > 0 {
+		cur := s.vt.Cursor()
+		cols, _ := s.vt.Size()
+		n, scrolls := cols-cur.X, 0
+		if s.vt.Mode()&vt10x.ModeWrap == 0 {
+			n = len(text)
+		} else if cur.State&cursorWrapNext != 0 {
+			n = cols
+			if cur.Y == s.bottom {
+				scrolls = 1
+			}
+		}
+		end := 0
+		for ; n > 0 && end < len(text); n-- {
+			_, size := utf8.DecodeRune(text[end:])
+			end += size
+		}
+		s.write(text[:end], scrolls)
+		text = text[end:]
+	}
+}
+
+// writeRune writes a control character or a character of an escape sequence
+func (s *terminalScreen) writeRune(c rune, b []byte) {
+	cur := s.vt.Cursor()
+	atBottom := 0
+	if cur.Y == s.bottom {
+		atBottom = 1
+	}
+
+	// Control characters take effect in the middle of escape sequences, except strings
+	if c < 0x20 || c == 0x7f {
+		switch {
+		case s.state == escString || s.state == escStringEnd:
+			switch c {
+			case '\a':
+				s.state = escGround
+			case 0x1b:
+				s.state = escStringEnd
+			}
+			s.write(b, 0)
+		case c == '\n' || c == '\v' || c == '\f':
+			s.write(b, atBottom)
+		case c == 0x1b:
+			s.state = escStart
+			s.params = s.params[:0]
+			s.write(b, 0)
+		case c == 0x18 || c == 0x1a: // CAN, SUB
+			s.state = escGround
+			s.write(b, 0)
+		default:
+			s.write(b, 0)
+		}
+		return
+	}
+
+	switch s.state {
+	case escStart:
+		s.state = escGround
+		switch c {
+		case '[':
+			s.state = escCSI
+		case ']', 'P', '_', '^', 'k':
+			s.state = escString
+		case '(', '#':
+			s.state = escCharset
+		case 'D', 'E': // Index, next line
+			s.write(b, atBottom)
+			return
+		case 'c': // Reset
+			s.write(b, 0)
+			s.vt.Write([]byte(clearScreen))
+			_, rows := s.vt.Size()
+			s.top, s.bottom = 0, rows-1
+			return
+		}
+		s.write(b, 0)
+	case escCSI:
+		if c < 0x40 || c > 0x7e {
+			s.params = append(s.params, b...)
+			s.write(b, 0)
+			return
+		}
+		s.state = escGround
+		s.writeCSI(c, b)
+	case escCharset, escStringEnd:
+		s.state = escGround
+		s.write(b, 0)
+	default:
+		s.write(b, 0)
+	}
+}
+
+// writeCSI writes the final character of a control sequence, keeping track of the
+// scroll region and saving the lines scrolled off by SU
+func (s *terminalScreen) writeCSI(final rune, b []byte) {
+	if len(s.params) > 0 && (s.params[0] < '0' || s.params[0] > ';') {
+		// Private sequences, e.g. the alternate screen, are left to vt10x
+		s.write(b, 0)
+		return
+	}
+	args := strings.Split(string(s.params), ";")
+	arg := func(i, def int) int {
+		if i >= len(args) {
+			return def
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n == 0 {
+			return def
+		}
+		return n
+	}
+
+	switch final {
+	case 'S': // Scroll up
+		s.write(b, min(arg(0, 1), s.bottom-s.top+1))
+	case 'r': // Set scroll region
+		s.write(b, 0)
+		_, rows := s.vt.Size()
+		top := min(max(arg(0, 1)-1, 0), rows-1)
+		bottom := min(max(arg(1, rows)-1, 0), rows-1)
+		s.top, s.bottom = min(top, bottom), max(top, bottom)
+	default:
+		s.write(b, 0)
+	}
+}
+
+// write passes output to vt10x; when it scrolls the screen up by scrolls lines, the
+// lines pushed off the top are saved first
+// As in xterm, lines only go to the scrollback when the scroll region starts at the
+// top of the main screen
+func (s *terminalScreen) write(b []byte, scrolls int) {
+	if scrolls > 0 && s.top == 0 && s.vt.Mode()&vt10x.ModeAltScreen == 0 {
+		s.save(0, min(scrolls, s.bottom+1))
+	}
+	s.vt.Write(b)
+}
+
+// save appends rows [from, to) of the screen to the scrollback
+func (s *terminalScreen) save(from, to int) {
+	s.vt.Lock()
+	for y := from; y < to; y++ {
+		s.saved.WriteString(s.renderRow(y, false) + "\n")
+	}
+	s.vt.Unlock()
+}
+
+// Window renders the last height lines of the scrollback and the screen, with the cursor
+// shown in reverse video when visible
+func (s *terminalScreen) Window(height int) []string {
+	s.vt.Lock()
+	defer s.vt.Unlock()
+	_, rows := s.vt.Size()
+	lines := make([]string, 0, height)
+	// The last line of saved is the empty line being written
+	saved := s.saved.Len() - 1
+	for i := max(saved-max(height-rows, 0), 0); i < saved; i++ {
+		lines = append(lines, s.saved.Line(i))
+	}
+	for y := max(rows-height, 0); y < rows; y++ {
+		lines = append(lines, s.renderRow(y, s.vt.CursorVisible()))
+	}
+	return lines
+}
+
+// Rows renders every line of the scrollback and the screen without the cursor, and
+// returns the index of the cursor's row among them
+func (s *terminalScreen) Rows() ([]string, int) {
+	s.vt.Lock()
+	defer s.vt.Unlock()
+	_, rows := s.vt.Size()
+	saved := s.saved.Len() - 1
+	lines := make([]string, 0, saved+rows)
+	for i := 0; i < saved; i++ {
+		lines = append(lines, s.saved.Line(i))
+	}
+	for y := 0; y < rows; y++ {
+		lines = append(lines, s.renderRow(y, false))
+	}
+	return lines, saved + s.vt.Cursor().Y
+}
+
+// renderRow renders row y with SGR sequences for its colors and attributes
+// Trailing blank cells are dropped; the caller holds the vt10x lock
+func (s *terminalScreen) renderRow(y int, showCursor bool) string {
+	cols, _ := s.vt.Size()
+	cur := s.vt.Cursor()
+	cursorX := -1
+	if showCursor && cur.Y == y {
+		cursorX = cur.X
+	}
+
+	end := cols
+	for end > 0 && end-1 != cursorX && blankGlyph(s.vt.Cell(end-1, y)) {
+		end--
+	}
+
+	var b strings.Builder
+	last := sgrReset
+	for x := 0; x < end; x++ {
+		g := s.vt.Cell(x, y)
+		sgr := glyphSGR(g, x == cursorX)
+		if sgr != last {
+			b.WriteString(sgr)
+			last = sgr
+		}
+		if g.Char == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteRune(g.Char)
+		}
+	}
+	if last != sgrReset {
+		b.WriteString(sgrReset)
+	}
+	return b.String()
+}
+
+// blankGlyph reports whether a cell shows nothing: a space on the default background
+func blankGlyph(g vt10x.Glyph) bool {
+	return (g.Char == ' ' || g.Char == 0) && g.BG == vt10x.DefaultBG && g.Mode&glyphUnderline == 0
+}
+
+// glyphSGR returns the SGR sequence selecting the colors and attributes of a cell
+func glyphSGR(g vt10x.Glyph, reverse bool) string {
+	var codes []string
+	if g.Mode&glyphBold != 0 {
+		codes = append(codes, "1")
+	}
+	if g.Mode&glyphItalic != 0 {
+		codes = append(codes, "3")
+	}
+	if g.Mode&glyphUnderline != 0 {
+		codes = append(codes, "4")
+	}
+	if g.Mode&glyphBlink != 0 {
+		codes = append(codes, "5")
+	}
+	if reverse {
+		codes = append(codes, "7")
+	}
+	if code := colorSGR(g.FG, 30, 90, "38"); code != "" {
+		codes = append(codes, code)
+	}
+	if code := colorSGR(g.BG, 40, 100, "48"); code != "" {
+		codes = append(codes, code)
+	}
+	if len(codes) == 0 {
+		return sgrReset
+	}
+	return "\x1b[0;" + strings.Join(codes, ";") + "m"
+}
+
+// colorSGR returns the SGR parameters for a vt10x color, "" for the default color
+// base and bright are the codes of the 8 basic and 8 bright colors, extended is the
+// prefix of 256 and 24-bit colors
+func colorSGR(c vt10x.Color, base, bright int, extended string) string {
+	switch {
+	case c >= vt10x.DefaultFG:
+		return ""
+	case c < 8:
+		return strconv.Itoa(base + int(c))
+	case c < 16:
+		return strconv.Itoa(bright + int(c) - 8)
+	case c < 256:
+		return fmt.Sprintf("%s;5;%d", extended, c)
+	default:
+		return fmt.Sprintf("%s;2;%d;%d;%d", extended, c>>16&0xff, c>>8&0xff, c&0xff)
+	}
+}
+
+// onlcr translates line feeds to carriage return and line feed, as a PTY does for
+// program output, for output that does not come through a PTY
+func onlcr(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
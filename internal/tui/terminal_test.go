@@ -0,0 +1,182 @@
+package tui
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+// plainRows returns the rows of the scrollback and the screen without styling, and the cursor row
+func plainRows(s *terminalScreen) ([]string, int) {
+	rows, cursor := s.Rows()
+	for i, row := range rows {
+		rows[i] = ansi.Strip(row)
+	}
+	return rows, cursor
+}
+
+func TestTerminalScreenWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		writes     []string
+		want       []string
+		wantCursor int
+	}{
+		{
+			name:       "lines scroll into the scrollback",
+			writes:     []string{"one\r\ntwo\r\nthree\r\nfour\r\nfive"},
+			want:       []string{"one", "two", "three", "four", "five"},
+			wantCursor: 4,
+		},
+		{
+			name:       "long lines wrap",
+			writes:     []string{"0123456789abcdefghijKLMNO\r\nnext"},
+			want:       []string{"0123456789", "abcdefghij", "KLMNO", "next"},
+			wantCursor: 3,
+		},
+		{
+			name:       "carriage return overwrites",
+			writes:     []string{"10%\r99%\r\n"},
+			want:       []string{"99%", "", ""},
+			wantCursor: 1,
+		},
+		{
+			name:       "escape sequences split across writes",
+			writes:     []string{"a\x1b", "[2", "J\x1b[H", "b\xc3", "\xa9"},
+			want:       []string{"bé", "", ""},
+			wantCursor: 0,
+		},
+		{
+			name:       "scroll up saves the top lines",
+			writes:     []string{"one\r\ntwo\r\nthree\x1b[2S"},
+			want:       []string{"one", "two", "three", "", ""},
+			wantCursor: 4,
+		},
+		{
+			name:       "scroll region below the top keeps nothing",
+			writes:     []string{"title\x1b[2;3r\x1b[3;1Hone\r\ntwo\r\nthree"},
+			want:       []string{"title", "two", "three"},
+			wantCursor: 2,
+		},
+		{
+			name:       "alternate screen keeps nothing",
+			writes:     []string{"shell$ \x1b[?1049h\x1b[Hone\r\ntwo\r\nthree\r\nfour", "\x1b[?1049l"},
+			want:       []string{"shell$", "", ""},
+			wantCursor: 0,
+		},
+		{
+			name:       "reset clears the whole screen and keeps the scrollback",
+			writes:     []string{"a\r\nb\r\nc\r\nd\r\nwide line here\x1bc"},
+			want:       []string{"a", "b", "c", "", "", ""},
+			wantCursor: 3,
+		},
+		{
+			name:       "title strings are not shown",
+			writes:     []string{"\x1b]0;user@web-1: ~\aprompt"},
+			want:       []string{"prompt", "", ""},
+			wantCursor: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTerminalScreen(10, 3)
+			for _, w := range tt.writes {
+				s.Write([]byte(w))
+			}
+			got, cursor := plainRows(s)
+			if !reflect.DeepEqual(got, tt.want) || cursor != tt.wantCursor {
+				t.Errorf("Rows() = %q cursor %d, want %q cursor %d", got, cursor, tt.want, tt.wantCursor)
+			}
+		})
+	}
+}
+
+func TestTerminalScreenStyles(t *testing.T) {
+	tests := []struct {
+		name  string
+		write string
+		want  string
+	}{
+		{name: "plain", write: "plain  ", want: "plain"},
+		{name: "basic color", write: "\x1b[31mred\x1b[0m ok", want: "\x1b[0;31mred\x1b[0m ok"},
+		{name: "bright background", write: "\x1b[1;102mgo\x1b[m", want: "\x1b[0;1;102mgo\x1b[0m"},
+		{name: "256 colors", write: "\x1b[38;5;208mx", want: "\x1b[0;38;5;208mx\x1b[0m"},
+		{name: "underlined spaces", write: "\x1b[4m  \x1b[m", want: "\x1b[0;4m  \x1b[0m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTerminalScreen(20, 2)
+			s.Write([]byte(tt.write))
+			rows, _ := s.Rows()
+			if rows[0] != tt.want {
+				t.Errorf("row = %q, want %q", rows[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalScreenWindow(t *testing.T) {
+	s := newTerminalScreen(10, 3)
+	s.Write([]byte("one\r\ntwo\r\nthree\r\nfour\r\n$ "))
+
+	got := s.Window(4)
+	for i := range got {
+		got[i] = ansi.Strip(got[i])
+	}
+	if want := []string{"two", "three", "four", "$  "}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Window(4) = %q, want %q", got, want)
+	}
+	// The cursor is drawn in reverse video after the prompt
+	if window := s.Window(1); !strings.Contains(window[0], "\x1b[0;7m ") {
+		t.Errorf("Window(1) = %q, want the cursor shown", window)
+	}
+	if got := s.Window(2); len(got) != 2 || ansi.Strip(got[0]) != "four" {
+		t.Errorf("Window(2) = %q, want the bottom of the screen", got)
+	}
+}
+
+func TestTerminalScreenResize(t *testing.T) {
+	s := newTerminalScreen(10, 4)
+	s.Write([]byte("one\r\ntwo\r\nthree\r\nfour"))
+
+	// Shrinking pushes the lines above the cursor into the scrollback
+	s.Resize(10, 2)
+	got, cursor := plainRows(s)
+	if want := []string{"one", "two", "three", "four"}; !reflect.DeepEqual(got, want) || cursor != 3 {
+		t.Errorf("Rows() after Resize() = %q cursor %d, want %q cursor 3", got, cursor, want)
+	}
+	if cols, rows := s.Size(); cols != 10 || rows != 2 {
+		t.Errorf("Size() = %dx%d, want 10x2", cols, rows)
+	}
+
+	s.Write([]byte("\x1b[?1h"))
+	if !s.AppCursor() {
+		t.Error("AppCursor() = false after DECCKM was set")
+	}
+
+	s.Reset()
+	if got, _ := plainRows(s); !reflect.DeepEqual(got, []string{"", ""}) {
+		t.Errorf("Rows() after Reset() = %q, want an empty screen", got)
+	}
+}
+
+func TestTerminalScreenScrollbackLimit(t *testing.T) {
+	s := newTerminalScreen(10, 2)
+	s.SetScrollback(3)
+	for i := 0; i < 10; i++ {
+		s.Write([]byte(strings.Repeat("x", i) + "\r\n"))
+	}
+	got, _ := plainRows(s)
+	if want := []string{"xxxxxx", "xxxxxxx", "xxxxxxxx", "xxxxxxxxx", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Rows() = %q, want %q", got, want)
+	}
+}
+
+func TestOnlcr(t *testing.T) {
+	if got := string(onlcr([]byte("a\nb\r\nc"))); got != "a\r\nb\r\nc" {
+		t.Errorf("onlcr() = %q, want %q", got, "a\r\nb\r\nc")
+	}
+}
@@ -5,24 +5,137 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/wclewett/gcdeploy/internal/config"
+	"github.com/wclewett/gcdeploy/internal/deploy"
+	"github.com/wclewett/gcdeploy/internal/headless"
+	"github.com/wclewett/gcdeploy/internal/history"
+	"github.com/wclewett/gcdeploy/internal/runner"
 	"github.com/wclewett/gcdeploy/internal/tui"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		runHistory(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		runRollback(os.Args[2:])
+		return
+	}
+
 	// Parse command line flags
 	debug := flag.Bool("debug", false, "Enable debug logging")
+	headlessMode := flag.Bool("headless", false, "Run the deployment script without the TUI (for CI); reads the key passphrase from $"+headless.PassphraseEnv)
+	strictHostKeys := flag.Bool("strict-host-keys", false, "In headless mode, refuse host keys that are not already in known_hosts")
+	env := flag.String("env", "", "Environment from [env.<name>] in .gcd.toml to deploy to")
+	vars := varFlags{}
+	flag.Var(vars, "var", "Set a ${{ name }} variable as key=value, overriding [vars] (repeatable)")
+	var only, skip listFlags
+	flag.Var(&only, "only", "Run only these deployment steps, by number or name (comma separated, repeatable)")
+	flag.Var(&skip, "skip", "Do not run these deployment steps, by number or name (comma separated, repeatable)")
+	fromStep := flag.String("from-step", "", "Start the deployment at this step (number or name), skipping the steps before it")
+	resume := flag.Bool("resume", false, "Continue the last deployment from the step that failed, against the same instances")
+	dryRun := flag.Bool("dry-run", false, "Show the resolved deployment plan without running anything; with the TUI, confirm with y to deploy")
+	planFormat := flag.String("plan-format", headless.PlanText, "Format of the --dry-run plan in headless mode: text or json")
+	events := flag.String("events", "", "Write deployment events as newline-delimited JSON to stdout in headless mode: json")
+	forceUnlock := flag.Bool("force-unlock", false, "Remove a deployment lock left on the VM by another run before deploying")
+	eventsFile := flag.String("events-file", "", "Append deployment events as newline-delimited JSON to this file")
 	flag.Parse()
 
+	if *planFormat != headless.PlanText && *planFormat != headless.PlanJSON {
+		fmt.Fprintf(os.Stderr, "Error: --plan-format must be %s or %s\n", headless.PlanText, headless.PlanJSON)
+		os.Exit(1)
+	}
+
+	if *events != "" && *events != "json" {
+		fmt.Fprintf(os.Stderr, "Error: --events must be json\n")
+		os.Exit(1)
+	}
+	if *events != "" && *eventsFile == "" && !*headlessMode {
+		fmt.Fprintf(os.Stderr, "Error: --events writes to stdout and requires --headless; use --events-file with the TUI\n")
+		os.Exit(1)
+	}
+
 	// Load configuration from .gcd.toml
-	cfg, err := config.Load()
+	cfg, err := config.Load(config.LoadOptions{Env: *env, Vars: vars})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
 		os.Exit(1)
 	}
 
+	// Select the steps to run; --resume picks up the progress saved by the last run
+	selection := runner.Selection{Only: only, Skip: skip, FromStep: *fromStep}
+	if cfg.Release != nil && (len(only) > 0 || len(skip) > 0 || *fromStep != "") {
+		// A release directory starts empty, so every step of the script has to run in it
+		fmt.Fprintf(os.Stderr, "Error: --only, --skip and --from-step cannot be used with [release], each deployment goes into a new release directory\n")
+		os.Exit(1)
+	}
+	if *resume {
+		if len(only) > 0 || *fromStep != "" {
+			fmt.Fprintf(os.Stderr, "Error: --resume cannot be combined with --only or --from-step\n")
+			os.Exit(1)
+		}
+		if cfg.Release != nil {
+			fmt.Fprintf(os.Stderr, "Error: --resume cannot be used with [release], each deployment goes into a new release directory\n")
+			os.Exit(1)
+		}
+		state, err := runner.LoadState(cfg.StatePath())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		selection.Resume = state
+	}
+
+	// Stream deployment events to a file, or to stdout in headless mode; step output
+	// then goes to stderr so stdout stays valid JSON
+	var eventWriter *runner.EventWriter
+	output := os.Stdout
+	switch {
+	case *eventsFile != "":
+		file, err := os.OpenFile(*eventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening events file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		eventWriter = runner.NewEventWriter(file, cfg.EnvName)
+	case *events != "":
+		eventWriter = runner.NewEventWriter(os.Stdout, cfg.EnvName)
+		output = os.Stderr
+	}
+
+	if *headlessMode {
+		// Cancel running local commands on Ctrl+C / SIGTERM
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := headless.Run(ctx, cfg, headless.Options{
+			StrictHostKeys: *strictHostKeys,
+			Selection:      selection,
+			DryRun:         *dryRun,
+			PlanFormat:     *planFormat,
+			ForceUnlock:    *forceUnlock,
+			Events:         eventWriter,
+			Output:         output,
+		})
+		stop()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	resolver, err := deploy.NewInstanceResolver(cfg.Resolver, cfg.CredentialsPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating instance resolver: %v\n", err)
+		os.Exit(1)
+	}
+
 	model, err := tui.New(*debug)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not initialize Bubble Tea model: %v\n", err)
@@ -31,8 +144,46 @@ func main() {
 
 	ctx := context.Background()
 
+	// Look up the instances to deploy to (lists them when a label selector is configured)
+	targets, err := cfg.Targets(ctx, resolver)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting instances: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Set up the model with instance, command, and deployment steps from config
-	model.SetInstanceAndCommand(ctx, cfg.Instance, cfg.Command, cfg.CredentialsPath, cfg.SSHKeyPath, cfg.Deployment)
+	// The interactive shell connects to the first target; a config with only a command
+	// deploys it as a single step, numbered the same as in headless mode and history
+	steps := cfg.Steps()
+	model.SetInstanceAndCommand(ctx, targets[0], cfg.Command, resolver, cfg.SSHKeyPath, steps)
+	model.SetTargets(targets, cfg.Concurrency)
+	model.SetParallelism(cfg.Parallelism)
+	model.SetHealthChecks(cfg.HealthChecks, cfg.OnFailure)
+	model.SetHooks(cfg.Hooks)
+
+	skips, err := runner.Select(selection, steps, cfg.EnvName, targets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	model.SetSelection(skips, runner.NewStateRecorder(cfg.StatePath(), cfg.EnvName, steps, targets, selection.Resume))
+
+	// With --dry-run the TUI shows the plan and waits for confirmation before deploying
+	if *dryRun {
+		plan, err := runner.NewPlan(ctx, cfg, steps, targets, resolver, skips)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error building deployment plan: %v\n", err)
+			os.Exit(1)
+		}
+		model.SetPlan(plan)
+	}
+	model.SetEnvironment(cfg.EnvName, cfg.Production)
+	model.SetVars(cfg.Vars)
+	model.SetEventWriter(eventWriter)
+	model.SetHistory(history.NewRecorder(cfg, steps, targets))
+	model.SetLock(cfg.LockPath, *forceUnlock)
+	model.SetConfigDir(filepath.Dir(cfg.Path))
+	model.SetScrollback(cfg.Scrollback)
 
 	program := tea.NewProgram(model, tea.WithAltScreen())
 	if _, err := program.Run(); err != nil {
@@ -40,3 +191,110 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// runHistory implements `gcdeploy history [flags] [run-id]`
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gcdeploy history [flags] [run-id]\n\nList past deployments to the configured instances, or show one run in detail.\n\n")
+		flags.PrintDefaults()
+	}
+	env := flags.String("env", "", "Environment from [env.<name>] in .gcd.toml whose instances to show")
+	limit := flags.Int("n", 20, "Number of runs to list, newest first (0 for all)")
+	remote := flags.Bool("remote", false, "Read the history file on the VMs (remote_history) instead of the local one; reads the key passphrase from $"+headless.PassphraseEnv)
+	vars := varFlags{}
+	flags.Var(vars, "var", "Set a ${{ name }} variable as key=value, overriding [vars] (repeatable)")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(config.LoadOptions{Env: *env, Vars: vars})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	err = history.Show(context.Background(), cfg, os.Stdout, history.Options{
+		ID:         flags.Arg(0),
+		Limit:      *limit,
+		Remote:     *remote,
+		Passphrase: os.Getenv(headless.PassphraseEnv),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runRollback implements `gcdeploy rollback [flags] [release]`
+func runRollback(args []string) {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: gcdeploy rollback [flags] [release]\n\nSwitch the current symlink back to an earlier release and run the [[release.restart]] steps.\nWithout a release, rolls back to the release deployed before the current one.\n\n")
+		flags.PrintDefaults()
+	}
+	env := flags.String("env", "", "Environment from [env.<name>] in .gcd.toml to roll back")
+	strictHostKeys := flags.Bool("strict-host-keys", false, "Refuse host keys that are not already in known_hosts")
+	forceUnlock := flags.Bool("force-unlock", false, "Remove a deployment lock left on the VM by another run before rolling back")
+	vars := varFlags{}
+	flags.Var(vars, "var", "Set a ${{ name }} variable as key=value, overriding [vars] (repeatable)")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(config.LoadOptions{Env: *env, Vars: vars})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := cfg.Rollback(flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Roll back without the TUI; reads the key passphrase like --headless
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = headless.Run(ctx, cfg, headless.Options{
+		StrictHostKeys: *strictHostKeys,
+		ForceUnlock:    *forceUnlock,
+	})
+	stop()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// varFlags collects repeated --var key=value flags
+type varFlags map[string]string
+
+func (v varFlags) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v varFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	v[key] = value
+	return nil
+}
+
+// listFlags collects repeated flags whose values may also be comma separated lists
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlags) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}